@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/willdot/bskyfeedgen/frontend"
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+func (s *Server) HandleAccount(w http.ResponseWriter, r *http.Request) {
+	usersDid, ok := s.getDidFromSession(r)
+	if !ok {
+		slog.Warn("did not found in session")
+		_ = frontend.Login("", "").Render(r.Context(), w)
+		return
+	}
+
+	session, err := s.sessionStore.Get(r, "oauth-session")
+	if err != nil {
+		slog.Error("getting session", "error", err)
+		http.Error(w, "failed to get session", http.StatusInternalServerError)
+		return
+	}
+
+	webSessions, err := s.sessionStore.SessionsForUser(usersDid)
+	if err != nil {
+		slog.Error("get web sessions for user", "error", err)
+		http.Error(w, "failed to get sessions", http.StatusInternalServerError)
+		return
+	}
+
+	_ = frontend.Account(webSessions, store.SessionIDHash(session)).Render(r.Context(), w)
+}
+
+// HandleRevokeSession signs the user out of one of their other sessions. Signing out of the current session is done
+// with the sign out link so that the cookie is cleared too.
+func (s *Server) HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	idHash := r.URL.Query().Get("id")
+	if idHash == "" {
+		http.Error(w, "missing session id", http.StatusBadRequest)
+		return
+	}
+
+	usersDid, ok := s.getDidFromSession(r)
+	if !ok {
+		slog.Warn("did not found in session")
+		_ = frontend.Login("", "").Render(r.Context(), w)
+		return
+	}
+
+	session, err := s.sessionStore.Get(r, "oauth-session")
+	if err != nil {
+		slog.Error("getting session", "error", err)
+		http.Error(w, "failed to get session", http.StatusInternalServerError)
+		return
+	}
+	if idHash == store.SessionIDHash(session) {
+		http.Error(w, "use sign out to sign out of this session", http.StatusBadRequest)
+		return
+	}
+
+	err = s.sessionStore.RevokeForUser(idHash, usersDid)
+	if err != nil {
+		slog.Error("revoke web session", "error", err)
+		http.Error(w, "failed to sign out of session", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
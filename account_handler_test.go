@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+// signedInRequest creates a request using the session cookie of a request that has already been signed in.
+func signedInRequest(signedIn *http.Request, method, target string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("Cookie", signedIn.Header.Get("Cookie"))
+	return req
+}
+
+func sessionIDHash(t *testing.T, srv *Server, signedIn *http.Request) string {
+	t.Helper()
+
+	session, err := srv.sessionStore.Get(signedInRequest(signedIn, http.MethodGet, "/"), "oauth-session")
+	if err != nil {
+		t.Fatalf("get session: %s", err)
+	}
+	return store.SessionIDHash(session)
+}
+
+func TestRevokeSession(t *testing.T) {
+	srv, _ := newTestServer(t, newFakeAppView(t))
+
+	// the user is signed in on two devices and another user is signed in elsewhere
+	phone := httptest.NewRequest(http.MethodGet, "/", nil)
+	addSessionCookie(t, srv, phone, testUserDID)
+	laptop := httptest.NewRequest(http.MethodGet, "/", nil)
+	addSessionCookie(t, srv, laptop, testUserDID)
+	other := httptest.NewRequest(http.MethodGet, "/", nil)
+	addSessionCookie(t, srv, other, "did:plc:other")
+
+	rec := httptest.NewRecorder()
+	srv.HandleAccount(rec, signedInRequest(laptop, http.MethodGet, "/account"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected account page, got %d", rec.Code)
+	}
+
+	sessions, err := srv.sessionStore.SessionsForUser(testUserDID)
+	if err != nil {
+		t.Fatalf("get sessions for user: %s", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(sessions))
+	}
+
+	revoke := func(signedIn *http.Request, idHash string) int {
+		rec := httptest.NewRecorder()
+		srv.HandleRevokeSession(rec, signedInRequest(signedIn, http.MethodDelete, "/account/sessions?id="+url.QueryEscape(idHash)))
+		return rec.Code
+	}
+	isSignedIn := func(signedIn *http.Request) bool {
+		_, ok := srv.getDidFromSession(signedInRequest(signedIn, http.MethodGet, "/"))
+		return ok
+	}
+
+	phoneIDHash := sessionIDHash(t, srv, phone)
+
+	// another user can't sign the phone out
+	revoke(other, phoneIDHash)
+	if !isSignedIn(phone) {
+		t.Fatal("expected another user to not be able to sign the phone out")
+	}
+
+	// the current session has to be signed out with sign out so that the cookie is cleared
+	if code := revoke(laptop, sessionIDHash(t, srv, laptop)); code != http.StatusBadRequest {
+		t.Fatalf("expected revoking the current session to fail, got %d", code)
+	}
+
+	if code := revoke(laptop, phoneIDHash); code != http.StatusOK {
+		t.Fatalf("expected phone session to be revoked, got %d", code)
+	}
+	if isSignedIn(phone) {
+		t.Fatal("expected phone to be signed out")
+	}
+	if !isSignedIn(laptop) {
+		t.Fatal("expected laptop to still be signed in")
+	}
+}
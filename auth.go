@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/bluesky-social/indigo/atproto/crypto"
 	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/hashicorp/golang-lru/v2/expirable"
 )
 
 // The contents of this file have been borrowed from here: https://github.com/orthanc/bluesky-go-feeds/blob/f719f113f1afc9080e50b4b1f5ca239aa3073c79/web/auth.go#L20-L46
@@ -49,45 +54,200 @@ func init() {
 
 }
 
-var directory = identity.DefaultDirectory()
+const (
+	feedSkeletonLexiconMethod = "app.bsky.feed.getFeedSkeleton"
+	signingKeyCacheSize       = 10000
+	signingKeyCacheTTL        = time.Hour
+	// a signing key isn't refreshed again if it was resolved within this long, so that requests with bad signatures
+	// can't be used to make a lookup every time
+	signingKeyMinRefreshInterval = time.Minute
+)
 
-func getRequestUserDID(r *http.Request) (string, error) {
-	headerValues := r.Header["Authorization"]
+// These are the reasons a feed request can be rejected for. They're wrapped with the details of the request.
+var (
+	errAuthMissing              = errors.New("missing authorization header")
+	errAuthMalformed            = errors.New("malformed token")
+	errAuthInvalidAlgorithm     = errors.New("unsupported signing algorithm")
+	errAuthInvalidIssuer        = errors.New("invalid issuer")
+	errAuthInvalidAudience      = errors.New("token is not for this feed generator")
+	errAuthExpired              = errors.New("token has expired")
+	errAuthInvalidLexiconMethod = errors.New("token is not for this method")
+	errAuthSigningKey           = errors.New("signing key could not be resolved")
+	errAuthInvalidSignature     = errors.New("invalid signature")
+)
+
+type feedAuthClaims struct {
+	jwt.RegisteredClaims
+	LexiconMethod string `json:"lxm"`
+}
+
+// feedAuth validates the service auth JWTs that the AppView sends with feed requests on behalf of users.
+type feedAuth struct {
+	// serviceDID is the DID the tokens must be for, which is did:web:FEED_HOST_NAME
+	serviceDID string
+	keys       *signingKeyCache
+}
+
+func newFeedAuth(serviceDID string, directory identity.Directory) *feedAuth {
+	return &feedAuth{
+		serviceDID: serviceDID,
+		keys:       newSigningKeyCache(directory),
+	}
+}
 
+// RequestUserDID validates the requests token for the given lexicon method and returns the DID of the user that made
+// the request.
+func (a *feedAuth) RequestUserDID(r *http.Request, lexiconMethod string) (string, error) {
+	headerValues := r.Header["Authorization"]
 	if len(headerValues) != 1 {
-		return "", fmt.Errorf("missing authorization header")
+		return "", errAuthMissing
+	}
+	tokenStr, ok := strings.CutPrefix(strings.TrimSpace(headerValues[0]), "Bearer ")
+	if !ok {
+		return "", fmt.Errorf("%w: not a bearer token", errAuthMalformed)
+	}
+
+	parser := jwt.NewParser()
+	var claims feedAuthClaims
+	token, parts, err := parser.ParseUnverified(strings.TrimSpace(tokenStr), &claims)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errAuthMalformed, err)
+	}
+
+	alg := token.Method.Alg()
+	if alg != ES256 && alg != ES256K {
+		return "", fmt.Errorf("%w: %s", errAuthInvalidAlgorithm, alg)
+	}
+
+	// the claims are checked before the signature so that tokens that would be rejected anyway don't need a lookup
+	did, err := a.validateClaims(claims, lexiconMethod, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := parser.DecodeSegment(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("%w: decode signature: %w", errAuthMalformed, err)
+	}
+
+	err = a.verifySignature(r.Context(), did, token.Method, strings.Join(parts[0:2], "."), signature)
+	if err != nil {
+		return "", err
+	}
+
+	return did.String(), nil
+}
+
+func (a *feedAuth) validateClaims(claims feedAuthClaims, lexiconMethod string, now time.Time) (syntax.DID, error) {
+	did, err := syntax.ParseDID(claims.Issuer)
+	if err != nil {
+		return "", fmt.Errorf("%w: %q", errAuthInvalidIssuer, claims.Issuer)
+	}
+
+	if !slices.Contains(claims.Audience, a.serviceDID) {
+		return "", fmt.Errorf("%w: audience %v", errAuthInvalidAudience, []string(claims.Audience))
 	}
-	token := strings.TrimSpace(strings.Replace(headerValues[0], "Bearer ", "", 1))
 
-	keyfunc := func(token *jwt.Token) (interface{}, error) {
-		did := syntax.DID(token.Claims.(jwt.MapClaims)["iss"].(string))
-		identity, err := directory.LookupDID(r.Context(), did)
-		if err != nil {
-			return nil, fmt.Errorf("unable to resolve did %s: %s", did, err)
+	if claims.ExpiresAt == nil {
+		return "", fmt.Errorf("%w: no expiry", errAuthExpired)
+	}
+	if !now.Before(claims.ExpiresAt.Time) {
+		return "", fmt.Errorf("%w: expired at %s", errAuthExpired, claims.ExpiresAt.Time.Format(time.RFC3339))
+	}
+
+	if claims.LexiconMethod != lexiconMethod {
+		return "", fmt.Errorf("%w: %q", errAuthInvalidLexiconMethod, claims.LexiconMethod)
+	}
+
+	return did, nil
+}
+
+// verifySignature checks the signature with the issuers cached signing key. If it doesn't match, the key is resolved
+// again in case the user has rotated it.
+func (a *feedAuth) verifySignature(ctx context.Context, did syntax.DID, method jwt.SigningMethod, signingString string, signature []byte) error {
+	key, fresh, err := a.keys.Get(ctx, did)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errAuthSigningKey, err)
+	}
+
+	err = method.Verify(signingString, signature, key)
+	if err != nil && !fresh {
+		// the user may have rotated their key since it was cached
+		refreshedKey, refreshed, refreshErr := a.keys.Refresh(ctx, did)
+		if refreshErr != nil {
+			return fmt.Errorf("%w: %w", errAuthSigningKey, refreshErr)
 		}
-		key, err := identity.PublicKey()
-		if err != nil {
-			return nil, fmt.Errorf("signing key not found for did %s: %s", did, err)
+		if refreshed {
+			err = method.Verify(signingString, signature, refreshedKey)
 		}
-		return key, nil
 	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", errAuthInvalidSignature, err)
+	}
+	return nil
+}
+
+type signingKey struct {
+	key        crypto.PublicKey
+	resolvedAt time.Time
+}
+
+// signingKeyCache caches users atproto signing keys so that their DID doesn't need to be resolved for every request.
+type signingKeyCache struct {
+	directory identity.Directory
+	keys      *expirable.LRU[syntax.DID, signingKey]
+}
+
+func newSigningKeyCache(directory identity.Directory) *signingKeyCache {
+	return &signingKeyCache{
+		directory: directory,
+		keys:      expirable.NewLRU[syntax.DID, signingKey](signingKeyCacheSize, nil, signingKeyCacheTTL),
+	}
+}
 
-	validMethods := jwt.WithValidMethods([]string{ES256, ES256K})
+// Get returns the DIDs signing key and whether it was just resolved rather than taken from the cache.
+func (c *signingKeyCache) Get(ctx context.Context, did syntax.DID) (crypto.PublicKey, bool, error) {
+	if cached, ok := c.keys.Get(did); ok {
+		return cached.key, false, nil
+	}
 
-	parsedToken, err := jwt.ParseWithClaims(token, jwt.MapClaims{}, keyfunc, validMethods)
+	key, err := c.resolve(ctx, did)
 	if err != nil {
-		return "", fmt.Errorf("invalid token: %s", err)
+		return nil, false, err
 	}
+	return key, true, nil
+}
 
-	claims, ok := parsedToken.Claims.(jwt.MapClaims)
-	if !ok {
-		return "", fmt.Errorf("token contained no claims")
+// Refresh resolves the DIDs signing key again, skipping the cache. It returns false without resolving if the key was
+// resolved too recently.
+func (c *signingKeyCache) Refresh(ctx context.Context, did syntax.DID) (crypto.PublicKey, bool, error) {
+	if cached, ok := c.keys.Get(did); ok && time.Since(cached.resolvedAt) < signingKeyMinRefreshInterval {
+		return cached.key, false, nil
 	}
 
-	issVal, ok := claims["iss"].(string)
-	if !ok {
-		return "", fmt.Errorf("iss claim missing")
+	// the directory has its own cache which would return the old key
+	err := c.directory.Purge(ctx, did.AtIdentifier())
+	if err != nil {
+		return nil, false, fmt.Errorf("purge did %s from directory: %w", did, err)
+	}
+
+	key, err := c.resolve(ctx, did)
+	if err != nil {
+		return nil, false, err
+	}
+	return key, true, nil
+}
+
+func (c *signingKeyCache) resolve(ctx context.Context, did syntax.DID) (crypto.PublicKey, error) {
+	ident, err := c.directory.LookupDID(ctx, did)
+	if err != nil {
+		return nil, fmt.Errorf("resolve did %s: %w", did, err)
+	}
+	key, err := ident.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("signing key not found for did %s: %w", did, err)
 	}
 
-	return string(syntax.DID(issVal)), nil
+	c.keys.Add(did, signingKey{key: key, resolvedAt: time.Now()})
+	return key, nil
 }
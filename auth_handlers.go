@@ -5,6 +5,7 @@ import (
 	"log/slog"
 	"net/http"
 
+	"github.com/gorilla/sessions"
 	"github.com/willdot/bskyfeedgen/frontend"
 )
 
@@ -29,6 +30,18 @@ func (s *Server) authMiddleware(next func(http.ResponseWriter, *http.Request)) f
 	}
 }
 
+// sessionOptions are the options for the session cookie. SameSite has to be lax rather than strict so that the cookie
+// is sent when the authorization server redirects back to the OAuth callback.
+func sessionOptions(maxAge int) *sessions.Options {
+	return &sessions.Options{
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
 func (s *Server) getDidFromSession(r *http.Request) (string, bool) {
 	session, err := s.sessionStore.Get(r, "oauth-session")
 	if err != nil {
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+const testServiceDID = "did:web:feeds.test"
+
+// countingDirectory is a mock directory that counts how many times DIDs are resolved.
+type countingDirectory struct {
+	identity.MockDirectory
+	lookups int
+}
+
+func (d *countingDirectory) LookupDID(ctx context.Context, did syntax.DID) (*identity.Identity, error) {
+	d.lookups++
+	return d.MockDirectory.LookupDID(ctx, did)
+}
+
+func (d *countingDirectory) setKey(t *testing.T, did string, key *crypto.PrivateKeyK256) {
+	t.Helper()
+
+	pub, err := key.PublicKey()
+	if err != nil {
+		t.Fatalf("get public key: %s", err)
+	}
+	d.Insert(identity.Identity{
+		DID:    syntax.DID(did),
+		Handle: syntax.HandleInvalid,
+		Keys:   map[string]identity.Key{"atproto": {Type: "Multikey", PublicKeyMultibase: pub.Multibase()}},
+	})
+}
+
+func newTestPrivateKey(t *testing.T) *crypto.PrivateKeyK256 {
+	t.Helper()
+
+	key, err := crypto.GeneratePrivateKeyK256()
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+	return key
+}
+
+// signServiceAuth creates a service auth JWT signed the way a PDS signs them.
+func signServiceAuth(t *testing.T, key *crypto.PrivateKeyK256, claims map[string]any) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": ES256K})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %s", err)
+	}
+
+	signingString := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature, err := key.HashAndSign([]byte(signingString))
+	if err != nil {
+		t.Fatalf("sign token: %s", err)
+	}
+	return signingString + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func validClaims() map[string]any {
+	return map[string]any{
+		"iss": testUserDID,
+		"aud": testServiceDID,
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"lxm": feedSkeletonLexiconMethod,
+	}
+}
+
+func feedRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/xrpc/app.bsky.feed.getFeedSkeleton", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestFeedAuthRejections(t *testing.T) {
+	key := newTestPrivateKey(t)
+	directory := &countingDirectory{MockDirectory: identity.NewMockDirectory()}
+	directory.setKey(t, testUserDID, key)
+	auth := newFeedAuth(testServiceDID, directory)
+
+	withClaim := func(name string, value any) map[string]any {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	tests := map[string]struct {
+		token string
+		err   error
+	}{
+		"missing header":      {token: "", err: errAuthMissing},
+		"malformed":           {token: "not-a-jwt", err: errAuthMalformed},
+		"wrong audience":      {token: signServiceAuth(t, key, withClaim("aud", "did:web:other.test")), err: errAuthInvalidAudience},
+		"missing audience":    {token: signServiceAuth(t, key, withClaim("aud", nil)), err: errAuthInvalidAudience},
+		"expired":             {token: signServiceAuth(t, key, withClaim("exp", time.Now().Add(-time.Minute).Unix())), err: errAuthExpired},
+		"no expiry":           {token: signServiceAuth(t, key, withClaim("exp", nil)), err: errAuthExpired},
+		"wrong method":        {token: signServiceAuth(t, key, withClaim("lxm", "app.bsky.feed.getTimeline")), err: errAuthInvalidLexiconMethod},
+		"missing method":      {token: signServiceAuth(t, key, withClaim("lxm", nil)), err: errAuthInvalidLexiconMethod},
+		"invalid issuer":      {token: signServiceAuth(t, key, withClaim("iss", "not a did")), err: errAuthInvalidIssuer},
+		"unknown issuer":      {token: signServiceAuth(t, key, withClaim("iss", "did:plc:unknown")), err: errAuthSigningKey},
+		"signed by other key": {token: signServiceAuth(t, newTestPrivateKey(t), validClaims()), err: errAuthInvalidSignature},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := auth.RequestUserDID(feedRequest(tt.token), feedSkeletonLexiconMethod)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	did, err := auth.RequestUserDID(feedRequest(signServiceAuth(t, key, validClaims())), feedSkeletonLexiconMethod)
+	if err != nil {
+		t.Fatalf("expected valid token to be accepted: %s", err)
+	}
+	if did != testUserDID {
+		t.Fatalf("expected did %s, got %s", testUserDID, did)
+	}
+}
+
+func TestFeedAuthCachesSigningKeys(t *testing.T) {
+	key := newTestPrivateKey(t)
+	directory := &countingDirectory{MockDirectory: identity.NewMockDirectory()}
+	directory.setKey(t, testUserDID, key)
+	auth := newFeedAuth(testServiceDID, directory)
+
+	for range 3 {
+		_, err := auth.RequestUserDID(feedRequest(signServiceAuth(t, key, validClaims())), feedSkeletonLexiconMethod)
+		if err != nil {
+			t.Fatalf("validate token: %s", err)
+		}
+	}
+	if directory.lookups != 1 {
+		t.Fatalf("expected signing key to be resolved once, got %d", directory.lookups)
+	}
+
+	// a cached key that's older than the refresh interval is resolved again when a signature doesn't match, so that
+	// rotated keys are picked up
+	rotated := newTestPrivateKey(t)
+	directory.setKey(t, testUserDID, rotated)
+	cached, _ := auth.keys.keys.Get(syntax.DID(testUserDID))
+	cached.resolvedAt = time.Now().Add(-signingKeyMinRefreshInterval)
+	auth.keys.keys.Add(syntax.DID(testUserDID), cached)
+
+	_, err := auth.RequestUserDID(feedRequest(signServiceAuth(t, rotated, validClaims())), feedSkeletonLexiconMethod)
+	if err != nil {
+		t.Fatalf("expected token signed with rotated key to be accepted: %s", err)
+	}
+	if directory.lookups != 2 {
+		t.Fatalf("expected signing key to be resolved again, got %d lookups", directory.lookups)
+	}
+
+	// the key was just refreshed, so a bad signature doesn't cause another lookup
+	_, err = auth.RequestUserDID(feedRequest(signServiceAuth(t, key, validClaims())), feedSkeletonLexiconMethod)
+	if !errors.Is(err, errAuthInvalidSignature) {
+		t.Fatalf("expected invalid signature, got %v", err)
+	}
+	if directory.lookups != 2 {
+		t.Fatalf("expected recently refreshed key to not be resolved again, got %d lookups", directory.lookups)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/willdot/bskyfeedgen/frontend"
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+const (
+	exportFormatJSON = "json"
+	exportFormatCSV  = "csv"
+	exportFormatHTML = "html"
+)
+
+var csvExportHeader = []string{"url", "at_uri", "author_handle", "author_did", "content", "tags", "collection", "created_at"}
+
+// ExportedBookmark is a bookmark as it's written to a JSON export. JSON exports can be imported again.
+type ExportedBookmark struct {
+	URL          string    `json:"url"`
+	ATURI        string    `json:"atUri"`
+	AuthorHandle string    `json:"authorHandle"`
+	AuthorDID    string    `json:"authorDid"`
+	Content      string    `json:"content"`
+	Tags         []string  `json:"tags"`
+	Collection   string    `json:"collection,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+func (s *Server) HandleExportBookmarks(w http.ResponseWriter, r *http.Request) {
+	usersDid, ok := s.getDidFromSession(r)
+	if !ok {
+		slog.Warn("did not found in session")
+		_ = frontend.Login("", "").Render(r.Context(), w)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = exportFormatJSON
+	}
+	if format != exportFormatJSON && format != exportFormatCSV && format != exportFormatHTML {
+		http.Error(w, "invalid export format - use json, csv or html", http.StatusBadRequest)
+		return
+	}
+
+	bookmarks, err := s.bookmarkStore.GetBookmarksForUser(usersDid)
+	if err != nil {
+		slog.Error("get bookmarks for export", "error", err)
+		http.Error(w, "failed to get bookmarks", http.StatusInternalServerError)
+		return
+	}
+
+	collections, err := s.collectionStore.GetCollectionsForUser(usersDid)
+	if err != nil {
+		slog.Error("get collections for export", "error", err)
+		http.Error(w, "failed to get collections", http.StatusInternalServerError)
+		return
+	}
+	collectionNames := make(map[int]string, len(collections))
+	for _, collection := range collections {
+		collectionNames[collection.ID] = collection.Name
+	}
+
+	exported := make([]ExportedBookmark, 0, len(bookmarks))
+	for _, bookmark := range bookmarks {
+		exported = append(exported, exportBookmark(bookmark, collectionNames))
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"bookmarks.%s\"", format))
+
+	switch format {
+	case exportFormatCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		err = writeCSVExport(w, exported)
+	case exportFormatHTML:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = writeHTMLExport(w, exported)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(exported)
+	}
+	if err != nil {
+		// the response has already started so all that can be done is log it
+		slog.Error("write bookmarks export", "error", err, "format", format)
+	}
+}
+
+func exportBookmark(bookmark store.Bookmark, collectionNames map[int]string) ExportedBookmark {
+	url := bookmark.PostURI
+	if url == "" {
+		url = getPublicPostURIFromATURI(bookmark.PostATURI, bookmark.AuthorHandle)
+	}
+
+	tags := bookmark.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	return ExportedBookmark{
+		URL:          url,
+		ATURI:        bookmark.PostATURI,
+		AuthorHandle: bookmark.AuthorHandle,
+		AuthorDID:    bookmark.AuthorDID,
+		Content:      bookmark.Content,
+		Tags:         tags,
+		Collection:   collectionNames[bookmark.CollectionID],
+		CreatedAt:    time.UnixMilli(bookmark.CreatedAt).UTC(),
+	}
+}
+
+func writeCSVExport(w io.Writer, bookmarks []ExportedBookmark) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvExportHeader); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+
+	for _, bookmark := range bookmarks {
+		record := []string{
+			bookmark.URL,
+			bookmark.ATURI,
+			bookmark.AuthorHandle,
+			bookmark.AuthorDID,
+			bookmark.Content,
+			strings.Join(bookmark.Tags, " "),
+			bookmark.Collection,
+			bookmark.CreatedAt.Format(time.RFC3339),
+		}
+		for i, cell := range record {
+			record[i] = escapeCSVCell(cell)
+		}
+		if err := cw.Write(record); err != nil {
+			return fmt.Errorf("write record: %w", err)
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvFormulaPrefixes are the characters that make a spreadsheet treat a cell as a formula.
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// escapeCSVCell stops post content and other cells that users control from being run as a formula when the export is
+// opened in a spreadsheet, by starting them with a ' like spreadsheets do themselves.
+func escapeCSVCell(cell string) string {
+	if cell != "" && strings.ContainsRune(csvFormulaPrefixes, rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// unescapeCSVCell reverses escapeCSVCell so that exports can be imported again.
+func unescapeCSVCell(cell string) string {
+	if len(cell) > 1 && cell[0] == '\'' && strings.ContainsRune(csvFormulaPrefixes, rune(cell[1])) {
+		return cell[1:]
+	}
+	return cell
+}
+
+// writeHTMLExport writes the bookmarks in the Netscape bookmark file format that browsers and most bookmarking tools
+// can import. Collections are written as folders.
+func writeHTMLExport(w io.Writer, bookmarks []ExportedBookmark) error {
+	var sb strings.Builder
+	sb.WriteString("<!DOCTYPE NETSCAPE-Bookmark-file-1>\n")
+	sb.WriteString("<META HTTP-EQUIV=\"Content-Type\" CONTENT=\"text/html; charset=UTF-8\">\n")
+	sb.WriteString("<TITLE>Bookmarks</TITLE>\n<H1>Bookmarks</H1>\n<DL><p>\n")
+
+	byCollection := make(map[string][]ExportedBookmark)
+	collectionOrder := make([]string, 0)
+	for _, bookmark := range bookmarks {
+		if bookmark.Collection == "" {
+			writeHTMLExportLink(&sb, bookmark, "    ")
+			continue
+		}
+		if _, ok := byCollection[bookmark.Collection]; !ok {
+			collectionOrder = append(collectionOrder, bookmark.Collection)
+		}
+		byCollection[bookmark.Collection] = append(byCollection[bookmark.Collection], bookmark)
+	}
+
+	for _, collection := range collectionOrder {
+		fmt.Fprintf(&sb, "    <DT><H3>%s</H3>\n    <DL><p>\n", html.EscapeString(collection))
+		for _, bookmark := range byCollection[collection] {
+			writeHTMLExportLink(&sb, bookmark, "        ")
+		}
+		sb.WriteString("    </DL><p>\n")
+	}
+
+	sb.WriteString("</DL><p>\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func writeHTMLExportLink(sb *strings.Builder, bookmark ExportedBookmark, indent string) {
+	fmt.Fprintf(sb, "%s<DT><A HREF=\"%s\" ADD_DATE=\"%d\"", indent, html.EscapeString(bookmark.URL), bookmark.CreatedAt.Unix())
+	if len(bookmark.Tags) > 0 {
+		fmt.Fprintf(sb, " TAGS=\"%s\"", html.EscapeString(strings.Join(bookmark.Tags, ",")))
+	}
+	fmt.Fprintf(sb, ">%s</A>\n", html.EscapeString(bookmark.Content))
+}
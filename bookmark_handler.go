@@ -8,6 +8,7 @@ import (
 	"log/slog"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,6 +18,8 @@ import (
 	"github.com/willdot/bskyfeedgen/store"
 )
 
+const searchResultsLimit = 50
+
 func (s *Server) HandleAddBookmark(w http.ResponseWriter, r *http.Request) {
 	usersDid, ok := s.getDidFromSession(r)
 	if !ok {
@@ -28,7 +31,12 @@ func (s *Server) HandleAddBookmark(w http.ResponseWriter, r *http.Request) {
 	postURI := r.FormValue("uri")
 	postURI = strings.TrimSuffix(postURI, "/")
 
-	atPostURI, err := convertPostURIToAtValidURI(postURI)
+	collectionID, ok := s.parseUsersCollectionID(w, r, usersDid)
+	if !ok {
+		return
+	}
+
+	atPostURI, err := s.convertPostURIToAtValidURI(postURI)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -54,29 +62,14 @@ func (s *Server) HandleAddBookmark(w http.ResponseWriter, r *http.Request) {
 	}
 
 	post := postResp.Posts[0]
-	postBytes, err := post.Record.MarshalJSON()
+	content, rootURI, err := getBookmarkDetailsFromPost(post)
 	if err != nil {
-		slog.Error("marshal post record", "error", err)
+		slog.Error("get bookmark details from post", "error", err)
 		http.Error(w, "decode the post from Bluesky", http.StatusInternalServerError)
 		return
 	}
 
-	var postRecord apibsky.FeedPost
-	if err := json.Unmarshal(postBytes, &postRecord); err != nil {
-		slog.Error("unmarshal post record", "error", err)
-		http.Error(w, "decode the post from Bluesky", http.StatusInternalServerError)
-		return
-	}
-
-	content := postRecord.Text
-	if content == "" {
-		content = "post contained no text"
-	}
-	if len(content) > 75 {
-		content = fmt.Sprintf("%s...", content[:75])
-	}
-
-	err = s.bookmarkStore.CreateBookmark(rkey, postURI, atPostURI, post.Author.Did, post.Author.Handle, usersDid, content, time.Now().UnixMilli())
+	err = s.bookmarkStore.CreateBookmark(rkey, postURI, atPostURI, rootURI, post.Author.Did, post.Author.Handle, usersDid, content, time.Now().UnixMilli())
 	if err != nil {
 		if errors.Is(err, store.ErrBookmarkAlreadyExists) {
 			return
@@ -86,6 +79,22 @@ func (s *Server) HandleAddBookmark(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if collectionID != 0 {
+		err = s.collectionStore.SetBookmarkCollection(atPostURI, usersDid, collectionID)
+		if err != nil {
+			slog.Error("set bookmark collection", "error", err)
+			http.Error(w, "failed to add bookmark to collection", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	s.bookmarkRecords.Sync(r.Context(), atPostURI, usersDid)
+
+	collections, err := s.collectionStore.GetCollectionsForUser(usersDid)
+	if err != nil {
+		slog.Error("get collections for user", "error", err)
+	}
+
 	bookmark := store.Bookmark{
 		PostRKey:     rkey,
 		PostURI:      postURI,
@@ -94,16 +103,43 @@ func (s *Server) HandleAddBookmark(w http.ResponseWriter, r *http.Request) {
 		AuthorHandle: post.Author.Handle,
 		UserDID:      usersDid,
 		Content:      content,
+		CollectionID: collectionID,
+		RootURI:      rootURI,
+	}
+
+	_ = frontend.NewBookmarkRow(bookmark, collections).Render(r.Context(), w)
+}
+
+// getBookmarkDetailsFromPost decodes the post record to get the content to store with the bookmark and the root of the
+// thread the post is in.
+func getBookmarkDetailsFromPost(post *bsky.FeedDefs_PostView) (content string, rootURI string, err error) {
+	postBytes, err := post.Record.MarshalJSON()
+	if err != nil {
+		return "", "", fmt.Errorf("marshal post record: %w", err)
+	}
+
+	var postRecord apibsky.FeedPost
+	if err := json.Unmarshal(postBytes, &postRecord); err != nil {
+		return "", "", fmt.Errorf("unmarshal post record: %w", err)
 	}
 
-	_ = frontend.NewBookmarkRow(bookmark).Render(r.Context(), w)
+	content = postRecord.Text
+	if content == "" {
+		content = "post contained no text"
+	}
+
+	rootURI = post.Uri
+	if postRecord.Reply != nil && postRecord.Reply.Root != nil && postRecord.Reply.Root.Uri != "" {
+		rootURI = postRecord.Reply.Root.Uri
+	}
+	return content, rootURI, nil
 }
 
-func convertPostURIToAtValidURI(input string) (string, error) {
+func (s *Server) convertPostURIToAtValidURI(input string) (string, error) {
 	input = strings.TrimPrefix(input, "https://bsky.app/profile/")
 	b := strings.Split(input, "/")
 
-	did, err := resolveHandle(b[0])
+	did, err := resolveHandle(s.appViewURL, b[0])
 	if err != nil {
 		slog.Error("error resolving handle", "error", err)
 		return "", fmt.Errorf("error resolving handle")
@@ -112,11 +148,16 @@ func convertPostURIToAtValidURI(input string) (string, error) {
 	input = strings.ReplaceAll(input, b[0], did)
 	input = strings.ReplaceAll(input, "https://bsky.app/profile/", "")
 
-	return fmt.Sprintf("at://%s", strings.ReplaceAll(input, "post", "app.bsky.feed.post")), nil
+	// only replace the path segment as the rkey could also contain "post"
+	return fmt.Sprintf("at://%s", strings.Replace(input, "/post/", "/app.bsky.feed.post/", 1)), nil
 }
 
 func (s *Server) HandleDeleteBookmark(w http.ResponseWriter, r *http.Request) {
-	rKey := r.PathValue("rkey")
+	postATURI := r.URL.Query().Get("uri")
+	if !strings.HasPrefix(postATURI, "at://") {
+		http.Error(w, "invalid post AT URI", http.StatusBadRequest)
+		return
+	}
 
 	usersDid, ok := s.getDidFromSession(r)
 	if !ok {
@@ -125,21 +166,18 @@ func (s *Server) HandleDeleteBookmark(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	bookmark, err := s.bookmarkStore.GetBookmarkByRKeyForUser(rKey, usersDid)
+	bookmark, err := s.bookmarkStore.GetBookmarkByURIForUser(postATURI, usersDid)
 	if err != nil {
-		slog.Error("getting bookmark by rkey and users did", "error", err)
+		slog.Error("getting bookmark by AT URI and users did", "error", err)
 		http.Error(w, "getting bookmark to delete", http.StatusInternalServerError)
 		return
 	}
-
-	err = s.bookmarkStore.DeleteRepliedPostsForBookmarkedPostURIandUserDID(bookmark.PostATURI, usersDid)
-	if err != nil {
-		slog.Error("deleting replied posts for bookmark", "error", err)
-		http.Error(w, "deleting replied posts for bookmark", http.StatusInternalServerError)
+	if bookmark == nil {
+		http.Error(w, "bookmark not found", http.StatusNotFound)
 		return
 	}
 
-	err = s.bookmarkStore.DeleteBookmark(rKey, usersDid)
+	err = s.bookmarkRecords.Delete(r.Context(), *bookmark)
 	if err != nil {
 		slog.Error("delete bookmark", "error", err)
 		http.Error(w, "failed to delete bookmark", http.StatusInternalServerError)
@@ -159,24 +197,165 @@ func (s *Server) HandleGetBookmarks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	collections, err := s.collectionStore.GetCollectionsForUser(usersDid)
+	if err != nil {
+		slog.Error("error getting collections for user", "error", err)
+	}
+
+	settings, err := s.settingsStore.GetUserSettings(usersDid)
+	if err != nil {
+		slog.Error("error getting settings for user", "error", err)
+	}
+
 	bookmarks, err := s.bookmarkStore.GetBookmarksForUser(usersDid)
 	if err != nil {
 		slog.Error("error getting bookmarks for user", "error", err)
-		_ = frontend.Bookmarks(nil).Render(r.Context(), w)
+		_ = frontend.Bookmarks(nil, collections, s.feedDidBase, settings).Render(r.Context(), w)
 		return
 	}
 
 	resp := make([]store.Bookmark, 0, len(bookmarks))
 	resp = append(resp, bookmarks...)
 
-	_ = frontend.Bookmarks(resp).Render(r.Context(), w)
+	_ = frontend.Bookmarks(resp, collections, s.feedDidBase, settings).Render(r.Context(), w)
+}
+
+func (s *Server) HandleSearchBookmarks(w http.ResponseWriter, r *http.Request) {
+	usersDid, ok := s.getDidFromSession(r)
+	if !ok {
+		slog.Warn("did not found in session")
+		_ = frontend.Login("", "").Render(r.Context(), w)
+		return
+	}
+
+	collections, err := s.collectionStore.GetCollectionsForUser(usersDid)
+	if err != nil {
+		slog.Error("error getting collections for user", "error", err)
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	var bookmarks []store.Bookmark
+	if query == "" {
+		bookmarks, err = s.bookmarkStore.GetBookmarksForUser(usersDid)
+	} else {
+		bookmarks, err = s.bookmarkStore.SearchBookmarks(usersDid, query, searchResultsLimit)
+	}
+	if err != nil {
+		slog.Error("search bookmarks", "error", err)
+		http.Error(w, "failed to search bookmarks", http.StatusInternalServerError)
+		return
+	}
+
+	_ = frontend.BookmarkRows(bookmarks, collections).Render(r.Context(), w)
+}
+
+func (s *Server) HandleSetBookmarkTags(w http.ResponseWriter, r *http.Request) {
+	usersDid, ok := s.getDidFromSession(r)
+	if !ok {
+		slog.Warn("did not found in session")
+		_ = frontend.Login("", "").Render(r.Context(), w)
+		return
+	}
+
+	postATURI := r.URL.Query().Get("uri")
+
+	tags, err := parseTags(r.FormValue("tags"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.bookmarkStore.SetBookmarkTags(postATURI, usersDid, tags)
+	if errors.Is(err, store.ErrBookmarkNotFound) {
+		http.Error(w, "bookmark not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("set bookmark tags", "error", err)
+		http.Error(w, "failed to set bookmark tags", http.StatusInternalServerError)
+		return
+	}
+
+	s.bookmarkRecords.Sync(r.Context(), postATURI, usersDid)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) HandleSetBookmarkFollowThread(w http.ResponseWriter, r *http.Request) {
+	usersDid, ok := s.getDidFromSession(r)
+	if !ok {
+		slog.Warn("did not found in session")
+		_ = frontend.Login("", "").Render(r.Context(), w)
+		return
+	}
+
+	postATURI := r.URL.Query().Get("uri")
+
+	// an unchecked checkbox isn't sent with the form
+	follow := r.FormValue("follow") != ""
+
+	err := s.bookmarkStore.SetBookmarkFollowThread(postATURI, usersDid, follow)
+	if errors.Is(err, store.ErrBookmarkNotFound) {
+		http.Error(w, "bookmark not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("set bookmark follow thread", "error", err)
+		http.Error(w, "failed to set bookmark follow thread", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) HandleSetBookmarkExpiry(w http.ResponseWriter, r *http.Request) {
+	usersDid, ok := s.getDidFromSession(r)
+	if !ok {
+		slog.Warn("did not found in session")
+		_ = frontend.Login("", "").Render(r.Context(), w)
+		return
+	}
+
+	postATURI := r.URL.Query().Get("uri")
+
+	expiresIn := r.FormValue("expiresIn")
+	if expiresIn == frontend.KeepBookmarkExpiry {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	days, err := strconv.Atoi(expiresIn)
+	if err != nil || days < 0 {
+		http.Error(w, "invalid expiry", http.StatusBadRequest)
+		return
+	}
+
+	// 0 days means the bookmark uses the users bookmark TTL setting
+	var expiresAt int64
+	if days > 0 {
+		expiresAt = time.Now().Add(time.Hour * 24 * time.Duration(days)).UnixMilli()
+	}
+
+	err = s.bookmarkStore.SetBookmarkExpiry(postATURI, usersDid, expiresAt)
+	if errors.Is(err, store.ErrBookmarkNotFound) {
+		http.Error(w, "bookmark not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("set bookmark expiry", "error", err)
+		http.Error(w, "failed to set bookmark expiry", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
 }
 
-func resolveHandle(handle string) (string, error) {
+func resolveHandle(appViewURL, handle string) (string, error) {
 	params := url.Values{
 		"handle": []string{handle},
 	}
-	reqUrl := "https://public.api.bsky.app/xrpc/com.atproto.identity.resolveHandle?" + params.Encode()
+	reqUrl := fmt.Sprintf("%s/xrpc/com.atproto.identity.resolveHandle?%s", appViewURL, params.Encode())
 
 	resp, err := http.DefaultClient.Get(reqUrl)
 	if err != nil {
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+func newTestServer(t *testing.T, appView *fakeAppView) (*Server, *store.Store) {
+	t.Helper()
+
+	s := newTestStore(t)
+	return &Server{
+		feedHost:          "feeds.test",
+		feedDidBase:       "did:web:feeds.test",
+		feeds:             newTestFeeds(s),
+		appViewURL:        appView.URL(),
+		bookmarkStore:     s,
+		collectionStore:   s,
+		bookmarkRecords:   newBookmarkRecords(s, nil),
+		oauthRequestStore: s,
+		settingsStore:     s,
+		xrpcClient:        &xrpc.Client{Host: appView.URL()},
+		sessionStore:      store.NewSessionStore(s, time.Hour, time.Hour*24, []byte("test-session-key")),
+	}, s
+}
+
+// addSessionCookie logs the request in as the given user.
+func addSessionCookie(t *testing.T, srv *Server, r *http.Request, did string) {
+	t.Helper()
+
+	session, err := srv.sessionStore.Get(r, "oauth-session")
+	if err != nil {
+		t.Fatalf("get session: %s", err)
+	}
+	session.Values["did"] = did
+
+	rec := httptest.NewRecorder()
+	if err := session.Save(r, rec); err != nil {
+		t.Fatalf("save session: %s", err)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+}
+
+func addBookmarkRequest(t *testing.T, srv *Server, postURI string) *http.Request {
+	t.Helper()
+
+	form := url.Values{"uri": []string{postURI}}
+	req := httptest.NewRequest(http.MethodPost, "/bookmarks", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	addSessionCookie(t, srv, req, testUserDID)
+	return req
+}
+
+func TestHandleAddBookmark(t *testing.T) {
+	appView := newFakeAppView(t)
+	atURI := appView.AddPost(testAuthorDID, "author.test", "3kpost", "the full text of the post")
+
+	srv, s := newTestServer(t, appView)
+
+	rec := httptest.NewRecorder()
+	srv.HandleAddBookmark(rec, addBookmarkRequest(t, srv, "https://bsky.app/profile/author.test/post/3kpost"))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "author.test") {
+		t.Errorf("expected the new bookmark row to be rendered, got %s", rec.Body.String())
+	}
+
+	bookmark, err := s.GetBookmarkByURIForUser(atURI, testUserDID)
+	if err != nil {
+		t.Fatalf("get bookmark: %s", err)
+	}
+	if bookmark == nil {
+		t.Fatal("expected bookmark to be created")
+	}
+	if bookmark.Content != "the full text of the post" {
+		t.Errorf("unexpected bookmark content %q", bookmark.Content)
+	}
+	if bookmark.AuthorDID != testAuthorDID {
+		t.Errorf("unexpected author did %q", bookmark.AuthorDID)
+	}
+}
+
+func TestHandleAddBookmarkPostNotFound(t *testing.T) {
+	appView := newFakeAppView(t)
+	appView.AddPost(testAuthorDID, "author.test", "3kpost", "the full text of the post")
+
+	srv, _ := newTestServer(t, appView)
+
+	rec := httptest.NewRecorder()
+	srv.HandleAddBookmark(rec, addBookmarkRequest(t, srv, "https://bsky.app/profile/author.test/post/missing"))
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandleAddBookmarkNotLoggedIn(t *testing.T) {
+	appView := newFakeAppView(t)
+	srv, s := newTestServer(t, appView)
+
+	form := url.Values{"uri": []string{"https://bsky.app/profile/author.test/post/3kpost"}}
+	req := httptest.NewRequest(http.MethodPost, "/bookmarks", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rec := httptest.NewRecorder()
+	srv.HandleAddBookmark(rec, req)
+
+	bookmarks, err := s.GetBookmarksForUser(testUserDID)
+	if err != nil {
+		t.Fatalf("get bookmarks: %s", err)
+	}
+	if len(bookmarks) != 0 {
+		t.Errorf("expected no bookmarks to be created, got %d", len(bookmarks))
+	}
+}
+
+func TestHandleSetBookmarkTagsBookmarkNotFound(t *testing.T) {
+	appView := newFakeAppView(t)
+	srv, _ := newTestServer(t, appView)
+
+	req := httptest.NewRequest(http.MethodPut, "/bookmarks/tags?uri="+url.QueryEscape("at://did:plc:author/app.bsky.feed.post/missing"), strings.NewReader(url.Values{"tags": {"go"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	addSessionCookie(t, srv, req, testUserDID)
+
+	rec := httptest.NewRecorder()
+	srv.HandleSetBookmarkTags(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandleSetBookmarkCollectionBookmarkNotFound(t *testing.T) {
+	appView := newFakeAppView(t)
+	srv, _ := newTestServer(t, appView)
+
+	tests := map[string]struct {
+		uri  string
+		code int
+	}{
+		"missing uri":      {uri: "", code: http.StatusBadRequest},
+		"unknown bookmark": {uri: "at://did:plc:author/app.bsky.feed.post/missing", code: http.StatusNotFound},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/bookmarks/collection?uri="+url.QueryEscape(tt.uri), strings.NewReader(url.Values{"collection": {"0"}}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			addSessionCookie(t, srv, req, testUserDID)
+
+			rec := httptest.NewRecorder()
+			srv.HandleSetBookmarkCollection(rec, req)
+
+			if rec.Code != tt.code {
+				t.Errorf("expected status %d, got %d: %s", tt.code, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleSetBookmarkFollowThreadBookmarkNotFound(t *testing.T) {
+	appView := newFakeAppView(t)
+	srv, _ := newTestServer(t, appView)
+
+	req := httptest.NewRequest(http.MethodPut, "/bookmarks/follow-thread?uri="+url.QueryEscape("at://did:plc:author/app.bsky.feed.post/missing"), strings.NewReader(url.Values{"follow": {"on"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	addSessionCookie(t, srv, req, testUserDID)
+
+	rec := httptest.NewRecorder()
+	srv.HandleSetBookmarkFollowThread(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandleSetBookmarkExpiryBookmarkNotFound(t *testing.T) {
+	appView := newFakeAppView(t)
+	srv, _ := newTestServer(t, appView)
+
+	req := httptest.NewRequest(http.MethodPut, "/bookmarks/expiry?uri="+url.QueryEscape("at://did:plc:author/app.bsky.feed.post/missing"), strings.NewReader(url.Values{"expiresIn": {"7"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	addSessionCookie(t, srv, req, testUserDID)
+
+	rec := httptest.NewRecorder()
+	srv.HandleSetBookmarkExpiry(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/willdot/bskyfeedgen/frontend"
+	"github.com/willdot/bskyfeedgen/store"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	maxImportFileSize = 5 << 20
+	maxImportRows     = 2000
+	// getPosts and getProfiles accept at most 25 posts or actors per request
+	importBatchSize = 25
+	// importTimeout limits how long an import can spend fetching posts and profiles from Bluesky
+	importTimeout = 2 * time.Minute
+)
+
+// importRow is a single bookmark read from an import file. Row is its position in the file, starting at 1, so that
+// failures can be reported back to the user.
+type importRow struct {
+	Row        int
+	URL        string
+	Tags       []string
+	Collection string
+}
+
+func (s *Server) HandleImportBookmarks(w http.ResponseWriter, r *http.Request) {
+	usersDid, ok := s.getDidFromSession(r)
+	if !ok {
+		slog.Warn("did not found in session")
+		_ = frontend.Login("", "").Render(r.Context(), w)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportFileSize)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "missing import file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "failed to read import file", http.StatusBadRequest)
+		return
+	}
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = detectImportFormat(header.Filename, data)
+	}
+
+	rows, err := parseImportFile(format, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(rows) > maxImportRows {
+		http.Error(w, fmt.Sprintf("an import can't contain more than %d bookmarks", maxImportRows), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), importTimeout)
+	defer cancel()
+
+	result, err := s.importBookmarks(ctx, usersDid, rows)
+	if err != nil {
+		slog.Error("import bookmarks", "error", err)
+		http.Error(w, "failed to import bookmarks", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("bookmarks imported", "did", usersDid, "imported", result.Imported, "duplicates", result.Duplicates, "failed", len(result.Failures))
+
+	_ = frontend.ImportResult(result).Render(r.Context(), w)
+}
+
+// detectImportFormat works out the format of an import file from its extension, falling back to its content.
+func detectImportFormat(filename string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return exportFormatJSON
+	case ".csv":
+		return exportFormatCSV
+	case ".html", ".htm":
+		return exportFormatHTML
+	}
+
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		return exportFormatJSON
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		return exportFormatHTML
+	default:
+		return exportFormatCSV
+	}
+}
+
+func parseImportFile(format string, data []byte) ([]importRow, error) {
+	switch format {
+	case exportFormatJSON:
+		return parseJSONImport(data)
+	case exportFormatCSV:
+		return parseCSVImport(data)
+	case exportFormatHTML:
+		return parseHTMLImport(data)
+	default:
+		return nil, fmt.Errorf("invalid import format %q - use json, csv or html", format)
+	}
+}
+
+func parseJSONImport(data []byte) ([]importRow, error) {
+	var bookmarks []ExportedBookmark
+	if err := json.Unmarshal(data, &bookmarks); err != nil {
+		return nil, fmt.Errorf("invalid JSON import file: %w", err)
+	}
+
+	rows := make([]importRow, 0, len(bookmarks))
+	for i, bookmark := range bookmarks {
+		url := bookmark.URL
+		if bookmark.ATURI != "" {
+			url = bookmark.ATURI
+		}
+		rows = append(rows, importRow{
+			Row:        i + 1,
+			URL:        url,
+			Tags:       bookmark.Tags,
+			Collection: bookmark.Collection,
+		})
+	}
+	return rows, nil
+}
+
+// parseCSVImport reads a CSV file with a header row. Only the url column is required, tags and collection are used if
+// they exist.
+func parseCSVImport(data []byte) ([]importRow, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV import file: %w", err)
+	}
+
+	columns := map[string]int{"url": -1, "tags": -1, "collection": -1}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "uri", "link":
+			name = "url"
+		case "folder":
+			name = "collection"
+		}
+		if index, ok := columns[name]; ok && index == -1 {
+			columns[name] = i
+		}
+	}
+	if columns["url"] == -1 {
+		return nil, errors.New("invalid CSV import file: missing url column")
+	}
+
+	column := func(record []string, name string) string {
+		index := columns[name]
+		if index == -1 || index >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(unescapeCSVCell(record[index]))
+	}
+
+	rows := make([]importRow, 0)
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV import file: %w", err)
+		}
+
+		rows = append(rows, importRow{
+			Row:        row,
+			URL:        column(record, "url"),
+			Tags:       strings.Fields(column(record, "tags")),
+			Collection: column(record, "collection"),
+		})
+	}
+	return rows, nil
+}
+
+// parseHTMLImport reads a Netscape bookmark file. Links inside a folder are imported into a collection with the
+// folder's name.
+func parseHTMLImport(data []byte) ([]importRow, error) {
+	tokenizer := html.NewTokenizer(bytes.NewReader(data))
+
+	// folders holds the name of each folder the tokenizer is inside of, with "" for lists that aren't a folder
+	folders := make([]string, 0)
+	pendingFolder := ""
+	inFolderName := false
+
+	rows := make([]importRow, 0)
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if errors.Is(tokenizer.Err(), io.EOF) {
+				return rows, nil
+			}
+			return nil, fmt.Errorf("invalid HTML import file: %w", tokenizer.Err())
+		case html.TextToken:
+			if inFolderName {
+				pendingFolder += string(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch atom.Lookup(name) {
+			case atom.H3:
+				inFolderName = false
+			case atom.Dl:
+				if len(folders) > 0 {
+					folders = folders[:len(folders)-1]
+				}
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			switch atom.Lookup(name) {
+			case atom.H3:
+				inFolderName = true
+				pendingFolder = ""
+			case atom.Dl:
+				folders = append(folders, strings.TrimSpace(pendingFolder))
+				pendingFolder = ""
+			case atom.A:
+				row := importRow{Row: len(rows) + 1}
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = tokenizer.TagAttr()
+					switch string(key) {
+					case "href":
+						row.URL = strings.TrimSpace(string(val))
+					case "tags":
+						row.Tags = strings.Split(string(val), ",")
+					}
+				}
+				for i := len(folders) - 1; i >= 0; i-- {
+					if folders[i] != "" {
+						row.Collection = folders[i]
+						break
+					}
+				}
+				rows = append(rows, row)
+			}
+		}
+	}
+}
+
+// pendingImport is an import row that has been resolved to a post AT URI and is waiting for the post to be fetched.
+type pendingImport struct {
+	importRow
+	atURI string
+}
+
+// importBookmarks creates a bookmark for each row. Rows that fail are reported in the result rather than stopping the
+// import. Posts that the user has already bookmarked, or that are in the file more than once, are skipped.
+func (s *Server) importBookmarks(ctx context.Context, usersDid string, rows []importRow) (frontend.ImportResultData, error) {
+	var result frontend.ImportResultData
+	fail := func(row importRow, reason string) {
+		result.Failures = append(result.Failures, frontend.ImportFailure{Row: row.Row, URL: row.URL, Reason: reason})
+	}
+
+	existing, err := s.bookmarkStore.GetBookmarksForUser(usersDid)
+	if err != nil {
+		return result, fmt.Errorf("get existing bookmarks: %w", err)
+	}
+	seen := make(map[string]bool, len(existing)+len(rows))
+	for _, bookmark := range existing {
+		seen[bookmark.PostATURI] = true
+	}
+
+	dids := s.resolveImportHandles(ctx, rows)
+
+	pending := make([]pendingImport, 0, len(rows))
+	for _, row := range rows {
+		atURI, err := importRowATURI(row, dids)
+		if err != nil {
+			fail(row, err.Error())
+			continue
+		}
+		if seen[atURI] {
+			result.Duplicates++
+			continue
+		}
+		seen[atURI] = true
+		pending = append(pending, pendingImport{importRow: row, atURI: atURI})
+	}
+
+	collections := make(map[string]int)
+	for start := 0; start < len(pending); start += importBatchSize {
+		batch := pending[start:min(start+importBatchSize, len(pending))]
+
+		uris := make([]string, 0, len(batch))
+		for _, p := range batch {
+			uris = append(uris, p.atURI)
+		}
+
+		postResp, err := bsky.FeedGetPosts(ctx, s.xrpcClient, uris)
+		if err != nil {
+			slog.Error("get posts for import", "error", err)
+			for _, p := range batch {
+				fail(p.importRow, "error fetching post from Bluesky")
+			}
+			continue
+		}
+
+		posts := make(map[string]*bsky.FeedDefs_PostView, len(postResp.Posts))
+		for _, post := range postResp.Posts {
+			posts[post.Uri] = post
+		}
+
+		for _, p := range batch {
+			post, ok := posts[p.atURI]
+			if !ok {
+				fail(p.importRow, "post not found")
+				continue
+			}
+
+			err := s.importBookmark(ctx, usersDid, p, post, collections)
+			if errors.Is(err, store.ErrBookmarkAlreadyExists) {
+				result.Duplicates++
+				continue
+			}
+			var userErr *importRowError
+			if errors.As(err, &userErr) {
+				fail(p.importRow, userErr.Error())
+				continue
+			}
+			if err != nil {
+				slog.Error("import bookmark", "error", err, "post AT URI", p.atURI)
+				fail(p.importRow, "failed to save bookmark")
+				continue
+			}
+			result.Imported++
+			s.bookmarkRecords.Sync(ctx, p.atURI, usersDid)
+		}
+	}
+
+	return result, nil
+}
+
+// importRowError is a problem with a single row of an import that is reported back to the user.
+type importRowError struct {
+	msg string
+}
+
+func (e *importRowError) Error() string {
+	return e.msg
+}
+
+func importRowATURI(row importRow, dids map[string]string) (string, error) {
+	url := strings.TrimSuffix(strings.TrimSpace(row.URL), "/")
+	switch {
+	case url == "":
+		return "", &importRowError{msg: "missing post URL"}
+	case strings.HasPrefix(url, "at://"):
+		if !strings.Contains(url, "/app.bsky.feed.post/") {
+			return "", &importRowError{msg: "not a Bluesky post"}
+		}
+		return url, nil
+	case strings.HasPrefix(url, "https://bsky.app/profile/"):
+		actor, rkey, ok := parsePostURL(url)
+		if !ok {
+			return "", &importRowError{msg: "not a Bluesky post URL"}
+		}
+		did := actor
+		if !strings.HasPrefix(actor, "did:") {
+			did = dids[strings.ToLower(actor)]
+		}
+		if did == "" {
+			return "", &importRowError{msg: "couldn't resolve the post author's handle"}
+		}
+		return fmt.Sprintf("at://%s/app.bsky.feed.post/%s", did, rkey), nil
+	default:
+		return "", &importRowError{msg: "not a Bluesky post URL"}
+	}
+}
+
+// parsePostURL splits a https://bsky.app/profile/{actor}/post/{rkey} URL into the actor, which is either a handle or
+// a DID, and the rkey of the post.
+func parsePostURL(url string) (string, string, bool) {
+	parts := strings.Split(strings.TrimPrefix(url, "https://bsky.app/profile/"), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] != "post" || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[2], true
+}
+
+// resolveImportHandles resolves the handle of every post author in an import to their DID, keyed by the lowercase
+// handle. Each handle is only looked up once, in batches, so that a large import doesn't make a request per row.
+// Handles that can't be resolved are left out so that their rows fail.
+func (s *Server) resolveImportHandles(ctx context.Context, rows []importRow) map[string]string {
+	handles := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		actor, _, ok := parsePostURL(strings.TrimSuffix(strings.TrimSpace(row.URL), "/"))
+		if !ok || strings.HasPrefix(actor, "did:") {
+			continue
+		}
+		handle := strings.ToLower(actor)
+		if seen[handle] {
+			continue
+		}
+		seen[handle] = true
+		handles = append(handles, handle)
+	}
+
+	dids := make(map[string]string, len(handles))
+	for start := 0; start < len(handles); start += importBatchSize {
+		batch := handles[start:min(start+importBatchSize, len(handles))]
+
+		profileResp, err := bsky.ActorGetProfiles(ctx, s.xrpcClient, batch)
+		if err != nil {
+			slog.Error("get profiles for import", "error", err)
+			continue
+		}
+		for _, profile := range profileResp.Profiles {
+			dids[strings.ToLower(profile.Handle)] = profile.Did
+		}
+	}
+	return dids
+}
+
+func (s *Server) importBookmark(ctx context.Context, usersDid string, p pendingImport, post *bsky.FeedDefs_PostView, collections map[string]int) error {
+	tags, err := parseTags(strings.Join(p.Tags, " "))
+	if err != nil {
+		return &importRowError{msg: err.Error()}
+	}
+
+	var collectionName string
+	if p.Collection != "" {
+		collectionName, err = normalizeCollectionName(p.Collection)
+		if err != nil {
+			return &importRowError{msg: err.Error()}
+		}
+	}
+
+	content, rootURI, err := getBookmarkDetailsFromPost(post)
+	if err != nil {
+		return fmt.Errorf("get bookmark details from post: %w", err)
+	}
+
+	// the collection is got before the bookmark is created so that failing to create it doesn't leave a bookmark behind
+	var collectionID int
+	if collectionName != "" {
+		var ok bool
+		collectionID, ok = collections[collectionName]
+		if !ok {
+			collection, err := getOrCreateCollection(ctx, s.collectionStore, s.feedPublisher, usersDid, collectionName)
+			if err != nil {
+				return fmt.Errorf("get or create collection: %w", err)
+			}
+			collectionID = collection.ID
+			collections[collectionName] = collectionID
+		}
+	}
+
+	publicURI := getPublicPostURIFromATURI(p.atURI, post.Author.Handle)
+	err = s.bookmarkStore.CreateBookmark(getRKeyFromATURI(p.atURI), publicURI, p.atURI, rootURI, post.Author.Did, post.Author.Handle, usersDid, content, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	err = s.setImportedBookmarkDetails(p.atURI, usersDid, tags, collectionID)
+	if err != nil {
+		// remove the half imported bookmark so that importing the file again retries the row rather than skipping it as
+		// a duplicate
+		deleteErr := s.bookmarkRecords.Delete(ctx, store.Bookmark{PostATURI: p.atURI, UserDID: usersDid})
+		if deleteErr != nil {
+			slog.Error("delete half imported bookmark", "error", deleteErr, "post AT URI", p.atURI)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) setImportedBookmarkDetails(postATURI, usersDid string, tags []string, collectionID int) error {
+	if len(tags) > 0 {
+		err := s.bookmarkStore.SetBookmarkTags(postATURI, usersDid, tags)
+		if err != nil {
+			return fmt.Errorf("set bookmark tags: %w", err)
+		}
+	}
+
+	if collectionID != 0 {
+		err := s.collectionStore.SetBookmarkCollection(postATURI, usersDid, collectionID)
+		if err != nil {
+			return fmt.Errorf("set bookmark collection: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+func importRequest(t *testing.T, srv *Server, filename, content string) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatalf("create form file: %s", err)
+	}
+	if _, err := fw.Write([]byte(content)); err != nil {
+		t.Fatalf("write form file: %s", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close multipart writer: %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/bookmarks/import", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	addSessionCookie(t, srv, req, testUserDID)
+	return req
+}
+
+func TestHandleImportBookmarksCSV(t *testing.T) {
+	appView := newFakeAppView(t)
+	first := appView.AddPost(testAuthorDID, "author.test", "3kfirst", "the first post")
+	second := appView.AddPost(testAuthorDID, "author.test", "3ksecond", "the second post")
+	existing := appView.AddPost(testAuthorDID, "author.test", "3kexisting", "already bookmarked")
+
+	srv, s := newTestServer(t, appView)
+
+	err := s.CreateBookmark("3kexisting", "", existing, "", testAuthorDID, "author.test", testUserDID, "already bookmarked", time.Now().UnixMilli())
+	if err != nil {
+		t.Fatalf("create bookmark: %s", err)
+	}
+
+	file := strings.Join([]string{
+		"url,tags,collection",
+		"https://bsky.app/profile/author.test/post/3kfirst,go sqlite,Reading",
+		second + ",,",
+		"https://bsky.app/profile/author.test/post/3kexisting,,",
+		"https://bsky.app/profile/author.test/post/3kfirst,,",
+		"https://bsky.app/profile/author.test/post/missing,,",
+		"https://example.com/not-a-post,,",
+	}, "\n")
+
+	rec := httptest.NewRecorder()
+	srv.HandleImportBookmarks(rec, importRequest(t, srv, "bookmarks.csv", file))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "Imported 2, skipped 2 duplicates, 2 failed") {
+		t.Errorf("unexpected import summary: %s", body)
+	}
+	if !strings.Contains(body, "Row 5") || !strings.Contains(body, "post not found") {
+		t.Errorf("expected the missing post to be reported, got %s", body)
+	}
+	if !strings.Contains(body, "Row 6") {
+		t.Errorf("expected the invalid URL to be reported, got %s", body)
+	}
+
+	bookmark, err := s.GetBookmarkByURIForUser(first, testUserDID)
+	if err != nil {
+		t.Fatalf("get bookmark: %s", err)
+	}
+	if bookmark == nil {
+		t.Fatal("expected the first post to be bookmarked")
+	}
+	if bookmark.Content != "the first post" {
+		t.Errorf("unexpected bookmark content %q", bookmark.Content)
+	}
+	if !slices.Equal(bookmark.Tags, []string{"go", "sqlite"}) {
+		t.Errorf("unexpected bookmark tags %v", bookmark.Tags)
+	}
+
+	collection, err := s.GetCollectionByName(testUserDID, "reading")
+	if err != nil {
+		t.Fatalf("get collection: %s", err)
+	}
+	if collection == nil {
+		t.Fatal("expected the collection to be created")
+	}
+	if bookmark.CollectionID != collection.ID {
+		t.Errorf("expected the bookmark to be in collection %d, got %d", collection.ID, bookmark.CollectionID)
+	}
+
+	bookmark, err = s.GetBookmarkByURIForUser(second, testUserDID)
+	if err != nil {
+		t.Fatalf("get bookmark: %s", err)
+	}
+	if bookmark == nil {
+		t.Fatal("expected the post imported by AT URI to be bookmarked")
+	}
+	if bookmark.PostURI != "https://bsky.app/profile/author.test/post/3ksecond" {
+		t.Errorf("unexpected public post URI %q", bookmark.PostURI)
+	}
+}
+
+func TestHandleImportBookmarksResolvesEachHandleOnce(t *testing.T) {
+	appView := newFakeAppView(t)
+	first := appView.AddPost(testAuthorDID, "author.test", "3kfirst", "the first post")
+	second := appView.AddPost(testAuthorDID, "author.test", "3ksecond", "the second post")
+	other := appView.AddPost("did:plc:other", "other.test", "3kother", "another author")
+	byDID := appView.AddPost("did:plc:bydid", "bydid.test", "3kbydid", "linked by DID")
+
+	srv, s := newTestServer(t, appView)
+
+	file := strings.Join([]string{
+		"url",
+		"https://bsky.app/profile/author.test/post/3kfirst",
+		"https://bsky.app/profile/Author.Test/post/3ksecond",
+		"https://bsky.app/profile/other.test/post/3kother",
+		"https://bsky.app/profile/did:plc:bydid/post/3kbydid",
+		"https://bsky.app/profile/unknown.test/post/3kunknown",
+	}, "\n")
+
+	rec := httptest.NewRecorder()
+	srv.HandleImportBookmarks(rec, importRequest(t, srv, "bookmarks.csv", file))
+
+	body := rec.Body.String()
+	if !strings.Contains(body, "Imported 4, skipped 0 duplicates, 1 failed") {
+		t.Fatalf("unexpected import summary: %s", body)
+	}
+	if !strings.Contains(body, "Row 5") || !strings.Contains(body, "couldn&#39;t resolve the post author&#39;s handle") {
+		t.Errorf("expected the unknown handle to be reported, got %s", body)
+	}
+
+	if got := appView.Requests("/xrpc/app.bsky.actor.getProfiles"); got != 1 {
+		t.Errorf("expected the handles to be resolved in 1 request, got %d", got)
+	}
+	if got := appView.Requests("/xrpc/com.atproto.identity.resolveHandle"); got != 0 {
+		t.Errorf("expected no handles to be resolved one at a time, got %d", got)
+	}
+
+	for _, uri := range []string{first, second, other, byDID} {
+		bookmark, err := s.GetBookmarkByURIForUser(uri, testUserDID)
+		if err != nil || bookmark == nil {
+			t.Errorf("expected %s to be bookmarked: %v", uri, err)
+		}
+	}
+}
+
+// failingTagsStore fails to tag bookmarks so that an import fails part way through saving a bookmark.
+type failingTagsStore struct {
+	*store.Store
+}
+
+func (f failingTagsStore) SetBookmarkTags(postATURI, userDID string, tags []string) error {
+	return errors.New("tags unavailable")
+}
+
+func TestHandleImportBookmarksRetriesHalfImportedRows(t *testing.T) {
+	appView := newFakeAppView(t)
+	postURI := appView.AddPost(testAuthorDID, "author.test", "3kpost", "a post")
+
+	srv, s := newTestServer(t, appView)
+	srv.bookmarkStore = failingTagsStore{s}
+
+	file := "url,tags,collection\n" + postURI + ",go,\n"
+
+	rec := httptest.NewRecorder()
+	srv.HandleImportBookmarks(rec, importRequest(t, srv, "bookmarks.csv", file))
+	if !strings.Contains(rec.Body.String(), "failed to save bookmark") {
+		t.Fatalf("expected the row to fail, got %s", rec.Body.String())
+	}
+	if bookmark, err := s.GetBookmarkByURIForUser(postURI, testUserDID); err != nil || bookmark != nil {
+		t.Fatalf("expected the half imported bookmark to be removed, got %+v: %v", bookmark, err)
+	}
+
+	srv.bookmarkStore = s
+	rec = httptest.NewRecorder()
+	srv.HandleImportBookmarks(rec, importRequest(t, srv, "bookmarks.csv", file))
+	if !strings.Contains(rec.Body.String(), "Imported 1, skipped 0 duplicates, 0 failed") {
+		t.Fatalf("expected the row to be imported again, got %s", rec.Body.String())
+	}
+
+	bookmark, err := s.GetBookmarkByURIForUser(postURI, testUserDID)
+	if err != nil || bookmark == nil {
+		t.Fatalf("get bookmark: %v", err)
+	}
+	if !slices.Equal(bookmark.Tags, []string{"go"}) {
+		t.Errorf("expected the tags to be applied, got %v", bookmark.Tags)
+	}
+}
+
+// TestExportImportRoundTrip exports bookmarks in each format and checks that importing the export into another
+// account gives the same bookmarks.
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, format := range []string{exportFormatJSON, exportFormatCSV, exportFormatHTML} {
+		t.Run(format, func(t *testing.T) {
+			appView := newFakeAppView(t)
+			tagged := appView.AddPost(testAuthorDID, "author.test", "3ktagged", "a tagged post")
+			collected := appView.AddPost(testAuthorDID, "author.test", "3kcollected", "a post in a collection")
+
+			srv, s := newTestServer(t, appView)
+
+			for _, uri := range []string{tagged, collected} {
+				err := s.CreateBookmark(getRKeyFromATURI(uri), getPublicPostURIFromATURI(uri, "author.test"), uri, "", testAuthorDID, "author.test", "did:plc:exporter", "content", time.Now().UnixMilli())
+				if err != nil {
+					t.Fatalf("create bookmark: %s", err)
+				}
+			}
+			if err := s.SetBookmarkTags(tagged, "did:plc:exporter", []string{"go"}); err != nil {
+				t.Fatalf("set bookmark tags: %s", err)
+			}
+			collection, err := s.CreateCollection("did:plc:exporter", "reading", time.Now().UnixMilli())
+			if err != nil {
+				t.Fatalf("create collection: %s", err)
+			}
+			if err := s.SetBookmarkCollection(collected, "did:plc:exporter", collection.ID); err != nil {
+				t.Fatalf("set bookmark collection: %s", err)
+			}
+
+			exportReq := httptest.NewRequest(http.MethodGet, "/bookmarks/export?format="+format, nil)
+			addSessionCookie(t, srv, exportReq, "did:plc:exporter")
+			exportRec := httptest.NewRecorder()
+			srv.HandleExportBookmarks(exportRec, exportReq)
+
+			if exportRec.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", exportRec.Code, exportRec.Body.String())
+			}
+			if format == exportFormatJSON {
+				var exported []ExportedBookmark
+				if err := json.Unmarshal(exportRec.Body.Bytes(), &exported); err != nil {
+					t.Fatalf("decode export: %s", err)
+				}
+				if len(exported) != 2 {
+					t.Fatalf("expected 2 exported bookmarks, got %d", len(exported))
+				}
+			}
+
+			importRec := httptest.NewRecorder()
+			srv.HandleImportBookmarks(importRec, importRequest(t, srv, "export."+format, exportRec.Body.String()))
+
+			if !strings.Contains(importRec.Body.String(), "Imported 2, skipped 0 duplicates, 0 failed") {
+				t.Fatalf("unexpected import summary: %s", importRec.Body.String())
+			}
+
+			bookmark, err := s.GetBookmarkByURIForUser(tagged, testUserDID)
+			if err != nil || bookmark == nil {
+				t.Fatalf("expected the tagged post to be imported: %v", err)
+			}
+			if !slices.Equal(bookmark.Tags, []string{"go"}) {
+				t.Errorf("unexpected bookmark tags %v", bookmark.Tags)
+			}
+
+			bookmark, err = s.GetBookmarkByURIForUser(collected, testUserDID)
+			if err != nil || bookmark == nil {
+				t.Fatalf("expected the collected post to be imported: %v", err)
+			}
+			imported, err := s.GetCollectionByName(testUserDID, "reading")
+			if err != nil || imported == nil {
+				t.Fatalf("expected the collection to be imported: %v", err)
+			}
+			if bookmark.CollectionID != imported.ID {
+				t.Errorf("expected the bookmark to be in collection %d, got %d", imported.ID, bookmark.CollectionID)
+			}
+		})
+	}
+}
+
+func TestDetectImportFormat(t *testing.T) {
+	tests := []struct {
+		filename string
+		content  string
+		want     string
+	}{
+		{filename: "bookmarks.JSON", content: "", want: exportFormatJSON},
+		{filename: "bookmarks.htm", content: "", want: exportFormatHTML},
+		{filename: "upload", content: "  [{}]", want: exportFormatJSON},
+		{filename: "upload", content: "<!DOCTYPE NETSCAPE-Bookmark-file-1>", want: exportFormatHTML},
+		{filename: "upload", content: "url\nhttps://bsky.app", want: exportFormatCSV},
+	}
+	for _, tt := range tests {
+		if got := detectImportFormat(tt.filename, []byte(tt.content)); got != tt.want {
+			t.Errorf("detectImportFormat(%q, %q) = %q, want %q", tt.filename, tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestCSVExportEscapesFormulas(t *testing.T) {
+	bookmarks := []ExportedBookmark{
+		{
+			URL:        "https://bsky.app/profile/author.test/post/3kpost",
+			Content:    "=HYPERLINK(\"https://evil.test\")",
+			Tags:       []string{"-go"},
+			Collection: "@reading",
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writeCSVExport(&buf, bookmarks); err != nil {
+		t.Fatalf("write CSV export: %s", err)
+	}
+
+	exported := buf.String()
+	records, err := csv.NewReader(strings.NewReader(exported)).ReadAll()
+	if err != nil {
+		t.Fatalf("read CSV export: %s", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected a header and 1 record, got %d rows", len(records))
+	}
+	for i, cell := range records[1] {
+		if cell != "" && strings.ContainsRune("=+-@", rune(cell[0])) {
+			t.Errorf("expected cell %d to be escaped, got %q", i, cell)
+		}
+	}
+
+	rows, err := parseCSVImport([]byte(exported))
+	if err != nil {
+		t.Fatalf("parse CSV import: %s", err)
+	}
+	if len(rows) != 1 || !slices.Equal(rows[0].Tags, []string{"-go"}) || rows[0].Collection != "@reading" {
+		t.Errorf("expected escaped cells to be imported as they were exported, got %+v", rows)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/bugsnag/bugsnag-go/v2"
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+// bookmarkRecordCollection is the collection bookmarks are stored in in users repos. The lexicon is in lexicons/.
+const bookmarkRecordCollection = "com.bsfeeder.bookmark"
+
+// bookmarkRecordPostTimeout is how long looking up the post of a new bookmark record can take, as it's done on a
+// Jetstream worker and holds up the events behind it.
+const bookmarkRecordPostTimeout = time.Second * 5
+
+var bookmarkRecordClock = syntax.NewTIDClock(0)
+
+type BookmarkRecord struct {
+	LexiconTypeID string   `json:"$type"`
+	Subject       string   `json:"subject"`
+	Tags          []string `json:"tags,omitempty"`
+	CreatedAt     string   `json:"createdAt"`
+}
+
+type UserRepoWriter interface {
+	PutUserRecord(ctx context.Context, userDID, collection, rkey string, record any) error
+	DeleteUserRecord(ctx context.Context, userDID, collection, rkey string) error
+}
+
+func newBookmarkRecord(bookmark store.Bookmark) BookmarkRecord {
+	return BookmarkRecord{
+		LexiconTypeID: bookmarkRecordCollection,
+		Subject:       bookmark.PostATURI,
+		Tags:          bookmark.Tags,
+		CreatedAt:     time.UnixMilli(bookmark.CreatedAt).UTC().Format(time.RFC3339),
+	}
+}
+
+// bookmarkRecords keeps the bookmark records in users repos in step with their bookmarks here, so that a bookmark isn't
+// lost or brought back when the bookmarks table is rebuilt from the network. Every way of creating, changing or deleting
+// a bookmark should go through it.
+type bookmarkRecords struct {
+	store BookmarkStore
+	// repoWriter can be nil, in which case bookmarks are only kept here
+	repoWriter UserRepoWriter
+}
+
+func newBookmarkRecords(store BookmarkStore, repoWriter UserRepoWriter) *bookmarkRecords {
+	return &bookmarkRecords{
+		store:      store,
+		repoWriter: repoWriter,
+	}
+}
+
+// Sync writes the users bookmark to their repo, creating the record if it doesn't have one yet. Users without an OAuth
+// session, such as those that only use DMs, just keep the bookmark here. Failing to write the record doesn't fail the
+// request as the bookmark has already been saved.
+func (b *bookmarkRecords) Sync(ctx context.Context, postATURI, userDID string) {
+	if b.repoWriter == nil {
+		return
+	}
+
+	bookmark, err := b.store.GetBookmarkByURIForUser(postATURI, userDID)
+	if err != nil {
+		slog.Error("get bookmark to write record", "error", err, "post AT URI", postATURI)
+		return
+	}
+	if bookmark == nil {
+		return
+	}
+
+	rkey := bookmark.RecordRKey
+	if rkey == "" {
+		rkey = bookmarkRecordClock.Next().String()
+	}
+
+	err = b.repoWriter.PutUserRecord(ctx, userDID, bookmarkRecordCollection, rkey, newBookmarkRecord(*bookmark))
+	if err != nil {
+		if !errors.Is(err, errNoOauthSession) {
+			slog.Error("put bookmark record", "error", err, "did", userDID, "post AT URI", postATURI)
+		}
+		return
+	}
+
+	if bookmark.RecordRKey == "" {
+		err = b.store.SetBookmarkRecordKey(postATURI, userDID, rkey)
+		if err != nil {
+			slog.Error("set bookmark record key", "error", err, "post AT URI", postATURI)
+		}
+	}
+}
+
+// Delete deletes the bookmark and the replies tracked for it. Failing to delete the record doesn't stop the bookmark
+// being deleted here as the user has asked for it to be removed.
+func (b *bookmarkRecords) Delete(ctx context.Context, bookmark store.Bookmark) error {
+	if b.repoWriter != nil && bookmark.RecordRKey != "" {
+		err := b.repoWriter.DeleteUserRecord(ctx, bookmark.UserDID, bookmarkRecordCollection, bookmark.RecordRKey)
+		if err != nil && !errors.Is(err, errNoOauthSession) {
+			slog.Error("delete bookmark record", "error", err, "did", bookmark.UserDID, "post AT URI", bookmark.PostATURI)
+		}
+	}
+
+	err := b.store.DeleteRepliedPostsForBookmarkedPostURIandUserDID(bookmark.PostATURI, bookmark.UserDID)
+	if err != nil {
+		return fmt.Errorf("delete replied posts for bookmark: %w", err)
+	}
+
+	err = b.store.DeleteBookmark(bookmark.PostATURI, bookmark.UserDID)
+	if err != nil {
+		return fmt.Errorf("delete bookmark: %w", err)
+	}
+	return nil
+}
+
+type BookmarkRecordStore interface {
+	BookmarkStore
+	GetBookmarkByRecordKey(userDID, recordRKey string) (*store.Bookmark, error)
+	IsKnownUser(did string) (bool, error)
+}
+
+// bookmarkRecordIndexer keeps the bookmarks table in sync with the bookmark records in users repos, so that bookmarks
+// made or removed by other clients show up here and the table can be rebuilt from the network.
+type bookmarkRecordIndexer struct {
+	store      BookmarkRecordStore
+	xrpcClient *xrpc.Client
+}
+
+func newBookmarkRecordIndexer(store BookmarkRecordStore, appViewURL string) *bookmarkRecordIndexer {
+	return &bookmarkRecordIndexer{
+		store:      store,
+		xrpcClient: &xrpc.Client{Host: appViewURL},
+	}
+}
+
+func (b *bookmarkRecordIndexer) HandleEvent(ctx context.Context, event *models.Event) error {
+	switch event.Commit.Operation {
+	case models.CommitOperationCreate, models.CommitOperationUpdate:
+		b.handleRecord(ctx, event)
+	case models.CommitOperationDelete:
+		b.handleDelete(event)
+	}
+	return nil
+}
+
+func (b *bookmarkRecordIndexer) handleRecord(ctx context.Context, event *models.Event) {
+	var record BookmarkRecord
+	if err := json.Unmarshal(event.Commit.Record, &record); err != nil {
+		// ignore this
+		return
+	}
+	if !strings.HasPrefix(record.Subject, "at://") || !strings.Contains(record.Subject, "/app.bsky.feed.post/") {
+		return
+	}
+
+	tags, err := parseTags(strings.Join(record.Tags, " "))
+	if err != nil {
+		slog.Warn("invalid tags in bookmark record", "error", err, "did", event.Did, "rkey", event.Commit.RKey)
+		tags = nil
+	}
+
+	bookmark, err := b.store.GetBookmarkByURIForUser(record.Subject, event.Did)
+	if err != nil {
+		slog.Error("get bookmark for record", "error", err, "did", event.Did, "subject", record.Subject)
+		_ = bugsnag.Notify(err)
+		return
+	}
+
+	if bookmark == nil {
+		known, err := b.store.IsKnownUser(event.Did)
+		if err != nil {
+			slog.Error("check if bookmark record user is known", "error", err, "did", event.Did)
+			_ = bugsnag.Notify(err)
+			return
+		}
+		if !known {
+			return
+		}
+
+		created, err := b.createBookmark(ctx, event.Did, record)
+		if err != nil {
+			slog.Error("create bookmark from record", "error", err, "did", event.Did, "subject", record.Subject)
+			_ = bugsnag.Notify(err)
+			return
+		}
+		if !created {
+			return
+		}
+		bookmark = &store.Bookmark{}
+	}
+
+	if bookmark.RecordRKey != event.Commit.RKey {
+		err = b.store.SetBookmarkRecordKey(record.Subject, event.Did, event.Commit.RKey)
+		if err != nil {
+			slog.Error("set bookmark record key", "error", err, "did", event.Did, "subject", record.Subject)
+			_ = bugsnag.Notify(err)
+		}
+	}
+
+	if !slices.Equal(bookmark.Tags, tags) && (len(bookmark.Tags) > 0 || len(tags) > 0) {
+		err = b.store.SetBookmarkTags(record.Subject, event.Did, tags)
+		if err != nil {
+			slog.Error("set bookmark tags from record", "error", err, "did", event.Did, "subject", record.Subject)
+			_ = bugsnag.Notify(err)
+		}
+	}
+}
+
+// createBookmark creates the bookmark for a record, returning false if the bookmarked post doesn't exist.
+func (b *bookmarkRecordIndexer) createBookmark(ctx context.Context, userDID string, record BookmarkRecord) (bool, error) {
+	postCtx, cancel := context.WithTimeout(ctx, bookmarkRecordPostTimeout)
+	defer cancel()
+
+	postResp, err := bsky.FeedGetPosts(postCtx, b.xrpcClient, []string{record.Subject})
+	if err != nil {
+		return false, fmt.Errorf("get post: %w", err)
+	}
+	if len(postResp.Posts) != 1 {
+		slog.Info("bookmarked post in record not found", "did", userDID, "subject", record.Subject)
+		return false, nil
+	}
+
+	post := postResp.Posts[0]
+	content, rootURI, err := getBookmarkDetailsFromPost(post)
+	if err != nil {
+		return false, fmt.Errorf("get bookmark details from post: %w", err)
+	}
+
+	createdAt := parsePostCreatedAt(record.CreatedAt)
+	publicURI := getPublicPostURIFromATURI(record.Subject, post.Author.Handle)
+	err = b.store.CreateBookmark(getRKeyFromATURI(record.Subject), publicURI, record.Subject, rootURI, post.Author.Did, post.Author.Handle, userDID, content, createdAt)
+	if err != nil && !errors.Is(err, store.ErrBookmarkAlreadyExists) {
+		return false, fmt.Errorf("create bookmark: %w", err)
+	}
+	return true, nil
+}
+
+func (b *bookmarkRecordIndexer) handleDelete(event *models.Event) {
+	bookmark, err := b.store.GetBookmarkByRecordKey(event.Did, event.Commit.RKey)
+	if err != nil {
+		slog.Error("get bookmark by record key", "error", err, "did", event.Did, "rkey", event.Commit.RKey)
+		_ = bugsnag.Notify(err)
+		return
+	}
+	if bookmark == nil {
+		return
+	}
+
+	err = b.store.DeleteRepliedPostsForBookmarkedPostURIandUserDID(bookmark.PostATURI, event.Did)
+	if err != nil {
+		slog.Error("delete replied posts for bookmark record", "error", err, "did", event.Did, "post AT URI", bookmark.PostATURI)
+		_ = bugsnag.Notify(err)
+		return
+	}
+
+	err = b.store.DeleteBookmark(bookmark.PostATURI, event.Did)
+	if err != nil {
+		slog.Error("delete bookmark from record", "error", err, "did", event.Did, "post AT URI", bookmark.PostATURI)
+		_ = bugsnag.Notify(err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/jetstream/pkg/models"
+	oauth "github.com/haileyok/atproto-oauth-golang"
+	oauthhelpers "github.com/haileyok/atproto-oauth-golang/helpers"
+)
+
+func bookmarkRecordEvent(did, rkey, operation string, record BookmarkRecord) *models.Event {
+	recordB, _ := json.Marshal(record)
+	return &models.Event{
+		Did:  did,
+		Kind: models.EventKindCommit,
+		Commit: &models.Commit{
+			Operation:  operation,
+			Collection: bookmarkRecordCollection,
+			RKey:       rkey,
+			Record:     recordB,
+		},
+	}
+}
+
+func TestBookmarkRecordIndexer(t *testing.T) {
+	appView := newFakeAppView(t)
+	postURI := appView.AddPost(testAuthorDID, "author.test", "3kpost", "a bookmarked post")
+
+	s := newTestStore(t)
+	h := newHandler(s, defaultThreadMaxDepth, newBookmarkRecordIndexer(s, appView.URL()))
+	ctx := context.Background()
+
+	record := BookmarkRecord{
+		LexiconTypeID: bookmarkRecordCollection,
+		Subject:       postURI,
+		Tags:          []string{"go"},
+		CreatedAt:     "2025-01-02T00:00:00Z",
+	}
+
+	// records from accounts that have never used the app are ignored
+	if err := h.HandleEvent(ctx, bookmarkRecordEvent(testUserDID, "3krecord", models.CommitOperationCreate, record)); err != nil {
+		t.Fatalf("handle create event: %s", err)
+	}
+	if bookmark, err := s.GetBookmarkByURIForUser(postURI, testUserDID); err != nil || bookmark != nil {
+		t.Fatalf("expected no bookmark to be created for an unknown user, got %+v: %v", bookmark, err)
+	}
+
+	saveTestOauthSession(t, s, testUserDID, "https://pds.test")
+	if err := h.HandleEvent(ctx, bookmarkRecordEvent(testUserDID, "3krecord", models.CommitOperationCreate, record)); err != nil {
+		t.Fatalf("handle create event: %s", err)
+	}
+
+	bookmark, err := s.GetBookmarkByURIForUser(postURI, testUserDID)
+	if err != nil {
+		t.Fatalf("get bookmark: %s", err)
+	}
+	if bookmark == nil {
+		t.Fatal("expected bookmark to be created from the record")
+	}
+	if bookmark.RecordRKey != "3krecord" {
+		t.Errorf("expected record rkey 3krecord, got %q", bookmark.RecordRKey)
+	}
+	if bookmark.Content != "a bookmarked post" || bookmark.AuthorHandle != "author.test" {
+		t.Errorf("unexpected bookmark details %+v", bookmark)
+	}
+	if !slices.Equal(bookmark.Tags, []string{"go"}) {
+		t.Errorf("unexpected tags %v", bookmark.Tags)
+	}
+	if want := time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC).UnixMilli(); bookmark.CreatedAt != want {
+		t.Errorf("expected created at %d, got %d", want, bookmark.CreatedAt)
+	}
+
+	record.Tags = []string{"go", "sqlite"}
+	if err := h.HandleEvent(ctx, bookmarkRecordEvent(testUserDID, "3krecord", models.CommitOperationUpdate, record)); err != nil {
+		t.Fatalf("handle update event: %s", err)
+	}
+	bookmark, err = s.GetBookmarkByURIForUser(postURI, testUserDID)
+	if err != nil || bookmark == nil {
+		t.Fatalf("get bookmark: %v", err)
+	}
+	if !slices.Equal(bookmark.Tags, []string{"go", "sqlite"}) {
+		t.Errorf("expected tags to be updated, got %v", bookmark.Tags)
+	}
+
+	if err := h.HandleEvent(ctx, bookmarkRecordEvent(testUserDID, "3krecord", models.CommitOperationDelete, BookmarkRecord{})); err != nil {
+		t.Fatalf("handle delete event: %s", err)
+	}
+	bookmark, err = s.GetBookmarkByURIForUser(postURI, testUserDID)
+	if err != nil {
+		t.Fatalf("get bookmark: %s", err)
+	}
+	if bookmark != nil {
+		t.Error("expected bookmark to be deleted with its record")
+	}
+}
+
+func TestBookmarkRecordIndexerLinksExistingBookmark(t *testing.T) {
+	// the post isn't in the AppView so the bookmark can only be linked, not created
+	appView := newFakeAppView(t)
+
+	s := newTestStore(t)
+	err := s.CreateBookmark("bookmarked", "", testBookmarkURI, "", testAuthorDID, "author.test", testUserDID, "a post", time.Now().UnixMilli())
+	if err != nil {
+		t.Fatalf("create bookmark: %s", err)
+	}
+
+	h := newHandler(s, defaultThreadMaxDepth, newBookmarkRecordIndexer(s, appView.URL()))
+	record := BookmarkRecord{LexiconTypeID: bookmarkRecordCollection, Subject: testBookmarkURI, CreatedAt: time.Now().UTC().Format(time.RFC3339)}
+	if err := h.HandleEvent(context.Background(), bookmarkRecordEvent(testUserDID, "3krecord", models.CommitOperationCreate, record)); err != nil {
+		t.Fatalf("handle create event: %s", err)
+	}
+
+	bookmark, err := s.GetBookmarkByRecordKey(testUserDID, "3krecord")
+	if err != nil {
+		t.Fatalf("get bookmark by record key: %s", err)
+	}
+	if bookmark == nil || bookmark.PostATURI != testBookmarkURI {
+		t.Fatalf("expected the existing bookmark to be linked to the record, got %+v", bookmark)
+	}
+}
+
+type fakeOauthSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*oauth.XrpcAuthedRequestArgs
+}
+
+func newFakeOauthSessions() *fakeOauthSessions {
+	return &fakeOauthSessions{sessions: make(map[string]*oauth.XrpcAuthedRequestArgs)}
+}
+
+func (f *fakeOauthSessions) add(t *testing.T, did, pdsURL string) {
+	t.Helper()
+
+	key, err := oauthhelpers.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generate dpop key: %s", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sessions[did] = &oauth.XrpcAuthedRequestArgs{
+		Did:            did,
+		PdsUrl:         pdsURL,
+		Issuer:         "https://auth.test",
+		AccessToken:    "access-token",
+		DpopPrivateJwk: key,
+	}
+}
+
+func (f *fakeOauthSessions) nonce(did string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sessions[did].DpopPdsNonce
+}
+
+func (f *fakeOauthSessions) AuthArgs(ctx context.Context, did string) (*oauth.XrpcAuthedRequestArgs, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	args, ok := f.sessions[did]
+	if !ok {
+		return nil, errNoOauthSession
+	}
+	copied := *args
+	return &copied, nil
+}
+
+func (f *fakeOauthSessions) UpdateDpopPdsNonce(did, nonce string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if args, ok := f.sessions[did]; ok {
+		args.DpopPdsNonce = nonce
+	}
+	return nil
+}
+
+func TestBookmarksAreWrittenToUsersRepo(t *testing.T) {
+	appView := newFakeAppView(t)
+	atURI := appView.AddPost(testAuthorDID, "author.test", "3kpost", "the full text of the post")
+	pds := newFakePDS(t)
+
+	srv, s := newTestServer(t, appView)
+	sessions := newFakeOauthSessions()
+	sessions.add(t, testUserDID, pds.URL())
+	srv.bookmarkRecords = newBookmarkRecords(s, newUserRepoWriter(sessions))
+
+	rec := httptest.NewRecorder()
+	srv.HandleAddBookmark(rec, addBookmarkRequest(t, srv, "https://bsky.app/profile/author.test/post/3kpost"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	puts := pds.Puts()
+	if len(puts) != 1 {
+		t.Fatalf("expected 1 record to be written, got %d", len(puts))
+	}
+	if puts[0].Repo != testUserDID || puts[0].Collection != bookmarkRecordCollection {
+		t.Errorf("unexpected put record request %+v", puts[0])
+	}
+	for _, auth := range pds.Auths() {
+		if auth != "DPoP access-token" {
+			t.Errorf("expected DPoP authorization, got %q", auth)
+		}
+	}
+
+	if nonce := sessions.nonce(testUserDID); nonce != fakePDSNonce {
+		t.Errorf("expected the PDS nonce to be saved, got %q", nonce)
+	}
+
+	bookmark, err := s.GetBookmarkByURIForUser(atURI, testUserDID)
+	if err != nil || bookmark == nil {
+		t.Fatalf("get bookmark: %v", err)
+	}
+	if bookmark.RecordRKey != puts[0].RKey {
+		t.Errorf("expected record rkey %q to be saved, got %q", puts[0].RKey, bookmark.RecordRKey)
+	}
+
+	tagsReq := httptest.NewRequest(http.MethodPut, "/bookmarks/tags?uri="+url.QueryEscape(atURI), strings.NewReader(url.Values{"tags": {"go"}}.Encode()))
+	tagsReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	addSessionCookie(t, srv, tagsReq, testUserDID)
+	srv.HandleSetBookmarkTags(httptest.NewRecorder(), tagsReq)
+
+	puts = pds.Puts()
+	if len(puts) != 2 || puts[1].RKey != bookmark.RecordRKey {
+		t.Fatalf("expected the record to be updated in place, got %+v", puts)
+	}
+
+	deleteReq := httptest.NewRequest(http.MethodDelete, "/bookmarks?uri="+url.QueryEscape(atURI), nil)
+	addSessionCookie(t, srv, deleteReq, testUserDID)
+	srv.HandleDeleteBookmark(httptest.NewRecorder(), deleteReq)
+
+	deletes := pds.Deletes()
+	if len(deletes) != 1 || deletes[0].RKey != bookmark.RecordRKey {
+		t.Errorf("expected the record to be deleted, got %+v", deletes)
+	}
+}
+
+func TestBookmarksWithoutOauthSessionStayLocal(t *testing.T) {
+	appView := newFakeAppView(t)
+	atURI := appView.AddPost(testAuthorDID, "author.test", "3kpost", "the full text of the post")
+	pds := newFakePDS(t)
+
+	srv, s := newTestServer(t, appView)
+	srv.bookmarkRecords = newBookmarkRecords(s, newUserRepoWriter(newFakeOauthSessions()))
+
+	rec := httptest.NewRecorder()
+	srv.HandleAddBookmark(rec, addBookmarkRequest(t, srv, "https://bsky.app/profile/author.test/post/3kpost"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if len(pds.Puts()) != 0 {
+		t.Errorf("expected no records to be written")
+	}
+	bookmark, err := s.GetBookmarkByURIForUser(atURI, testUserDID)
+	if err != nil || bookmark == nil {
+		t.Fatalf("expected bookmark to be created: %v", err)
+	}
+	if bookmark.RecordRKey != "" {
+		t.Errorf("expected no record rkey, got %q", bookmark.RecordRKey)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/willdot/bskyfeedgen/frontend"
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+func (s *Server) HandleCreateCollection(w http.ResponseWriter, r *http.Request) {
+	usersDid, ok := s.getDidFromSession(r)
+	if !ok {
+		slog.Warn("did not found in session")
+		_ = frontend.Login("", "").Render(r.Context(), w)
+		return
+	}
+
+	name, err := normalizeCollectionName(r.FormValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = getOrCreateCollection(r.Context(), s.collectionStore, s.feedPublisher, usersDid, name)
+	if err != nil {
+		slog.Error("create collection", "error", err)
+		http.Error(w, "failed to create collection", http.StatusInternalServerError)
+		return
+	}
+
+	// every bookmark row has a list of collections to pick from so reload the page to include the new one
+	w.Header().Set("HX-Refresh", "true")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) HandleSetBookmarkCollection(w http.ResponseWriter, r *http.Request) {
+	usersDid, ok := s.getDidFromSession(r)
+	if !ok {
+		slog.Warn("did not found in session")
+		_ = frontend.Login("", "").Render(r.Context(), w)
+		return
+	}
+
+	postATURI := r.URL.Query().Get("uri")
+	if !strings.HasPrefix(postATURI, "at://") {
+		http.Error(w, "invalid post AT URI", http.StatusBadRequest)
+		return
+	}
+
+	collectionID, ok := s.parseUsersCollectionID(w, r, usersDid)
+	if !ok {
+		return
+	}
+
+	err := s.collectionStore.SetBookmarkCollection(postATURI, usersDid, collectionID)
+	if errors.Is(err, store.ErrBookmarkNotFound) {
+		http.Error(w, "bookmark not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("set bookmark collection", "error", err)
+		http.Error(w, "failed to set bookmark collection", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseUsersCollectionID gets the collection ID from the request form and checks that it belongs to the user. An
+// empty value or 0 means no collection. If false is returned then an error response has already been written.
+func (s *Server) parseUsersCollectionID(w http.ResponseWriter, r *http.Request, usersDid string) (int, bool) {
+	collectionIDStr := r.FormValue("collection")
+	if collectionIDStr == "" || collectionIDStr == "0" {
+		return 0, true
+	}
+
+	collectionID, err := strconv.Atoi(collectionIDStr)
+	if err != nil {
+		http.Error(w, "invalid collection", http.StatusBadRequest)
+		return 0, false
+	}
+
+	collection, err := s.collectionStore.GetCollection(collectionID)
+	if err != nil {
+		slog.Error("get collection", "error", err)
+		http.Error(w, "failed to get collection", http.StatusInternalServerError)
+		return 0, false
+	}
+	if collection == nil || collection.UserDID != usersDid {
+		http.Error(w, "collection not found", http.StatusNotFound)
+		return 0, false
+	}
+
+	return collection.ID, true
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bugsnag/bugsnag-go/v2"
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+const maxCollectionNameLength = 50
+
+type CollectionStore interface {
+	CreateCollection(userDID, name string, createdAt int64) (store.Collection, error)
+	GetCollectionsForUser(userDID string) ([]store.Collection, error)
+	GetAllCollections() ([]store.Collection, error)
+	GetCollection(id int) (*store.Collection, error)
+	GetCollectionByName(userDID, name string) (*store.Collection, error)
+	SetBookmarkCollection(postATURI, userDID string, collectionID int) error
+}
+
+type CollectionFeedPublisher interface {
+	PublishCollectionFeed(ctx context.Context, collection store.Collection) error
+}
+
+func collectionIDFromFeedRKey(rkey string) (int, bool) {
+	idStr, ok := strings.CutPrefix(rkey, store.CollectionFeedRKeyPrefix)
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil || id < 1 {
+		return 0, false
+	}
+	return id, true
+}
+
+func normalizeCollectionName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return "", fmt.Errorf("collection name can't be empty")
+	}
+	if len(name) > maxCollectionNameLength {
+		return "", fmt.Errorf("collection name can't be longer than %d characters", maxCollectionNameLength)
+	}
+	return name, nil
+}
+
+// getOrCreateCollection finds a users collection by name and if it doesn't exist, creates it and publishes a feed for
+// it. Failing to publish the feed doesn't fail creating the collection.
+func getOrCreateCollection(ctx context.Context, collectionStore CollectionStore, publisher CollectionFeedPublisher, userDID, name string) (store.Collection, error) {
+	name, err := normalizeCollectionName(name)
+	if err != nil {
+		return store.Collection{}, err
+	}
+
+	existing, err := collectionStore.GetCollectionByName(userDID, name)
+	if err != nil {
+		return store.Collection{}, fmt.Errorf("get collection by name: %w", err)
+	}
+	if existing != nil {
+		return *existing, nil
+	}
+
+	collection, err := collectionStore.CreateCollection(userDID, name, time.Now().UnixMilli())
+	if err != nil {
+		if !errors.Is(err, store.ErrCollectionAlreadyExists) {
+			return store.Collection{}, fmt.Errorf("create collection: %w", err)
+		}
+		// it was created between checking and creating so fetch it again
+		existing, err = collectionStore.GetCollectionByName(userDID, name)
+		if err != nil || existing == nil {
+			return store.Collection{}, fmt.Errorf("get collection by name after create: %w", err)
+		}
+		return *existing, nil
+	}
+
+	if publisher != nil {
+		err = publisher.PublishCollectionFeed(ctx, collection)
+		if err != nil {
+			slog.Error("publish collection feed", "error", err, "collection id", collection.ID)
+			_ = bugsnag.Notify(err)
+		}
+	}
+
+	return collection, nil
+}
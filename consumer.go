@@ -5,45 +5,86 @@ import (
 
 	"fmt"
 	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bluesky-social/jetstream/pkg/client"
-	"github.com/bluesky-social/jetstream/pkg/client/schedulers/sequential"
+	"github.com/bugsnag/bugsnag-go/v2"
 )
 
+const (
+	jetstreamCursorName = "jetstream"
+	cursorFlushInterval = time.Second * 5
+)
+
+type CursorStore interface {
+	GetCursor(name string) (int64, error)
+	SaveCursor(name string, cursor int64) error
+}
+
 type consumer struct {
-	cfg     *client.ClientConfig
-	handler *handler
-	logger  *slog.Logger
+	cfg         *client.ClientConfig
+	handler     *handler
+	logger      *slog.Logger
+	cursorStore CursorStore
+	maxRewind   time.Duration
+	workers     int
+
+	// lastCursor is the TimeUS of the last event that was fully processed
+	lastCursor atomic.Int64
+	// lastProcessedAt is the wall clock time in unix micro when the cursor last moved. Unlike the cursor it stays
+	// recent while catching up on old events.
+	lastProcessedAt atomic.Int64
+
+	flushMu     sync.Mutex
+	savedCursor int64
 }
 
-func NewConsumer(jsAddr string, logger *slog.Logger, handler *handler) *consumer {
+func NewConsumer(jsAddr string, logger *slog.Logger, handler *handler, cursorStore CursorStore, maxRewind time.Duration, workers int) *consumer {
 	cfg := client.DefaultClientConfig()
 	if jsAddr != "" {
 		cfg.WebsocketURL = jsAddr
 	}
 	cfg.WantedCollections = []string{
 		"app.bsky.feed.post",
+		bookmarkRecordCollection,
 	}
 	cfg.WantedDids = []string{}
 
 	return &consumer{
-		cfg:     cfg,
-		logger:  logger,
-		handler: handler,
+		cfg:         cfg,
+		logger:      logger,
+		handler:     handler,
+		cursorStore: cursorStore,
+		maxRewind:   maxRewind,
+		workers:     workers,
 	}
 }
 
 func (c *consumer) Consume(ctx context.Context) error {
-	scheduler := sequential.NewScheduler("jetstream_localdev", c.logger, c.handler.HandleEvent)
-	defer scheduler.Shutdown()
+	// events can finish out of order across workers, so the cursor only moves once everything before it is done
+	tracker := newCursorTracker(func(cursor int64) {
+		c.lastCursor.Store(cursor)
+		c.lastProcessedAt.Store(time.Now().UnixMicro())
+	})
+	scheduler := newOrderedScheduler(c.workers, c.logger, tracker, orderingKey, c.handler.HandleEvent)
 
 	client, err := client.NewClient(c.cfg, c.logger, scheduler)
 	if err != nil {
+		scheduler.Shutdown()
 		return fmt.Errorf("failed to create client: %w", err)
 	}
 
-	cursor := time.Now().Add(1 * -time.Minute).UnixMicro()
+	cursor := c.startCursor()
+
+	flushCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go c.flushCursorTask(flushCtx)
+	// make sure that whatever was processed before the connection dropped is saved
+	defer c.flushCursor()
+	// wait for queued events to be handled before the final flush
+	defer scheduler.Shutdown()
 
 	if err := client.ConnectAndRead(ctx, &cursor); err != nil {
 		return fmt.Errorf("connect and read: %w", err)
@@ -52,3 +93,86 @@ func (c *consumer) Consume(ctx context.Context) error {
 	slog.Info("stopping consume")
 	return nil
 }
+
+// LastEventTime returns the time of the last event that was fully processed, or zero if none have been.
+func (c *consumer) LastEventTime() time.Time {
+	cursor := c.lastCursor.Load()
+	if cursor == 0 {
+		return time.Time{}
+	}
+	return time.UnixMicro(cursor)
+}
+
+// LastProcessedAt returns when an event was last fully processed, or zero if none have been. It shows the consumer is
+// alive even when it's behind, while LastEventTime shows how far behind it is.
+func (c *consumer) LastProcessedAt() time.Time {
+	processedAt := c.lastProcessedAt.Load()
+	if processedAt == 0 {
+		return time.Time{}
+	}
+	return time.UnixMicro(processedAt)
+}
+
+// startCursor works out where to resume consuming from. It prefers the last event processed by this process, then the
+// cursor saved in the store and if neither exist it starts from a minute ago. The cursor will never be further back than
+// the configured max rewind window.
+func (c *consumer) startCursor() int64 {
+	now := time.Now()
+
+	cursor := c.lastCursor.Load()
+	if cursor == 0 {
+		savedCursor, err := c.cursorStore.GetCursor(jetstreamCursorName)
+		if err != nil {
+			slog.Error("get saved jetstream cursor", "error", err)
+			_ = bugsnag.Notify(err)
+		}
+		cursor = savedCursor
+	}
+
+	if cursor == 0 {
+		slog.Info("no saved jetstream cursor - starting from a minute ago")
+		return now.Add(1 * -time.Minute).UnixMicro()
+	}
+
+	earliestCursor := now.Add(-c.maxRewind).UnixMicro()
+	if cursor < earliestCursor {
+		skipped := time.Duration(earliestCursor-cursor) * time.Microsecond
+		slog.Warn("saved jetstream cursor is older than the max rewind window - events will be skipped", "cursor", cursor, "max rewind", c.maxRewind.String(), "skipped", skipped.String())
+		cursor = earliestCursor
+	}
+
+	slog.Info("resuming jetstream consume", "cursor", cursor, "replay gap", now.Sub(time.UnixMicro(cursor)).String())
+	return cursor
+}
+
+func (c *consumer) flushCursorTask(ctx context.Context) {
+	ticker := time.NewTicker(cursorFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.flushCursor()
+		}
+	}
+}
+
+func (c *consumer) flushCursor() {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	cursor := c.lastCursor.Load()
+	if cursor <= c.savedCursor {
+		return
+	}
+
+	err := c.cursorStore.SaveCursor(jetstreamCursorName, cursor)
+	if err != nil {
+		slog.Error("save jetstream cursor", "error", err, "cursor", cursor)
+		_ = bugsnag.Notify(err)
+		return
+	}
+	c.savedCursor = cursor
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	testUserDID     = "did:plc:user"
+	testAuthorDID   = "did:plc:author"
+	testReplierDID  = "did:plc:replier"
+	testBookmarkURI = "at://did:plc:author/app.bsky.feed.post/bookmarked"
+)
+
+func newTestConsumer(t *testing.T, js *fakeJetstream, s CursorStore, h *handler) *consumer {
+	t.Helper()
+
+	c := NewConsumer(js.URL(), slog.Default(), h, s, time.Hour, 2)
+	// the fake server sends plain JSON rather than zstd compressed messages
+	c.cfg.Compress = false
+	return c
+}
+
+func TestConsumeStoresRepliesToBookmarkedPosts(t *testing.T) {
+	s := newTestStore(t)
+	err := s.CreateBookmark("bookmarked", "", testBookmarkURI, "", testAuthorDID, "author.test", testUserDID, "a post", time.Now().UnixMilli())
+	if err != nil {
+		t.Fatalf("create bookmark: %s", err)
+	}
+
+	now := time.Now().UnixMicro()
+	js := newFakeJetstream(t,
+		replyEvent(testReplierDID, "reply1", testBookmarkURI, testBookmarkURI, now),
+		replyEvent(testReplierDID, "reply2", "at://did:plc:author/app.bsky.feed.post/other", "at://did:plc:author/app.bsky.feed.post/other", now+1),
+	)
+
+	c := newTestConsumer(t, js, s, newHandler(s, defaultThreadMaxDepth, nil))
+
+	done := make(chan error)
+	go func() {
+		done <- c.Consume(context.Background())
+	}()
+
+	waitFor(t, "the last event to be processed", func() bool {
+		return c.lastCursor.Load() == now+1
+	})
+	js.CloseConnections()
+	<-done
+
+	replies, err := s.GetUsersReplies(testUserDID, time.Now().Add(time.Hour).UnixMilli(), 10)
+	if err != nil {
+		t.Fatalf("get users replies: %s", err)
+	}
+	if len(replies) != 1 {
+		t.Fatalf("expected 1 reply, got %d", len(replies))
+	}
+	if replies[0].ReplyURI != "at://did:plc:replier/app.bsky.feed.post/reply1" {
+		t.Errorf("unexpected reply URI %q", replies[0].ReplyURI)
+	}
+
+	savedCursor, err := s.GetCursor(jetstreamCursorName)
+	if err != nil {
+		t.Fatalf("get cursor: %s", err)
+	}
+	if savedCursor != now+1 {
+		t.Errorf("expected saved cursor %d, got %d", now+1, savedCursor)
+	}
+}
+
+func TestConsumeResumesFromSavedCursor(t *testing.T) {
+	s := newTestStore(t)
+
+	savedCursor := time.Now().Add(-time.Minute * 10).UnixMicro()
+	if err := s.SaveCursor(jetstreamCursorName, savedCursor); err != nil {
+		t.Fatalf("save cursor: %s", err)
+	}
+
+	js := newFakeJetstream(t)
+	c := newTestConsumer(t, js, s, newHandler(s, defaultThreadMaxDepth, nil))
+
+	done := make(chan error)
+	go func() {
+		done <- c.Consume(context.Background())
+	}()
+
+	waitFor(t, "the consumer to connect", func() bool {
+		return len(js.Cursors()) == 1
+	})
+	js.CloseConnections()
+	<-done
+
+	if got := js.Cursors()[0]; got != strconv.FormatInt(savedCursor, 10) {
+		t.Errorf("expected to resume from cursor %d, got %s", savedCursor, got)
+	}
+}
+
+func TestStartCursorIsClampedToMaxRewind(t *testing.T) {
+	s := newTestStore(t)
+
+	if err := s.SaveCursor(jetstreamCursorName, time.Now().Add(-time.Hour*48).UnixMicro()); err != nil {
+		t.Fatalf("save cursor: %s", err)
+	}
+
+	c := NewConsumer("", slog.Default(), newHandler(s, defaultThreadMaxDepth, nil), s, time.Hour, 1)
+
+	earliest := time.Now().Add(-time.Hour).UnixMicro()
+	cursor := c.startCursor()
+	if cursor < earliest {
+		t.Errorf("expected cursor to be clamped to the last hour, got %s ago", time.Since(time.UnixMicro(cursor)))
+	}
+}
+
+func TestConsumeReportsLivenessWhileCatchingUp(t *testing.T) {
+	s := newTestStore(t)
+
+	// the events are replayed from half an hour ago, like after an outage
+	eventTime := time.Now().Add(-time.Minute * 30).UnixMicro()
+	if err := s.SaveCursor(jetstreamCursorName, eventTime); err != nil {
+		t.Fatalf("save cursor: %s", err)
+	}
+	js := newFakeJetstream(t,
+		replyEvent(testReplierDID, "reply", testBookmarkURI, testBookmarkURI, eventTime),
+	)
+
+	c := newTestConsumer(t, js, s, newHandler(s, defaultThreadMaxDepth, nil))
+
+	done := make(chan error)
+	go func() {
+		done <- c.Consume(context.Background())
+	}()
+
+	waitFor(t, "the event to be processed", func() bool {
+		return c.lastCursor.Load() == eventTime
+	})
+	js.CloseConnections()
+	<-done
+
+	if lag := time.Since(c.LastEventTime()); lag < time.Minute*29 {
+		t.Errorf("expected the last event time to be half an hour old, got %s", lag)
+	}
+
+	health := newHealthChecker(s)
+	health.WatchLastSeen("jetstream", time.Minute*5, c.LastProcessedAt)
+	if resp := health.check(context.Background(), true); resp.Status != "ok" {
+		t.Errorf("expected the consumer to be healthy while catching up, got %+v", resp)
+	}
+}
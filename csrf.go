@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/willdot/bskyfeedgen/frontend"
+)
+
+const csrfSessionKey = "csrf_token"
+
+// csrfMiddleware wraps authMiddleware and makes sure that requests that change anything carry the CSRF token of the
+// users session. The token is put in the request context so that the Base template can add it to every HTMX request.
+func (s *Server) csrfMiddleware(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return s.authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		token, err := s.csrfToken(w, r)
+		if err != nil {
+			slog.Error("get csrf token", "error", err)
+			http.Error(w, "failed to get session", http.StatusInternalServerError)
+			return
+		}
+
+		if !isSafeMethod(r.Method) && !validCSRFToken(token, r.Header.Get(frontend.CSRFHeader)) {
+			slog.Warn("invalid csrf token", "method", r.Method, "path", r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			_ = frontend.CSRFFailed().Render(r.Context(), w)
+			return
+		}
+
+		next(w, r.WithContext(frontend.WithCSRFToken(r.Context(), token)))
+	})
+}
+
+// csrfToken returns the CSRF token for the users session, creating one if the session doesn't have one yet.
+func (s *Server) csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	session, err := s.sessionStore.Get(r, "oauth-session")
+	if err != nil {
+		return "", fmt.Errorf("get session: %w", err)
+	}
+
+	if token, ok := session.Values[csrfSessionKey].(string); ok && token != "" {
+		return token, nil
+	}
+
+	token, err := newCSRFToken()
+	if err != nil {
+		return "", err
+	}
+	session.Values[csrfSessionKey] = token
+
+	err = session.Save(r, w)
+	if err != nil {
+		return "", fmt.Errorf("save session: %w", err)
+	}
+	return token, nil
+}
+
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("generate csrf token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func validCSRFToken(expected, got string) bool {
+	if expected == "" || got == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(got)) == 1
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
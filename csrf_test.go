@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/willdot/bskyfeedgen/frontend"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	srv, _ := newTestServer(t, newFakeAppView(t))
+
+	var handled int
+	handler := srv.csrfMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		handled++
+		_ = frontend.Account(nil, "").Render(r.Context(), w)
+	})
+
+	signedIn := httptest.NewRequest(http.MethodGet, "/", nil)
+	addSessionCookie(t, srv, signedIn, testUserDID)
+
+	// loading a page gives the session a token which is added to every HTMX request
+	rec := httptest.NewRecorder()
+	handler(rec, signedInRequest(signedIn, http.MethodGet, "/account"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected page to load, got %d", rec.Code)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		if !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode {
+			t.Errorf("expected session cookie to be secure and same site lax, got %s", cookie.String())
+		}
+	}
+
+	session, err := srv.sessionStore.Get(signedInRequest(signedIn, http.MethodGet, "/"), "oauth-session")
+	if err != nil {
+		t.Fatalf("get session: %s", err)
+	}
+	token, _ := session.Values[csrfSessionKey].(string)
+	if token == "" {
+		t.Fatal("expected session to have a csrf token")
+	}
+	if !strings.Contains(rec.Body.String(), token) {
+		t.Fatal("expected page to include the csrf token in hx-headers")
+	}
+
+	tests := map[string]struct {
+		token string
+		code  int
+	}{
+		"missing token": {token: "", code: http.StatusForbidden},
+		"wrong token":   {token: "not-the-token", code: http.StatusForbidden},
+		"valid token":   {token: token, code: http.StatusOK},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := signedInRequest(signedIn, http.MethodDelete, "/account/sessions")
+			if tt.token != "" {
+				req.Header.Set(frontend.CSRFHeader, tt.token)
+			}
+
+			handledBefore := handled
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.code {
+				t.Fatalf("expected %d, got %d", tt.code, rec.Code)
+			}
+			if tt.code == http.StatusForbidden && handled != handledBefore {
+				t.Fatal("expected request with an invalid token to not be handled")
+			}
+		})
+	}
+}
+
+func TestSignOutRequiresCSRFToken(t *testing.T) {
+	srv, _ := newTestServer(t, newFakeAppView(t))
+	handler := srv.csrfMiddleware(srv.HandleSignOut)
+
+	signedIn := httptest.NewRequest(http.MethodGet, "/", nil)
+	addSessionCookie(t, srv, signedIn, testUserDID)
+	// loading a page gives the session a token
+	loadPage := srv.csrfMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+	loadPage(httptest.NewRecorder(), signedInRequest(signedIn, http.MethodGet, "/"))
+
+	session, err := srv.sessionStore.Get(signedInRequest(signedIn, http.MethodGet, "/"), "oauth-session")
+	if err != nil {
+		t.Fatalf("get session: %s", err)
+	}
+	token, _ := session.Values[csrfSessionKey].(string)
+
+	rec := httptest.NewRecorder()
+	handler(rec, signedInRequest(signedIn, http.MethodPost, "/sign-out"))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected sign out without a token to be forbidden, got %d", rec.Code)
+	}
+	if _, ok := srv.getDidFromSession(signedInRequest(signedIn, http.MethodGet, "/")); !ok {
+		t.Fatal("expected user to still be signed in")
+	}
+
+	req := signedInRequest(signedIn, http.MethodPost, "/sign-out")
+	req.Header.Set(frontend.CSRFHeader, token)
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected sign out to succeed, got %d", rec.Code)
+	}
+	if redirect := rec.Header().Get("HX-Redirect"); redirect != "/" {
+		t.Errorf("expected redirect to /, got %q", redirect)
+	}
+	if _, ok := srv.getDidFromSession(signedInRequest(signedIn, http.MethodGet, "/")); ok {
+		t.Error("expected user to be signed out")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/bugsnag/bugsnag-go/v2"
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+// digestIntervals is how long after the last digest the next one is due for each schedule. Immediate digests are sent
+// on the next run of the digest task.
+var digestIntervals = map[string]time.Duration{
+	store.DigestImmediately: 0,
+	store.DigestHourly:      time.Hour,
+	store.DigestDaily:       time.Hour * 24,
+}
+
+func (d *DmService) DigestTask(ctx context.Context) {
+	timer := time.NewTimer(d.timerDuration)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			err := d.SendDueDigests(ctx, time.Now())
+			if err != nil {
+				slog.Error("send due digests", "error", err)
+				_ = bugsnag.Notify(err)
+			}
+			timer.Reset(d.timerDuration)
+		}
+	}
+}
+
+// SendDueDigests sends a digest of new replies to every user whose digest is due. Users with no new replies aren't sent
+// anything but their digest still moves on so that the next one covers the following period.
+func (d *DmService) SendDueDigests(ctx context.Context, now time.Time) error {
+	subscribers, err := d.dmStore.GetDigestSubscribers()
+	if err != nil {
+		return fmt.Errorf("get digest subscribers: %w", err)
+	}
+
+	until := now.UnixMilli()
+	for _, subscriber := range subscribers {
+		interval, ok := digestIntervals[subscriber.DigestSchedule]
+		if !ok {
+			slog.Error("unknown digest schedule", "schedule", subscriber.DigestSchedule, "did", subscriber.UserDID)
+			continue
+		}
+		if now.Sub(time.UnixMilli(subscriber.LastDigestAt)) < interval {
+			continue
+		}
+
+		entries, err := d.dmStore.GetDigestEntries(subscriber.UserDID, subscriber.LastDigestAt, until)
+		if err != nil {
+			slog.Error("get digest entries", "error", err, "did", subscriber.UserDID)
+			_ = bugsnag.Notify(err)
+			continue
+		}
+
+		if len(entries) > 0 {
+			err = d.SendMessage(ctx, subscriber.DigestConvoID, formatDigestMessage(entries))
+			if err != nil {
+				// the digest will be tried again on the next run
+				slog.Error("send digest", "error", err, "did", subscriber.UserDID)
+				_ = bugsnag.Notify(err)
+				continue
+			}
+		}
+
+		err = d.dmStore.SetLastDigestAt(subscriber.UserDID, until)
+		if err != nil {
+			slog.Error("set last digest at", "error", err, "did", subscriber.UserDID)
+			_ = bugsnag.Notify(err)
+		}
+	}
+
+	return nil
+}
+
+func formatDigestMessage(entries []store.DigestEntry) string {
+	var sb strings.Builder
+	sb.WriteString("New replies to your bookmarks:\n")
+	for i, entry := range entries {
+		if i == dmListLimit {
+			fmt.Fprintf(&sb, "\n...and %d more bookmarks with new replies\n", len(entries)-dmListLimit)
+			break
+		}
+
+		content := []rune(entry.Content)
+		if len(content) > dmSnippetLength {
+			content = append(content[:dmSnippetLength], []rune("...")...)
+		}
+		fmt.Fprintf(&sb, "\n%d. @%s: %s\n%s\n%s\n", i+1, entry.AuthorHandle, string(content), formatDigestCounts(entry), entry.PostURI)
+	}
+
+	return truncateMessageText(sb.String())
+}
+
+func formatDigestCounts(entry store.DigestEntry) string {
+	counts := make([]string, 0, 2)
+	if entry.Replies > 0 {
+		counts = append(counts, pluralise(entry.Replies, "reply", "replies"))
+	}
+	if entry.Quotes > 0 {
+		counts = append(counts, pluralise(entry.Quotes, "quote", "quotes"))
+	}
+	return strings.Join(counts, ", ")
+}
+
+func pluralise(count int, singular, plural string) string {
+	if count == 1 {
+		return fmt.Sprintf("%d %s", count, singular)
+	}
+	return fmt.Sprintf("%d %s", count, plural)
+}
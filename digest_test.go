@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+func TestDigestIsSentWhenDue(t *testing.T) {
+	s := newTestStore(t)
+	service, chat := newTestDmService(t, s)
+
+	err := s.CreateBookmark("bookmarked", "https://bsky.app/profile/author.test/post/bookmarked", testBookmarkURI, "", testAuthorDID, "author.test", testUserDID, "a post", 0)
+	if err != nil {
+		t.Fatalf("create bookmark: %s", err)
+	}
+
+	chat.AddMessage(testConvoID, Message{ID: "msg1", Sender: MessageSender{Did: testUserDID}, Text: "digest hourly"})
+	if err := service.HandleMessageTimer(context.Background()); err != nil {
+		t.Fatalf("handle message timer: %s", err)
+	}
+	if text := lastSentText(t, chat); !strings.Contains(text, "sent hourly") {
+		t.Fatalf("unexpected reply to digest command: %q", text)
+	}
+	sentBefore := len(chat.Sent())
+
+	replies := []store.ReplyPost{
+		{ReplyURI: "at://did:plc:replier/app.bsky.feed.post/reply1", UserDID: testUserDID, SubscribedPostURI: testBookmarkURI, Kind: store.ReplyKindReply},
+		{ReplyURI: "at://did:plc:replier/app.bsky.feed.post/reply2", UserDID: testUserDID, SubscribedPostURI: testBookmarkURI, Kind: store.ReplyKindReply},
+		{ReplyURI: "at://did:plc:replier/app.bsky.feed.post/quote1", UserDID: testUserDID, SubscribedPostURI: testBookmarkURI, Kind: store.ReplyKindQuote},
+	}
+	for _, reply := range replies {
+		if err := s.AddRepliedPost(reply); err != nil {
+			t.Fatalf("add replied post: %s", err)
+		}
+	}
+
+	// not an hour since the digest was turned on
+	if err := service.SendDueDigests(context.Background(), time.Now()); err != nil {
+		t.Fatalf("send due digests: %s", err)
+	}
+	if len(chat.Sent()) != sentBefore {
+		t.Fatalf("expected no digest before it is due, got %+v", chat.Sent()[sentBefore:])
+	}
+
+	if err := service.SendDueDigests(context.Background(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("send due digests: %s", err)
+	}
+	sent := chat.Sent()
+	if len(sent) != sentBefore+1 {
+		t.Fatalf("expected a digest to be sent, got %+v", sent[sentBefore:])
+	}
+	digest := sent[len(sent)-1]
+	if digest.ConvoID != testConvoID {
+		t.Errorf("expected digest to be sent to %q, got %q", testConvoID, digest.ConvoID)
+	}
+	if !strings.Contains(digest.Message.Text, "2 replies, 1 quote") || !strings.Contains(digest.Message.Text, "https://bsky.app/profile/author.test/post/bookmarked") {
+		t.Errorf("unexpected digest text: %q", digest.Message.Text)
+	}
+
+	// the replies have already been included so the next digest has nothing to send
+	if err := service.SendDueDigests(context.Background(), time.Now().Add(time.Hour*3)); err != nil {
+		t.Fatalf("send due digests: %s", err)
+	}
+	if len(chat.Sent()) != sentBefore+1 {
+		t.Errorf("expected no further digest, got %+v", chat.Sent()[sentBefore+1:])
+	}
+}
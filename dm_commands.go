@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+const (
+	commandSave     = "save"
+	commandDelete   = "delete"
+	commandList     = "list"
+	commandTag      = "tag"
+	commandFind     = "find"
+	commandHelp     = "help"
+	commandMute     = "mute"
+	commandUnmute   = "unmute"
+	commandStats    = "stats"
+	commandFollow   = "follow"
+	commandUnfollow = "unfollow"
+	commandDigest   = "digest"
+
+	dmListLimit = 10
+)
+
+const helpMessage = `Send me a post to bookmark it. You can also send one of these commands:
+
+save [to <collection>] - with a post, bookmark it (optionally into a collection)
+delete - with a post, remove its bookmark
+tag <tags> - with a post, set the tags on its bookmark
+follow / unfollow - with a post, add or remove all replies in its thread from your threads feed
+list [<collection>] - show your latest bookmarks
+find <terms> - search your bookmarks, use #tag to search tags
+stats - show how many bookmarks and replies you have
+mute / unmute - turn confirmation messages off or on
+digest [off|immediately|hourly|daily] - get a message summarising new replies to your bookmarks
+help - show this message`
+
+// dmCommand is a parsed message sent to the DM bot.
+type dmCommand struct {
+	name    string
+	args    string
+	postURI string
+	// convoID is the chat the command was sent in
+	convoID string
+}
+
+// dmUserError is returned when a message can't be handled because of something the sender did, rather than because
+// of an internal error. The error message is sent back to the user.
+type dmUserError struct {
+	msg string
+}
+
+func (e *dmUserError) Error() string {
+	return e.msg
+}
+
+func newDmUserError(format string, args ...any) error {
+	return &dmUserError{msg: fmt.Sprintf(format, args...)}
+}
+
+// dmReply is a message to send back to the user after handling their command. Confirmations are not sent if the user
+// has muted them.
+type dmReply struct {
+	text         string
+	confirmation bool
+}
+
+// parseDmCommand parses the text of a message into a command. The first word of the message is the command and the
+// rest of the message is the arguments. Messages that contain a post but no recognised command are treated as a save,
+// unless they mention "delete" anywhere, which is how deleting worked before commands were added.
+func parseDmCommand(text, postURI string) (dmCommand, error) {
+	text = strings.TrimSpace(text)
+	name, args, _ := strings.Cut(text, " ")
+	name = strings.ToLower(name)
+	args = strings.TrimSpace(args)
+
+	cmd := dmCommand{
+		name:    name,
+		args:    args,
+		postURI: postURI,
+	}
+
+	switch name {
+	case commandSave, commandDelete, commandTag, commandFollow, commandUnfollow:
+		if postURI == "" {
+			return cmd, newDmUserError("%q needs a post to be sent with it. Send \"help\" to see what I can do.", name)
+		}
+		if name == commandTag && args == "" {
+			return cmd, newDmUserError("\"tag\" needs at least one tag, for example \"tag golang reading\"")
+		}
+		if name == commandSave {
+			// "save to reading" and "save reading" both save into the reading collection
+			if collection, ok := strings.CutPrefix(strings.ToLower(args), "to "); ok {
+				cmd.args = strings.TrimSpace(collection)
+			}
+		}
+		return cmd, nil
+	case commandFind:
+		if args == "" {
+			return cmd, newDmUserError("\"find\" needs something to search for, for example \"find golang\"")
+		}
+		return cmd, nil
+	case commandDigest:
+		cmd.args = strings.ToLower(args)
+		if _, ok := digestIntervals[cmd.args]; !ok && cmd.args != "" && cmd.args != store.DigestOff {
+			return cmd, newDmUserError("I don't know the digest schedule %q. Use off, immediately, hourly or daily.", args)
+		}
+		return cmd, nil
+	case commandList, commandHelp, commandMute, commandUnmute, commandStats:
+		return cmd, nil
+	}
+
+	if postURI != "" {
+		if strings.Contains(strings.ToLower(text), commandDelete) {
+			return dmCommand{
+				name:    commandDelete,
+				postURI: postURI,
+			}, nil
+		}
+		return dmCommand{
+			name:    commandSave,
+			postURI: postURI,
+		}, nil
+	}
+
+	if name == "" {
+		return cmd, newDmUserError("Send me a post to bookmark it, or send \"help\" to see what I can do.")
+	}
+	return cmd, newDmUserError("I don't know the command %q. Send \"help\" to see what I can do.", name)
+}
+
+func (d *DmService) runCommand(ctx context.Context, cmd dmCommand, msg Message) (dmReply, error) {
+	switch cmd.name {
+	case commandSave:
+		return d.runSaveCommand(ctx, cmd, msg)
+	case commandDelete:
+		return d.runDeleteCommand(ctx, msg)
+	case commandTag:
+		return d.runTagCommand(ctx, cmd, msg)
+	case commandList:
+		return d.runListCommand(cmd, msg)
+	case commandFind:
+		return d.runFindCommand(cmd, msg)
+	case commandMute:
+		return d.runMuteCommand(msg, true)
+	case commandUnmute:
+		return d.runMuteCommand(msg, false)
+	case commandStats:
+		return d.runStatsCommand(msg)
+	case commandFollow:
+		return d.runFollowCommand(ctx, msg, true)
+	case commandUnfollow:
+		return d.runFollowCommand(ctx, msg, false)
+	case commandDigest:
+		return d.runDigestCommand(cmd, msg)
+	case commandHelp:
+		return dmReply{text: helpMessage}, nil
+	default:
+		return dmReply{}, fmt.Errorf("unhandled command %q", cmd.name)
+	}
+}
+
+func (d *DmService) runSaveCommand(ctx context.Context, cmd dmCommand, msg Message) (dmReply, error) {
+	if cmd.args != "" {
+		collectionName, err := normalizeCollectionName(cmd.args)
+		if err != nil {
+			return dmReply{}, newDmUserError("%s", err.Error())
+		}
+
+		err = d.handleCreateBookmarkInCollection(ctx, msg, collectionName)
+		if err != nil {
+			return dmReply{}, err
+		}
+		return dmReply{text: fmt.Sprintf("Saved to your %q collection", collectionName), confirmation: true}, nil
+	}
+
+	err := d.handleCreateBookmark(ctx, msg)
+	if err != nil {
+		if errors.Is(err, store.ErrBookmarkAlreadyExists) {
+			return dmReply{text: "You've already bookmarked that post", confirmation: true}, nil
+		}
+		return dmReply{}, err
+	}
+	return dmReply{text: "Bookmarked!", confirmation: true}, nil
+}
+
+func (d *DmService) runDeleteCommand(ctx context.Context, msg Message) (dmReply, error) {
+	bookmark, err := d.bookmarkStore.GetBookmarkByURIForUser(msg.Embed.Record.URI, msg.Sender.Did)
+	if err != nil {
+		return dmReply{}, fmt.Errorf("get bookmark to delete: %w", err)
+	}
+	if bookmark == nil {
+		return dmReply{}, newDmUserError("You haven't bookmarked that post")
+	}
+
+	err = d.bookmarkRecords.Delete(ctx, *bookmark)
+	if err != nil {
+		return dmReply{}, err
+	}
+	return dmReply{text: "Bookmark deleted", confirmation: true}, nil
+}
+
+func (d *DmService) runTagCommand(ctx context.Context, cmd dmCommand, msg Message) (dmReply, error) {
+	tags, err := parseTags(cmd.args)
+	if err != nil {
+		return dmReply{}, newDmUserError("%s", err.Error())
+	}
+
+	// tagging a post that isn't bookmarked yet bookmarks it
+	err = d.handleCreateBookmark(ctx, msg)
+	if err != nil && !errors.Is(err, store.ErrBookmarkAlreadyExists) {
+		return dmReply{}, err
+	}
+
+	err = d.bookmarkStore.SetBookmarkTags(msg.Embed.Record.URI, msg.Sender.Did, tags)
+	if err != nil {
+		return dmReply{}, fmt.Errorf("set bookmark tags: %w", err)
+	}
+	d.bookmarkRecords.Sync(ctx, msg.Embed.Record.URI, msg.Sender.Did)
+	return dmReply{text: fmt.Sprintf("Tagged with %s", strings.Join(tags, ", ")), confirmation: true}, nil
+}
+
+func (d *DmService) runListCommand(cmd dmCommand, msg Message) (dmReply, error) {
+	// if no cursor provided use a date waaaaay in the future to start the less than query
+	cursor := int64(9999999999999)
+
+	if cmd.args == "" {
+		bookmarks, err := d.dmStore.GetBookmarksForUserWithPaging(msg.Sender.Did, cursor, dmListLimit)
+		if err != nil {
+			return dmReply{}, fmt.Errorf("get bookmarks for user: %w", err)
+		}
+		return dmReply{text: formatBookmarksMessage("Your latest bookmarks:", "You don't have any bookmarks yet", bookmarks)}, nil
+	}
+
+	collectionName, err := normalizeCollectionName(cmd.args)
+	if err != nil {
+		return dmReply{}, newDmUserError("%s", err.Error())
+	}
+	collection, err := d.collectionStore.GetCollectionByName(msg.Sender.Did, collectionName)
+	if err != nil {
+		return dmReply{}, fmt.Errorf("get collection by name: %w", err)
+	}
+	if collection == nil {
+		return dmReply{}, newDmUserError("You don't have a collection called %q", collectionName)
+	}
+
+	bookmarks, err := d.dmStore.GetBookmarksForCollectionWithPaging(collection.ID, msg.Sender.Did, cursor, dmListLimit)
+	if err != nil {
+		return dmReply{}, fmt.Errorf("get bookmarks for collection: %w", err)
+	}
+	heading := fmt.Sprintf("Your latest bookmarks in %q:", collectionName)
+	return dmReply{text: formatBookmarksMessage(heading, fmt.Sprintf("Your %q collection is empty", collectionName), bookmarks)}, nil
+}
+
+func (d *DmService) runFindCommand(cmd dmCommand, msg Message) (dmReply, error) {
+	bookmarks, err := d.bookmarkStore.SearchBookmarks(msg.Sender.Did, cmd.args, dmSearchResultsLimit)
+	if err != nil {
+		return dmReply{}, fmt.Errorf("search bookmarks: %w", err)
+	}
+
+	heading := fmt.Sprintf("Bookmarks matching %q:", cmd.args)
+	return dmReply{text: formatBookmarksMessage(heading, fmt.Sprintf("No bookmarks found matching %q", cmd.args), bookmarks)}, nil
+}
+
+func (d *DmService) runFollowCommand(ctx context.Context, msg Message, follow bool) (dmReply, error) {
+	if follow {
+		// following a thread of a post that isn't bookmarked yet bookmarks it
+		err := d.handleCreateBookmark(ctx, msg)
+		if err != nil && !errors.Is(err, store.ErrBookmarkAlreadyExists) {
+			return dmReply{}, err
+		}
+	} else {
+		bookmark, err := d.bookmarkStore.GetBookmarkByURIForUser(msg.Embed.Record.URI, msg.Sender.Did)
+		if err != nil {
+			return dmReply{}, fmt.Errorf("get bookmark to unfollow: %w", err)
+		}
+		if bookmark == nil {
+			return dmReply{}, newDmUserError("You haven't bookmarked that post")
+		}
+	}
+
+	err := d.bookmarkStore.SetBookmarkFollowThread(msg.Embed.Record.URI, msg.Sender.Did, follow)
+	if err != nil {
+		return dmReply{}, fmt.Errorf("set bookmark follow thread: %w", err)
+	}
+
+	if follow {
+		return dmReply{text: "Following the thread. Replies will show up in your threads feed", confirmation: true}, nil
+	}
+	return dmReply{text: "Stopped following the thread", confirmation: true}, nil
+}
+
+func (d *DmService) runMuteCommand(msg Message, muted bool) (dmReply, error) {
+	err := d.dmStore.SetConfirmationsMuted(msg.Sender.Did, muted)
+	if err != nil {
+		return dmReply{}, fmt.Errorf("set confirmations muted: %w", err)
+	}
+
+	if muted {
+		return dmReply{text: "Confirmations muted. I'll still reply to list, find, stats and help, and let you know if something goes wrong."}, nil
+	}
+	return dmReply{text: "Confirmations unmuted"}, nil
+}
+
+func (d *DmService) runDigestCommand(cmd dmCommand, msg Message) (dmReply, error) {
+	if cmd.args == "" {
+		settings, err := d.dmStore.GetUserSettings(msg.Sender.Did)
+		if err != nil {
+			return dmReply{}, fmt.Errorf("get user settings: %w", err)
+		}
+		return dmReply{text: fmt.Sprintf("Your digest is %s. Send \"digest <off|immediately|hourly|daily>\" to change it.", describeDigestSchedule(settings.DigestSchedule))}, nil
+	}
+
+	err := d.dmStore.SetDigestSchedule(msg.Sender.Did, cmd.args, cmd.convoID, time.Now().UnixMilli())
+	if err != nil {
+		return dmReply{}, fmt.Errorf("set digest schedule: %w", err)
+	}
+
+	if cmd.args == store.DigestOff {
+		return dmReply{text: "Digest turned off"}, nil
+	}
+	return dmReply{text: fmt.Sprintf("Your digest is now %s. I'll message you here when your bookmarks get new replies.", describeDigestSchedule(cmd.args))}, nil
+}
+
+func describeDigestSchedule(schedule string) string {
+	switch schedule {
+	case store.DigestImmediately:
+		return "sent as soon as there are new replies"
+	case store.DigestHourly:
+		return "sent hourly"
+	case store.DigestDaily:
+		return "sent daily"
+	default:
+		return "off"
+	}
+}
+
+func (d *DmService) runStatsCommand(msg Message) (dmReply, error) {
+	stats, err := d.dmStore.GetUserStats(msg.Sender.Did)
+	if err != nil {
+		return dmReply{}, fmt.Errorf("get user stats: %w", err)
+	}
+
+	text := fmt.Sprintf("You have %d bookmarks in %d collections, with %d replies tracked", stats.Bookmarks, stats.Collections, stats.Replies)
+	return dmReply{text: text}, nil
+}
+
+func formatBookmarksMessage(heading, emptyText string, bookmarks []store.Bookmark) string {
+	if len(bookmarks) == 0 {
+		return emptyText
+	}
+
+	var sb strings.Builder
+	sb.WriteString(heading)
+	sb.WriteString("\n")
+	for i, bookmark := range bookmarks {
+		content := []rune(bookmark.Content)
+		if len(content) > dmSnippetLength {
+			content = append(content[:dmSnippetLength], []rune("...")...)
+		}
+		if bookmark.DeletedAt != 0 {
+			fmt.Fprintf(&sb, "\n%d. @%s: %s\n(deleted by the author)\n", i+1, bookmark.AuthorHandle, string(content))
+			continue
+		}
+		fmt.Fprintf(&sb, "\n%d. @%s: %s\n%s\n", i+1, bookmark.AuthorHandle, string(content), bookmark.PostURI)
+	}
+
+	return truncateMessageText(sb.String())
+}
+
+// truncateMessageText makes sure that text fits in a single chat message.
+func truncateMessageText(text string) string {
+	runes := []rune(text)
+	if len(runes) <= maxMessageLength {
+		return text
+	}
+	return string(runes[:maxMessageLength-3]) + "..."
+}
+
+func (d *DmService) handleCreateBookmark(ctx context.Context, msg Message) error {
+	content := msg.Embed.Record.Value.Text
+	if content == "" {
+		content = "post contained no text"
+	}
+
+	publicURI := getPublicPostURIFromATURI(msg.Embed.Record.URI, msg.Embed.Record.Author.Handle)
+
+	rkey := getRKeyFromATURI(msg.Embed.Record.URI)
+
+	rootURI := msg.Embed.Record.URI
+	if msg.Embed.Record.Value.Reply != nil && msg.Embed.Record.Value.Reply.Root.URI != "" {
+		rootURI = msg.Embed.Record.Value.Reply.Root.URI
+	}
+
+	err := d.bookmarkStore.CreateBookmark(rkey, publicURI, msg.Embed.Record.URI, rootURI, msg.Embed.Record.Author.Did, msg.Embed.Record.Author.Handle, msg.Sender.Did, content, time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("creating bookmark: %w", err)
+	}
+
+	d.bookmarkRecords.Sync(ctx, msg.Embed.Record.URI, msg.Sender.Did)
+	return nil
+}
+
+func (d *DmService) handleCreateBookmarkInCollection(ctx context.Context, msg Message, collectionName string) error {
+	collection, err := getOrCreateCollection(ctx, d.collectionStore, d.feedPublisher, msg.Sender.Did, collectionName)
+	if err != nil {
+		return fmt.Errorf("get or create collection: %w", err)
+	}
+
+	// if the post is already bookmarked then it will be moved into the collection
+	err = d.handleCreateBookmark(ctx, msg)
+	if err != nil && !errors.Is(err, store.ErrBookmarkAlreadyExists) {
+		return err
+	}
+
+	err = d.collectionStore.SetBookmarkCollection(msg.Embed.Record.URI, msg.Sender.Did, collection.ID)
+	if err != nil {
+		return fmt.Errorf("set bookmark collection: %w", err)
+	}
+	return nil
+}
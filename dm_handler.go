@@ -8,17 +8,28 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
-	"os"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/bugsnag/bugsnag-go/v2"
 	"github.com/pkg/errors"
+	"github.com/willdot/bskyfeedgen/store"
 )
 
 const (
 	httpClientTimeoutDuration        = time.Second * 5
 	transportIdleConnTimeoutDuration = time.Second * 90
-	baseBskyURL                      = "https://bsky.social/xrpc"
+	defaultAuthURL                   = "https://bsky.social/xrpc"
+
+	// chat messages can be at most 1000 graphemes
+	maxMessageLength     = 1000
+	dmSearchResultsLimit = 10
+	dmSnippetLength      = 50
+	// the number of times to try handling a message before giving up and telling the user
+	maxMessageAttempts = 3
 )
 
 type auth struct {
@@ -80,7 +91,16 @@ type MessageEmbedRecordAuthor struct {
 }
 
 type MessageEmbedPost struct {
-	Text string `json:"text"`
+	Text  string                 `json:"text"`
+	Reply *MessageEmbedPostReply `json:"reply"`
+}
+
+type MessageEmbedPostReply struct {
+	Root MessageEmbedPostRef `json:"root"`
+}
+
+type MessageEmbedPostRef struct {
+	URI string `json:"uri"`
 }
 
 type MessageSender struct {
@@ -92,16 +112,71 @@ type UpdateMessageReadRequest struct {
 	MessageID string `json:"messageId"`
 }
 
+type SendMessageRequest struct {
+	ConvoID string             `json:"convoId"`
+	Message SendMessageContent `json:"message"`
+}
+
+type SendMessageContent struct {
+	Text string `json:"text"`
+}
+
+type PutRecordRequest struct {
+	Repo       string `json:"repo"`
+	Collection string `json:"collection"`
+	RKey       string `json:"rkey"`
+	Record     any    `json:"record"`
+}
+
+type DmStore interface {
+	BookmarkStore
+	CollectionStore
+	GetBookmarksForUserWithPaging(userDID string, cursor int64, limit int) ([]store.Bookmark, error)
+	GetBookmarksForCollectionWithPaging(collectionID int, userDID string, cursor int64, limit int) ([]store.Bookmark, error)
+	GetUserSettings(userDID string) (store.UserSettings, error)
+	SetConfirmationsMuted(userDID string, muted bool) error
+	GetUserStats(userDID string) (store.UserStats, error)
+	SetDigestSchedule(userDID, schedule, convoID string, now int64) error
+	GetDigestSubscribers() ([]store.UserSettings, error)
+	GetDigestEntries(userDID string, after, until int64) ([]store.DigestEntry, error)
+	SetLastDigestAt(userDID string, lastDigestAt int64) error
+}
+
+type DmServiceConfig struct {
+	AccessHandle      string
+	AccessAppPassword string
+	// PDSURL is the PDS of the messaging account that chat and repo requests are sent to
+	PDSURL string
+	// AuthURL is the XRPC base URL used to create and refresh the messaging account session
+	AuthURL       string
+	TimerDuration time.Duration
+	FeedHost      string
+}
+
 type DmService struct {
-	httpClient    *http.Client
-	accessData    accessData
-	auth          auth
-	timerDuration time.Duration
-	pdsURL        string
-	bookmarkStore BookmarkStore
+	httpClient *http.Client
+	accessData accessData
+	// authMu guards auth as it's replaced by the refresh task while other goroutines are using it
+	authMu          sync.RWMutex
+	auth            auth
+	timerDuration   time.Duration
+	pdsURL          string
+	authURL         string
+	dmStore         DmStore
+	bookmarkStore   BookmarkStore
+	collectionStore CollectionStore
+	feedPublisher   CollectionFeedPublisher
+	bookmarkRecords *bookmarkRecords
+	// messageAttempts counts how many times a message has failed to be handled, keyed by message ID
+	messageAttempts map[string]int
+
+	// lastSuccessfulPoll is the unix milli time that unread messages were last fetched without an error
+	lastSuccessfulPoll atomic.Int64
+	// sessionValid is false when the app password session has failed to be refreshed
+	sessionValid atomic.Bool
 }
 
-func NewDmService(bookmarkStore BookmarkStore, timerDuration time.Duration) (*DmService, error) {
+func NewDmService(dmStore DmStore, cfg DmServiceConfig) (*DmService, error) {
 	httpClient := http.Client{
 		Timeout: httpClientTimeoutDuration,
 		Transport: &http.Transport{
@@ -109,33 +184,42 @@ func NewDmService(bookmarkStore BookmarkStore, timerDuration time.Duration) (*Dm
 		},
 	}
 
-	accessHandle := os.Getenv("MESSAGING_ACCESS_HANDLE")
-	accessAppPassword := os.Getenv("MESSAGING_ACCESS_APP_PASSWORD")
-	pdsURL := os.Getenv("MESSAGING_PDS_URL")
+	authURL := cfg.AuthURL
+	if authURL == "" {
+		authURL = defaultAuthURL
+	}
 
 	service := DmService{
 		httpClient: &httpClient,
 		accessData: accessData{
-			handle:      accessHandle,
-			appPassword: accessAppPassword,
+			handle:      cfg.AccessHandle,
+			appPassword: cfg.AccessAppPassword,
 		},
-		timerDuration: timerDuration,
-		pdsURL:        pdsURL,
-		bookmarkStore: bookmarkStore,
+		timerDuration:   cfg.TimerDuration,
+		pdsURL:          cfg.PDSURL,
+		authURL:         authURL,
+		dmStore:         dmStore,
+		bookmarkStore:   dmStore,
+		collectionStore: dmStore,
+		bookmarkRecords: newBookmarkRecords(dmStore, nil),
+		messageAttempts: make(map[string]int),
 	}
+	service.feedPublisher = NewFeedPublisher(&service, cfg.FeedHost)
 
 	auth, err := service.Authenicate()
 	if err != nil {
 		return nil, fmt.Errorf("authenticating: %w", err)
 	}
 
-	service.auth = auth
+	service.setAuth(auth)
+	service.sessionValid.Store(true)
 
 	return &service, nil
 }
 
 func (d *DmService) Start(ctx context.Context) {
 	go d.RefreshTask(ctx)
+	go d.DigestTask(ctx)
 
 	timer := time.NewTimer(d.timerDuration)
 	defer timer.Stop()
@@ -146,15 +230,33 @@ func (d *DmService) Start(ctx context.Context) {
 			slog.Warn("context canceled - stopping dm task")
 			return
 		case <-timer.C:
+			start := time.Now()
 			err := d.HandleMessageTimer(ctx)
+			dmPollDuration.Observe(time.Since(start).Seconds())
 			if err != nil {
+				dmPollErrors.Inc()
 				slog.Error("handle message timer", "error", err)
+			} else {
+				d.lastSuccessfulPoll.Store(time.Now().UnixMilli())
 			}
 			timer.Reset(d.timerDuration)
 		}
 	}
 }
 
+// LastSuccessfulPoll returns when unread messages were last fetched without an error, or zero if they never have been.
+func (d *DmService) LastSuccessfulPoll() time.Time {
+	lastPoll := d.lastSuccessfulPoll.Load()
+	if lastPoll == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(lastPoll)
+}
+
+func (d *DmService) SessionValid() bool {
+	return d.sessionValid.Load()
+}
+
 func (d *DmService) HandleMessageTimer(ctx context.Context) error {
 	convoResp, err := d.GetUnreadMessages()
 	if err != nil {
@@ -170,6 +272,7 @@ func (d *DmService) HandleMessageTimer(ctx context.Context) error {
 
 		messageResp, err := d.GetMessages(ctx, convo.ID)
 		if err != nil {
+			dmPollErrors.Inc()
 			slog.Error("failed to get messages for convo", "error", err, "convo id", convo.ID)
 			continue
 		}
@@ -180,7 +283,7 @@ func (d *DmService) HandleMessageTimer(ctx context.Context) error {
 		for _, msg := range messageResp.Messages {
 			// TODO: techincally if I get to a message that's from the bot account, then there shouldn't be
 			// an more unread messages?
-			if msg.Sender.Did == d.auth.Did {
+			if msg.Sender.Did == d.currentAuth().Did {
 				continue
 			}
 
@@ -191,8 +294,15 @@ func (d *DmService) HandleMessageTimer(ctx context.Context) error {
 			}
 		}
 
+		// messages are returned newest first, but marking a message as read also marks all of the messages before
+		// it as read. So handle the oldest first and stop at the first one that fails so that it stays unread and
+		// is tried again next time along with all of the messages after it.
+		slices.Reverse(unreadMessages)
 		for _, msg := range unreadMessages {
-			d.handleMessage(msg)
+			handled := d.handleMessage(ctx, convo.ID, msg)
+			if !handled {
+				break
+			}
 
 			err = d.MarkMessageRead(msg.ID, convo.ID)
 			if err != nil {
@@ -205,65 +315,56 @@ func (d *DmService) HandleMessageTimer(ctx context.Context) error {
 	return nil
 }
 
-func (d *DmService) handleMessage(msg Message) {
-	// for now, ignore messages that don't have linked posts in them
-	if msg.Embed.Record.URI == "" {
-		return
-	}
-
-	rkey := getRKeyFromATURI(msg.Embed.Record.URI)
-	msgAction := strings.ToLower(msg.Text)
-
-	var err error
+func (d *DmService) handleMessage(ctx context.Context, convoID string, msg Message) bool {
+	reply, err := d.handleCommand(ctx, convoID, msg)
+	if err != nil {
+		var userErr *dmUserError
+		if errors.As(err, &userErr) {
+			reply = dmReply{text: userErr.Error()}
+		} else {
+			d.messageAttempts[msg.ID]++
+			if d.messageAttempts[msg.ID] < maxMessageAttempts {
+				slog.Error("failed to handle message - will retry", "error", err, "attempt", d.messageAttempts[msg.ID], "post uri", msg.Embed.Record.URI, "sender", msg.Sender.Did)
+				return false
+			}
 
-	switch {
-	case strings.Contains(msgAction, "delete"):
-		err = d.handleDeleteBookmark(msg)
-	default:
-		err = d.handleCreateBookmark(msg)
+			slog.Error("failed to handle message - giving up", "error", err, "post uri", msg.Embed.Record.URI, "sender", msg.Sender.Did)
+			_ = bugsnag.Notify(err)
+			reply = dmReply{text: "Sorry, something went wrong handling your message. Please try again later."}
+		}
 	}
+	delete(d.messageAttempts, msg.ID)
 
-	if err != nil {
-		// TODO: perhaps continue here so that we don't mark the message as read so it can be tried again? Or perhaps send a message
-		// too the user?
-		slog.Error("failed to handle bookmark message", "error", err, "rkey", rkey, "sender", msg.Sender.Did)
+	if reply.text == "" {
+		return true
 	}
-}
 
-func (d *DmService) handleCreateBookmark(msg Message) error {
-	content := msg.Embed.Record.Value.Text
-	if content == "" {
-		content = "post contained no text"
-	}
-	if len(content) > 75 {
-		content = fmt.Sprintf("%s...", content[:75])
+	if reply.confirmation {
+		settings, err := d.dmStore.GetUserSettings(msg.Sender.Did)
+		if err != nil {
+			slog.Error("get user settings", "error", err, "did", msg.Sender.Did)
+		}
+		if settings.ConfirmationsMuted {
+			return true
+		}
 	}
 
-	publicURI := getPublicPostURIFromATURI(msg.Embed.Record.URI, msg.Embed.Record.Author.Handle)
-
-	rkey := getRKeyFromATURI(msg.Embed.Record.URI)
-
-	err := d.bookmarkStore.CreateBookmark(rkey, publicURI, msg.Embed.Record.URI, msg.Embed.Record.Author.Did, msg.Embed.Record.Author.Handle, msg.Sender.Did, content, time.Now().UnixMilli())
+	err = d.SendMessage(ctx, convoID, reply.text)
 	if err != nil {
-		return fmt.Errorf("creating bookmark: %w", err)
+		// the command has been handled so don't retry it just because the reply failed
+		slog.Error("failed to send reply", "error", err, "sender", msg.Sender.Did)
 	}
-	return nil
+	return true
 }
 
-func (d *DmService) handleDeleteBookmark(msg Message) error {
-	rkey := getRKeyFromATURI(msg.Embed.Record.URI)
-
-	err := d.bookmarkStore.DeleteRepliedPostsForBookmarkedPostURIandUserDID(msg.Embed.Record.URI, msg.Sender.Did)
-	if err != nil {
-		return fmt.Errorf("failed to delete replied posts for bookmark for user: %w", err)
-	}
-
-	err = d.bookmarkStore.DeleteBookmark(rkey, msg.Sender.Did)
+func (d *DmService) handleCommand(ctx context.Context, convoID string, msg Message) (dmReply, error) {
+	cmd, err := parseDmCommand(msg.Text, msg.Embed.Record.URI)
 	if err != nil {
-		return fmt.Errorf("failed to delete bookmark: %w", err)
+		return dmReply{}, err
 	}
+	cmd.convoID = convoID
 
-	return nil
+	return d.runCommand(ctx, cmd, msg)
 }
 
 func getPublicPostURIFromATURI(atURI, authorHandle string) string {
@@ -285,7 +386,7 @@ func (d *DmService) GetUnreadMessages() (ListConvosResponse, error) {
 	request.Header.Add("Content-Type", "application/json")
 	request.Header.Add("Accept", "application/json")
 	request.Header.Add("Atproto-Proxy", "did:web:api.bsky.chat#bsky_chat")
-	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", d.auth.AccessJwt))
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", d.currentAuth().AccessJwt))
 
 	resp, err := d.httpClient.Do(request)
 	if err != nil {
@@ -334,7 +435,7 @@ func (d *DmService) MarkMessageRead(messageID, convoID string) error {
 	request.Header.Add("Content-Type", "application/json")
 	request.Header.Add("Accept", "application/json")
 	request.Header.Add("Atproto-Proxy", "did:web:api.bsky.chat#bsky_chat")
-	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", d.auth.AccessJwt))
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", d.currentAuth().AccessJwt))
 
 	resp, err := d.httpClient.Do(request)
 	if err != nil {
@@ -357,7 +458,7 @@ func (d *DmService) MarkMessageRead(messageID, convoID string) error {
 }
 
 func (d *DmService) Authenicate() (auth, error) {
-	url := fmt.Sprintf("%s/com.atproto.server.createSession", baseBskyURL)
+	url := fmt.Sprintf("%s/com.atproto.server.createSession", d.authURL)
 
 	requestData := map[string]interface{}{
 		"identifier": d.accessData.handle,
@@ -384,6 +485,15 @@ func (d *DmService) Authenicate() (auth, error) {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		var errorResp ErrorResponse
+		err = decodeResp(resp.Body, &errorResp)
+		if err != nil {
+			return auth{}, err
+		}
+		return auth{}, fmt.Errorf("creating session responded with code %d: %s", resp.StatusCode, errorResp.Error)
+	}
+
 	var loginResp auth
 	err = decodeResp(resp.Body, &loginResp)
 	if err != nil {
@@ -403,6 +513,7 @@ func (d *DmService) RefreshTask(ctx context.Context) {
 			return
 		case <-timer.C:
 			err := d.RefreshAuthenication(ctx)
+			d.sessionValid.Store(err == nil)
 			if err != nil {
 				slog.Error("handle refresh auth timer", "error", err)
 				// TODO: better retry with backoff probably
@@ -415,7 +526,7 @@ func (d *DmService) RefreshTask(ctx context.Context) {
 }
 
 func (d *DmService) RefreshAuthenication(ctx context.Context) error {
-	url := fmt.Sprintf("%s/com.atproto.server.refreshSession", baseBskyURL)
+	url := fmt.Sprintf("%s/com.atproto.server.refreshSession", d.authURL)
 
 	request, err := http.NewRequest("POST", url, nil)
 	if err != nil {
@@ -423,7 +534,7 @@ func (d *DmService) RefreshAuthenication(ctx context.Context) error {
 	}
 
 	request.Header.Add("Content-Type", "application/json")
-	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", d.auth.RefershJWT))
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", d.currentAuth().RefershJWT))
 
 	resp, err := d.httpClient.Do(request)
 	if err != nil {
@@ -431,17 +542,124 @@ func (d *DmService) RefreshAuthenication(ctx context.Context) error {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		var errorResp ErrorResponse
+		err = decodeResp(resp.Body, &errorResp)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("refreshing session responded with code %d: %s", resp.StatusCode, errorResp.Error)
+	}
+
 	var loginResp auth
 	err = decodeResp(resp.Body, &loginResp)
 	if err != nil {
 		return err
 	}
 
-	d.auth = loginResp
+	d.setAuth(loginResp)
 
 	return nil
 }
 
+func (d *DmService) currentAuth() auth {
+	d.authMu.RLock()
+	defer d.authMu.RUnlock()
+	return d.auth
+}
+
+func (d *DmService) setAuth(auth auth) {
+	d.authMu.Lock()
+	defer d.authMu.Unlock()
+	d.auth = auth
+}
+
+func (d *DmService) SendMessage(ctx context.Context, convoID, text string) error {
+	bodyReq := SendMessageRequest{
+		ConvoID: convoID,
+		Message: SendMessageContent{
+			Text: truncateMessageText(text),
+		},
+	}
+
+	bodyB, err := json.Marshal(bodyReq)
+	if err != nil {
+		return fmt.Errorf("marshal send message request body: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/xrpc/chat.bsky.convo.sendMessage", d.pdsURL)
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(bodyB))
+	if err != nil {
+		return fmt.Errorf("create new send message http request: %w", err)
+	}
+
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("Accept", "application/json")
+	request.Header.Add("Atproto-Proxy", "did:web:api.bsky.chat#bsky_chat")
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", d.currentAuth().AccessJwt))
+
+	resp, err := d.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("do http request to send message: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var errorResp ErrorResponse
+	err = decodeResp(resp.Body, &errorResp)
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("send message responded with code %d: %s", resp.StatusCode, errorResp.Error)
+}
+
+// PutRecord creates or updates a record in the messaging accounts repo.
+func (d *DmService) PutRecord(ctx context.Context, collection, rkey string, record any) error {
+	bodyReq := PutRecordRequest{
+		Repo:       d.currentAuth().Did,
+		Collection: collection,
+		RKey:       rkey,
+		Record:     record,
+	}
+
+	bodyB, err := json.Marshal(bodyReq)
+	if err != nil {
+		return fmt.Errorf("marshal put record request body: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/xrpc/com.atproto.repo.putRecord", d.pdsURL)
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(bodyB))
+	if err != nil {
+		return fmt.Errorf("create new put record http request: %w", err)
+	}
+
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("Accept", "application/json")
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", d.currentAuth().AccessJwt))
+
+	resp, err := d.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("do http request to put record: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var errorResp ErrorResponse
+	err = decodeResp(resp.Body, &errorResp)
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("put record responded with code %d: %s", resp.StatusCode, errorResp.Error)
+}
+
 func (d *DmService) GetMessages(ctx context.Context, convoID string) (MessageResp, error) {
 	url := fmt.Sprintf("%s/xrpc/chat.bsky.convo.getMessages?convoId=%s", d.pdsURL, convoID)
 	request, err := http.NewRequest("GET", url, nil)
@@ -452,7 +670,7 @@ func (d *DmService) GetMessages(ctx context.Context, convoID string) (MessageRes
 	request.Header.Add("Content-Type", "application/json")
 	request.Header.Add("Accept", "application/json")
 	request.Header.Add("Atproto-Proxy", "did:web:api.bsky.chat#bsky_chat")
-	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", d.auth.AccessJwt))
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", d.currentAuth().AccessJwt))
 
 	resp, err := d.httpClient.Do(request)
 	if err != nil {
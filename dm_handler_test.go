@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+const (
+	testBotDID  = "did:plc:bot"
+	testConvoID = "convo1"
+)
+
+func newTestDmService(t *testing.T, dmStore DmStore) (*DmService, *fakeChat) {
+	t.Helper()
+
+	chat := newFakeChat(t, testBotDID)
+	service, err := NewDmService(dmStore, chat.Config())
+	if err != nil {
+		t.Fatalf("create dm service: %s", err)
+	}
+	return service, chat
+}
+
+func postMessage(id, text, postURI string) Message {
+	return Message{
+		ID:     id,
+		Sender: MessageSender{Did: testUserDID},
+		Text:   text,
+		Embed: MessageEmbed{
+			Record: MessageEmbedRecord{
+				URI:    postURI,
+				Author: MessageEmbedRecordAuthor{Did: testAuthorDID, Handle: "author.test"},
+				Value:  MessageEmbedPost{Text: "a post worth saving"},
+			},
+		},
+	}
+}
+
+func lastSentText(t *testing.T, chat *fakeChat) string {
+	t.Helper()
+
+	sent := chat.Sent()
+	if len(sent) == 0 {
+		t.Fatal("expected a reply to be sent")
+	}
+	return sent[len(sent)-1].Message.Text
+}
+
+func TestDmSaveCommandCreatesBookmark(t *testing.T) {
+	s := newTestStore(t)
+	service, chat := newTestDmService(t, s)
+
+	chat.AddMessage(testConvoID, postMessage("msg1", "", testBookmarkURI))
+
+	if err := service.HandleMessageTimer(context.Background()); err != nil {
+		t.Fatalf("handle message timer: %s", err)
+	}
+
+	bookmark, err := s.GetBookmarkByURIForUser(testBookmarkURI, testUserDID)
+	if err != nil {
+		t.Fatalf("get bookmark: %s", err)
+	}
+	if bookmark == nil {
+		t.Fatal("expected bookmark to be created")
+	}
+	if bookmark.Content != "a post worth saving" {
+		t.Errorf("unexpected bookmark content %q", bookmark.Content)
+	}
+
+	if got := lastSentText(t, chat); got != "Bookmarked!" {
+		t.Errorf("unexpected reply %q", got)
+	}
+	if unread := chat.Unread(testConvoID); unread != 0 {
+		t.Errorf("expected message to be marked read, %d unread", unread)
+	}
+}
+
+func TestDmHandlesMessagesOldestFirst(t *testing.T) {
+	s := newTestStore(t)
+	service, chat := newTestDmService(t, s)
+
+	chat.AddMessage(testConvoID, postMessage("msg1", "save", testBookmarkURI))
+	chat.AddMessage(testConvoID, postMessage("msg2", "delete", testBookmarkURI))
+
+	if err := service.HandleMessageTimer(context.Background()); err != nil {
+		t.Fatalf("handle message timer: %s", err)
+	}
+
+	bookmark, err := s.GetBookmarkByURIForUser(testBookmarkURI, testUserDID)
+	if err != nil {
+		t.Fatalf("get bookmark: %s", err)
+	}
+	if bookmark != nil {
+		t.Error("expected bookmark to be saved and then deleted")
+	}
+
+	reads := chat.Reads()
+	if len(reads) != 2 || reads[0].MessageID != "msg1" || reads[1].MessageID != "msg2" {
+		t.Errorf("expected messages to be marked read in order, got %+v", reads)
+	}
+}
+
+func TestDmBookmarksAreWrittenToUsersRepo(t *testing.T) {
+	s := newTestStore(t)
+	service, chat := newTestDmService(t, s)
+
+	pds := newFakePDS(t)
+	sessions := newFakeOauthSessions()
+	sessions.add(t, testUserDID, pds.URL())
+	service.bookmarkRecords = newBookmarkRecords(s, newUserRepoWriter(sessions))
+
+	chat.AddMessage(testConvoID, postMessage("msg1", "save", testBookmarkURI))
+	chat.AddMessage(testConvoID, postMessage("msg2", "tag go", testBookmarkURI))
+
+	if err := service.HandleMessageTimer(context.Background()); err != nil {
+		t.Fatalf("handle message timer: %s", err)
+	}
+
+	bookmark, err := s.GetBookmarkByURIForUser(testBookmarkURI, testUserDID)
+	if err != nil || bookmark == nil {
+		t.Fatalf("get bookmark: %v", err)
+	}
+
+	puts := pds.Puts()
+	if len(puts) != 2 {
+		t.Fatalf("expected the record to be written when saved and tagged, got %+v", puts)
+	}
+	for _, put := range puts {
+		if put.Repo != testUserDID || put.RKey != bookmark.RecordRKey {
+			t.Errorf("expected the bookmarks record to be written, got %+v", put)
+		}
+	}
+	recordB, _ := json.Marshal(puts[1].Record)
+	var record BookmarkRecord
+	if err := json.Unmarshal(recordB, &record); err != nil {
+		t.Fatalf("unmarshal record: %s", err)
+	}
+	if record.Subject != testBookmarkURI || !slices.Equal(record.Tags, []string{"go"}) {
+		t.Errorf("unexpected record %+v", record)
+	}
+}
+
+func TestDmDeleteCommandDeletesBookmarkRecord(t *testing.T) {
+	s := newTestStore(t)
+	service, chat := newTestDmService(t, s)
+
+	pds := newFakePDS(t)
+	sessions := newFakeOauthSessions()
+	sessions.add(t, testUserDID, pds.URL())
+	service.bookmarkRecords = newBookmarkRecords(s, newUserRepoWriter(sessions))
+
+	if err := s.CreateBookmark("", "", testBookmarkURI, "", testAuthorDID, "author.test", testUserDID, "a post", time.Now().UnixMilli()); err != nil {
+		t.Fatalf("create bookmark: %s", err)
+	}
+	if err := s.SetBookmarkRecordKey(testBookmarkURI, testUserDID, "3krecord"); err != nil {
+		t.Fatalf("set bookmark record key: %s", err)
+	}
+
+	chat.AddMessage(testConvoID, postMessage("msg1", "delete", testBookmarkURI))
+
+	if err := service.HandleMessageTimer(context.Background()); err != nil {
+		t.Fatalf("handle message timer: %s", err)
+	}
+
+	bookmark, err := s.GetBookmarkByURIForUser(testBookmarkURI, testUserDID)
+	if err != nil {
+		t.Fatalf("get bookmark: %s", err)
+	}
+	if bookmark != nil {
+		t.Error("expected bookmark to be deleted")
+	}
+
+	deletes := pds.Deletes()
+	if len(deletes) != 1 || deletes[0].Repo != testUserDID || deletes[0].RKey != "3krecord" {
+		t.Errorf("expected the bookmark record to be deleted, got %+v", deletes)
+	}
+	if got := lastSentText(t, chat); got != "Bookmark deleted" {
+		t.Errorf("unexpected reply %q", got)
+	}
+}
+
+func TestDmUnknownCommandReplies(t *testing.T) {
+	s := newTestStore(t)
+	service, chat := newTestDmService(t, s)
+
+	chat.AddMessage(testConvoID, postMessage("msg1", "dance", ""))
+
+	if err := service.HandleMessageTimer(context.Background()); err != nil {
+		t.Fatalf("handle message timer: %s", err)
+	}
+
+	if got := lastSentText(t, chat); !strings.Contains(got, `I don't know the command "dance"`) {
+		t.Errorf("unexpected reply %q", got)
+	}
+	if unread := chat.Unread(testConvoID); unread != 0 {
+		t.Errorf("expected message to be marked read, %d unread", unread)
+	}
+}
+
+func TestDmMutedConfirmationsAreNotSent(t *testing.T) {
+	s := newTestStore(t)
+	service, chat := newTestDmService(t, s)
+
+	if err := s.SetConfirmationsMuted(testUserDID, true); err != nil {
+		t.Fatalf("mute confirmations: %s", err)
+	}
+
+	chat.AddMessage(testConvoID, postMessage("msg1", "", testBookmarkURI))
+
+	if err := service.HandleMessageTimer(context.Background()); err != nil {
+		t.Fatalf("handle message timer: %s", err)
+	}
+
+	if sent := chat.Sent(); len(sent) != 0 {
+		t.Errorf("expected no replies, got %+v", sent)
+	}
+	if unread := chat.Unread(testConvoID); unread != 0 {
+		t.Errorf("expected message to be marked read, %d unread", unread)
+	}
+}
+
+// failingBookmarkStore fails to create bookmarks so that internal errors can be tested.
+type failingBookmarkStore struct {
+	*store.Store
+}
+
+func (f *failingBookmarkStore) CreateBookmark(postRKey, postURI, postATURI, rootURI, authorDID, authorHandle, userDID, content string, createdAt int64) error {
+	return errors.New("database is locked")
+}
+
+func TestDmFailedMessageIsRetried(t *testing.T) {
+	s := newTestStore(t)
+	service, chat := newTestDmService(t, &failingBookmarkStore{Store: s})
+
+	chat.AddMessage(testConvoID, postMessage("msg1", "", testBookmarkURI))
+
+	for attempt := 1; attempt < maxMessageAttempts; attempt++ {
+		if err := service.HandleMessageTimer(context.Background()); err != nil {
+			t.Fatalf("handle message timer: %s", err)
+		}
+		if unread := chat.Unread(testConvoID); unread != 1 {
+			t.Fatalf("expected message to stay unread after attempt %d", attempt)
+		}
+		if sent := chat.Sent(); len(sent) != 0 {
+			t.Fatalf("expected no reply after attempt %d, got %+v", attempt, sent)
+		}
+	}
+
+	if err := service.HandleMessageTimer(context.Background()); err != nil {
+		t.Fatalf("handle message timer: %s", err)
+	}
+	if unread := chat.Unread(testConvoID); unread != 0 {
+		t.Errorf("expected message to be marked read after giving up, %d unread", unread)
+	}
+	if got := lastSentText(t, chat); !strings.HasPrefix(got, "Sorry, something went wrong") {
+		t.Errorf("unexpected reply %q", got)
+	}
+}
+
+func TestDmRefreshKeepsSessionWhenRefreshFails(t *testing.T) {
+	s := newTestStore(t)
+	service, chat := newTestDmService(t, s)
+
+	chat.ExpireRefresh()
+	if err := service.RefreshAuthenication(context.Background()); err == nil {
+		t.Fatal("expected refreshing an expired session to fail")
+	}
+
+	if got := service.currentAuth(); got.AccessJwt != fakeAccessJwt || got.Did != testBotDID {
+		t.Errorf("expected the previous session to be kept, got %+v", got)
+	}
+}
+
+func TestParseDmCommand(t *testing.T) {
+	tt := map[string]struct {
+		text    string
+		postURI string
+		want    dmCommand
+		wantErr bool
+	}{
+		"post with no text is a save": {
+			postURI: testBookmarkURI,
+			want:    dmCommand{name: commandSave, postURI: testBookmarkURI},
+		},
+		"post with unknown text is a save": {
+			text:    "look at this",
+			postURI: testBookmarkURI,
+			want:    dmCommand{name: commandSave, postURI: testBookmarkURI},
+		},
+		"save to collection": {
+			text:    "Save to Reading",
+			postURI: testBookmarkURI,
+			want:    dmCommand{name: commandSave, args: "reading", postURI: testBookmarkURI},
+		},
+		"delete": {
+			text:    "Delete",
+			postURI: testBookmarkURI,
+			want:    dmCommand{name: commandDelete, postURI: testBookmarkURI},
+		},
+		"post mentioning delete is still a delete": {
+			text:    "please delete this one",
+			postURI: testBookmarkURI,
+			want:    dmCommand{name: commandDelete, postURI: testBookmarkURI},
+		},
+		"find": {
+			text: "find golang #tips",
+			want: dmCommand{name: commandFind, args: "golang #tips"},
+		},
+		"delete without a post": {
+			text:    "delete",
+			wantErr: true,
+		},
+		"tag without tags": {
+			text:    "tag",
+			postURI: testBookmarkURI,
+			wantErr: true,
+		},
+		"unknown command": {
+			text:    "dance",
+			wantErr: true,
+		},
+		"digest schedule": {
+			text: "digest Hourly",
+			want: dmCommand{name: commandDigest, args: store.DigestHourly},
+		},
+		"digest with unknown schedule": {
+			text:    "digest weekly",
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseDmCommand(tc.text, tc.postURI)
+			if tc.wantErr {
+				var userErr *dmUserError
+				if !errors.As(err, &userErr) {
+					t.Fatalf("expected a user error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != tc.want {
+				t.Errorf("expected %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDmSaveToCollectionPublishesFeed(t *testing.T) {
+	s := newTestStore(t)
+	service, chat := newTestDmService(t, s)
+
+	chat.AddMessage(testConvoID, postMessage("msg1", "save to reading", testBookmarkURI))
+
+	if err := service.HandleMessageTimer(context.Background()); err != nil {
+		t.Fatalf("handle message timer: %s", err)
+	}
+
+	collection, err := s.GetCollectionByName(testUserDID, "reading")
+	if err != nil {
+		t.Fatalf("get collection: %s", err)
+	}
+	if collection == nil {
+		t.Fatal("expected collection to be created")
+	}
+
+	bookmark, err := s.GetBookmarkByURIForUser(testBookmarkURI, testUserDID)
+	if err != nil {
+		t.Fatalf("get bookmark: %s", err)
+	}
+	if bookmark == nil || bookmark.CollectionID != collection.ID {
+		t.Fatalf("expected bookmark to be saved into the collection, got %+v", bookmark)
+	}
+
+	records := chat.Records()
+	if len(records) != 1 {
+		t.Fatalf("expected 1 feed record to be published, got %d", len(records))
+	}
+	if records[0].RKey != store.CollectionFeedRKey(collection.ID) {
+		t.Errorf("unexpected feed record rkey %q", records[0].RKey)
+	}
+}
+
+func TestDmFollowCommandFollowsThreadRoot(t *testing.T) {
+	s := newTestStore(t)
+	service, chat := newTestDmService(t, s)
+
+	rootURI := "at://did:plc:author/app.bsky.feed.post/root"
+	msg := postMessage("msg1", "follow", testBookmarkURI)
+	msg.Embed.Record.Value.Reply = &MessageEmbedPostReply{Root: MessageEmbedPostRef{URI: rootURI}}
+	chat.AddMessage(testConvoID, msg)
+
+	if err := service.HandleMessageTimer(context.Background()); err != nil {
+		t.Fatalf("handle message timer: %s", err)
+	}
+
+	bookmark, err := s.GetBookmarkByURIForUser(testBookmarkURI, testUserDID)
+	if err != nil {
+		t.Fatalf("get bookmark: %s", err)
+	}
+	if bookmark == nil || !bookmark.FollowThread || bookmark.RootURI != rootURI {
+		t.Fatalf("expected bookmark to follow the thread rooted at %s, got %+v", rootURI, bookmark)
+	}
+
+	if !s.IsThreadFollowed(rootURI) {
+		t.Error("expected thread to be followed")
+	}
+}
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/gorilla/websocket"
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+func newTestStore(t *testing.T) *store.Store {
+	t.Helper()
+
+	s, err := store.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("create store: %s", err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newTestFeeds(s *store.Store) *FeedRegistry {
+	feeds := NewFeedRegistry("did:web:feeds.test")
+	NewFeedGenerator(s).RegisterFeeds(feeds)
+	return feeds
+}
+
+// getTestFeed gets the first page of one of the feeds for the user.
+func getTestFeed(t *testing.T, s *store.Store, rkey, userDID string) FeedReponse {
+	t.Helper()
+
+	feed, err := newTestFeeds(s).Lookup("at://did:web:feeds.test/app.bsky.feed.generator/" + rkey)
+	if err != nil {
+		t.Fatalf("lookup feed: %s", err)
+	}
+	resp, err := feed.GetFeed(context.Background(), userDID, "", 10)
+	if err != nil {
+		t.Fatalf("get feed: %s", err)
+	}
+	return resp
+}
+
+// waitFor polls until the condition is true or fails the test after a few seconds.
+func waitFor(t *testing.T, msg string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("timed out waiting for %s", msg)
+}
+
+// fakeJetstream is a Jetstream websocket server that sends every event at or after the requested cursor to each client
+// that connects and then keeps the connection open.
+type fakeJetstream struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	events  []models.Event
+	cursors []string
+	conns   []*websocket.Conn
+}
+
+func newFakeJetstream(t *testing.T, events ...models.Event) *fakeJetstream {
+	t.Helper()
+
+	f := &fakeJetstream{
+		events: events,
+	}
+
+	upgrader := websocket.Upgrader{}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		cursorStr := r.URL.Query().Get("cursor")
+		cursor, _ := strconv.ParseInt(cursorStr, 10, 64)
+
+		f.mu.Lock()
+		f.cursors = append(f.cursors, cursorStr)
+		f.conns = append(f.conns, conn)
+		events := f.events
+		f.mu.Unlock()
+
+		for _, event := range events {
+			if event.TimeUS < cursor {
+				continue
+			}
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		}
+
+		// keep the connection open until either side closes it
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+func (f *fakeJetstream) URL() string {
+	return "ws" + strings.TrimPrefix(f.server.URL, "http") + "/subscribe"
+}
+
+// CloseConnections drops all connected clients, as if the websocket had died.
+func (f *fakeJetstream) CloseConnections() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, conn := range f.conns {
+		_ = conn.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeJetstream) Close() {
+	f.CloseConnections()
+	f.server.Close()
+}
+
+func (f *fakeJetstream) Cursors() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.cursors...)
+}
+
+func replyEvent(did, rkey, parentURI, rootURI string, timeUS int64) models.Event {
+	record := map[string]any{
+		"$type":     "app.bsky.feed.post",
+		"text":      "a reply",
+		"createdAt": time.UnixMicro(timeUS).UTC().Format(time.RFC3339),
+		"reply": map[string]any{
+			"parent": map[string]any{"uri": parentURI, "cid": "bafyparent"},
+			"root":   map[string]any{"uri": rootURI, "cid": "bafyroot"},
+		},
+	}
+	recordB, _ := json.Marshal(record)
+
+	return models.Event{
+		Did:    did,
+		TimeUS: timeUS,
+		Kind:   models.EventKindCommit,
+		Commit: &models.Commit{
+			Rev:        "rev",
+			Operation:  models.CommitOperationCreate,
+			Collection: "app.bsky.feed.post",
+			RKey:       rkey,
+			Record:     recordB,
+			CID:        "bafyreply",
+		},
+	}
+}
+
+func deleteEvent(did, rkey string, timeUS int64) models.Event {
+	return models.Event{
+		Did:    did,
+		TimeUS: timeUS,
+		Kind:   models.EventKindCommit,
+		Commit: &models.Commit{
+			Rev:        "rev",
+			Operation:  models.CommitOperationDelete,
+			Collection: "app.bsky.feed.post",
+			RKey:       rkey,
+		},
+	}
+}
+
+func quoteEvent(did, rkey, quotedURI string, withMedia bool, timeUS int64) models.Event {
+	embed := map[string]any{
+		"$type":  "app.bsky.embed.record",
+		"record": map[string]any{"uri": quotedURI, "cid": "bafyquoted"},
+	}
+	if withMedia {
+		embed = map[string]any{
+			"$type":  "app.bsky.embed.recordWithMedia",
+			"record": embed,
+			"media": map[string]any{
+				"$type":    "app.bsky.embed.external",
+				"external": map[string]any{"uri": "https://example.com", "title": "example", "description": ""},
+			},
+		}
+	}
+
+	record := map[string]any{
+		"$type":     "app.bsky.feed.post",
+		"text":      "a quote",
+		"createdAt": time.UnixMicro(timeUS).UTC().Format(time.RFC3339),
+		"embed":     embed,
+	}
+	recordB, _ := json.Marshal(record)
+
+	return models.Event{
+		Did:    did,
+		TimeUS: timeUS,
+		Kind:   models.EventKindCommit,
+		Commit: &models.Commit{
+			Rev:        "rev",
+			Operation:  models.CommitOperationCreate,
+			Collection: "app.bsky.feed.post",
+			RKey:       rkey,
+			Record:     recordB,
+			CID:        "bafyquote",
+		},
+	}
+}
+
+const (
+	fakeAccessJwt  = "fake-access-jwt"
+	fakeRefreshJwt = "fake-refresh-jwt"
+)
+
+// fakeChat is a PDS that handles the session, chat.bsky.convo and repo endpoints used by the DmService.
+type fakeChat struct {
+	server *httptest.Server
+	botDID string
+
+	mu       sync.Mutex
+	convos   map[string]*fakeConvo
+	sent     []SendMessageRequest
+	reads    []UpdateMessageReadRequest
+	records  []PutRecordRequest
+	sessions int
+	// refreshExpired makes refreshing the session fail as if the refresh token has expired
+	refreshExpired bool
+}
+
+type fakeConvo struct {
+	memberDID string
+	// messages are stored newest first, the same as getMessages returns them
+	messages []Message
+	unread   int
+}
+
+func newFakeChat(t *testing.T, botDID string) *fakeChat {
+	t.Helper()
+
+	f := &fakeChat{
+		botDID: botDID,
+		convos: make(map[string]*fakeConvo),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /xrpc/com.atproto.server.createSession", f.handleSession)
+	mux.HandleFunc("POST /xrpc/com.atproto.server.refreshSession", f.handleRefreshSession)
+	mux.HandleFunc("GET /xrpc/chat.bsky.convo.listConvos", f.authed(f.handleListConvos))
+	mux.HandleFunc("GET /xrpc/chat.bsky.convo.getMessages", f.authed(f.handleGetMessages))
+	mux.HandleFunc("POST /xrpc/chat.bsky.convo.updateRead", f.authed(f.handleUpdateRead))
+	mux.HandleFunc("POST /xrpc/chat.bsky.convo.sendMessage", f.authed(f.handleSendMessage))
+	mux.HandleFunc("POST /xrpc/com.atproto.repo.putRecord", f.authed(f.handlePutRecord))
+
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+func (f *fakeChat) Config() DmServiceConfig {
+	return DmServiceConfig{
+		AccessHandle:      "bot.test",
+		AccessAppPassword: "password",
+		PDSURL:            f.server.URL,
+		AuthURL:           f.server.URL + "/xrpc",
+		TimerDuration:     time.Hour,
+		FeedHost:          "feeds.test",
+	}
+}
+
+// AddMessage adds an unread message from the user to the convo, creating the convo if needed.
+func (f *fakeChat) AddMessage(convoID string, msg Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	convo, ok := f.convos[convoID]
+	if !ok {
+		convo = &fakeConvo{memberDID: msg.Sender.Did}
+		f.convos[convoID] = convo
+	}
+	convo.messages = append([]Message{msg}, convo.messages...)
+	convo.unread++
+}
+
+func (f *fakeChat) Sent() []SendMessageRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]SendMessageRequest{}, f.sent...)
+}
+
+func (f *fakeChat) Reads() []UpdateMessageReadRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]UpdateMessageReadRequest{}, f.reads...)
+}
+
+func (f *fakeChat) Records() []PutRecordRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]PutRecordRequest{}, f.records...)
+}
+
+func (f *fakeChat) Unread(convoID string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	convo, ok := f.convos[convoID]
+	if !ok {
+		return 0
+	}
+	return convo.unread
+}
+
+func (f *fakeChat) authed(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+fakeAccessJwt {
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "AuthRequired"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (f *fakeChat) handleSession(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.sessions++
+	f.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, auth{
+		AccessJwt:  fakeAccessJwt,
+		RefershJWT: fakeRefreshJwt,
+		Did:        f.botDID,
+	})
+}
+
+func (f *fakeChat) handleRefreshSession(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	expired := f.refreshExpired
+	f.mu.Unlock()
+
+	if expired {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "ExpiredToken"})
+		return
+	}
+	f.handleSession(w, r)
+}
+
+// ExpireRefresh makes refreshing the session fail from now on.
+func (f *fakeChat) ExpireRefresh() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refreshExpired = true
+}
+
+func (f *fakeChat) handleListConvos(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	resp := ListConvosResponse{}
+	for id, convo := range f.convos {
+		if r.URL.Query().Get("readState") == "unread" && convo.unread == 0 {
+			continue
+		}
+		resp.Convos = append(resp.Convos, Convo{
+			ID:          id,
+			Members:     []ConvoMember{{Did: convo.memberDID}, {Did: f.botDID}},
+			UnreadCount: convo.unread,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (f *fakeChat) handleGetMessages(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	convo, ok := f.convos[r.URL.Query().Get("convoId")]
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "InvalidConvo"})
+		return
+	}
+	writeJSON(w, http.StatusOK, MessageResp{Messages: convo.messages})
+}
+
+func (f *fakeChat) handleUpdateRead(w http.ResponseWriter, r *http.Request) {
+	var req UpdateMessageReadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "InvalidRequest"})
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	convo, ok := f.convos[req.ConvoID]
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "InvalidConvo"})
+		return
+	}
+	f.reads = append(f.reads, req)
+
+	// everything up to and including the message is now read, so only newer messages from the user are unread
+	unread := 0
+	for _, msg := range convo.messages {
+		if msg.ID == req.MessageID {
+			break
+		}
+		if msg.Sender.Did != f.botDID {
+			unread++
+		}
+	}
+	convo.unread = unread
+
+	writeJSON(w, http.StatusOK, map[string]any{})
+}
+
+func (f *fakeChat) handleSendMessage(w http.ResponseWriter, r *http.Request) {
+	var req SendMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "InvalidRequest"})
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	convo, ok := f.convos[req.ConvoID]
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "InvalidConvo"})
+		return
+	}
+	f.sent = append(f.sent, req)
+
+	msg := Message{
+		ID:     fmt.Sprintf("bot-%d", len(f.sent)),
+		Sender: MessageSender{Did: f.botDID},
+		Text:   req.Message.Text,
+	}
+	convo.messages = append([]Message{msg}, convo.messages...)
+
+	writeJSON(w, http.StatusOK, msg)
+}
+
+func (f *fakeChat) handlePutRecord(w http.ResponseWriter, r *http.Request) {
+	var req PutRecordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "InvalidRequest"})
+		return
+	}
+
+	f.mu.Lock()
+	f.records = append(f.records, req)
+	f.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"uri": fmt.Sprintf("at://%s/%s/%s", req.Repo, req.Collection, req.RKey),
+		"cid": "bafyrecord",
+	})
+}
+
+// fakeAppView handles the getPosts, getProfiles and resolveHandle calls that are made to the public AppView.
+type fakeAppView struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	handles map[string]string
+	posts   map[string]fakePost
+	// requests counts the requests made to each endpoint, keyed by path
+	requests map[string]int
+}
+
+type fakePost struct {
+	AuthorDID    string
+	AuthorHandle string
+	Text         string
+}
+
+func newFakeAppView(t *testing.T) *fakeAppView {
+	t.Helper()
+
+	f := &fakeAppView{
+		handles:  make(map[string]string),
+		posts:    make(map[string]fakePost),
+		requests: make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /xrpc/com.atproto.identity.resolveHandle", f.handleResolveHandle)
+	mux.HandleFunc("GET /xrpc/app.bsky.feed.getPosts", f.handleGetPosts)
+	mux.HandleFunc("GET /xrpc/app.bsky.actor.getProfiles", f.handleGetProfiles)
+
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.requests[r.URL.Path]++
+		f.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+func (f *fakeAppView) URL() string {
+	return f.server.URL
+}
+
+// AddPost adds a post that can be fetched and registers the authors handle so that it can be resolved. It returns the
+// posts AT URI.
+func (f *fakeAppView) AddPost(authorDID, authorHandle, rkey, text string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	uri := fmt.Sprintf("at://%s/app.bsky.feed.post/%s", authorDID, rkey)
+	f.handles[authorHandle] = authorDID
+	f.posts[uri] = fakePost{
+		AuthorDID:    authorDID,
+		AuthorHandle: authorHandle,
+		Text:         text,
+	}
+	return uri
+}
+
+// Requests returns how many requests have been made to the given path.
+func (f *fakeAppView) Requests(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[path]
+}
+
+func (f *fakeAppView) handleGetProfiles(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	profiles := make([]map[string]any, 0)
+	for _, actor := range r.URL.Query()["actors"] {
+		did, ok := f.handles[actor]
+		if !ok {
+			continue
+		}
+		profiles = append(profiles, map[string]any{
+			"did":    did,
+			"handle": actor,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"profiles": profiles})
+}
+
+func (f *fakeAppView) handleResolveHandle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	did, ok := f.handles[r.URL.Query().Get("handle")]
+	f.mu.Unlock()
+
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "InvalidRequest", "message": "Unable to resolve handle"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"did": did})
+}
+
+func (f *fakeAppView) handleGetPosts(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	posts := make([]map[string]any, 0)
+	for _, uri := range r.URL.Query()["uris"] {
+		post, ok := f.posts[uri]
+		if !ok {
+			continue
+		}
+		posts = append(posts, map[string]any{
+			"uri": uri,
+			"cid": "bafypost",
+			"author": map[string]any{
+				"did":    post.AuthorDID,
+				"handle": post.AuthorHandle,
+			},
+			"record": map[string]any{
+				"$type":     "app.bsky.feed.post",
+				"text":      post.Text,
+				"createdAt": "2025-01-01T00:00:00Z",
+			},
+			"indexedAt": "2025-01-01T00:00:00Z",
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"posts": posts})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// fakePDS handles the repo writes made with a users OAuth session. Like a real PDS it makes the first request retry
+// with a DPoP nonce.
+type fakePDS struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	puts    []PutRecordRequest
+	deletes []DeleteRecordRequest
+	// auths holds the Authorization header of every request
+	auths []string
+}
+
+const fakePDSNonce = "pds-nonce"
+
+func newFakePDS(t *testing.T) *fakePDS {
+	t.Helper()
+
+	f := &fakePDS{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /xrpc/com.atproto.repo.putRecord", f.dpop(func(w http.ResponseWriter, r *http.Request) {
+		var req PutRecordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "InvalidRequest"})
+			return
+		}
+		f.mu.Lock()
+		f.puts = append(f.puts, req)
+		f.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]any{"uri": fmt.Sprintf("at://%s/%s/%s", req.Repo, req.Collection, req.RKey), "cid": "bafyrecord"})
+	}))
+	mux.HandleFunc("POST /xrpc/com.atproto.repo.deleteRecord", f.dpop(func(w http.ResponseWriter, r *http.Request) {
+		var req DeleteRecordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "InvalidRequest"})
+			return
+		}
+		f.mu.Lock()
+		f.deletes = append(f.deletes, req)
+		f.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]any{})
+	}))
+
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+func (f *fakePDS) URL() string {
+	return f.server.URL
+}
+
+func (f *fakePDS) dpop(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.auths = append(f.auths, r.Header.Get("Authorization"))
+		f.mu.Unlock()
+
+		if r.Header.Get("DPoP") == "" {
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "InvalidToken"})
+			return
+		}
+		if !dpopProofHasNonce(r.Header.Get("DPoP"), fakePDSNonce) {
+			w.Header().Set("DPoP-Nonce", fakePDSNonce)
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "use_dpop_nonce"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (f *fakePDS) Puts() []PutRecordRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]PutRecordRequest{}, f.puts...)
+}
+
+func (f *fakePDS) Deletes() []DeleteRecordRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]DeleteRecordRequest{}, f.deletes...)
+}
+
+func (f *fakePDS) Auths() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.auths...)
+}
+
+// dpopProofHasNonce checks the nonce claim of a DPoP proof without verifying it.
+func dpopProofHasNonce(proof, nonce string) bool {
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	var claims struct {
+		Nonce string `json:"nonce"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return false
+	}
+	return claims.Nonce == nonce
+}
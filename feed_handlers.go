@@ -2,10 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+
+	"github.com/willdot/bskyfeedgen/store"
 )
 
 type FeedReponse struct {
@@ -58,23 +63,31 @@ func (s *Server) HandleGetFeedSkeleton(w http.ResponseWriter, r *http.Request) {
 	}
 
 	cursor := params.Get("cursor")
-	usersDID, err := getRequestUserDID(r)
+
+	requestedFeed, err := s.feeds.Lookup(feed)
 	if err != nil {
-		slog.Error("validate auth", "error", err)
-		http.Error(w, "validate auth", http.StatusUnauthorized)
-		return
-	}
-	if usersDID == "" {
-		slog.Error("missing users DID from request")
-		http.Error(w, "validate auth", http.StatusUnauthorized)
+		slog.Warn("unknown feed requested", "error", err, "feed", feed)
+		http.Error(w, fmt.Sprintf("unknown feed: %s", err), http.StatusBadRequest)
 		return
 	}
 
-	resp, err := s.feeder.GetFeed(r.Context(), usersDID, feed, cursor, limit)
-	if err != nil {
-		slog.Error("get feed", "error", err, "feed", feed)
-		http.Error(w, "error getting feed", http.StatusInternalServerError)
+	var resp FeedReponse
+	usersDID, err := s.feedAuth.RequestUserDID(r, feedSkeletonLexiconMethod)
+	switch {
+	case errors.Is(err, errAuthMissing):
+		// logged out viewers and some clients previews don't send a token
+		resp = s.loggedOutFeed(cursor)
+	case err != nil:
+		slog.Warn("validate auth", "error", err)
+		http.Error(w, fmt.Sprintf("validate auth: %s", err), http.StatusUnauthorized)
 		return
+	default:
+		resp, err = requestedFeed.GetFeed(r.Context(), usersDID, cursor, limit)
+		if err != nil {
+			slog.Error("get feed", "error", err, "feed", feed)
+			http.Error(w, "error getting feed", http.StatusInternalServerError)
+			return
+		}
 	}
 
 	b, err := json.Marshal(resp)
@@ -89,6 +102,37 @@ func (s *Server) HandleGetFeedSkeleton(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(b)
 }
 
+// loggedOutFeedContext is the feed context of the post pinned to the feed served to viewers that aren't logged in.
+const loggedOutFeedContext = "logged-out"
+
+// loggedOutFeed is served to viewers that aren't logged in. Every feed is personal so there's nothing to show them, but
+// a post explaining the feeds can be pinned with FEED_LOGGED_OUT_POST, otherwise the feed is empty.
+func (s *Server) loggedOutFeed(cursor string) FeedReponse {
+	resp := FeedReponse{
+		Feed: make([]FeedItem, 0),
+	}
+	// the post is only on the first page so that it isn't repeated when scrolling
+	if s.loggedOutPost != "" && cursor == "" {
+		resp.Feed = append(resp.Feed, FeedItem{
+			Post:        s.loggedOutPost,
+			FeedContext: loggedOutFeedContext,
+		})
+	}
+	return resp
+}
+
+func loggedOutPostFromEnv() string {
+	post := os.Getenv("FEED_LOGGED_OUT_POST")
+	if post == "" {
+		return ""
+	}
+	if !strings.HasPrefix(post, "at://") || !strings.Contains(post, "/app.bsky.feed.post/") {
+		slog.Error("FEED_LOGGED_OUT_POST is not a post AT URI - logged out viewers will get an empty feed", "value", post)
+		return ""
+	}
+	return post
+}
+
 type DescribeFeedResponse struct {
 	DID   string          `json:"did"`
 	Feeds []FeedRespsonse `json:"feeds"`
@@ -100,16 +144,29 @@ type FeedRespsonse struct {
 
 func (s *Server) HandleDescribeFeedGenerator(w http.ResponseWriter, r *http.Request) {
 	slog.Info("got request for describe feed", "host", r.RemoteAddr)
+
+	collections, err := s.collectionStore.GetAllCollections()
+	if err != nil {
+		slog.Error("get collections for describe feed", "error", err)
+		http.Error(w, "failed to get feeds", http.StatusInternalServerError)
+		return
+	}
+
 	resp := DescribeFeedResponse{
-		DID: fmt.Sprintf("did:web:%s", s.feedHost),
-		Feeds: []FeedRespsonse{
-			{
-				URI: fmt.Sprintf("at://%s/app.bsky.feed.generator/bookmark-replies", s.feedDidBase),
-			},
-			{
-				URI: fmt.Sprintf("at://%s/app.bsky.feed.generator/bookmarks", s.feedDidBase),
-			},
-		},
+		DID:   fmt.Sprintf("did:web:%s", s.feedHost),
+		Feeds: make([]FeedRespsonse, 0),
+	}
+
+	for _, uri := range s.feeds.URIs() {
+		resp.Feeds = append(resp.Feeds, FeedRespsonse{
+			URI: uri,
+		})
+	}
+
+	for _, collection := range collections {
+		resp.Feeds = append(resp.Feeds, FeedRespsonse{
+			URI: s.feeds.feedURI(store.CollectionFeedRKey(collection.ID)),
+		})
 	}
 
 	b, err := json.Marshal(resp)
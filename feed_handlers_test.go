@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+)
+
+const testLoggedOutPost = "at://did:plc:feeds/app.bsky.feed.post/explainer"
+
+func TestGetFeedSkeletonLoggedOut(t *testing.T) {
+	srv, s := newTestServer(t, newFakeAppView(t))
+
+	key := newTestPrivateKey(t)
+	directory := &countingDirectory{MockDirectory: identity.NewMockDirectory()}
+	directory.setKey(t, testUserDID, key)
+	srv.feedAuth = newFeedAuth(testServiceDID, directory)
+
+	err := s.CreateBookmark("bookmarked", "https://bsky.app/profile/author.test/post/bookmarked", "at://did:plc:author/app.bsky.feed.post/bookmarked", "", "did:plc:author", "author.test", testUserDID, "a post", 1)
+	if err != nil {
+		t.Fatalf("create bookmark: %s", err)
+	}
+
+	getFeed := func(token, cursor string) (int, FeedReponse) {
+		params := url.Values{"feed": {"at://did:web:feeds.test/app.bsky.feed.generator/bookmarks"}}
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+		r := feedRequest(token)
+		r.URL.RawQuery = params.Encode()
+
+		rec := httptest.NewRecorder()
+		srv.HandleGetFeedSkeleton(rec, r)
+
+		var resp FeedReponse
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode feed: %s", err)
+			}
+		}
+		return rec.Code, resp
+	}
+
+	code, resp := getFeed("", "")
+	if code != http.StatusOK || len(resp.Feed) != 0 {
+		t.Fatalf("expected empty feed when no post is configured, got %d %+v", code, resp)
+	}
+
+	srv.loggedOutPost = testLoggedOutPost
+	code, resp = getFeed("", "")
+	if code != http.StatusOK || len(resp.Feed) != 1 {
+		t.Fatalf("expected pinned post, got %d %+v", code, resp)
+	}
+	if resp.Feed[0].Post != testLoggedOutPost || resp.Feed[0].FeedContext != loggedOutFeedContext {
+		t.Errorf("unexpected pinned post %+v", resp.Feed[0])
+	}
+
+	code, resp = getFeed("", "1234")
+	if code != http.StatusOK || len(resp.Feed) != 0 {
+		t.Fatalf("expected pinned post to only be on the first page, got %d %+v", code, resp)
+	}
+
+	// a token that fails validation is still rejected rather than treated as logged out
+	if code, _ := getFeed("not-a-jwt", ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected invalid token to be rejected, got %d", code)
+	}
+
+	code, resp = getFeed(signServiceAuth(t, key, validClaims()), "")
+	if code != http.StatusOK || len(resp.Feed) != 1 || resp.Feed[0].Post != "at://did:plc:author/app.bsky.feed.post/bookmarked" {
+		t.Fatalf("expected users bookmarks feed, got %d %+v", code, resp)
+	}
+}
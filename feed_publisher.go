@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+const (
+	feedGeneratorCollection = "app.bsky.feed.generator"
+	// displayName for a feed generator has a max length of 24 graphemes
+	maxFeedDisplayNameLength = 24
+)
+
+type RecordWriter interface {
+	PutRecord(ctx context.Context, collection, rkey string, record any) error
+}
+
+// FeedPublisher writes app.bsky.feed.generator records so that feeds can be subscribed to from Bluesky.
+type FeedPublisher struct {
+	recordWriter RecordWriter
+	feedHost     string
+}
+
+func NewFeedPublisher(recordWriter RecordWriter, feedHost string) *FeedPublisher {
+	return &FeedPublisher{
+		recordWriter: recordWriter,
+		feedHost:     feedHost,
+	}
+}
+
+func (p *FeedPublisher) PublishCollectionFeed(ctx context.Context, collection store.Collection) error {
+	displayName := []rune(fmt.Sprintf("Bookmarks: %s", collection.Name))
+	if len(displayName) > maxFeedDisplayNameLength {
+		displayName = displayName[:maxFeedDisplayNameLength]
+	}
+	description := fmt.Sprintf("Your bookmarks saved to the %q collection", collection.Name)
+
+	record := bsky.FeedGenerator{
+		LexiconTypeID: feedGeneratorCollection,
+		Did:           fmt.Sprintf("did:web:%s", p.feedHost),
+		DisplayName:   string(displayName),
+		Description:   &description,
+		CreatedAt:     time.Now().UTC().Format(time.RFC3339),
+	}
+
+	err := p.recordWriter.PutRecord(ctx, feedGeneratorCollection, store.CollectionFeedRKey(collection.ID), record)
+	if err != nil {
+		return fmt.Errorf("put feed generator record: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+var (
+	errInvalidFeedURI       = errors.New("invalid feed URI")
+	errUnknownFeedPublisher = errors.New("feed is not published by this feed generator")
+	errUnknownFeed          = errors.New("unknown feed")
+)
+
+// Feed is a feed that can be served for a user.
+type Feed interface {
+	GetFeed(ctx context.Context, userDID, cursor string, limit int) (FeedReponse, error)
+}
+
+// FeedFunc lets a function be used as a Feed.
+type FeedFunc func(ctx context.Context, userDID, cursor string, limit int) (FeedReponse, error)
+
+func (f FeedFunc) GetFeed(ctx context.Context, userDID, cursor string, limit int) (FeedReponse, error) {
+	return f(ctx, userDID, cursor, limit)
+}
+
+// FeedRegistry maps the record keys of the feeds published by FEED_DID_BASE to the feeds that serve them. Collection
+// feeds are created by users so they're looked up by their ID rather than being registered.
+type FeedRegistry struct {
+	feedDidBase    string
+	feeds          map[string]Feed
+	rkeys          []string
+	collectionFeed func(collectionID int) Feed
+}
+
+func NewFeedRegistry(feedDidBase string) *FeedRegistry {
+	return &FeedRegistry{
+		feedDidBase: feedDidBase,
+		feeds:       make(map[string]Feed),
+	}
+}
+
+// Register adds a feed with the given record key. Like http.ServeMux, it panics if the record key is already taken
+// as that's a programming error.
+func (r *FeedRegistry) Register(rkey string, feed Feed) {
+	if _, ok := r.feeds[rkey]; ok {
+		panic(fmt.Sprintf("feed %q is already registered", rkey))
+	}
+	if _, ok := collectionIDFromFeedRKey(rkey); ok {
+		panic(fmt.Sprintf("feed %q clashes with the collection feeds", rkey))
+	}
+	r.feeds[rkey] = feed
+	r.rkeys = append(r.rkeys, rkey)
+}
+
+// RegisterCollectionFeeds sets how the feeds for users collections are created.
+func (r *FeedRegistry) RegisterCollectionFeeds(collectionFeed func(collectionID int) Feed) {
+	r.collectionFeed = collectionFeed
+}
+
+// Lookup returns the feed for a feed generator AT URI, checking that it's published by FEED_DID_BASE.
+func (r *FeedRegistry) Lookup(feedURI string) (Feed, error) {
+	rkey, err := r.parseFeedURI(feedURI)
+	if err != nil {
+		return nil, err
+	}
+
+	if feed, ok := r.feeds[rkey]; ok {
+		return feed, nil
+	}
+	if collectionID, ok := collectionIDFromFeedRKey(rkey); ok && r.collectionFeed != nil {
+		return r.collectionFeed(collectionID), nil
+	}
+	return nil, fmt.Errorf("%w: %s", errUnknownFeed, rkey)
+}
+
+func (r *FeedRegistry) parseFeedURI(feedURI string) (string, error) {
+	uri, err := syntax.ParseATURI(feedURI)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errInvalidFeedURI, err)
+	}
+	if uri.Collection().String() != feedGeneratorCollection || uri.RecordKey() == "" {
+		return "", fmt.Errorf("%w: not a feed generator record", errInvalidFeedURI)
+	}
+	if uri.Authority().String() != r.feedDidBase {
+		return "", fmt.Errorf("%w: %s", errUnknownFeedPublisher, uri.Authority())
+	}
+	return uri.RecordKey().String(), nil
+}
+
+// URIs returns the AT URIs of the registered feeds in the order they were registered.
+func (r *FeedRegistry) URIs() []string {
+	uris := make([]string, 0, len(r.rkeys))
+	for _, rkey := range r.rkeys {
+		uris = append(uris, r.feedURI(rkey))
+	}
+	return uris
+}
+
+func (r *FeedRegistry) feedURI(rkey string) string {
+	return fmt.Sprintf("at://%s/%s/%s", r.feedDidBase, feedGeneratorCollection, rkey)
+}
+
+// MetricName turns a requested feed URI into a label with a bounded number of values. Collection feeds are grouped
+// together and anything that isn't a feed served here is reported as unknown.
+func (r *FeedRegistry) MetricName(feedURI string) string {
+	rkey, err := r.parseFeedURI(feedURI)
+	if err != nil {
+		return "unknown"
+	}
+
+	if _, ok := r.feeds[rkey]; ok {
+		return rkey
+	}
+	if _, ok := collectionIDFromFeedRKey(rkey); ok && r.collectionFeed != nil {
+		return "collection"
+	}
+	return "unknown"
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+func namedFeed(name string) Feed {
+	return FeedFunc(func(ctx context.Context, userDID, cursor string, limit int) (FeedReponse, error) {
+		return FeedReponse{Feed: []FeedItem{{Post: name}}}, nil
+	})
+}
+
+func TestFeedRegistryLookup(t *testing.T) {
+	feeds := NewFeedRegistry("did:plc:feeds")
+	feeds.Register("bookmarks", namedFeed("bookmarks"))
+	feeds.Register("bookmark-replies", namedFeed("bookmark-replies"))
+	feeds.RegisterCollectionFeeds(func(collectionID int) Feed {
+		return namedFeed("collection")
+	})
+
+	tests := map[string]struct {
+		uri  string
+		feed string
+		err  error
+	}{
+		"exact rkey":             {uri: "at://did:plc:feeds/app.bsky.feed.generator/bookmarks", feed: "bookmarks"},
+		"rkey containing other":  {uri: "at://did:plc:feeds/app.bsky.feed.generator/bookmark-replies", feed: "bookmark-replies"},
+		"collection":             {uri: "at://did:plc:feeds/app.bsky.feed.generator/" + store.CollectionFeedRKey(3), feed: "collection"},
+		"rkey with extra suffix": {uri: "at://did:plc:feeds/app.bsky.feed.generator/bookmarks-old", err: errUnknownFeed},
+		"other publisher":        {uri: "at://did:plc:someone/app.bsky.feed.generator/bookmarks", err: errUnknownFeedPublisher},
+		"not a feed generator":   {uri: "at://did:plc:feeds/app.bsky.feed.post/bookmarks", err: errInvalidFeedURI},
+		"not an AT URI":          {uri: "bookmarks", err: errInvalidFeedURI},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			feed, err := feeds.Lookup(tt.uri)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lookup feed: %s", err)
+			}
+
+			resp, err := feed.GetFeed(context.Background(), testUserDID, "", 10)
+			if err != nil {
+				t.Fatalf("get feed: %s", err)
+			}
+			if resp.Feed[0].Post != tt.feed {
+				t.Errorf("expected feed %q, got %q", tt.feed, resp.Feed[0].Post)
+			}
+		})
+	}
+}
+
+func TestDescribeFeedGeneratorListsRegisteredFeeds(t *testing.T) {
+	srv, s := newTestServer(t, newFakeAppView(t))
+
+	collection, err := s.CreateCollection(testUserDID, "reading", 1)
+	if err != nil {
+		t.Fatalf("create collection: %s", err)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.HandleDescribeFeedGenerator(rec, httptest.NewRequest(http.MethodGet, "/xrpc/app.bsky.feed.describeFeedGenerator", nil))
+
+	var resp DescribeFeedResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %s", err)
+	}
+
+	got := make([]string, 0, len(resp.Feeds))
+	for _, feed := range resp.Feeds {
+		got = append(got, feed.URI)
+	}
+	want := append(srv.feeds.URIs(), "at://did:web:feeds.test/app.bsky.feed.generator/"+store.CollectionFeedRKey(collection.ID))
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected feeds %v, got %v", want, got)
+	}
+
+	// every described feed can be served
+	for _, uri := range got {
+		if _, err := srv.feeds.Lookup(uri); err != nil {
+			t.Errorf("described feed %s can't be looked up: %s", uri, err)
+		}
+	}
+}
@@ -5,14 +5,16 @@ import (
 	"fmt"
 	"log/slog"
 	"strconv"
-	"strings"
 
 	"github.com/willdot/bskyfeedgen/store"
 )
 
 type repliesStore interface {
 	GetUsersReplies(usersDID string, cursor int64, limit int) ([]store.ReplyPost, error)
+	GetUsersThreadReplies(userDID string, cursor int64, limit int) ([]store.ThreadReply, error)
 	GetBookmarksForUserWithPaging(userDID string, cursor int64, limit int) ([]store.Bookmark, error)
+	GetBookmarksForCollectionWithPaging(collectionID int, userDID string, cursor int64, limit int) ([]store.Bookmark, error)
+	GetCollection(id int) (*store.Collection, error)
 	AddRepliedPost(replyPost store.ReplyPost) error
 }
 
@@ -26,18 +28,16 @@ func NewFeedGenerator(store repliesStore) *FeedGenerator {
 	}
 }
 
-func (f *FeedGenerator) GetFeed(ctx context.Context, userDID, feed, cursor string, limit int) (FeedReponse, error) {
-	switch {
-	case strings.Contains(feed, "bookmark-replies"):
-		return f.getBookmarkRepliesFeed(ctx, userDID, cursor, limit)
-	case strings.Contains(feed, "bookmarks"):
-		return f.getBookmarksFeed(ctx, userDID, cursor, limit)
-
-	default:
-		return FeedReponse{
-			Feed: make([]FeedItem, 0),
-		}, fmt.Errorf("invalid feed requested")
-	}
+// RegisterFeeds adds the bookmark feeds to the registry.
+func (f *FeedGenerator) RegisterFeeds(registry *FeedRegistry) {
+	registry.Register("bookmark-replies", FeedFunc(f.getBookmarkRepliesFeed))
+	registry.Register("bookmarks", FeedFunc(f.getBookmarksFeed))
+	registry.Register("bookmark-threads", FeedFunc(f.getBookmarkThreadsFeed))
+	registry.RegisterCollectionFeeds(func(collectionID int) Feed {
+		return FeedFunc(func(ctx context.Context, userDID, cursor string, limit int) (FeedReponse, error) {
+			return f.getCollectionFeed(ctx, userDID, collectionID, cursor, limit)
+		})
+	})
 }
 
 func (f *FeedGenerator) getBookmarkRepliesFeed(ctx context.Context, userDID, cursor string, limit int) (FeedReponse, error) {
@@ -61,9 +61,14 @@ func (f *FeedGenerator) getBookmarkRepliesFeed(ctx context.Context, userDID, cur
 
 	feedItems := make([]FeedItem, 0, len(usersReplies))
 	for _, post := range usersReplies {
-		feedItems = append(feedItems, FeedItem{
+		feedItem := FeedItem{
 			Post: post.ReplyURI,
-		})
+		}
+		// quotes are mixed in with replies so mark them to let clients tell them apart
+		if post.Kind == store.ReplyKindQuote {
+			feedItem.FeedContext = store.ReplyKindQuote
+		}
+		feedItems = append(feedItems, feedItem)
 	}
 
 	resp.Feed = feedItems
@@ -77,6 +82,43 @@ func (f *FeedGenerator) getBookmarkRepliesFeed(ctx context.Context, userDID, cur
 	return resp, nil
 }
 
+func (f *FeedGenerator) getBookmarkThreadsFeed(ctx context.Context, userDID, cursor string, limit int) (FeedReponse, error) {
+	resp := FeedReponse{
+		Feed: make([]FeedItem, 0),
+	}
+
+	cursorInt, err := strconv.Atoi(cursor)
+	if err != nil && cursor != "" {
+		slog.Error("convert cursor to int", "error", err, "cursor value", cursor)
+	}
+	if cursorInt == 0 {
+		// if no cursor provided use a date waaaaay in the future to start the less than query
+		cursorInt = 9999999999999
+	}
+
+	threadReplies, err := f.store.GetUsersThreadReplies(userDID, int64(cursorInt), limit)
+	if err != nil {
+		return resp, fmt.Errorf("get users thread replies from DB: %w", err)
+	}
+
+	feedItems := make([]FeedItem, 0, len(threadReplies))
+	for _, reply := range threadReplies {
+		feedItems = append(feedItems, FeedItem{
+			Post: reply.ReplyURI,
+		})
+	}
+
+	resp.Feed = feedItems
+
+	// only set the return cursor if there was a record returned and that the len of records
+	// being returned is the same as the limit
+	if len(threadReplies) > 0 && len(threadReplies) == limit {
+		lastFeedItem := threadReplies[len(threadReplies)-1]
+		resp.Cursor = fmt.Sprintf("%d", lastFeedItem.CreatedAt)
+	}
+	return resp, nil
+}
+
 func (f *FeedGenerator) getBookmarksFeed(ctx context.Context, userDID, cursor string, limit int) (FeedReponse, error) {
 	resp := FeedReponse{
 		Feed: make([]FeedItem, 0),
@@ -113,3 +155,49 @@ func (f *FeedGenerator) getBookmarksFeed(ctx context.Context, userDID, cursor st
 	}
 	return resp, nil
 }
+
+func (f *FeedGenerator) getCollectionFeed(ctx context.Context, userDID string, collectionID int, cursor string, limit int) (FeedReponse, error) {
+	resp := FeedReponse{
+		Feed: make([]FeedItem, 0),
+	}
+
+	collection, err := f.store.GetCollection(collectionID)
+	if err != nil {
+		return resp, fmt.Errorf("get collection from DB: %w", err)
+	}
+	// collections are private to the user that created them so anyone else gets an empty feed
+	if collection == nil || collection.UserDID != userDID {
+		return resp, nil
+	}
+
+	cursorInt, err := strconv.Atoi(cursor)
+	if err != nil && cursor != "" {
+		slog.Error("convert cursor to int", "error", err, "cursor value", cursor)
+	}
+	if cursorInt == 0 {
+		// if no cursor provided use a date waaaaay in the future to start the less than query
+		cursorInt = 9999999999999
+	}
+
+	bookmarks, err := f.store.GetBookmarksForCollectionWithPaging(collection.ID, userDID, int64(cursorInt), limit)
+	if err != nil {
+		return resp, fmt.Errorf("get collection bookmarks from DB: %w", err)
+	}
+
+	feedItems := make([]FeedItem, 0, len(bookmarks))
+	for _, bookmark := range bookmarks {
+		feedItems = append(feedItems, FeedItem{
+			Post: bookmark.PostATURI,
+		})
+	}
+
+	resp.Feed = feedItems
+
+	// only set the return cursor if there was a record returned and that the len of records
+	// being returned is the same as the limit
+	if len(bookmarks) > 0 && len(bookmarks) == limit {
+		lastFeedItem := bookmarks[len(bookmarks)-1]
+		resp.Cursor = fmt.Sprintf("%d", lastFeedItem.CreatedAt)
+	}
+	return resp, nil
+}
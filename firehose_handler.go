@@ -10,26 +10,65 @@ import (
 	apibsky "github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/jetstream/pkg/models"
 	"github.com/bugsnag/bugsnag-go/v2"
+	"github.com/hashicorp/golang-lru/v2/expirable"
 	"github.com/willdot/bskyfeedgen/store"
 )
 
 type HandlerStore interface {
 	AddRepliedPost(replyPost store.ReplyPost) error
 	GetBookmarksForPost(postURI string) ([]string, error)
+	IsPostBookmarked(postATURI string) bool
+	IsThreadFollowed(rootURI string) bool
+	IsPostStored(postATURI string) bool
+	GetThreadReplyDepth(replyURI string) (int, error)
+	AddThreadReply(reply store.ThreadReply) error
+	DeletePost(postATURI string, deletedAt int64) error
 }
 
+const (
+	recentlyDeletedPostsSize = 100_000
+	recentlyDeletedPostsTTL  = time.Minute * 10
+)
+
 type handler struct {
 	store HandlerStore
+	// threadMaxDepth is how many replies deep into a followed thread replies are captured
+	threadMaxDepth int
+	// bookmarkRecords indexes bookmark records from users repos, or is nil if they aren't being indexed
+	bookmarkRecords *bookmarkRecordIndexer
+	// recentlyDeletedPosts holds the URIs of posts that have just been deleted. Events are ordered by thread rather
+	// than by post, so a delete can be handled before the create of the same post.
+	recentlyDeletedPosts *expirable.LRU[string, struct{}]
+}
+
+func newHandler(store HandlerStore, threadMaxDepth int, bookmarkRecords *bookmarkRecordIndexer) *handler {
+	return &handler{
+		store:                store,
+		threadMaxDepth:       threadMaxDepth,
+		bookmarkRecords:      bookmarkRecords,
+		recentlyDeletedPosts: expirable.NewLRU[string, struct{}](recentlyDeletedPostsSize, nil, recentlyDeletedPostsTTL),
+	}
 }
 
 func (h *handler) HandleEvent(ctx context.Context, event *models.Event) error {
+	defer jetstreamEventsProcessed.WithLabelValues(event.Kind).Inc()
+
 	if event.Commit == nil {
 		return nil
 	}
 
+	if event.Commit.Collection == bookmarkRecordCollection {
+		if h.bookmarkRecords == nil {
+			return nil
+		}
+		return h.bookmarkRecords.HandleEvent(ctx, event)
+	}
+
 	switch event.Commit.Operation {
 	case models.CommitOperationCreate:
 		return h.handleCreateEvent(ctx, event)
+	case models.CommitOperationDelete:
+		return h.handleDeleteEvent(ctx, event)
 	default:
 		return nil
 	}
@@ -46,33 +85,212 @@ func (h *handler) handleCreateEvent(_ context.Context, event *models.Event) erro
 		return nil
 	}
 
-	// we only care about posts that have parents which are replies
-	if post.Reply == nil || post.Reply.Parent == nil || post.Reply.Parent.Uri == "" {
+	postURI := fmt.Sprintf("at://%s/app.bsky.feed.post/%s", event.Did, event.Commit.RKey)
+	if h.recentlyDeletedPosts.Contains(postURI) {
 		return nil
 	}
 
+	// we only care about posts that are replies or quotes, and a post can be both
+	if post.Reply != nil && post.Reply.Parent != nil && post.Reply.Parent.Uri != "" {
+		h.handleReply(postURI, &post)
+	}
+
+	if quotedPostURI := getQuotedPostURI(&post); quotedPostURI != "" {
+		h.handleQuote(postURI, quotedPostURI, &post)
+	}
+
+	// the delete can be handled on another worker while the post was being stored, and will have skipped it if it wasn't
+	// stored yet
+	if h.recentlyDeletedPosts.Contains(postURI) && h.store.IsPostStored(postURI) {
+		h.deletePost(postURI)
+	}
+
+	return nil
+}
+
+func (h *handler) handleReply(replyPostURI string, post *apibsky.FeedPost) {
 	subscribedPostURI := post.Reply.Parent.Uri
 
+	if post.Reply.Root != nil && post.Reply.Root.Uri != "" {
+		h.handleThreadReply(replyPostURI, post.Reply.Root.Uri, subscribedPostURI, post.CreatedAt)
+	}
+
 	// see if the post is a reply to a post we are subscribed to
 	subscribedDids := h.getSubscribedDidsForPost(subscribedPostURI)
 	if len(subscribedDids) == 0 {
+		return
+	}
+
+	jetstreamReplyMatches.Inc()
+	slog.Info("post is a reply to a post that users are subscribed to", "subscribed post URI", subscribedPostURI, "dids", subscribedDids, "reply post URI", replyPostURI)
+
+	h.createReplyPostForSubscribedUsers(subscribedDids, replyPostURI, subscribedPostURI, store.ReplyKindReply, parsePostCreatedAt(post.CreatedAt))
+}
+
+func (h *handler) handleQuote(quotePostURI, quotedPostURI string, post *apibsky.FeedPost) {
+	subscribedDids := h.getSubscribedDidsForPost(quotedPostURI)
+	if len(subscribedDids) == 0 {
+		return
+	}
+
+	jetstreamQuoteMatches.Inc()
+	slog.Info("post is a quote of a post that users are subscribed to", "subscribed post URI", quotedPostURI, "dids", subscribedDids, "quote post URI", quotePostURI)
+
+	h.createReplyPostForSubscribedUsers(subscribedDids, quotePostURI, quotedPostURI, store.ReplyKindQuote, parsePostCreatedAt(post.CreatedAt))
+}
+
+// getQuotedPostURI returns the URI of the record embedded in a post, either on its own or alongside media. Records can
+// be things other than posts, such as feeds or lists, but those will never match a bookmark.
+func getQuotedPostURI(post *apibsky.FeedPost) string {
+	if post.Embed == nil {
+		return ""
+	}
+
+	var embedRecord *apibsky.EmbedRecord
+	switch {
+	case post.Embed.EmbedRecord != nil:
+		embedRecord = post.Embed.EmbedRecord
+	case post.Embed.EmbedRecordWithMedia != nil:
+		embedRecord = post.Embed.EmbedRecordWithMedia.Record
+	}
+
+	if embedRecord == nil || embedRecord.Record == nil {
+		return ""
+	}
+	return embedRecord.Record.Uri
+}
+
+func (h *handler) handleDeleteEvent(_ context.Context, event *models.Event) error {
+	if event.Commit.Collection != "app.bsky.feed.post" {
 		return nil
 	}
 
-	slog.Info("post is a reply to a post that users are subscribed to", "subscribed post URI", subscribedPostURI, "dids", subscribedDids, "RKey", event.Commit.RKey)
+	postURI := fmt.Sprintf("at://%s/app.bsky.feed.post/%s", event.Did, event.Commit.RKey)
+	h.recentlyDeletedPosts.Add(postURI, struct{}{})
 
-	createdAt, err := time.Parse(time.RFC3339, post.CreatedAt)
-	if err != nil {
-		slog.Error("parsing createdAt time from post", "error", err, "timestamp", post.CreatedAt)
-		createdAt = time.Now().UTC()
+	// almost every deleted post has nothing to do with any bookmark
+	if !h.store.IsPostStored(postURI) {
+		return nil
 	}
 
-	replyPostURI := fmt.Sprintf("at://%s/app.bsky.feed.post/%s", event.Did, event.Commit.RKey)
-	h.createReplyPostForSubscribedUsers(subscribedDids, replyPostURI, subscribedPostURI, createdAt.UnixMilli())
+	h.deletePost(postURI)
 	return nil
 }
 
+func (h *handler) deletePost(postURI string) {
+	err := h.store.DeletePost(postURI, time.Now().UnixMilli())
+	if err != nil {
+		slog.Error("delete post", "error", err, "post URI", postURI)
+		_ = bugsnag.Notify(err)
+	}
+}
+
+// postOrderingRefs is the part of a post record needed to work out its ordering key.
+type postOrderingRefs struct {
+	Reply *struct {
+		Root struct {
+			URI string `json:"uri"`
+		} `json:"root"`
+	} `json:"reply"`
+	Embed *struct {
+		Record *struct {
+			URI string `json:"uri"`
+			// set when the record is embedded alongside media
+			Record *struct {
+				URI string `json:"uri"`
+			} `json:"record"`
+		} `json:"record"`
+	} `json:"embed"`
+}
+
+// orderingKey returns the key used to decide which events must be handled in order. Replies are keyed by the root of
+// their thread so that a parent is always stored before its replies, quotes are keyed by the post they quote and
+// everything else by the author.
+func orderingKey(event *models.Event) string {
+	if event.Commit == nil || event.Commit.Operation != models.CommitOperationCreate || len(event.Commit.Record) == 0 {
+		return event.Did
+	}
+
+	var refs postOrderingRefs
+	if err := json.Unmarshal(event.Commit.Record, &refs); err != nil {
+		return event.Did
+	}
+
+	if refs.Reply != nil && refs.Reply.Root.URI != "" {
+		return refs.Reply.Root.URI
+	}
+
+	if refs.Embed != nil && refs.Embed.Record != nil {
+		if refs.Embed.Record.Record != nil && refs.Embed.Record.Record.URI != "" {
+			return refs.Embed.Record.Record.URI
+		}
+		if refs.Embed.Record.URI != "" {
+			return refs.Embed.Record.URI
+		}
+	}
+
+	return event.Did
+}
+
+func parsePostCreatedAt(createdAt string) int64 {
+	t, err := time.Parse(time.RFC3339, createdAt)
+	if err != nil {
+		slog.Error("parsing createdAt time from post", "error", err, "timestamp", createdAt)
+		t = time.Now().UTC()
+	}
+	return t.UnixMilli()
+}
+
+// handleThreadReply stores a reply if it's in a thread that is being followed and is within the max depth. The depth of
+// a reply is worked out from its parent, so a reply is only captured if its parent is the root or was captured too.
+func (h *handler) handleThreadReply(replyPostURI, rootURI, parentURI, createdAt string) {
+	if !h.store.IsThreadFollowed(rootURI) {
+		bookmarkIndexThreadMisses.Inc()
+		return
+	}
+	bookmarkIndexThreadHits.Inc()
+
+	depth := 1
+	if parentURI != rootURI {
+		parentDepth, err := h.store.GetThreadReplyDepth(parentURI)
+		if err != nil {
+			slog.Error("getting thread reply depth", "error", err, "parent URI", parentURI)
+			_ = bugsnag.Notify(err)
+			return
+		}
+		if parentDepth == 0 {
+			return
+		}
+		depth = parentDepth + 1
+	}
+
+	if depth > h.threadMaxDepth {
+		return
+	}
+
+	err := h.store.AddThreadReply(store.ThreadReply{
+		ReplyURI:  replyPostURI,
+		RootURI:   rootURI,
+		ParentURI: parentURI,
+		Depth:     depth,
+		CreatedAt: parsePostCreatedAt(createdAt),
+	})
+	if err != nil {
+		slog.Error("add thread reply", "error", err, "reply post URI", replyPostURI)
+		_ = bugsnag.Notify(err)
+		return
+	}
+	jetstreamThreadMatches.Inc()
+}
+
 func (h *handler) getSubscribedDidsForPost(postURI string) []string {
+	// almost every post on the network isn't bookmarked so check the in memory index before going to the database
+	if !h.store.IsPostBookmarked(postURI) {
+		bookmarkIndexPostMisses.Inc()
+		return nil
+	}
+	bookmarkIndexPostHits.Inc()
+
 	// dids, err := h.store.GetSubscriptionsForPost(postURI)
 	dids, err := h.store.GetBookmarksForPost(postURI)
 	if err != nil {
@@ -83,13 +301,14 @@ func (h *handler) getSubscribedDidsForPost(postURI string) []string {
 	return dids
 }
 
-func (h *handler) createReplyPostForSubscribedUsers(usersDids []string, replyPostURI, subscribedPostURI string, createdAt int64) {
+func (h *handler) createReplyPostForSubscribedUsers(usersDids []string, replyPostURI, subscribedPostURI, kind string, createdAt int64) {
 	for _, did := range usersDids {
 		repliedPost := store.ReplyPost{
 			ReplyURI:          replyPostURI,
 			UserDID:           did,
 			SubscribedPostURI: subscribedPostURI,
 			CreatedAt:         createdAt,
+			Kind:              kind,
 		}
 		err := h.store.AddRepliedPost(repliedPost)
 		if err != nil {
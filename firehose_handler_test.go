@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+func TestHandleEventCapturesFollowedThreadReplies(t *testing.T) {
+	s := newTestStore(t)
+	err := s.CreateBookmark("bookmarked", "", testBookmarkURI, "", testAuthorDID, "author.test", testUserDID, "a post", time.Now().UnixMilli())
+	if err != nil {
+		t.Fatalf("create bookmark: %s", err)
+	}
+	if err := s.SetBookmarkFollowThread(testBookmarkURI, testUserDID, true); err != nil {
+		t.Fatalf("follow thread: %s", err)
+	}
+
+	h := newHandler(s, 2, nil)
+
+	replyURI := func(rkey string) string {
+		return fmt.Sprintf("at://%s/app.bsky.feed.post/%s", testReplierDID, rkey)
+	}
+
+	now := time.Now()
+	events := []struct {
+		rkey      string
+		parentURI string
+	}{
+		{rkey: "depth1", parentURI: testBookmarkURI},
+		{rkey: "depth2", parentURI: replyURI("depth1")},
+		{rkey: "depth3", parentURI: replyURI("depth2")},
+		{rkey: "unknown-parent", parentURI: replyURI("never-seen")},
+	}
+	for i, e := range events {
+		event := replyEvent(testReplierDID, e.rkey, e.parentURI, testBookmarkURI, now.Add(time.Duration(i)*time.Second).UnixMicro())
+		if err := h.HandleEvent(context.Background(), &event); err != nil {
+			t.Fatalf("handle event: %s", err)
+		}
+	}
+
+	// an unrelated thread shouldn't be captured
+	otherEvent := replyEvent(testReplierDID, "other", "at://did:plc:author/app.bsky.feed.post/other", "at://did:plc:author/app.bsky.feed.post/other", now.UnixMicro())
+	if err := h.HandleEvent(context.Background(), &otherEvent); err != nil {
+		t.Fatalf("handle event: %s", err)
+	}
+
+	replies, err := s.GetUsersThreadReplies(testUserDID, now.Add(time.Hour).UnixMilli(), 10)
+	if err != nil {
+		t.Fatalf("get users thread replies: %s", err)
+	}
+
+	got := make(map[string]int)
+	for _, reply := range replies {
+		got[reply.ReplyURI] = reply.Depth
+	}
+	want := map[string]int{
+		replyURI("depth1"): 1,
+		replyURI("depth2"): 2,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected thread replies %v, got %v", want, got)
+	}
+	for uri, depth := range want {
+		if got[uri] != depth {
+			t.Errorf("expected %s to have depth %d, got %d", uri, depth, got[uri])
+		}
+	}
+
+	// once the thread is unfollowed the replies are no longer in the users feed
+	if err := s.SetBookmarkFollowThread(testBookmarkURI, testUserDID, false); err != nil {
+		t.Fatalf("unfollow thread: %s", err)
+	}
+	replies, err = s.GetUsersThreadReplies(testUserDID, now.Add(time.Hour).UnixMilli(), 10)
+	if err != nil {
+		t.Fatalf("get users thread replies: %s", err)
+	}
+	if len(replies) != 0 {
+		t.Errorf("expected no thread replies after unfollowing, got %d", len(replies))
+	}
+}
+
+func TestHandleEventCapturesQuotesOfBookmarkedPosts(t *testing.T) {
+	s := newTestStore(t)
+	err := s.CreateBookmark("bookmarked", "", testBookmarkURI, "", testAuthorDID, "author.test", testUserDID, "a post", time.Now().UnixMilli())
+	if err != nil {
+		t.Fatalf("create bookmark: %s", err)
+	}
+
+	h := newHandler(s, 2, nil)
+
+	now := time.Now()
+	events := []models.Event{
+		replyEvent(testReplierDID, "reply", testBookmarkURI, testBookmarkURI, now.UnixMicro()),
+		quoteEvent(testReplierDID, "quote", testBookmarkURI, false, now.Add(time.Second).UnixMicro()),
+		quoteEvent(testReplierDID, "quote-with-media", testBookmarkURI, true, now.Add(time.Second*2).UnixMicro()),
+		quoteEvent(testReplierDID, "other-quote", "at://did:plc:author/app.bsky.feed.post/other", false, now.Add(time.Second*3).UnixMicro()),
+	}
+	for _, event := range events {
+		if err := h.HandleEvent(context.Background(), &event); err != nil {
+			t.Fatalf("handle event: %s", err)
+		}
+	}
+
+	resp := getTestFeed(t, s, "bookmark-replies", testUserDID)
+
+	want := []FeedItem{
+		{Post: fmt.Sprintf("at://%s/app.bsky.feed.post/quote-with-media", testReplierDID), FeedContext: "quote"},
+		{Post: fmt.Sprintf("at://%s/app.bsky.feed.post/quote", testReplierDID), FeedContext: "quote"},
+		{Post: fmt.Sprintf("at://%s/app.bsky.feed.post/reply", testReplierDID)},
+	}
+	if len(resp.Feed) != len(want) {
+		t.Fatalf("expected feed %+v, got %+v", want, resp.Feed)
+	}
+	for i := range want {
+		if resp.Feed[i] != want[i] {
+			t.Errorf("expected feed item %d to be %+v, got %+v", i, want[i], resp.Feed[i])
+		}
+	}
+}
+
+func TestHandleEventDeletesPosts(t *testing.T) {
+	s := newTestStore(t)
+	err := s.CreateBookmark("bookmarked", "", testBookmarkURI, "", testAuthorDID, "author.test", testUserDID, "a post", time.Now().UnixMilli())
+	if err != nil {
+		t.Fatalf("create bookmark: %s", err)
+	}
+
+	h := newHandler(s, 2, nil)
+
+	now := time.Now()
+	events := []models.Event{
+		replyEvent(testReplierDID, "kept", testBookmarkURI, testBookmarkURI, now.UnixMicro()),
+		replyEvent(testReplierDID, "deleted", testBookmarkURI, testBookmarkURI, now.Add(time.Second).UnixMicro()),
+		deleteEvent(testReplierDID, "deleted", now.Add(time.Second*2).UnixMicro()),
+	}
+	for _, event := range events {
+		if err := h.HandleEvent(context.Background(), &event); err != nil {
+			t.Fatalf("handle event: %s", err)
+		}
+	}
+
+	replies, err := s.GetUsersReplies(testUserDID, now.Add(time.Hour).UnixMilli(), 10)
+	if err != nil {
+		t.Fatalf("get users replies: %s", err)
+	}
+	if len(replies) != 1 || replies[0].ReplyURI != fmt.Sprintf("at://%s/app.bsky.feed.post/kept", testReplierDID) {
+		t.Errorf("expected only the kept reply, got %+v", replies)
+	}
+
+	// the bookmarked post itself is deleted
+	event := deleteEvent(testAuthorDID, "bookmarked", now.Add(time.Second*3).UnixMicro())
+	if err := h.HandleEvent(context.Background(), &event); err != nil {
+		t.Fatalf("handle event: %s", err)
+	}
+
+	bookmark, err := s.GetBookmarkByURIForUser(testBookmarkURI, testUserDID)
+	if err != nil {
+		t.Fatalf("get bookmark: %s", err)
+	}
+	if bookmark == nil || bookmark.DeletedAt == 0 {
+		t.Fatalf("expected bookmark to be kept and marked as deleted, got %+v", bookmark)
+	}
+
+	resp := getTestFeed(t, s, "bookmarks", testUserDID)
+	if len(resp.Feed) != 0 {
+		t.Errorf("expected deleted bookmark to not be in the feed, got %+v", resp.Feed)
+	}
+}
+
+func TestHandleEventIgnoresCreateAfterItsDelete(t *testing.T) {
+	s := newTestStore(t)
+	err := s.CreateBookmark("bookmarked", "", testBookmarkURI, "", testAuthorDID, "author.test", testUserDID, "a post", time.Now().UnixMilli())
+	if err != nil {
+		t.Fatalf("create bookmark: %s", err)
+	}
+
+	h := newHandler(s, 2, nil)
+
+	// deletes and creates can have different ordering keys so the delete can be handled first
+	now := time.Now()
+	events := []models.Event{
+		deleteEvent(testReplierDID, "reply", now.Add(time.Second).UnixMicro()),
+		replyEvent(testReplierDID, "reply", testBookmarkURI, testBookmarkURI, now.UnixMicro()),
+	}
+	for _, event := range events {
+		if err := h.HandleEvent(context.Background(), &event); err != nil {
+			t.Fatalf("handle event: %s", err)
+		}
+	}
+
+	replies, err := s.GetUsersReplies(testUserDID, now.Add(time.Hour).UnixMilli(), 10)
+	if err != nil {
+		t.Fatalf("get users replies: %s", err)
+	}
+	if len(replies) != 0 {
+		t.Errorf("expected the deleted reply to not be stored, got %+v", replies)
+	}
+}
+
+// deleteCountingStore counts the posts that the handler tries to delete from the store.
+type deleteCountingStore struct {
+	*store.Store
+	deleted []string
+}
+
+func (d *deleteCountingStore) DeletePost(postATURI string, deletedAt int64) error {
+	d.deleted = append(d.deleted, postATURI)
+	return d.Store.DeletePost(postATURI, deletedAt)
+}
+
+func TestHandleEventIgnoresDeletesOfUntrackedPosts(t *testing.T) {
+	s := &deleteCountingStore{Store: newTestStore(t)}
+	err := s.CreateBookmark("bookmarked", "", testBookmarkURI, "", testAuthorDID, "author.test", testUserDID, "a post", time.Now().UnixMilli())
+	if err != nil {
+		t.Fatalf("create bookmark: %s", err)
+	}
+
+	h := newHandler(s, 2, nil)
+
+	now := time.Now()
+	events := []models.Event{
+		deleteEvent(testReplierDID, "unrelated", now.UnixMicro()),
+		deleteEvent(testAuthorDID, "bookmarked", now.Add(time.Second).UnixMicro()),
+	}
+	for _, event := range events {
+		if err := h.HandleEvent(context.Background(), &event); err != nil {
+			t.Fatalf("handle event: %s", err)
+		}
+	}
+
+	if len(s.deleted) != 1 || s.deleted[0] != testBookmarkURI {
+		t.Errorf("expected only the bookmarked post to be deleted from the store, got %v", s.deleted)
+	}
+}
+
+// interleavingStore runs a callback before a reply is stored, to act like another worker handling an event meanwhile.
+type interleavingStore struct {
+	*store.Store
+	beforeAddReply func()
+}
+
+func (i *interleavingStore) AddRepliedPost(replyPost store.ReplyPost) error {
+	if i.beforeAddReply != nil {
+		i.beforeAddReply()
+		i.beforeAddReply = nil
+	}
+	return i.Store.AddRepliedPost(replyPost)
+}
+
+func TestHandleEventRemovesPostDeletedWhileBeingStored(t *testing.T) {
+	s := &interleavingStore{Store: newTestStore(t)}
+	err := s.CreateBookmark("bookmarked", "", testBookmarkURI, "", testAuthorDID, "author.test", testUserDID, "a post", time.Now().UnixMilli())
+	if err != nil {
+		t.Fatalf("create bookmark: %s", err)
+	}
+
+	h := newHandler(s, 2, nil)
+
+	now := time.Now()
+	s.beforeAddReply = func() {
+		event := deleteEvent(testReplierDID, "reply", now.Add(time.Second).UnixMicro())
+		if err := h.HandleEvent(context.Background(), &event); err != nil {
+			t.Errorf("handle delete event: %s", err)
+		}
+	}
+
+	event := replyEvent(testReplierDID, "reply", testBookmarkURI, testBookmarkURI, now.UnixMicro())
+	if err := h.HandleEvent(context.Background(), &event); err != nil {
+		t.Fatalf("handle event: %s", err)
+	}
+
+	replies, err := s.GetUsersReplies(testUserDID, now.Add(time.Hour).UnixMilli(), 10)
+	if err != nil {
+		t.Fatalf("get users replies: %s", err)
+	}
+	if len(replies) != 0 {
+		t.Errorf("expected the reply deleted while it was being stored to be removed, got %+v", replies)
+	}
+}
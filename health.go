@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const healthPingTimeout = time.Second * 2
+
+type DBPinger interface {
+	Ping(ctx context.Context) error
+}
+
+// healthChecker reports on the state of the database and each of the background subsystems. Subsystems register
+// themselves as they start so that ones that are disabled aren't reported.
+type healthChecker struct {
+	startedAt time.Time
+	db        DBPinger
+
+	mu         sync.Mutex
+	lastSeen   []lastSeenCheck
+	conditions []conditionCheck
+}
+
+// lastSeenCheck fails when the time returned by lastSeen is older than maxAge.
+type lastSeenCheck struct {
+	name     string
+	maxAge   time.Duration
+	lastSeen func() time.Time
+}
+
+type conditionCheck struct {
+	name string
+	ok   func() bool
+}
+
+type HealthResponse struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+type HealthCheck struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	LastSeen string `json:"lastSeen,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func newHealthChecker(db DBPinger) *healthChecker {
+	return &healthChecker{
+		startedAt: time.Now(),
+		db:        db,
+	}
+}
+
+// WatchLastSeen registers a subsystem that is unhealthy once the time returned by lastSeen is older than maxAge.
+func (h *healthChecker) WatchLastSeen(name string, maxAge time.Duration, lastSeen func() time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSeen = append(h.lastSeen, lastSeenCheck{name: name, maxAge: maxAge, lastSeen: lastSeen})
+}
+
+// WatchCondition registers a subsystem that is unhealthy whenever ok returns false.
+func (h *healthChecker) WatchCondition(name string, ok func() bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.conditions = append(h.conditions, conditionCheck{name: name, ok: ok})
+}
+
+// check runs every check. When ready is false, subsystems that haven't reported anything yet are given until their max
+// age has passed since startup before they are considered unhealthy. Readiness doesn't allow that grace period.
+func (h *healthChecker) check(ctx context.Context, ready bool) HealthResponse {
+	resp := HealthResponse{
+		Status: "ok",
+	}
+
+	dbCheck := HealthCheck{Name: "database", OK: true}
+	ctx, cancel := context.WithTimeout(ctx, healthPingTimeout)
+	defer cancel()
+	if err := h.db.Ping(ctx); err != nil {
+		dbCheck.OK = false
+		dbCheck.Error = err.Error()
+	}
+	resp.Checks = append(resp.Checks, dbCheck)
+
+	h.mu.Lock()
+	lastSeenChecks := h.lastSeen
+	conditionChecks := h.conditions
+	h.mu.Unlock()
+
+	now := time.Now()
+	for _, c := range lastSeenChecks {
+		check := HealthCheck{Name: c.name, OK: true}
+
+		lastSeen := c.lastSeen()
+		switch {
+		case lastSeen.IsZero() && ready:
+			check.OK = false
+			check.Error = "not seen yet"
+		case lastSeen.IsZero():
+			if now.Sub(h.startedAt) > c.maxAge {
+				check.OK = false
+				check.Error = "not seen since startup"
+			}
+		default:
+			check.LastSeen = lastSeen.UTC().Format(time.RFC3339)
+			if now.Sub(lastSeen) > c.maxAge {
+				check.OK = false
+				check.Error = "stale"
+			}
+		}
+		resp.Checks = append(resp.Checks, check)
+	}
+
+	for _, c := range conditionChecks {
+		check := HealthCheck{Name: c.name, OK: c.ok()}
+		if !check.OK {
+			check.Error = "failing"
+		}
+		resp.Checks = append(resp.Checks, check)
+	}
+
+	for _, check := range resp.Checks {
+		if !check.OK {
+			resp.Status = "failing"
+			break
+		}
+	}
+
+	return resp
+}
+
+func (h *healthChecker) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	h.writeResponse(w, h.check(r.Context(), false))
+}
+
+func (h *healthChecker) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	h.writeResponse(w, h.check(r.Context(), true))
+}
+
+func (h *healthChecker) writeResponse(w http.ResponseWriter, resp HealthResponse) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		slog.Error("marshal health response", "error", err)
+		http.Error(w, "failed to encode resp", http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if resp.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(b)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakePinger struct {
+	err error
+}
+
+func (f *fakePinger) Ping(ctx context.Context) error {
+	return f.err
+}
+
+func getHealth(t *testing.T, handler http.HandlerFunc) (int, HealthResponse) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var resp HealthResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %s", err)
+	}
+	return rec.Code, resp
+}
+
+func TestHealthChecks(t *testing.T) {
+	pinger := &fakePinger{}
+	health := newHealthChecker(pinger)
+
+	var lastEvent time.Time
+	sessionValid := true
+	health.WatchLastSeen("jetstream", time.Minute, func() time.Time { return lastEvent })
+	health.WatchCondition("dm session", func() bool { return sessionValid })
+
+	// nothing has been seen yet, which is healthy straight after startup but not ready
+	if code, _ := getHealth(t, health.HandleHealthz); code != http.StatusOK {
+		t.Errorf("expected healthz to be ok during startup, got %d", code)
+	}
+	if code, _ := getHealth(t, health.HandleReadyz); code != http.StatusServiceUnavailable {
+		t.Errorf("expected readyz to fail before any events, got %d", code)
+	}
+
+	lastEvent = time.Now()
+	if code, resp := getHealth(t, health.HandleReadyz); code != http.StatusOK {
+		t.Errorf("expected readyz to be ok, got %d: %+v", code, resp)
+	}
+
+	lastEvent = time.Now().Add(-time.Minute * 2)
+	code, resp := getHealth(t, health.HandleHealthz)
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("expected healthz to fail when jetstream is stale, got %d", code)
+	}
+	if resp.Checks[1].Name != "jetstream" || resp.Checks[1].Error != "stale" {
+		t.Errorf("expected jetstream check to be stale, got %+v", resp.Checks[1])
+	}
+
+	lastEvent = time.Now()
+	sessionValid = false
+	if code, _ := getHealth(t, health.HandleHealthz); code != http.StatusServiceUnavailable {
+		t.Errorf("expected healthz to fail when the dm session is invalid, got %d", code)
+	}
+
+	sessionValid = true
+	pinger.err = errors.New("database is locked")
+	code, resp = getHealth(t, health.HandleHealthz)
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("expected healthz to fail when the database can't be pinged, got %d", code)
+	}
+	if resp.Checks[0].Error != "database is locked" {
+		t.Errorf("expected database error to be reported, got %+v", resp.Checks[0])
+	}
+}
+
+func TestHealthzFailsWhenNothingSeenSinceStartup(t *testing.T) {
+	health := newHealthChecker(&fakePinger{})
+	health.startedAt = time.Now().Add(-time.Hour)
+	health.WatchLastSeen("dm poll", time.Minute, func() time.Time { return time.Time{} })
+
+	if code, _ := getHealth(t, health.HandleHealthz); code != http.StatusServiceUnavailable {
+		t.Errorf("expected healthz to fail, got %d", code)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bugsnag/bugsnag-go/v2"
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+const janitorBatchSize = 500
+
+type JanitorStore interface {
+	GetExpiredBookmarks(now int64, limit int) ([]store.Bookmark, error)
+	GetBookmarksTrackingRepliesCreatedBefore(before int64, limit int) ([]store.Bookmark, error)
+	StopTrackingReplies(postATURI, userDID string) error
+	DeleteRepliedPostsForBookmarkedPostURIandUserDID(subscribedPostURI, userDID string) error
+}
+
+type ExpiredSessionDeleter interface {
+	DeleteExpired(now time.Time) (int64, error)
+}
+
+// janitor periodically deletes expired bookmarks and stops tracking replies to bookmarks that are older than the reply
+// tracking window, so that the replies table doesn't grow forever for old but busy threads. It also deletes users web
+// sessions that have expired.
+type janitor struct {
+	store    JanitorStore
+	records  *bookmarkRecords
+	sessions ExpiredSessionDeleter
+	interval time.Duration
+	// replyTrackingWindow is how long after being bookmarked replies to a post are tracked for, or 0 to track forever
+	replyTrackingWindow time.Duration
+}
+
+func newJanitor(store JanitorStore, records *bookmarkRecords, sessions ExpiredSessionDeleter, interval, replyTrackingWindow time.Duration) *janitor {
+	return &janitor{
+		store:               store,
+		records:             records,
+		sessions:            sessions,
+		interval:            interval,
+		replyTrackingWindow: replyTrackingWindow,
+	}
+}
+
+func (j *janitor) Run(ctx context.Context) {
+	timer := time.NewTimer(j.interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Warn("context canceled - stopping janitor")
+			return
+		case <-timer.C:
+			err := j.Clean(ctx, time.Now())
+			if err != nil {
+				slog.Error("janitor clean", "error", err)
+				_ = bugsnag.Notify(err)
+			}
+			timer.Reset(j.interval)
+		}
+	}
+}
+
+func (j *janitor) Clean(ctx context.Context, now time.Time) error {
+	expired, err := j.deleteExpiredBookmarks(ctx, now)
+	if err != nil {
+		return fmt.Errorf("delete expired bookmarks: %w", err)
+	}
+
+	stopped, err := j.stopTrackingOldReplies(now)
+	if err != nil {
+		return fmt.Errorf("stop tracking old replies: %w", err)
+	}
+
+	if expired > 0 || stopped > 0 {
+		slog.Info("janitor cleaned bookmarks", "expired bookmarks", expired, "stopped tracking replies", stopped)
+	}
+
+	if j.sessions != nil {
+		deleted, err := j.sessions.DeleteExpired(now)
+		if err != nil {
+			return fmt.Errorf("delete expired sessions: %w", err)
+		}
+		if deleted > 0 {
+			slog.Info("janitor deleted expired sessions", "sessions", deleted)
+		}
+	}
+	return nil
+}
+
+func (j *janitor) deleteExpiredBookmarks(ctx context.Context, now time.Time) (int, error) {
+	total := 0
+	for {
+		bookmarks, err := j.store.GetExpiredBookmarks(now.UnixMilli(), janitorBatchSize)
+		if err != nil {
+			return total, fmt.Errorf("get expired bookmarks: %w", err)
+		}
+
+		failed := false
+		for _, bookmark := range bookmarks {
+			err := j.records.Delete(ctx, bookmark)
+			if err != nil {
+				slog.Error("delete expired bookmark", "error", err, "post AT URI", bookmark.PostATURI, "did", bookmark.UserDID)
+				_ = bugsnag.Notify(err)
+				failed = true
+				continue
+			}
+			janitorBookmarksExpired.Inc()
+			total++
+		}
+
+		// failed bookmarks would be returned again so leave them until the next run
+		if len(bookmarks) < janitorBatchSize || failed {
+			return total, nil
+		}
+	}
+}
+
+func (j *janitor) stopTrackingOldReplies(now time.Time) (int, error) {
+	if j.replyTrackingWindow == 0 {
+		return 0, nil
+	}
+
+	before := now.Add(-j.replyTrackingWindow).UnixMilli()
+	total := 0
+	for {
+		bookmarks, err := j.store.GetBookmarksTrackingRepliesCreatedBefore(before, janitorBatchSize)
+		if err != nil {
+			return total, fmt.Errorf("get bookmarks tracking replies: %w", err)
+		}
+
+		failed := false
+		for _, bookmark := range bookmarks {
+			// stop tracking first so that no new replies are stored after the old ones have been deleted
+			err := j.store.StopTrackingReplies(bookmark.PostATURI, bookmark.UserDID)
+			if err == nil {
+				err = j.store.DeleteRepliedPostsForBookmarkedPostURIandUserDID(bookmark.PostATURI, bookmark.UserDID)
+			}
+			if err != nil {
+				slog.Error("stop tracking replies for bookmark", "error", err, "post AT URI", bookmark.PostATURI, "did", bookmark.UserDID)
+				_ = bugsnag.Notify(err)
+				failed = true
+				continue
+			}
+			janitorReplyTrackingStopped.Inc()
+			total++
+		}
+
+		if len(bookmarks) < janitorBatchSize || failed {
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+func TestJanitorDeletesExpiredBookmarks(t *testing.T) {
+	s := newTestStore(t)
+	now := time.Now()
+
+	bookmarks := map[string]int64{
+		"at://did:plc:author/app.bsky.feed.post/expired":    now.Add(-time.Hour).UnixMilli(),
+		"at://did:plc:author/app.bsky.feed.post/old":        now.Add(-time.Hour * 24 * 10).UnixMilli(),
+		"at://did:plc:author/app.bsky.feed.post/kept":       now.Add(-time.Hour).UnixMilli(),
+		"at://did:plc:author/app.bsky.feed.post/kept-later": now.Add(-time.Hour * 24 * 10).UnixMilli(),
+	}
+	for uri, createdAt := range bookmarks {
+		if err := s.CreateBookmark("", "", uri, "", testAuthorDID, "author.test", testUserDID, "a post", createdAt); err != nil {
+			t.Fatalf("create bookmark: %s", err)
+		}
+		err := s.AddRepliedPost(store.ReplyPost{ReplyURI: uri + "-reply", UserDID: testUserDID, SubscribedPostURI: uri})
+		if err != nil {
+			t.Fatalf("add replied post: %s", err)
+		}
+	}
+
+	if err := s.SetBookmarkTTLDays(testUserDID, 7); err != nil {
+		t.Fatalf("set bookmark TTL: %s", err)
+	}
+	// a bookmark's own expiry is used instead of the users TTL
+	if err := s.SetBookmarkExpiry("at://did:plc:author/app.bsky.feed.post/expired", testUserDID, now.Add(-time.Minute).UnixMilli()); err != nil {
+		t.Fatalf("set bookmark expiry: %s", err)
+	}
+	if err := s.SetBookmarkExpiry("at://did:plc:author/app.bsky.feed.post/kept-later", testUserDID, now.Add(time.Hour).UnixMilli()); err != nil {
+		t.Fatalf("set bookmark expiry: %s", err)
+	}
+
+	if err := s.SetBookmarkRecordKey("at://did:plc:author/app.bsky.feed.post/expired", testUserDID, "3krecord"); err != nil {
+		t.Fatalf("set bookmark record key: %s", err)
+	}
+
+	pds := newFakePDS(t)
+	sessions := newFakeOauthSessions()
+	sessions.add(t, testUserDID, pds.URL())
+
+	j := newJanitor(s, newBookmarkRecords(s, newUserRepoWriter(sessions)), nil, time.Hour, 0)
+	if err := j.Clean(context.Background(), now); err != nil {
+		t.Fatalf("clean: %s", err)
+	}
+
+	deletes := pds.Deletes()
+	if len(deletes) != 1 || deletes[0].RKey != "3krecord" {
+		t.Errorf("expected the expired bookmarks record to be deleted, got %+v", deletes)
+	}
+
+	remaining, err := s.GetBookmarksForUser(testUserDID)
+	if err != nil {
+		t.Fatalf("get bookmarks: %s", err)
+	}
+	remainingURIs := make(map[string]bool)
+	for _, bookmark := range remaining {
+		remainingURIs[bookmark.PostATURI] = true
+	}
+	if len(remaining) != 2 || !remainingURIs["at://did:plc:author/app.bsky.feed.post/kept"] || !remainingURIs["at://did:plc:author/app.bsky.feed.post/kept-later"] {
+		t.Errorf("expected only the unexpired bookmarks to remain, got %+v", remainingURIs)
+	}
+
+	replies, err := s.GetUsersReplies(testUserDID, now.Add(time.Hour).UnixMilli(), 10)
+	if err != nil {
+		t.Fatalf("get users replies: %s", err)
+	}
+	if len(replies) != 2 {
+		t.Errorf("expected replies to expired bookmarks to be deleted, got %+v", replies)
+	}
+	if s.IsPostBookmarked("at://did:plc:author/app.bsky.feed.post/expired") {
+		t.Error("expected expired bookmark to be removed from the index")
+	}
+}
+
+func TestJanitorStopsTrackingOldReplies(t *testing.T) {
+	s := newTestStore(t)
+	now := time.Now()
+
+	oldURI := "at://did:plc:author/app.bsky.feed.post/old"
+	newURI := "at://did:plc:author/app.bsky.feed.post/new"
+	for uri, createdAt := range map[string]int64{oldURI: now.Add(-time.Hour * 24 * 40).UnixMilli(), newURI: now.UnixMilli()} {
+		if err := s.CreateBookmark("", "", uri, uri, testAuthorDID, "author.test", testUserDID, "a post", createdAt); err != nil {
+			t.Fatalf("create bookmark: %s", err)
+		}
+		err := s.AddRepliedPost(store.ReplyPost{ReplyURI: uri + "-reply", UserDID: testUserDID, SubscribedPostURI: uri})
+		if err != nil {
+			t.Fatalf("add replied post: %s", err)
+		}
+		if err := s.SetBookmarkFollowThread(uri, testUserDID, true); err != nil {
+			t.Fatalf("follow thread: %s", err)
+		}
+		err = s.AddThreadReply(store.ThreadReply{ReplyURI: uri + "-thread-reply", RootURI: uri, ParentURI: uri, Depth: 1, CreatedAt: now.UnixMilli()})
+		if err != nil {
+			t.Fatalf("add thread reply: %s", err)
+		}
+	}
+
+	j := newJanitor(s, newBookmarkRecords(s, nil), nil, time.Hour, time.Hour*24*30)
+	if err := j.Clean(context.Background(), now); err != nil {
+		t.Fatalf("clean: %s", err)
+	}
+
+	if s.IsPostBookmarked(oldURI) {
+		t.Error("expected replies to the old bookmark to no longer be tracked")
+	}
+	if !s.IsPostBookmarked(newURI) {
+		t.Error("expected replies to the new bookmark to still be tracked")
+	}
+	if s.IsThreadFollowed(oldURI) {
+		t.Error("expected the old bookmarks thread to no longer be followed")
+	}
+	if !s.IsThreadFollowed(newURI) {
+		t.Error("expected the new bookmarks thread to still be followed")
+	}
+
+	replies, err := s.GetUsersReplies(testUserDID, now.Add(time.Hour).UnixMilli(), 10)
+	if err != nil {
+		t.Fatalf("get users replies: %s", err)
+	}
+	if len(replies) != 1 || replies[0].SubscribedPostURI != newURI {
+		t.Errorf("expected only replies to the new bookmark to remain, got %+v", replies)
+	}
+
+	bookmark, err := s.GetBookmarkByURIForUser(oldURI, testUserDID)
+	if err != nil {
+		t.Fatalf("get bookmark: %s", err)
+	}
+	if bookmark == nil || bookmark.TrackReplies || bookmark.FollowThread {
+		t.Errorf("expected the old bookmark to be kept without tracking replies, got %+v", bookmark)
+	}
+
+	threadReplies, err := s.GetUsersThreadReplies(testUserDID, now.Add(time.Hour).UnixMilli(), 10)
+	if err != nil {
+		t.Fatalf("get users thread replies: %s", err)
+	}
+	if len(threadReplies) != 1 || threadReplies[0].RootURI != newURI {
+		t.Errorf("expected only thread replies to the new bookmark to remain, got %+v", threadReplies)
+	}
+	counts, err := s.GetTableRowCounts()
+	if err != nil {
+		t.Fatalf("get table row counts: %s", err)
+	}
+	if counts["thread_replies"] != 1 {
+		t.Errorf("expected the old thread replies to be removed, got %d rows", counts["thread_replies"])
+	}
+}
@@ -5,20 +5,38 @@ import (
 	"errors"
 	"log"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"path"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/avast/retry-go/v4"
 	"github.com/bugsnag/bugsnag-go/v2"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/willdot/bskyfeedgen/store"
 )
 
 const (
-	defaultServerAddr = "wss://jetstream.atproto.tools/subscribe"
+	defaultServerAddr     = "wss://jetstream.atproto.tools/subscribe"
+	defaultMaxRewind      = time.Hour * 24
+	defaultThreadMaxDepth = 10
+	defaultJSWorkers      = 4
+	// how long the last processed Jetstream event and the last successful DM poll can be before they are unhealthy
+	defaultJetstreamMaxAge = time.Minute * 5
+	defaultDMPollMaxAge    = time.Minute * 5
+	defaultJanitorInterval = time.Hour
+	// replies are capped per bookmark by default but are never aged out unless configured
+	defaultRetentionInterval  = time.Hour * 6
+	defaultRepliesPerBookmark = 1000
+	defaultAppViewURL         = "https://public.api.bsky.app"
+	// sessions are signed out after a week without being used, and a month after logging in no matter what
+	defaultSessionIdleTimeout     = time.Hour * 24 * 7
+	defaultSessionAbsoluteTimeout = time.Hour * 24 * 30
+	defaultRowCountInterval       = time.Minute * 15
 )
 
 func main() {
@@ -47,6 +65,11 @@ func main() {
 		slog.Error("FEED_HOST_NAME not set")
 		os.Exit(1)
 	}
+	sessionKey := os.Getenv("SESSION_KEY")
+	if sessionKey == "" {
+		slog.Error("SESSION_KEY not set")
+		os.Exit(1)
+	}
 	dbMountPath := os.Getenv("RAILWAY_VOLUME_MOUNT_PATH")
 	if dbMountPath == "" {
 		slog.Error("RAILWAY_VOLUME_MOUNT_PATH env not set")
@@ -65,6 +88,12 @@ func main() {
 	}
 
 	dbFilename := path.Join(dbMountPath, "database.db")
+
+	if os.Getenv("DB_MIGRATIONS_DRY_RUN") == "true" {
+		dryRunMigrations(dbFilename)
+		return
+	}
+
 	store, err := store.New(dbFilename)
 	if err != nil {
 		slog.Error("create new store", "error", err)
@@ -73,33 +102,102 @@ func main() {
 	}
 	defer store.Close()
 
-	feeder := NewFeedGenerator(store)
+	feeds := NewFeedRegistry(feedDidBase)
+	NewFeedGenerator(store).RegisterFeeds(feeds)
+	health := newHealthChecker(store)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	rowCounts := newRowCountCollector(store, durationFromEnv("METRICS_ROW_COUNT_INTERVAL", defaultRowCountInterval))
+	prometheus.MustRegister(rowCounts)
+	go rowCounts.Run(ctx)
+
+	// metrics are only served when given their own address so that they're never public
+	var metricsServer *http.Server
+	if metricsAddr := os.Getenv("METRICS_ADDR"); metricsAddr != "" {
+		metricsServer = newMetricsServer(metricsAddr)
+		go func() {
+			err := metricsServer.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("metrics listen and serve", "error", err)
+			}
+		}()
+	}
+
+	appViewURL := os.Getenv("APPVIEW_URL")
+	if appViewURL == "" {
+		appViewURL = defaultAppViewURL
+	}
+
 	if enableJS == "true" {
 		slog.Info("enabling jetstream consume")
-		go consumeLoop(ctx, store)
+		go consumeLoop(ctx, store, health, appViewURL)
 	}
 
-	dmService, err := NewDmService(store, time.Second*30)
+	replyTrackingDays := 0
+	if replyTrackingDaysStr := os.Getenv("REPLY_TRACKING_DAYS"); replyTrackingDaysStr != "" {
+		replyTrackingDays, err = strconv.Atoi(replyTrackingDaysStr)
+		if err != nil || replyTrackingDays < 0 {
+			slog.Error("invalid REPLY_TRACKING_DAYS - replies will be tracked forever", "error", err)
+			replyTrackingDays = 0
+		}
+	}
+	sessionStore := newSessionStore(store, sessionKey)
+
+	dmService, err := NewDmService(store, DmServiceConfig{
+		AccessHandle:      os.Getenv("MESSAGING_ACCESS_HANDLE"),
+		AccessAppPassword: os.Getenv("MESSAGING_ACCESS_APP_PASSWORD"),
+		PDSURL:            os.Getenv("MESSAGING_PDS_URL"),
+		AuthURL:           os.Getenv("MESSAGING_AUTH_URL"),
+		TimerDuration:     time.Second * 30,
+		FeedHost:          feedHost,
+	})
 	if err != nil {
 		slog.Error("create new dm service", "error", err)
 		_ = bugsnag.Notify(err)
 		return
 	}
-	go dmService.Start(ctx)
+	// collection feeds are published to the messaging account repo, but are served and described as FEED_DID_BASE
+	if dmService.currentAuth().Did != feedDidBase {
+		slog.Warn("messaging account isn't FEED_DID_BASE - collection feeds won't be published", "messaging did", dmService.currentAuth().Did, "feed did base", feedDidBase)
+		dmService.feedPublisher = nil
+	}
+
+	repliesPerBookmark := defaultRepliesPerBookmark
+	if repliesPerBookmarkStr := os.Getenv("REPLIES_MAX_PER_BOOKMARK"); repliesPerBookmarkStr != "" {
+		repliesPerBookmark, err = strconv.Atoi(repliesPerBookmarkStr)
+		if err != nil || repliesPerBookmark < 0 {
+			slog.Error("invalid REPLIES_MAX_PER_BOOKMARK - using default", "error", err, "default", defaultRepliesPerBookmark)
+			repliesPerBookmark = defaultRepliesPerBookmark
+		}
+	}
+	retention := newRetention(store, durationFromEnv("RETENTION_INTERVAL", defaultRetentionInterval), durationFromEnv("REPLIES_MAX_AGE", 0), repliesPerBookmark)
+	go retention.Run(ctx)
+	health.WatchLastSeen("dm poll", durationFromEnv("HEALTH_DM_POLL_MAX_AGE", defaultDMPollMaxAge), dmService.LastSuccessfulPoll)
+	health.WatchCondition("dm session", dmService.SessionValid)
 
-	server, err := NewServer(443, feeder, feedHost, feedDidBase, store)
+	server, err := NewServer(443, feeds, feedHost, feedDidBase, appViewURL, store, sessionStore, dmService.feedPublisher, health)
 	if err != nil {
 		slog.Error("create new server", "error", err)
 		_ = bugsnag.Notify(err)
 		return
 	}
+	go server.oauthSessions.Run(ctx)
+
+	// bookmarks made or deleted over DMs or by the janitor are written to users repos too
+	dmService.bookmarkRecords = server.bookmarkRecords
+	go dmService.Start(ctx)
+
+	janitor := newJanitor(store, server.bookmarkRecords, sessionStore, durationFromEnv("JANITOR_INTERVAL", defaultJanitorInterval), time.Duration(replyTrackingDays)*time.Hour*24)
+	go janitor.Run(ctx)
+
 	go func() {
 		<-signals
 		cancel()
+		if metricsServer != nil {
+			_ = metricsServer.Shutdown(context.Background())
+		}
 		_ = server.Stop(context.Background())
 	}()
 
@@ -109,17 +207,73 @@ func main() {
 	time.Sleep(time.Second)
 }
 
-func consumeLoop(ctx context.Context, store *store.Store) {
-	handler := handler{
-		store: store,
+func dryRunMigrations(dbFilename string) {
+	pending, err := store.DryRunMigrations(dbFilename)
+	if err != nil {
+		slog.Error("dry run migrations", "error", err)
+		os.Exit(1)
+	}
+
+	for _, migration := range pending {
+		slog.Info("pending migration", "version", migration.Version, "name", migration.Name)
+	}
+	slog.Info("migrations dry run complete", "pending migrations", len(pending))
+}
+
+// newSessionStore creates the store for users web sessions. Cookies signed with SESSION_KEY_PREVIOUS are still accepted
+// so that the key can be rotated without signing everyone out.
+func newSessionStore(db *store.Store, sessionKey string) *store.SessionStore {
+	keyPairs := [][]byte{[]byte(sessionKey), nil}
+	if previousKey := os.Getenv("SESSION_KEY_PREVIOUS"); previousKey != "" {
+		keyPairs = append(keyPairs, []byte(previousKey), nil)
 	}
 
+	idleTimeout := durationFromEnv("SESSION_IDLE_TIMEOUT", defaultSessionIdleTimeout)
+	absoluteTimeout := durationFromEnv("SESSION_ABSOLUTE_TIMEOUT", defaultSessionAbsoluteTimeout)
+	return store.NewSessionStore(db, idleTimeout, absoluteTimeout, keyPairs...)
+}
+
+func consumeLoop(ctx context.Context, store *store.Store, health *healthChecker, appViewURL string) {
+	threadMaxDepth := defaultThreadMaxDepth
+	if threadMaxDepthStr := os.Getenv("THREAD_MAX_DEPTH"); threadMaxDepthStr != "" {
+		var err error
+		threadMaxDepth, err = strconv.Atoi(threadMaxDepthStr)
+		if err != nil || threadMaxDepth < 1 {
+			slog.Error("invalid THREAD_MAX_DEPTH - using default", "error", err, "default", defaultThreadMaxDepth)
+			threadMaxDepth = defaultThreadMaxDepth
+		}
+	}
+
+	handler := newHandler(store, threadMaxDepth, newBookmarkRecordIndexer(store, appViewURL))
+
 	jsServerAddr := os.Getenv("JS_SERVER_ADDR")
 	if jsServerAddr == "" {
 		jsServerAddr = defaultServerAddr
 	}
 
-	consumer := NewConsumer(jsServerAddr, slog.Default(), &handler)
+	maxRewind := defaultMaxRewind
+	if maxRewindStr := os.Getenv("JS_MAX_REWIND"); maxRewindStr != "" {
+		var err error
+		maxRewind, err = time.ParseDuration(maxRewindStr)
+		if err != nil {
+			slog.Error("invalid JS_MAX_REWIND - using default", "error", err, "default", defaultMaxRewind.String())
+			maxRewind = defaultMaxRewind
+		}
+	}
+
+	workers := defaultJSWorkers
+	if workersStr := os.Getenv("JS_WORKERS"); workersStr != "" {
+		var err error
+		workers, err = strconv.Atoi(workersStr)
+		if err != nil || workers < 1 {
+			slog.Error("invalid JS_WORKERS - using default", "error", err, "default", defaultJSWorkers)
+			workers = defaultJSWorkers
+		}
+	}
+
+	consumer := NewConsumer(jsServerAddr, slog.Default(), handler, store, maxRewind, workers)
+	health.WatchLastSeen("jetstream", durationFromEnv("HEALTH_JETSTREAM_MAX_AGE", defaultJetstreamMaxAge), consumer.LastProcessedAt)
+	prometheus.MustRegister(newJetstreamConsumerLagGauge(consumer.LastEventTime))
 
 	_ = retry.Do(func() error {
 		err := consumer.Consume(ctx)
@@ -135,3 +289,18 @@ func consumeLoop(ctx context.Context, store *store.Store) {
 
 	slog.Warn("exiting consume loop")
 }
+
+// durationFromEnv parses the named env var as a duration, falling back to the default if it's not set or invalid.
+func durationFromEnv(name string, defaultDuration time.Duration) time.Duration {
+	durationStr := os.Getenv(name)
+	if durationStr == "" {
+		return defaultDuration
+	}
+
+	duration, err := time.ParseDuration(durationStr)
+	if err != nil || duration <= 0 {
+		slog.Error("invalid duration env var - using default", "name", name, "error", err, "default", defaultDuration.String())
+		return defaultDuration
+	}
+	return duration
+}
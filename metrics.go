@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bugsnag/bugsnag-go/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// bookmarkIndexLookups counts checks of the in memory bookmark indexes by the firehose handler. Misses are
+	// posts that were rejected without touching the database.
+	bookmarkIndexLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bsfeeder_bookmark_index_lookups_total",
+		Help: "The number of firehose posts checked against the in memory bookmark indexes",
+	}, []string{"index", "result"})
+
+	bookmarkIndexPostHits     = bookmarkIndexLookups.WithLabelValues("post", "hit")
+	bookmarkIndexPostMisses   = bookmarkIndexLookups.WithLabelValues("post", "miss")
+	bookmarkIndexThreadHits   = bookmarkIndexLookups.WithLabelValues("thread", "hit")
+	bookmarkIndexThreadMisses = bookmarkIndexLookups.WithLabelValues("thread", "miss")
+
+	feedSkeletonRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bsfeeder_feed_skeleton_request_duration_seconds",
+		Help:    "How long getFeedSkeleton requests took, by feed and response status",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"feed", "status"})
+
+	jetstreamEventsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bsfeeder_jetstream_events_processed_total",
+		Help: "The number of Jetstream events handled, by event kind",
+	}, []string{"kind"})
+
+	// jetstreamEventsMatched counts posts that were stored because they matched a bookmark or followed thread
+	jetstreamEventsMatched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bsfeeder_jetstream_events_matched_total",
+		Help: "The number of Jetstream posts that matched a bookmark, by match type",
+	}, []string{"match"})
+
+	jetstreamReplyMatches  = jetstreamEventsMatched.WithLabelValues("reply")
+	jetstreamQuoteMatches  = jetstreamEventsMatched.WithLabelValues("quote")
+	jetstreamThreadMatches = jetstreamEventsMatched.WithLabelValues("thread")
+
+	dmPollDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bsfeeder_dm_poll_duration_seconds",
+		Help:    "How long each poll for unread DMs took",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	dmPollErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bsfeeder_dm_poll_errors_total",
+		Help: "The number of errors fetching unread DMs",
+	})
+
+	janitorBookmarksExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bsfeeder_janitor_bookmarks_expired_total",
+		Help: "The number of expired bookmarks deleted by the janitor",
+	})
+
+	janitorReplyTrackingStopped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bsfeeder_janitor_reply_tracking_stopped_total",
+		Help: "The number of bookmarks the janitor stopped tracking replies for",
+	})
+
+	retentionRowsRemoved = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bsfeeder_retention_rows_removed_total",
+		Help: "The number of replies removed by retention, by the reason they were removed",
+	}, []string{"reason"})
+
+	retentionRepliesAged   = retentionRowsRemoved.WithLabelValues("age")
+	retentionRepliesCapped = retentionRowsRemoved.WithLabelValues("cap")
+
+	retentionCompactDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bsfeeder_retention_compact_duration_seconds",
+		Help:    "How long compacting the database took",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	oauthTokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bsfeeder_oauth_token_refreshes_total",
+		Help: "The number of OAuth token refreshes, by result",
+	}, []string{"result"})
+
+	oauthTokenRefreshesOK      = oauthTokenRefreshes.WithLabelValues("ok")
+	oauthTokenRefreshesFailed  = oauthTokenRefreshes.WithLabelValues("failed")
+	oauthTokenRefreshesRevoked = oauthTokenRefreshes.WithLabelValues("revoked")
+)
+
+// instrumentFeedSkeleton records the latency and response status of getFeedSkeleton requests, labelled by the feeds in
+// the registry.
+func instrumentFeedSkeleton(feeds *FeedRegistry, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next(rec, r)
+
+		feed := feeds.MetricName(r.URL.Query().Get("feed"))
+		feedSkeletonRequestDuration.WithLabelValues(feed, strconv.Itoa(rec.status)).Observe(time.Since(start).Seconds())
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+type TableRowCounter interface {
+	GetTableRowCounts() (map[string]int, error)
+}
+
+// rowCountCollector reports the number of rows in each table, counted from the database rather than keeping a running
+// count that could drift from it. Counting scans the whole table so it's done on a timer rather than on every scrape.
+type rowCountCollector struct {
+	store    TableRowCounter
+	desc     *prometheus.Desc
+	interval time.Duration
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newRowCountCollector(store TableRowCounter, interval time.Duration) *rowCountCollector {
+	return &rowCountCollector{
+		store:    store,
+		desc:     prometheus.NewDesc("bsfeeder_table_rows", "The number of rows in each table", []string{"table"}, nil),
+		interval: interval,
+	}
+}
+
+func (c *rowCountCollector) Run(ctx context.Context) {
+	c.Count()
+
+	timer := time.NewTimer(c.interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			c.Count()
+			timer.Reset(c.interval)
+		}
+	}
+}
+
+// Count counts the rows in each table so that the counts are reported until the next time they're counted.
+func (c *rowCountCollector) Count() {
+	counts, err := c.store.GetTableRowCounts()
+	if err != nil {
+		slog.Error("get table row counts for metrics", "error", err)
+		_ = bugsnag.Notify(err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts = counts
+}
+
+func (c *rowCountCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *rowCountCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for table, count := range c.counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), table)
+	}
+}
+
+// newMetricsServer serves the Prometheus metrics on their own address, such as one that's only reachable from inside
+// the deployment, so that they aren't public alongside the feeds and web UI.
+func newMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	return &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+}
+
+// newJetstreamConsumerLagGauge reports how far behind the network the last fully processed event is. It's worked out
+// when metrics are scraped so that it keeps growing if the stream stalls.
+func newJetstreamConsumerLagGauge(lastEventTime func() time.Time) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "bsfeeder_jetstream_consumer_lag_seconds",
+		Help: "The time between now and the last fully processed Jetstream event",
+	}, func() float64 {
+		last := lastEventTime()
+		if last.IsZero() {
+			return 0
+		}
+		return time.Since(last).Seconds()
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+func TestFeedMetricName(t *testing.T) {
+	feeds := newTestFeeds(newTestStore(t))
+
+	tt := map[string]string{
+		"at://did:web:feeds.test/app.bsky.feed.generator/bookmarks":                       "bookmarks",
+		"at://did:web:feeds.test/app.bsky.feed.generator/bookmark-replies":                "bookmark-replies",
+		"at://did:web:feeds.test/app.bsky.feed.generator/bookmark-threads":                "bookmark-threads",
+		"at://did:web:feeds.test/app.bsky.feed.generator/" + store.CollectionFeedRKey(12): "collection",
+		"at://did:web:feeds.test/app.bsky.feed.generator/something-else":                  "unknown",
+		"at://did:web:other.test/app.bsky.feed.generator/bookmarks":                       "unknown",
+		"": "unknown",
+	}
+
+	for feed, expected := range tt {
+		if got := feeds.MetricName(feed); got != expected {
+			t.Errorf("feed %q: expected %q, got %q", feed, expected, got)
+		}
+	}
+}
+
+func feedSkeletonRequestCount(t *testing.T, feed, status string) uint64 {
+	t.Helper()
+
+	var metric dto.Metric
+	histogram := feedSkeletonRequestDuration.WithLabelValues(feed, status).(prometheus.Histogram)
+	if err := histogram.Write(&metric); err != nil {
+		t.Fatalf("write histogram: %s", err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestFeedSkeletonRequestsAreRecorded(t *testing.T) {
+	srv, _ := newTestServer(t, newFakeAppView(t))
+	handler := instrumentFeedSkeleton(srv.feeds, srv.HandleGetFeedSkeleton)
+
+	// the metrics are global so only the change is checked
+	before := feedSkeletonRequestCount(t, "bookmarks", "401")
+
+	// an invalid token so the request is rejected
+	req := httptest.NewRequest(http.MethodGet, "/xrpc/app.bsky.feed.getFeedSkeleton?feed=at://did:web:feeds.test/app.bsky.feed.generator/bookmarks", nil)
+	req.Header.Set("Authorization", "Bearer not-a-jwt")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	if got := feedSkeletonRequestCount(t, "bookmarks", "401"); got != before+1 {
+		t.Errorf("expected 1 request to be recorded, got %d", got-before)
+	}
+
+	rec = httptest.NewRecorder()
+	newMetricsServer(":0").Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `bsfeeder_feed_skeleton_request_duration_seconds_count{feed="bookmarks",status="401"}`) {
+		t.Error("expected the metrics endpoint to serve feed skeleton requests")
+	}
+}
+
+func TestRowCountCollector(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.CreateBookmark("bookmarked", "", testBookmarkURI, "", testAuthorDID, "author.test", testUserDID, "a post", 0); err != nil {
+		t.Fatalf("create bookmark: %s", err)
+	}
+
+	collector := newRowCountCollector(s, time.Hour)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	collector.Count()
+
+	expected := `
+# HELP bsfeeder_table_rows The number of rows in each table
+# TYPE bsfeeder_table_rows gauge
+bsfeeder_table_rows{table="bookmarks"} 1
+bsfeeder_table_rows{table="replies"} 0
+bsfeeder_table_rows{table="thread_replies"} 0
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+
+	// scrapes report the last counts rather than counting the tables again
+	if err := s.CreateBookmark("another", "", testBookmarkURI+"2", "", testAuthorDID, "author.test", testUserDID, "a post", 0); err != nil {
+		t.Fatalf("create bookmark: %s", err)
+	}
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+
+	collector.Count()
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(strings.Replace(expected, `{table="bookmarks"} 1`, `{table="bookmarks"} 2`, 1))); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJetstreamConsumerLagGrowsWhenStalled(t *testing.T) {
+	var lastEvent time.Time
+	gauge := newJetstreamConsumerLagGauge(func() time.Time { return lastEvent })
+
+	if lag := testutil.ToFloat64(gauge); lag != 0 {
+		t.Errorf("expected no lag before any events, got %f", lag)
+	}
+
+	// no events have been processed since, so the lag is measured from when the stream stalled
+	lastEvent = time.Now().Add(-time.Minute)
+	if lag := testutil.ToFloat64(gauge); lag < 60 {
+		t.Errorf("expected lag of at least 60 seconds, got %f", lag)
+	}
+}
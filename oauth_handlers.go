@@ -9,8 +9,8 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
-	"github.com/gorilla/sessions"
 	oauth "github.com/haileyok/atproto-oauth-golang"
 	oauthhelpers "github.com/haileyok/atproto-oauth-golang/helpers"
 	"github.com/lestrrat-go/jwx/v2/jwk"
@@ -69,7 +69,7 @@ func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	usersDID, err := resolveHandle(loginReq.Handle)
+	usersDID, err := resolveHandle(s.appViewURL, loginReq.Handle)
 	if err != nil {
 		slog.Error("resolve users handle", "error", err)
 		_ = frontend.Login("", "bad request").Render(r.Context(), w)
@@ -121,11 +121,7 @@ func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	session, _ := s.sessionStore.Get(r, "oauth-session")
 	session.Values = map[interface{}]interface{}{}
 
-	session.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   300, // save for five minutes
-		HttpOnly: true,
-	}
+	session.Options = sessionOptions(300) // save for five minutes
 
 	session.Values["oauth_state"] = parResp.State
 	session.Values["oauth_did"] = usersDID
@@ -224,15 +220,58 @@ func (s *Server) handleOauthCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   86400 * 7,
-		HttpOnly: true,
+	if initialTokenResp.Sub != oauthRequest.Did {
+		slog.Error("token request was for a different did", "expected", oauthRequest.Did, "sub", initialTokenResp.Sub)
+		_ = frontend.Login("", "internal server errror").Render(r.Context(), w)
+		return
+	}
+
+	pdsURL, err := resolveService(r.Context(), oauthRequest.Did)
+	if err != nil {
+		slog.Error("resolve users PDS", "error", err)
+		_ = frontend.Login("", "internal server errror").Render(r.Context(), w)
+		return
+	}
+
+	now := time.Now()
+	err = s.oauthSessionStore.SaveOauthSession(store.OauthSession{
+		Did:                 oauthRequest.Did,
+		PdsURL:              pdsURL,
+		AuthserverIss:       oauthRequest.AuthserverIss,
+		AccessToken:         initialTokenResp.AccessToken,
+		RefreshToken:        initialTokenResp.RefreshToken,
+		DpopAuthserverNonce: initialTokenResp.DpopAuthserverNonce,
+		DpopPrivateJwk:      oauthRequest.DpopPrivateJwk,
+		ExpiresAt:           now.Add(time.Duration(initialTokenResp.ExpiresIn) * time.Second).UnixMilli(),
+		UpdatedAt:           now.UnixMilli(),
+	})
+	if err != nil {
+		slog.Error("save oauth session", "error", err)
+		_ = frontend.Login("", "internal server errror").Render(r.Context(), w)
+		return
+	}
+
+	// logging in gets a new session ID so that one that was known before logging in can't be used
+	err = s.sessionStore.RenewID(session)
+	if err != nil {
+		slog.Error("renew session ID", "error", err)
+		_ = frontend.Login("", "internal server errror").Render(r.Context(), w)
+		return
+	}
+
+	session.Options = sessionOptions(s.sessionStore.Options.MaxAge)
+
+	csrfToken, err := newCSRFToken()
+	if err != nil {
+		slog.Error("create csrf token", "error", err)
+		_ = frontend.Login("", "internal server errror").Render(r.Context(), w)
+		return
 	}
 
 	// make sure the session is empty
 	session.Values = map[interface{}]interface{}{}
 	session.Values["did"] = oauthRequest.Did
+	session.Values[csrfSessionKey] = csrfToken
 
 	err = session.Save(r, w)
 	if err != nil {
@@ -242,9 +281,11 @@ func (s *Server) handleOauthCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// TODO: work out how the hell HTMX redirects really work
-	s.HandleGetBookmarks(w, r)
+	s.HandleGetBookmarks(w, r.WithContext(frontend.WithCSRFToken(r.Context(), csrfToken)))
 }
 
+// HandleSignOut is a POST behind the CSRF middleware so that other sites can't sign users out, and redirects back to the
+// login page once the session has been cleared.
 func (s *Server) HandleSignOut(w http.ResponseWriter, r *http.Request) {
 	session, err := s.sessionStore.Get(r, "oauth-session")
 	if err != nil {
@@ -252,12 +293,11 @@ func (s *Server) HandleSignOut(w http.ResponseWriter, r *http.Request) {
 		_ = frontend.Login("", "internal server error").Render(r.Context(), w)
 		return
 	}
+
+	did, signedIn := s.getDidFromSession(r)
+
 	session.Values = map[interface{}]interface{}{}
-	session.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   -1,
-		HttpOnly: true,
-	}
+	session.Options = sessionOptions(-1)
 
 	err = session.Save(r, w)
 	if err != nil {
@@ -266,6 +306,11 @@ func (s *Server) HandleSignOut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if signedIn && s.oauthSessions != nil {
+		s.revokeOauthSessionIfSignedOut(r.Context(), did)
+	}
+
+	w.Header().Add("HX-Redirect", "/")
 	_ = frontend.Login("", "").Render(r.Context(), w)
 }
 
@@ -321,3 +366,22 @@ func resolveService(ctx context.Context, did string) (string, error) {
 
 	return service, nil
 }
+
+// revokeOauthSessionIfSignedOut revokes the users OAuth session once they have no web sessions left, as it's shared by
+// all of the devices they're signed in on.
+func (s *Server) revokeOauthSessionIfSignedOut(ctx context.Context, did string) {
+	webSessions, err := s.sessionStore.SessionsForUser(did)
+	if err != nil {
+		slog.Error("get web sessions for user", "error", err, "did", did)
+		return
+	}
+	if len(webSessions) > 0 {
+		return
+	}
+
+	err = s.oauthSessions.Revoke(ctx, did)
+	if err != nil {
+		// the session has still been deleted so carry on signing out
+		slog.Error("revoke oauth session", "error", err, "did", did)
+	}
+}
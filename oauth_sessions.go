@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bugsnag/bugsnag-go/v2"
+	oauth "github.com/haileyok/atproto-oauth-golang"
+	oauthhelpers "github.com/haileyok/atproto-oauth-golang/helpers"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+const (
+	defaultOauthRefreshInterval = time.Minute
+	// access tokens are refreshed when they have less than this left so that they don't expire mid request
+	oauthRefreshWindow = time.Minute * 5
+	// how many sessions are refreshed each interval, any more are refreshed on the next one
+	oauthRefreshBatchSize = 100
+	// sessions that fail to refresh wait this long before being retried, doubling with each failure up to the max
+	oauthRefreshMinBackoff = time.Minute
+	oauthRefreshMaxBackoff = time.Hour
+)
+
+type OauthSessionStore interface {
+	SaveOauthSession(session store.OauthSession) error
+	GetOauthSession(did string) (*store.OauthSession, error)
+	GetOauthSessionsExpiringBefore(before, now int64, limit int) ([]store.OauthSession, error)
+	UpdateOauthSessionDpopPdsNonce(did, nonce string) error
+	SetOauthSessionRefreshBackoff(did string, failures int, nextRefreshAt int64) error
+	DeleteOauthSession(did string) error
+}
+
+// OauthTokenClient makes the requests to a users authorization server. It's implemented by *oauth.Client.
+type OauthTokenClient interface {
+	RefreshTokenRequest(ctx context.Context, refreshToken, authserverIss, dpopAuthserverNonce string, dpopPrivateJwk jwk.Key) (*oauth.TokenResponse, error)
+	FetchAuthServerMetadata(ctx context.Context, ustr string) (*oauth.OauthAuthorizationMetadata, error)
+	ClientAssertionJwt(authServerUrl string) (string, error)
+	AuthServerDpopJwt(method, url, nonce string, privateJwk jwk.Key) (string, error)
+}
+
+// oauthSessions keeps users OAuth sessions usable by refreshing their tokens before they expire, and revokes them when
+// the user signs out.
+type oauthSessions struct {
+	store      OauthSessionStore
+	client     OauthTokenClient
+	clientID   string
+	httpClient *http.Client
+	interval   time.Duration
+
+	// refresh tokens can only be used once, so refreshes of the same session must not run at the same time
+	locksMu sync.Mutex
+	locks   map[string]*sync.Mutex
+}
+
+func newOauthSessions(store OauthSessionStore, client OauthTokenClient, clientID string, interval time.Duration) *oauthSessions {
+	return &oauthSessions{
+		store:      store,
+		client:     client,
+		clientID:   clientID,
+		httpClient: &http.Client{Timeout: time.Second * 10},
+		interval:   interval,
+		locks:      make(map[string]*sync.Mutex),
+	}
+}
+
+func (o *oauthSessions) lock(did string) func() {
+	o.locksMu.Lock()
+	mu, ok := o.locks[did]
+	if !ok {
+		mu = &sync.Mutex{}
+		o.locks[did] = mu
+	}
+	o.locksMu.Unlock()
+
+	mu.Lock()
+	return mu.Unlock
+}
+
+func (o *oauthSessions) Run(ctx context.Context) {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			o.RefreshExpiring(ctx, time.Now())
+		}
+	}
+}
+
+// RefreshExpiring refreshes the sessions that will expire within the refresh window of now. Sessions that fail to
+// refresh are backed off so that they don't stay at the front of the queue and stop other sessions being refreshed.
+func (o *oauthSessions) RefreshExpiring(ctx context.Context, now time.Time) {
+	before := now.Add(oauthRefreshWindow).UnixMilli()
+
+	sessions, err := o.store.GetOauthSessionsExpiringBefore(before, now.UnixMilli(), oauthRefreshBatchSize)
+	if err != nil {
+		slog.Error("get expiring oauth sessions", "error", err)
+		_ = bugsnag.Notify(err)
+		return
+	}
+
+	for _, session := range sessions {
+		_, err := o.refreshIfExpiring(ctx, session.Did, before)
+		if err == nil || errors.Is(err, errOauthSessionExpired) || errors.Is(err, errNoOauthSession) {
+			continue
+		}
+
+		slog.Error("refresh oauth session", "error", err, "did", session.Did, "failures", session.RefreshFailures+1)
+		_ = bugsnag.Notify(err)
+
+		failures := session.RefreshFailures + 1
+		err = o.store.SetOauthSessionRefreshBackoff(session.Did, failures, now.Add(oauthRefreshBackoff(failures)).UnixMilli())
+		if err != nil {
+			slog.Error("set oauth session refresh backoff", "error", err, "did", session.Did)
+			_ = bugsnag.Notify(err)
+		}
+	}
+}
+
+// oauthRefreshBackoff returns how long to wait before refreshing a session again after it has failed the given number
+// of times in a row.
+func oauthRefreshBackoff(failures int) time.Duration {
+	backoff := oauthRefreshMinBackoff
+	for i := 1; i < failures && backoff < oauthRefreshMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, oauthRefreshMaxBackoff)
+}
+
+// Session returns the users OAuth session, refreshing it first if it's about to expire.
+func (o *oauthSessions) Session(ctx context.Context, did string) (*store.OauthSession, error) {
+	return o.refreshIfExpiring(ctx, did, time.Now().Add(time.Second*30).UnixMilli())
+}
+
+// AuthArgs returns the args needed to make DPoP bound requests to the users PDS.
+func (o *oauthSessions) AuthArgs(ctx context.Context, did string) (*oauth.XrpcAuthedRequestArgs, error) {
+	session, err := o.Session(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+
+	dpopKey, err := oauthhelpers.ParseJWKFromBytes([]byte(session.DpopPrivateJwk))
+	if err != nil {
+		return nil, fmt.Errorf("parse dpop private JWK: %w", err)
+	}
+
+	return &oauth.XrpcAuthedRequestArgs{
+		Did:            session.Did,
+		PdsUrl:         session.PdsURL,
+		Issuer:         session.AuthserverIss,
+		AccessToken:    session.AccessToken,
+		DpopPdsNonce:   session.DpopPdsNonce,
+		DpopPrivateJwk: dpopKey,
+	}, nil
+}
+
+func (o *oauthSessions) UpdateDpopPdsNonce(did, nonce string) error {
+	return o.store.UpdateOauthSessionDpopPdsNonce(did, nonce)
+}
+
+// refreshIfExpiring refreshes the users session if it expires before the given unix milli time. If the authorization
+// server rejects the refresh token, the session is deleted and the user has to log in again.
+func (o *oauthSessions) refreshIfExpiring(ctx context.Context, did string, before int64) (*store.OauthSession, error) {
+	unlock := o.lock(did)
+	defer unlock()
+
+	// it may have been refreshed while waiting for the lock
+	session, err := o.store.GetOauthSession(did)
+	if err != nil {
+		return nil, fmt.Errorf("get oauth session: %w", err)
+	}
+	if session == nil {
+		return nil, errNoOauthSession
+	}
+	if session.ExpiresAt >= before {
+		return session, nil
+	}
+
+	dpopKey, err := oauthhelpers.ParseJWKFromBytes([]byte(session.DpopPrivateJwk))
+	if err != nil {
+		return nil, fmt.Errorf("parse dpop private JWK: %w", err)
+	}
+
+	tokenResp, err := o.client.RefreshTokenRequest(ctx, session.RefreshToken, session.AuthserverIss, session.DpopAuthserverNonce, dpopKey)
+	if err != nil {
+		if !strings.Contains(err.Error(), "invalid_grant") {
+			oauthTokenRefreshesFailed.Inc()
+			return nil, fmt.Errorf("refresh token request: %w", err)
+		}
+
+		oauthTokenRefreshesRevoked.Inc()
+		slog.Info("oauth refresh token rejected - deleting session", "did", did)
+		err = o.store.DeleteOauthSession(did)
+		if err != nil {
+			return nil, fmt.Errorf("delete rejected oauth session: %w", err)
+		}
+		return nil, errOauthSessionExpired
+	}
+	if tokenResp == nil {
+		oauthTokenRefreshesFailed.Inc()
+		return nil, fmt.Errorf("refresh token request got no response")
+	}
+
+	now := time.Now()
+	session.AccessToken = tokenResp.AccessToken
+	// refresh tokens are rotated on every use, but keep the old one if a new one wasn't sent
+	if tokenResp.RefreshToken != "" {
+		session.RefreshToken = tokenResp.RefreshToken
+	}
+	session.DpopAuthserverNonce = tokenResp.DpopAuthserverNonce
+	session.ExpiresAt = now.Add(time.Duration(tokenResp.ExpiresIn) * time.Second).UnixMilli()
+	session.UpdatedAt = now.UnixMilli()
+	session.RefreshFailures = 0
+	session.NextRefreshAt = 0
+
+	err = o.store.SaveOauthSession(*session)
+	if err != nil {
+		oauthTokenRefreshesFailed.Inc()
+		return nil, fmt.Errorf("save refreshed oauth session: %w", err)
+	}
+
+	oauthTokenRefreshesOK.Inc()
+	return session, nil
+}
+
+// Revoke revokes the users tokens with their authorization server and deletes the session. The session is deleted
+// even if revoking fails so that it can't be used again from here.
+func (o *oauthSessions) Revoke(ctx context.Context, did string) error {
+	unlock := o.lock(did)
+	defer unlock()
+
+	session, err := o.store.GetOauthSession(did)
+	if err != nil {
+		return fmt.Errorf("get oauth session: %w", err)
+	}
+	if session == nil {
+		return nil
+	}
+
+	revokeErr := o.revokeTokens(ctx, session)
+
+	err = o.store.DeleteOauthSession(did)
+	if err != nil {
+		return fmt.Errorf("delete oauth session: %w", err)
+	}
+
+	if revokeErr != nil {
+		return fmt.Errorf("revoke tokens: %w", revokeErr)
+	}
+	return nil
+}
+
+func (o *oauthSessions) revokeTokens(ctx context.Context, session *store.OauthSession) error {
+	meta, err := o.client.FetchAuthServerMetadata(ctx, session.AuthserverIss)
+	if err != nil {
+		return fmt.Errorf("fetch auth server metadata: %w", err)
+	}
+	if meta.RevocationEndpoint == "" {
+		return fmt.Errorf("auth server has no revocation endpoint")
+	}
+
+	dpopKey, err := oauthhelpers.ParseJWKFromBytes([]byte(session.DpopPrivateJwk))
+	if err != nil {
+		return fmt.Errorf("parse dpop private JWK: %w", err)
+	}
+
+	// revoking the refresh token ends the whole grant, the access token is revoked too in case the server doesn't
+	nonce := session.DpopAuthserverNonce
+	for _, token := range []string{session.RefreshToken, session.AccessToken} {
+		nonce, err = o.revokeToken(ctx, meta.RevocationEndpoint, session.AuthserverIss, token, nonce, dpopKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeToken sends a token revocation request, retrying once if the server asks for a new DPoP nonce. It returns the
+// nonce that was used so that it can be reused for the next request.
+func (o *oauthSessions) revokeToken(ctx context.Context, endpoint, authserverIss, token, nonce string, dpopKey jwk.Key) (string, error) {
+	for range 2 {
+		clientAssertion, err := o.client.ClientAssertionJwt(authserverIss)
+		if err != nil {
+			return nonce, fmt.Errorf("create client assertion: %w", err)
+		}
+
+		dpopProof, err := o.client.AuthServerDpopJwt(http.MethodPost, endpoint, nonce, dpopKey)
+		if err != nil {
+			return nonce, fmt.Errorf("create dpop proof: %w", err)
+		}
+
+		params := url.Values{
+			"token":                 {token},
+			"client_id":             {o.clientID},
+			"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+			"client_assertion":      {clientAssertion},
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(params.Encode()))
+		if err != nil {
+			return nonce, fmt.Errorf("create revoke request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("DPoP", dpopProof)
+
+		resp, err := o.httpClient.Do(req)
+		if err != nil {
+			return nonce, fmt.Errorf("do revoke request: %w", err)
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			return nonce, nil
+		}
+
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&errResp)
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusBadRequest && errResp.Error == "use_dpop_nonce" {
+			nonce = resp.Header.Get("DPoP-Nonce")
+			continue
+		}
+		return nonce, fmt.Errorf("revoke responded with code %d: %s", resp.StatusCode, errResp.Error)
+	}
+	return nonce, fmt.Errorf("revoke failed after getting a new dpop nonce")
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	oauth "github.com/haileyok/atproto-oauth-golang"
+	oauthhelpers "github.com/haileyok/atproto-oauth-golang/helpers"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+// fakeTokenClient stands in for the users authorization server.
+type fakeTokenClient struct {
+	revocationEndpoint string
+
+	mu            sync.Mutex
+	refreshTokens []string
+	refreshErr    error
+	nextToken     int
+}
+
+func (f *fakeTokenClient) RefreshTokenRequest(ctx context.Context, refreshToken, authserverIss, dpopAuthserverNonce string, dpopPrivateJwk jwk.Key) (*oauth.TokenResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.refreshTokens = append(f.refreshTokens, refreshToken)
+	if f.refreshErr != nil {
+		return nil, f.refreshErr
+	}
+
+	f.nextToken++
+	return &oauth.TokenResponse{
+		AccessToken:         fmt.Sprintf("access-%d", f.nextToken),
+		RefreshToken:        fmt.Sprintf("refresh-%d", f.nextToken),
+		ExpiresIn:           3600,
+		DpopAuthserverNonce: "auth-nonce",
+	}, nil
+}
+
+func (f *fakeTokenClient) FetchAuthServerMetadata(ctx context.Context, ustr string) (*oauth.OauthAuthorizationMetadata, error) {
+	return &oauth.OauthAuthorizationMetadata{Issuer: ustr, RevocationEndpoint: f.revocationEndpoint}, nil
+}
+
+func (f *fakeTokenClient) ClientAssertionJwt(authServerUrl string) (string, error) {
+	return "client-assertion", nil
+}
+
+func (f *fakeTokenClient) AuthServerDpopJwt(method, url, nonce string, privateJwk jwk.Key) (string, error) {
+	return "proof:" + nonce, nil
+}
+
+func (f *fakeTokenClient) RefreshTokens() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.refreshTokens...)
+}
+
+func saveTestOauthSession(t *testing.T, s *store.Store, did, pdsURL string) {
+	t.Helper()
+
+	key, err := oauthhelpers.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generate dpop key: %s", err)
+	}
+	keyB, err := json.Marshal(key)
+	if err != nil {
+		t.Fatalf("marshal dpop key: %s", err)
+	}
+
+	err = s.SaveOauthSession(store.OauthSession{
+		Did:            did,
+		PdsURL:         pdsURL,
+		AuthserverIss:  "https://auth.test",
+		AccessToken:    "access-token",
+		RefreshToken:   "refresh-token",
+		DpopPrivateJwk: string(keyB),
+		ExpiresAt:      time.Now().Add(time.Hour).UnixMilli(),
+		UpdatedAt:      time.Now().UnixMilli(),
+	})
+	if err != nil {
+		t.Fatalf("save oauth session: %s", err)
+	}
+}
+
+func TestOauthSessionsAuthArgs(t *testing.T) {
+	s := newTestStore(t)
+	sessions := newOauthSessions(s, &fakeTokenClient{}, "https://feeds.test/client-metadata.json", time.Minute)
+	saveTestOauthSession(t, s, testUserDID, "https://pds.test")
+
+	args, err := sessions.AuthArgs(context.Background(), testUserDID)
+	if err != nil {
+		t.Fatalf("get auth args: %s", err)
+	}
+	if args.Did != testUserDID || args.PdsUrl != "https://pds.test" || args.AccessToken != "access-token" || args.DpopPrivateJwk == nil {
+		t.Errorf("unexpected auth args %+v", args)
+	}
+
+	_, err = sessions.AuthArgs(context.Background(), "did:plc:unknown")
+	if !errors.Is(err, errNoOauthSession) {
+		t.Errorf("expected errNoOauthSession, got %v", err)
+	}
+}
+
+func TestOauthSessionsRefreshExpiring(t *testing.T) {
+	s := newTestStore(t)
+	client := &fakeTokenClient{}
+	sessions := newOauthSessions(s, client, "https://feeds.test/client-metadata.json", time.Minute)
+
+	saveTestOauthSession(t, s, testUserDID, "https://pds.test")
+	saveTestOauthSession(t, s, "did:plc:other", "https://pds.test")
+
+	sessions.RefreshExpiring(context.Background(), time.Now().Add(time.Hour))
+
+	if tokens := client.RefreshTokens(); len(tokens) != 2 {
+		t.Fatalf("expected both sessions to be refreshed an hour from now, got %v", tokens)
+	}
+
+	session, err := s.GetOauthSession(testUserDID)
+	if err != nil || session == nil {
+		t.Fatalf("get oauth session: %v", err)
+	}
+	if session.AccessToken == "access-token" || session.RefreshToken == "refresh-token" {
+		t.Errorf("expected the tokens to be rotated, got %+v", session)
+	}
+	if session.DpopAuthserverNonce != "auth-nonce" {
+		t.Errorf("expected the auth server nonce to be saved, got %q", session.DpopAuthserverNonce)
+	}
+	if session.ExpiresAt < time.Now().Add(time.Minute*59).UnixMilli() {
+		t.Errorf("expected the session expiry to be extended, got %d", session.ExpiresAt)
+	}
+
+	// nothing is near expiry now
+	sessions.RefreshExpiring(context.Background(), time.Now())
+	if tokens := client.RefreshTokens(); len(tokens) != 2 {
+		t.Errorf("expected no more refreshes, got %v", tokens)
+	}
+}
+
+func TestOauthSessionsRejectedRefreshDeletesSession(t *testing.T) {
+	s := newTestStore(t)
+	client := &fakeTokenClient{refreshErr: errors.New("token refresh error: invalid_grant")}
+	sessions := newOauthSessions(s, client, "https://feeds.test/client-metadata.json", time.Minute)
+
+	saveTestOauthSession(t, s, testUserDID, "https://pds.test")
+
+	_, err := sessions.refreshIfExpiring(context.Background(), testUserDID, time.Now().Add(time.Hour*2).UnixMilli())
+	if !errors.Is(err, errOauthSessionExpired) {
+		t.Fatalf("expected session expired error, got %v", err)
+	}
+
+	session, err := s.GetOauthSession(testUserDID)
+	if err != nil {
+		t.Fatalf("get oauth session: %s", err)
+	}
+	if session != nil {
+		t.Error("expected the session to be deleted")
+	}
+}
+
+func TestOauthSessionsRefreshFailureKeepsSession(t *testing.T) {
+	s := newTestStore(t)
+	client := &fakeTokenClient{refreshErr: errors.New("connection refused")}
+	sessions := newOauthSessions(s, client, "https://feeds.test/client-metadata.json", time.Minute)
+
+	saveTestOauthSession(t, s, testUserDID, "https://pds.test")
+
+	_, err := sessions.refreshIfExpiring(context.Background(), testUserDID, time.Now().Add(time.Hour*2).UnixMilli())
+	if err == nil || errors.Is(err, errOauthSessionExpired) {
+		t.Fatalf("expected a retryable error, got %v", err)
+	}
+
+	session, err := s.GetOauthSession(testUserDID)
+	if err != nil || session == nil {
+		t.Fatalf("expected the session to be kept so it can be retried: %v", err)
+	}
+}
+
+func TestOauthSessionsRefreshExpiringBacksOffFailures(t *testing.T) {
+	s := newTestStore(t)
+	client := &fakeTokenClient{refreshErr: errors.New("connection refused")}
+	sessions := newOauthSessions(s, client, "https://feeds.test/client-metadata.json", time.Minute)
+
+	saveTestOauthSession(t, s, testUserDID, "https://pds.test")
+
+	now := time.Now().Add(time.Hour)
+	sessions.RefreshExpiring(context.Background(), now)
+	sessions.RefreshExpiring(context.Background(), now.Add(time.Second*30))
+	if tokens := client.RefreshTokens(); len(tokens) != 1 {
+		t.Fatalf("expected the failed session to not be retried until its backoff has passed, got %v", tokens)
+	}
+
+	session, err := s.GetOauthSession(testUserDID)
+	if err != nil || session == nil {
+		t.Fatalf("get oauth session: %v", err)
+	}
+	if session.RefreshFailures != 1 || session.NextRefreshAt != now.Add(oauthRefreshMinBackoff).UnixMilli() {
+		t.Errorf("expected the session to back off for %s, got %+v", oauthRefreshMinBackoff, session)
+	}
+
+	// the second failure doubles the backoff
+	now = now.Add(oauthRefreshMinBackoff)
+	sessions.RefreshExpiring(context.Background(), now)
+	session, err = s.GetOauthSession(testUserDID)
+	if err != nil || session == nil {
+		t.Fatalf("get oauth session: %v", err)
+	}
+	if session.RefreshFailures != 2 || session.NextRefreshAt != now.Add(oauthRefreshMinBackoff*2).UnixMilli() {
+		t.Errorf("expected the session to back off for %s, got %+v", oauthRefreshMinBackoff*2, session)
+	}
+
+	client.mu.Lock()
+	client.refreshErr = nil
+	client.mu.Unlock()
+
+	sessions.RefreshExpiring(context.Background(), now.Add(oauthRefreshMinBackoff*2))
+	if tokens := client.RefreshTokens(); len(tokens) != 3 {
+		t.Fatalf("expected the session to be retried once its backoff passed, got %v", tokens)
+	}
+	session, err = s.GetOauthSession(testUserDID)
+	if err != nil || session == nil {
+		t.Fatalf("get oauth session: %v", err)
+	}
+	if session.RefreshFailures != 0 || session.NextRefreshAt != 0 {
+		t.Errorf("expected a successful refresh to clear the backoff, got %+v", session)
+	}
+}
+
+func TestOauthRefreshBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:   time.Minute,
+		2:   time.Minute * 2,
+		3:   time.Minute * 4,
+		7:   time.Hour,
+		100: time.Hour,
+	}
+	for failures, want := range tests {
+		if got := oauthRefreshBackoff(failures); got != want {
+			t.Errorf("expected %d failures to back off for %s, got %s", failures, want, got)
+		}
+	}
+}
+
+func TestOauthSessionsRevoke(t *testing.T) {
+	var mu sync.Mutex
+	var revoked []string
+	revocationServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("DPoP") != "proof:revoke-nonce" {
+			w.Header().Set("DPoP-Nonce", "revoke-nonce")
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "use_dpop_nonce"})
+			return
+		}
+		if r.FormValue("client_assertion") != "client-assertion" || r.FormValue("client_id") != "https://feeds.test/client-metadata.json" {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+			return
+		}
+		mu.Lock()
+		revoked = append(revoked, r.FormValue("token"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(revocationServer.Close)
+
+	s := newTestStore(t)
+	client := &fakeTokenClient{revocationEndpoint: revocationServer.URL}
+	sessions := newOauthSessions(s, client, "https://feeds.test/client-metadata.json", time.Minute)
+
+	saveTestOauthSession(t, s, testUserDID, "https://pds.test")
+
+	if err := sessions.Revoke(context.Background(), testUserDID); err != nil {
+		t.Fatalf("revoke: %s", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(revoked) != 2 || revoked[0] != "refresh-token" || revoked[1] != "access-token" {
+		t.Errorf("expected the refresh and access tokens to be revoked, got %v", revoked)
+	}
+
+	session, err := s.GetOauthSession(testUserDID)
+	if err != nil {
+		t.Fatalf("get oauth session: %s", err)
+	}
+	if session != nil {
+		t.Error("expected the session to be deleted")
+	}
+}
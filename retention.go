@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bugsnag/bugsnag-go/v2"
+)
+
+type RetentionStore interface {
+	DeleteRepliesIndexedBefore(before int64) (int64, error)
+	DeleteRepliesOverCap(maxPerBookmark int) (int64, error)
+	Compact(ctx context.Context) error
+}
+
+// retention keeps the replies table from growing forever by removing replies that are too old or that are beyond the
+// newest few for a bookmark, and then compacts the database file.
+type retention struct {
+	store    RetentionStore
+	interval time.Duration
+	// maxAge is how old a reply can be before it's removed, or 0 to keep replies regardless of age
+	maxAge time.Duration
+	// maxPerBookmark is how many of the newest replies are kept for each bookmark, or 0 for no limit
+	maxPerBookmark int
+}
+
+func newRetention(store RetentionStore, interval, maxAge time.Duration, maxPerBookmark int) *retention {
+	return &retention{
+		store:          store,
+		interval:       interval,
+		maxAge:         maxAge,
+		maxPerBookmark: maxPerBookmark,
+	}
+}
+
+func (r *retention) Run(ctx context.Context) {
+	timer := time.NewTimer(r.interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Warn("context canceled - stopping retention")
+			return
+		case <-timer.C:
+			err := r.Apply(ctx, time.Now())
+			if err != nil {
+				slog.Error("apply retention", "error", err)
+				_ = bugsnag.Notify(err)
+			}
+			timer.Reset(r.interval)
+		}
+	}
+}
+
+func (r *retention) Apply(ctx context.Context, now time.Time) error {
+	if r.maxAge > 0 {
+		n, err := r.store.DeleteRepliesIndexedBefore(now.Add(-r.maxAge).UnixMilli())
+		if err != nil {
+			return fmt.Errorf("delete old replies: %w", err)
+		}
+		retentionRepliesAged.Add(float64(n))
+		slog.Info("removed old replies", "count", n, "max age", r.maxAge.String())
+	}
+
+	if r.maxPerBookmark > 0 {
+		n, err := r.store.DeleteRepliesOverCap(r.maxPerBookmark)
+		if err != nil {
+			return fmt.Errorf("delete replies over cap: %w", err)
+		}
+		retentionRepliesCapped.Add(float64(n))
+		slog.Info("removed replies over the per bookmark cap", "count", n, "cap", r.maxPerBookmark)
+	}
+
+	start := time.Now()
+	err := r.store.Compact(ctx)
+	if err != nil {
+		return fmt.Errorf("compact database: %w", err)
+	}
+	retentionCompactDuration.Observe(time.Since(start).Seconds())
+	return nil
+}
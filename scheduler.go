@@ -0,0 +1,164 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/bugsnag/bugsnag-go/v2"
+)
+
+const schedulerQueueSize = 100
+
+// orderedScheduler handles events on a number of workers in parallel. Events with the same key are always handled by
+// the same worker so that they are handled in the order they were received.
+type orderedScheduler struct {
+	handleEvent func(context.Context, *models.Event) error
+	keyFunc     func(*models.Event) string
+	tracker     *cursorTracker
+	logger      *slog.Logger
+
+	queues []chan scheduledEvent
+	wg     sync.WaitGroup
+
+	errMu sync.Mutex
+	err   error
+}
+
+type scheduledEvent struct {
+	ctx     context.Context
+	event   *models.Event
+	tracked *list.Element
+}
+
+func newOrderedScheduler(workers int, logger *slog.Logger, tracker *cursorTracker, keyFunc func(*models.Event) string, handleEvent func(context.Context, *models.Event) error) *orderedScheduler {
+	if workers < 1 {
+		workers = 1
+	}
+
+	s := &orderedScheduler{
+		handleEvent: handleEvent,
+		keyFunc:     keyFunc,
+		tracker:     tracker,
+		logger:      logger,
+		queues:      make([]chan scheduledEvent, workers),
+	}
+
+	for i := range s.queues {
+		s.queues[i] = make(chan scheduledEvent, schedulerQueueSize)
+		s.wg.Add(1)
+		go s.worker(s.queues[i])
+	}
+
+	return s
+}
+
+// AddWork queues an event to be handled. It blocks if the worker for the event is busy and its queue is full. If a
+// previous event failed to be handled then the error is returned so that the client stops reading and reconnects
+// from the last event that was fully processed.
+func (s *orderedScheduler) AddWork(ctx context.Context, repo string, event *models.Event) error {
+	s.errMu.Lock()
+	err := s.err
+	s.errMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	queue := s.queues[shardIndex(s.keyFunc(event), len(s.queues))]
+
+	tracked := s.tracker.add(event.TimeUS)
+
+	select {
+	case queue <- scheduledEvent{ctx: ctx, event: event, tracked: tracked}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func shardIndex(key string, shards int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// Shutdown stops accepting work and waits for every queued event to be handled.
+func (s *orderedScheduler) Shutdown() {
+	for _, queue := range s.queues {
+		close(queue)
+	}
+	s.wg.Wait()
+}
+
+func (s *orderedScheduler) worker(queue chan scheduledEvent) {
+	defer s.wg.Done()
+
+	for item := range queue {
+		err := s.handleEvent(item.ctx, item.event)
+		if err != nil {
+			// the event isn't marked as done so the cursor will never move past it
+			s.logger.Error("failed to handle event", "error", err, "time us", item.event.TimeUS)
+			_ = bugsnag.Notify(err)
+
+			s.errMu.Lock()
+			if s.err == nil {
+				s.err = fmt.Errorf("handle event %d: %w", item.event.TimeUS, err)
+			}
+			s.errMu.Unlock()
+			continue
+		}
+
+		s.tracker.done(item.tracked)
+	}
+}
+
+// cursorTracker keeps the events that are being handled in the order they were received so that the cursor is only
+// moved forward once every event before it has been handled, regardless of which worker handled it.
+type cursorTracker struct {
+	mu        sync.Mutex
+	inFlight  *list.List
+	onAdvance func(cursor int64)
+}
+
+type trackedEvent struct {
+	timeUS int64
+	done   bool
+}
+
+func newCursorTracker(onAdvance func(cursor int64)) *cursorTracker {
+	return &cursorTracker{
+		inFlight:  list.New(),
+		onAdvance: onAdvance,
+	}
+}
+
+func (t *cursorTracker) add(timeUS int64) *list.Element {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.inFlight.PushBack(&trackedEvent{timeUS: timeUS})
+}
+
+func (t *cursorTracker) done(element *list.Element) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	element.Value.(*trackedEvent).done = true
+
+	var cursor int64
+	for front := t.inFlight.Front(); front != nil; front = t.inFlight.Front() {
+		tracked := front.Value.(*trackedEvent)
+		if !tracked.done {
+			break
+		}
+		cursor = tracked.timeUS
+		t.inFlight.Remove(front)
+	}
+
+	if cursor != 0 {
+		t.onAdvance(cursor)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bluesky-social/jetstream/pkg/models"
+)
+
+func TestOrderedSchedulerKeepsEventsWithTheSameKeyInOrder(t *testing.T) {
+	release := make(chan struct{})
+
+	var mu sync.Mutex
+	handled := make(map[string][]int64)
+
+	var cursor atomic.Int64
+	tracker := newCursorTracker(func(c int64) {
+		cursor.Store(c)
+	})
+
+	s := newOrderedScheduler(4, slog.Default(), tracker, func(evt *models.Event) string {
+		return evt.Did
+	}, func(ctx context.Context, evt *models.Event) error {
+		if evt.Did == "blocked" {
+			<-release
+		}
+		mu.Lock()
+		handled[evt.Did] = append(handled[evt.Did], evt.TimeUS)
+		mu.Unlock()
+		return nil
+	})
+
+	ctx := context.Background()
+	if err := s.AddWork(ctx, "", &models.Event{Did: "blocked", TimeUS: 1}); err != nil {
+		t.Fatalf("add work: %s", err)
+	}
+
+	// pick a key that isn't handled by the blocked worker so that it can carry on
+	other := "other"
+	for i := 0; shard(s, other) == shard(s, "blocked"); i++ {
+		other = "other" + string(rune('a'+i))
+	}
+	for i := int64(2); i <= 5; i++ {
+		if err := s.AddWork(ctx, "", &models.Event{Did: other, TimeUS: i}); err != nil {
+			t.Fatalf("add work: %s", err)
+		}
+	}
+
+	waitFor(t, "the unblocked events to be handled", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled[other]) == 4
+	})
+
+	if got := cursor.Load(); got != 0 {
+		t.Errorf("expected the cursor not to move past the blocked event, got %d", got)
+	}
+
+	close(release)
+	s.Shutdown()
+
+	if got := cursor.Load(); got != 5 {
+		t.Errorf("expected cursor 5 once every event was handled, got %d", got)
+	}
+	for i, timeUS := range handled[other] {
+		if timeUS != int64(i+2) {
+			t.Fatalf("expected events to be handled in order, got %v", handled[other])
+		}
+	}
+}
+
+func TestOrderedSchedulerDoesNotMoveCursorPastFailedEvent(t *testing.T) {
+	var cursor atomic.Int64
+	tracker := newCursorTracker(func(c int64) {
+		cursor.Store(c)
+	})
+
+	s := newOrderedScheduler(2, slog.Default(), tracker, func(evt *models.Event) string {
+		return evt.Did
+	}, func(ctx context.Context, evt *models.Event) error {
+		if evt.TimeUS == 2 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	ctx := context.Background()
+	for i := int64(1); i <= 3; i++ {
+		if err := s.AddWork(ctx, "", &models.Event{Did: "did", TimeUS: i}); err != nil {
+			t.Fatalf("add work: %s", err)
+		}
+	}
+	s.Shutdown()
+
+	if got := cursor.Load(); got != 1 {
+		t.Errorf("expected cursor to stop before the failed event, got %d", got)
+	}
+
+	err := s.AddWork(ctx, "", &models.Event{Did: "did", TimeUS: 4})
+	if err == nil {
+		t.Error("expected an error adding work after an event failed")
+	}
+}
+
+func TestOrderingKey(t *testing.T) {
+	rootURI := "at://did:plc:author/app.bsky.feed.post/root"
+
+	tt := map[string]struct {
+		event    models.Event
+		expected string
+	}{
+		"reply is keyed by its thread root": {
+			event:    replyEvent(testReplierDID, "reply", "at://did:plc:other/app.bsky.feed.post/parent", rootURI, 1),
+			expected: rootURI,
+		},
+		"quote is keyed by the quoted post": {
+			event:    quoteEvent(testReplierDID, "quote", testBookmarkURI, false, 1),
+			expected: testBookmarkURI,
+		},
+		"quote with media is keyed by the quoted post": {
+			event:    quoteEvent(testReplierDID, "quote", testBookmarkURI, true, 1),
+			expected: testBookmarkURI,
+		},
+		"delete is keyed by the author": {
+			event:    deleteEvent(testReplierDID, "reply", 1),
+			expected: testReplierDID,
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			if got := orderingKey(&tc.event); got != tc.expected {
+				t.Errorf("expected key %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func shard(s *orderedScheduler, key string) chan scheduledEvent {
+	return s.queues[shardIndex(key, len(s.queues))]
+}
@@ -10,29 +10,33 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/bluesky-social/indigo/xrpc"
-	"github.com/gorilla/sessions"
 	oauth "github.com/haileyok/atproto-oauth-golang"
 	oauthhelpers "github.com/haileyok/atproto-oauth-golang/helpers"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/willdot/bskyfeedgen/store"
 )
 
-type Feeder interface {
-	GetFeed(ctx context.Context, userDID, feed, cursor string, limit int) (FeedReponse, error)
-}
-
 type Store interface {
 	BookmarkStore
+	CollectionStore
 	OauthRequestStore
+	OauthSessionStore
+	UserSettingsStore
 }
 
 type BookmarkStore interface {
-	CreateBookmark(postRKey, postURI, postATURI, authorDID, authorHandle, userDID, content string, createdAt int64) error
+	CreateBookmark(postRKey, postURI, postATURI, rootURI, authorDID, authorHandle, userDID, content string, createdAt int64) error
 	GetBookmarksForUser(userDID string) ([]store.Bookmark, error)
-	DeleteBookmark(postRKey, userDID string) error
-	GetBookmarkByRKeyForUser(rkey, userDID string) (*store.Bookmark, error)
+	DeleteBookmark(postATURI, userDID string) error
+	GetBookmarkByURIForUser(postATURI, userDID string) (*store.Bookmark, error)
 	DeleteRepliedPostsForBookmarkedPostURIandUserDID(subscribedPostURI, userDID string) error
+	SetBookmarkTags(postATURI, userDID string, tags []string) error
+	SearchBookmarks(userDID, query string, limit int) ([]store.Bookmark, error)
+	SetBookmarkFollowThread(postATURI, userDID string, follow bool) error
+	SetBookmarkExpiry(postATURI, userDID string, expiresAt int64) error
+	SetBookmarkRecordKey(postATURI, userDID, recordRKey string) error
 }
 
 type OauthRequestStore interface {
@@ -43,15 +47,25 @@ type OauthRequestStore interface {
 
 type Server struct {
 	httpsrv           *http.Server
-	feeder            Feeder
+	feeds             *FeedRegistry
 	feedHost          string
 	feedDidBase       string
+	appViewURL        string
 	bookmarkStore     BookmarkStore
+	collectionStore   CollectionStore
+	feedPublisher     CollectionFeedPublisher
 	oauthRequestStore OauthRequestStore
+	oauthSessionStore OauthSessionStore
+	oauthSessions     *oauthSessions
+	bookmarkRecords   *bookmarkRecords
+	settingsStore     UserSettingsStore
 	xrpcClient        *xrpc.Client
 	jwks              *JWKS
+	feedAuth          *feedAuth
+	loggedOutPost     string
 	oauthClient       *oauth.Client
-	sessionStore      *sessions.CookieStore
+	sessionStore      *store.SessionStore
+	health            *healthChecker
 }
 
 type JWKS struct {
@@ -59,7 +73,7 @@ type JWKS struct {
 	private jwk.Key
 }
 
-func NewServer(port int, feeder Feeder, feedHost, feedDidBase string, store Store) (*Server, error) {
+func NewServer(port int, feeds *FeedRegistry, feedHost, feedDidBase, appViewURL string, store Store, sessionStore *store.SessionStore, feedPublisher CollectionFeedPublisher, health *healthChecker) (*Server, error) {
 	jwks, err := getJWKS()
 	if err != nil {
 		return nil, fmt.Errorf("create public JWKS: %w", err)
@@ -70,34 +84,57 @@ func NewServer(port int, feeder Feeder, feedHost, feedDidBase string, store Stor
 		return nil, fmt.Errorf("create oauth client: %w", err)
 	}
 
-	sessionStore := sessions.NewCookieStore([]byte(os.Getenv("SESSION_KEY")))
+	oauthSessions := newOauthSessions(store, oauthClient, fmt.Sprintf("https://%s/client-metadata.json", feedHost), defaultOauthRefreshInterval)
 
 	srv := &Server{
-		feeder:            feeder,
+		feeds:             feeds,
 		feedHost:          feedHost,
 		feedDidBase:       feedDidBase,
+		appViewURL:        appViewURL,
 		bookmarkStore:     store,
+		collectionStore:   store,
+		feedPublisher:     feedPublisher,
 		oauthRequestStore: store,
+		oauthSessionStore: store,
+		oauthSessions:     oauthSessions,
+		bookmarkRecords:   newBookmarkRecords(store, newUserRepoWriter(oauthSessions)),
+		settingsStore:     store,
 		jwks:              jwks,
+		feedAuth:          newFeedAuth(fmt.Sprintf("did:web:%s", feedHost), identity.DefaultDirectory()),
+		loggedOutPost:     loggedOutPostFromEnv(),
 		oauthClient:       oauthClient,
 		sessionStore:      sessionStore,
+		health:            health,
 	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/public/styles.css", serveCSS)
-	mux.HandleFunc("/xrpc/app.bsky.feed.getFeedSkeleton", srv.HandleGetFeedSkeleton)
+	mux.HandleFunc("/xrpc/app.bsky.feed.getFeedSkeleton", instrumentFeedSkeleton(feeds, srv.HandleGetFeedSkeleton))
 	mux.HandleFunc("/xrpc/app.bsky.feed.describeFeedGenerator", srv.HandleDescribeFeedGenerator)
 	mux.HandleFunc("/.well-known/did.json", srv.HandleWellKnown)
+	mux.HandleFunc("GET /healthz", srv.health.HandleHealthz)
+	mux.HandleFunc("GET /readyz", srv.health.HandleReadyz)
 	mux.HandleFunc("/client-metadata.json", srv.serveClientMetadata)
 	mux.HandleFunc("/jwks.json", srv.serverJwks)
 	mux.HandleFunc("/oauth-callback", srv.handleOauthCallback)
 
-	mux.HandleFunc("/", srv.authMiddleware(srv.HandleGetBookmarks))
+	mux.HandleFunc("/", srv.csrfMiddleware(srv.HandleGetBookmarks))
 	mux.HandleFunc("/login", srv.HandleLogin)
-	mux.HandleFunc("/sign-out", srv.HandleSignOut)
-	mux.HandleFunc("GET /bookmarks", srv.authMiddleware(srv.HandleGetBookmarks))
-	mux.HandleFunc("POST /bookmarks", srv.authMiddleware(srv.HandleAddBookmark))
-	mux.HandleFunc("DELETE /bookmarks/{rkey}", srv.authMiddleware(srv.HandleDeleteBookmark))
+	mux.HandleFunc("POST /sign-out", srv.csrfMiddleware(srv.HandleSignOut))
+	mux.HandleFunc("GET /bookmarks", srv.csrfMiddleware(srv.HandleGetBookmarks))
+	mux.HandleFunc("POST /bookmarks", srv.csrfMiddleware(srv.HandleAddBookmark))
+	mux.HandleFunc("DELETE /bookmarks", srv.csrfMiddleware(srv.HandleDeleteBookmark))
+	mux.HandleFunc("GET /bookmarks/search", srv.csrfMiddleware(srv.HandleSearchBookmarks))
+	mux.HandleFunc("GET /bookmarks/export", srv.csrfMiddleware(srv.HandleExportBookmarks))
+	mux.HandleFunc("POST /bookmarks/import", srv.csrfMiddleware(srv.HandleImportBookmarks))
+	mux.HandleFunc("PUT /bookmarks/tags", srv.csrfMiddleware(srv.HandleSetBookmarkTags))
+	mux.HandleFunc("PUT /bookmarks/collection", srv.csrfMiddleware(srv.HandleSetBookmarkCollection))
+	mux.HandleFunc("PUT /bookmarks/follow-thread", srv.csrfMiddleware(srv.HandleSetBookmarkFollowThread))
+	mux.HandleFunc("PUT /bookmarks/expiry", srv.csrfMiddleware(srv.HandleSetBookmarkExpiry))
+	mux.HandleFunc("PUT /settings/bookmark-ttl", srv.csrfMiddleware(srv.HandleSetBookmarkTTL))
+	mux.HandleFunc("POST /collections", srv.csrfMiddleware(srv.HandleCreateCollection))
+	mux.HandleFunc("GET /account", srv.csrfMiddleware(srv.HandleAccount))
+	mux.HandleFunc("DELETE /account/sessions", srv.csrfMiddleware(srv.HandleRevokeSession))
 
 	addr := fmt.Sprintf("0.0.0.0:%d", port)
 
@@ -108,7 +145,7 @@ func NewServer(port int, feeder Feeder, feedHost, feedDidBase string, store Stor
 
 	srv.xrpcClient = &xrpc.Client{
 		// Client: http.DefaultClient,
-		Host: "https://public.api.bsky.app",
+		Host: appViewURL,
 	}
 
 	return srv, nil
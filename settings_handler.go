@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/willdot/bskyfeedgen/frontend"
+	"github.com/willdot/bskyfeedgen/store"
+)
+
+type UserSettingsStore interface {
+	GetUserSettings(userDID string) (store.UserSettings, error)
+	SetBookmarkTTLDays(userDID string, days int) error
+}
+
+func (s *Server) HandleSetBookmarkTTL(w http.ResponseWriter, r *http.Request) {
+	usersDid, ok := s.getDidFromSession(r)
+	if !ok {
+		slog.Warn("did not found in session")
+		_ = frontend.Login("", "").Render(r.Context(), w)
+		return
+	}
+
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil || days < 0 {
+		http.Error(w, "invalid bookmark TTL", http.StatusBadRequest)
+		return
+	}
+
+	err = s.settingsStore.SetBookmarkTTLDays(usersDid, days)
+	if err != nil {
+		slog.Error("set bookmark TTL days", "error", err)
+		http.Error(w, "failed to set bookmark TTL", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -5,11 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
 )
 
-var ErrBookmarkAlreadyExists = errors.New("bookmark already exists")
+var (
+	ErrBookmarkAlreadyExists = errors.New("bookmark already exists")
+	ErrBookmarkNotFound      = errors.New("bookmark not found")
+)
 
-func createBookmarksTable(db *sql.DB) error {
+func createBookmarksTable(tx *sql.Tx) error {
 	createBooksmarksTableSQL := `CREATE TABLE IF NOT EXISTS bookmarks (
 		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
 		"postRKey" TEXT,
@@ -20,11 +24,11 @@ func createBookmarksTable(db *sql.DB) error {
 		"userDID" TEXT,
 		"content" TEXT,
 		"createdAt" integer NOT NULL,
-		UNIQUE(postRKey, userDID)
+		UNIQUE(postATURI, userDID)
 	  );`
 
 	slog.Info("Create bookmarks table...")
-	statement, err := db.Prepare(createBooksmarksTableSQL)
+	statement, err := tx.Prepare(createBooksmarksTableSQL)
 	if err != nil {
 		return fmt.Errorf("prepare DB statement to create bookmarks table: %w", err)
 	}
@@ -37,6 +41,51 @@ func createBookmarksTable(db *sql.DB) error {
 	return nil
 }
 
+// migrateBookmarksUniqueKey rebuilds a bookmarks table that was created with the old UNIQUE(postRKey, userDID)
+// constraint so that bookmarks are unique by the posts AT URI instead. RKeys are only unique per repo so two
+// different authors posts could previously collide.
+func migrateBookmarksUniqueKey(tx *sql.Tx) error {
+	var tableSQL string
+	err := tx.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'bookmarks';").Scan(&tableSQL)
+	if err != nil {
+		return fmt.Errorf("get bookmarks table definition: %w", err)
+	}
+
+	if !strings.Contains(tableSQL, "UNIQUE(postRKey, userDID)") {
+		return nil
+	}
+
+	slog.Info("migrating bookmarks table to be unique by post AT URI...")
+
+	statements := []string{
+		`CREATE TABLE bookmarks_new (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"postRKey" TEXT,
+		"postURI" TEXT,
+		"postATURI" TEXT,
+		"authorDID" TEXT,
+		"authorHandle" TEXT,
+		"userDID" TEXT,
+		"content" TEXT,
+		"createdAt" integer NOT NULL,
+		UNIQUE(postATURI, userDID)
+	  );`,
+		`INSERT OR IGNORE INTO bookmarks_new (id, postRKey, postURI, postATURI, authorDID, authorHandle, userDID, content, createdAt)
+			SELECT id, postRKey, postURI, postATURI, authorDID, authorHandle, userDID, content, createdAt FROM bookmarks ORDER BY id;`,
+		"DROP TABLE bookmarks;",
+		"ALTER TABLE bookmarks_new RENAME TO bookmarks;",
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return fmt.Errorf("exec bookmarks migration statement: %w", err)
+		}
+	}
+
+	slog.Info("bookmarks table migrated")
+	return nil
+}
+
 type Bookmark struct {
 	ID           int
 	PostRKey     string
@@ -47,11 +96,52 @@ type Bookmark struct {
 	UserDID      string
 	Content      string
 	CreatedAt    int64
+	CollectionID int
+	Tags         []string
+	// RootURI is the AT URI of the root post of the thread the bookmarked post is in. If the post isn't a reply then
+	// it's the post itself.
+	RootURI      string
+	FollowThread bool
+	// DeletedAt is when the bookmarked post was deleted by its author, or 0 if it still exists
+	DeletedAt int64
+	// ExpiresAt is when the bookmark will be removed, or 0 if it only expires by the users bookmark TTL setting
+	ExpiresAt int64
+	// TrackReplies is false once replies to the bookmarked post are no longer being stored
+	TrackReplies bool
+	// RecordRKey is the rkey of the bookmark record in the users repo, or empty if the bookmark only exists here
+	RecordRKey string
+}
+
+const bookmarkColumns = `id, postRKey, postURI, postATURI, authorDID, authorHandle, userDID, content, createdAt, collectionID, rootURI, followThread, deletedAt, expiresAt, trackReplies, recordRKey,
+	(SELECT COALESCE(group_concat(tag, ' '), '') FROM bookmark_tags WHERE bookmarkID = bookmarks.id) AS tags`
+
+type scanner interface {
+	Scan(dest ...any) error
 }
 
-func (s *Store) CreateBookmark(postRKey, postURI, postATURI, authorDID, authorHandle, userDID, content string, createdAt int64) error {
-	sql := `INSERT INTO bookmarks (postRKey, postURI,postATURI, authorDID, authorHandle, userDID, content, createdAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(postRKey, userDID) DO NOTHING;`
-	res, err := s.db.Exec(sql, postRKey, postURI, postATURI, authorDID, authorHandle, userDID, content, createdAt)
+func scanBookmark(row scanner) (Bookmark, error) {
+	var bookmark Bookmark
+	var tags string
+	err := row.Scan(&bookmark.ID, &bookmark.PostRKey, &bookmark.PostURI, &bookmark.PostATURI, &bookmark.AuthorDID, &bookmark.AuthorHandle, &bookmark.UserDID, &bookmark.Content, &bookmark.CreatedAt, &bookmark.CollectionID, &bookmark.RootURI, &bookmark.FollowThread, &bookmark.DeletedAt, &bookmark.ExpiresAt, &bookmark.TrackReplies, &bookmark.RecordRKey, &tags)
+	if err != nil {
+		return bookmark, fmt.Errorf("scan row: %w", err)
+	}
+	bookmark.Tags = strings.Fields(tags)
+	return bookmark, nil
+}
+
+func (s *Store) CreateBookmark(postRKey, postURI, postATURI, rootURI, authorDID, authorHandle, userDID, content string, createdAt int64) error {
+	if rootURI == "" {
+		rootURI = postATURI
+	}
+
+	s.indexSyncMu.Lock()
+	defer s.indexSyncMu.Unlock()
+	s.storedPostsMu.Lock()
+	defer s.storedPostsMu.Unlock()
+
+	sql := `INSERT INTO bookmarks (postRKey, postURI,postATURI, rootURI, authorDID, authorHandle, userDID, content, createdAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(postATURI, userDID) DO NOTHING;`
+	res, err := s.db.Exec(sql, postRKey, postURI, postATURI, rootURI, authorDID, authorHandle, userDID, content, createdAt)
 	if err != nil {
 		return fmt.Errorf("exec insert bookmark: %w", err)
 	}
@@ -59,11 +149,15 @@ func (s *Store) CreateBookmark(postRKey, postURI, postATURI, authorDID, authorHa
 	if x, _ := res.RowsAffected(); x == 0 {
 		return ErrBookmarkAlreadyExists
 	}
+
+	// new bookmarks never follow their thread so only the post index needs updating
+	s.bookmarkedPosts.add(postATURI)
+	s.storedPosts.add(postATURI)
 	return nil
 }
 
 func (s *Store) GetBookmarksForUser(userDID string) ([]Bookmark, error) {
-	sql := "SELECT id, postRKey, postURI, postATURI, authorDID, authorHandle, userDID, content, createdAt FROM bookmarks WHERE userDID = ?;"
+	sql := "SELECT " + bookmarkColumns + " FROM bookmarks WHERE userDID = ?;"
 	rows, err := s.db.Query(sql, userDID)
 	if err != nil {
 		return nil, fmt.Errorf("run query to get bookmarked posts for user: %w", err)
@@ -72,9 +166,9 @@ func (s *Store) GetBookmarksForUser(userDID string) ([]Bookmark, error) {
 
 	var results []Bookmark
 	for rows.Next() {
-		var bookmark Bookmark
-		if err := rows.Scan(&bookmark.ID, &bookmark.PostRKey, &bookmark.PostURI, &bookmark.PostATURI, &bookmark.AuthorDID, &bookmark.AuthorHandle, &bookmark.UserDID, &bookmark.Content, &bookmark.CreatedAt); err != nil {
-			return nil, fmt.Errorf("scan row: %w", err)
+		bookmark, err := scanBookmark(rows)
+		if err != nil {
+			return nil, err
 		}
 
 		results = append(results, bookmark)
@@ -83,8 +177,8 @@ func (s *Store) GetBookmarksForUser(userDID string) ([]Bookmark, error) {
 }
 
 func (s *Store) GetBookmarksForUserWithPaging(userDID string, cursor int64, limit int) ([]Bookmark, error) {
-	sql := `SELECT id, postRKey, postURI, postATURI, authorDID, authorHandle,  userDID, content, createdAt FROM bookmarks
-			WHERE userDID = ? AND createdAt < ?
+	sql := `SELECT ` + bookmarkColumns + ` FROM bookmarks
+			WHERE userDID = ? AND createdAt < ? AND deletedAt = 0
 			ORDER BY createdAt DESC LIMIT ?;`
 	rows, err := s.db.Query(sql, userDID, cursor, limit)
 	if err != nil {
@@ -94,9 +188,9 @@ func (s *Store) GetBookmarksForUserWithPaging(userDID string, cursor int64, limi
 
 	var results []Bookmark
 	for rows.Next() {
-		var bookmark Bookmark
-		if err := rows.Scan(&bookmark.ID, &bookmark.PostRKey, &bookmark.PostURI, &bookmark.PostATURI, &bookmark.AuthorDID, &bookmark.AuthorHandle, &bookmark.UserDID, &bookmark.Content, &bookmark.CreatedAt); err != nil {
-			return nil, fmt.Errorf("scan row: %w", err)
+		bookmark, err := scanBookmark(rows)
+		if err != nil {
+			return nil, err
 		}
 
 		results = append(results, bookmark)
@@ -104,17 +198,65 @@ func (s *Store) GetBookmarksForUserWithPaging(userDID string, cursor int64, limi
 	return results, nil
 }
 
-func (s *Store) DeleteBookmark(postRKey, userDID string) error {
-	sql := "DELETE FROM bookmarks WHERE postRKey = ? AND userDID = ?;"
-	_, err := s.db.Exec(sql, postRKey, userDID)
+func (s *Store) GetBookmarksForCollectionWithPaging(collectionID int, userDID string, cursor int64, limit int) ([]Bookmark, error) {
+	sql := `SELECT ` + bookmarkColumns + ` FROM bookmarks
+			WHERE collectionID = ? AND userDID = ? AND createdAt < ? AND deletedAt = 0
+			ORDER BY createdAt DESC LIMIT ?;`
+	rows, err := s.db.Query(sql, collectionID, userDID, cursor, limit)
 	if err != nil {
-		return fmt.Errorf("exec delete bookmark by postRKey and userDID: %w", err)
+		return nil, fmt.Errorf("run query to get bookmarked posts for collection: %w", err)
+	}
+	defer rows.Close()
+
+	var results []Bookmark
+	for rows.Next() {
+		bookmark, err := scanBookmark(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, bookmark)
+	}
+	return results, nil
+}
+
+func (s *Store) DeleteBookmark(postATURI, userDID string) error {
+	s.indexSyncMu.Lock()
+	defer s.indexSyncMu.Unlock()
+	s.storedPostsMu.Lock()
+	defer s.storedPostsMu.Unlock()
+
+	sql := "DELETE FROM bookmarks WHERE postATURI = ? AND userDID = ? RETURNING rootURI;"
+	rows, err := s.db.Query(sql, postATURI, userDID)
+	if err != nil {
+		return fmt.Errorf("exec delete bookmark by postATURI and userDID: %w", err)
+	}
+	defer rows.Close()
+
+	var rootURI string
+	if rows.Next() {
+		if err := rows.Scan(&rootURI); err != nil {
+			return fmt.Errorf("scan row: %w", err)
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return fmt.Errorf("exec delete bookmark by postATURI and userDID: %w", err)
+	}
+
+	err = s.syncBookmarkIndexes(postATURI, rootURI)
+	if err != nil {
+		return fmt.Errorf("sync bookmark indexes: %w", err)
+	}
+
+	err = s.forgetStoredPosts([]string{postATURI})
+	if err != nil {
+		return fmt.Errorf("forget deleted bookmarked post: %w", err)
 	}
 	return nil
 }
 
 func (s *Store) GetBookmarksForPost(postURI string) ([]string, error) {
-	sql := "SELECT userDID FROM bookmarks WHERE postATURI = ?"
+	sql := "SELECT userDID FROM bookmarks WHERE postATURI = ? AND trackReplies = 1"
 	rows, err := s.db.Query(sql, postURI)
 	if err != nil {
 		return nil, fmt.Errorf("run query to get bookmarks for post: %w", err)
@@ -133,18 +275,18 @@ func (s *Store) GetBookmarksForPost(postURI string) ([]string, error) {
 	return dids, nil
 }
 
-func (s *Store) GetBookmarkByRKeyForUser(rkey, userDID string) (*Bookmark, error) {
-	sql := "SELECT id, postRKey, postURI, postATURI, authorDID, authorHandle,  userDID, content FROM bookmarks WHERE postRKey = ? AND userDID = ?;"
-	rows, err := s.db.Query(sql, rkey, userDID)
+func (s *Store) GetBookmarkByURIForUser(postATURI, userDID string) (*Bookmark, error) {
+	sql := "SELECT " + bookmarkColumns + " FROM bookmarks WHERE postATURI = ? AND userDID = ?;"
+	rows, err := s.db.Query(sql, postATURI, userDID)
 	if err != nil {
-		return nil, fmt.Errorf("run query to get bookmark by rkey and user: %w", err)
+		return nil, fmt.Errorf("run query to get bookmark by AT URI and user: %w", err)
 	}
 	defer rows.Close()
 
 	if rows.Next() {
-		var bookmark Bookmark
-		if err := rows.Scan(&bookmark.ID, &bookmark.PostRKey, &bookmark.PostURI, &bookmark.PostATURI, &bookmark.AuthorDID, &bookmark.AuthorHandle, &bookmark.UserDID, &bookmark.Content); err != nil {
-			return nil, fmt.Errorf("scan row: %w", err)
+		bookmark, err := scanBookmark(rows)
+		if err != nil {
+			return nil, err
 		}
 
 		return &bookmark, nil
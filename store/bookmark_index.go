@@ -0,0 +1,204 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// forgetStoredPostsBatchSize is how many URIs are checked at a time when forgetting stored posts, so that the number of
+// query parameters stays well under SQLite's limit.
+const forgetStoredPostsBatchSize = 500
+
+// uriIndex is an in memory count of how many bookmarks reference each URI. It lets the firehose handler reject the
+// vast majority of posts, which have nothing to do with any bookmark, without querying the database.
+type uriIndex struct {
+	mu     sync.RWMutex
+	counts map[string]int
+}
+
+func newURIIndex() *uriIndex {
+	return &uriIndex{
+		counts: make(map[string]int),
+	}
+}
+
+func (i *uriIndex) has(uri string) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.counts[uri] > 0
+}
+
+func (i *uriIndex) add(uri string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.counts[uri]++
+}
+
+func (i *uriIndex) set(uri string, count int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if count <= 0 {
+		delete(i.counts, uri)
+		return
+	}
+	i.counts[uri] = count
+}
+
+func (i *uriIndex) size() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return len(i.counts)
+}
+
+// loadBookmarkIndexes fills the indexes of bookmarked posts, followed thread roots and stored posts from the database.
+func (s *Store) loadBookmarkIndexes() error {
+	err := loadURIIndex(s.db, s.bookmarkedPosts, "SELECT postATURI, COUNT(*) FROM bookmarks WHERE trackReplies = 1 GROUP BY postATURI;")
+	if err != nil {
+		return fmt.Errorf("load bookmarked posts index: %w", err)
+	}
+
+	err = loadURIIndex(s.db, s.followedThreads, "SELECT rootURI, COUNT(*) FROM bookmarks WHERE followThread = 1 GROUP BY rootURI;")
+	if err != nil {
+		return fmt.Errorf("load followed threads index: %w", err)
+	}
+
+	err = loadURIIndex(s.db, s.storedPosts, `SELECT uri, 1 FROM (
+			SELECT postATURI AS uri FROM bookmarks WHERE deletedAt = 0
+			UNION SELECT replyURI FROM replies
+			UNION SELECT replyURI FROM thread_replies
+		);`)
+	if err != nil {
+		return fmt.Errorf("load stored posts index: %w", err)
+	}
+	return nil
+}
+
+func loadURIIndex(db *sql.DB, index *uriIndex, query string) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return fmt.Errorf("run query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var uri string
+		var count int
+		if err := rows.Scan(&uri, &count); err != nil {
+			return fmt.Errorf("scan row: %w", err)
+		}
+		index.set(uri, count)
+	}
+	return rows.Err()
+}
+
+// forgetStoredPosts removes deleted posts from the stored posts index once they aren't bookmarked or stored as a reply
+// anywhere else. Callers must hold storedPostsMu across deleting the posts and forgetting them.
+func (s *Store) forgetStoredPosts(uris []string) error {
+	for len(uris) > 0 {
+		batch := uris[:min(len(uris), forgetStoredPostsBatchSize)]
+		uris = uris[len(batch):]
+
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ")
+		args := make([]any, 0, len(batch)*3)
+		for range 3 {
+			for _, uri := range batch {
+				args = append(args, uri)
+			}
+		}
+
+		sql := fmt.Sprintf(`SELECT postATURI FROM bookmarks WHERE deletedAt = 0 AND postATURI IN (%[1]s)
+				UNION SELECT replyURI FROM replies WHERE replyURI IN (%[1]s)
+				UNION SELECT replyURI FROM thread_replies WHERE replyURI IN (%[1]s);`, placeholders)
+		rows, err := s.db.Query(sql, args...)
+		if err != nil {
+			return fmt.Errorf("run query to get posts that are still stored: %w", err)
+		}
+
+		stillStored := make(map[string]bool)
+		for rows.Next() {
+			var uri string
+			if err := rows.Scan(&uri); err != nil {
+				rows.Close()
+				return fmt.Errorf("scan row: %w", err)
+			}
+			stillStored[uri] = true
+		}
+		if err := rows.Close(); err != nil {
+			return fmt.Errorf("run query to get posts that are still stored: %w", err)
+		}
+
+		for _, uri := range batch {
+			if !stillStored[uri] {
+				s.storedPosts.set(uri, 0)
+			}
+		}
+	}
+	return nil
+}
+
+// scanURIs reads the URIs returned by a DELETE ... RETURNING statement.
+func scanURIs(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+
+	var uris []string
+	for rows.Next() {
+		var uri string
+		if err := rows.Scan(&uri); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		uris = append(uris, uri)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	return uris, nil
+}
+
+// syncBookmarkIndexes recounts the bookmarks for a post and the followers of a thread root after they have been
+// changed. Callers must hold indexSyncMu across the change and the sync so that an older count can't overwrite a
+// newer one.
+func (s *Store) syncBookmarkIndexes(postATURI, rootURI string) error {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM bookmarks WHERE postATURI = ? AND trackReplies = 1;", postATURI).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("count bookmarks for post: %w", err)
+	}
+	s.bookmarkedPosts.set(postATURI, count)
+
+	if rootURI == "" {
+		return nil
+	}
+
+	err = s.db.QueryRow("SELECT COUNT(*) FROM bookmarks WHERE rootURI = ? AND followThread = 1;", rootURI).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("count followers of thread: %w", err)
+	}
+	s.followedThreads.set(rootURI, count)
+	return nil
+}
+
+// IsPostBookmarked returns if any user has bookmarked the post and is still tracking its replies. It doesn't touch the
+// database.
+func (s *Store) IsPostBookmarked(postATURI string) bool {
+	return s.bookmarkedPosts.has(postATURI)
+}
+
+// IsThreadFollowed returns if any user has a bookmark following the thread with the given root. It doesn't touch the
+// database.
+func (s *Store) IsThreadFollowed(rootURI string) bool {
+	return s.followedThreads.has(rootURI)
+}
+
+type BookmarkIndexStats struct {
+	BookmarkedPosts int
+	FollowedThreads int
+}
+
+func (s *Store) GetBookmarkIndexStats() BookmarkIndexStats {
+	return BookmarkIndexStats{
+		BookmarkedPosts: s.bookmarkedPosts.size(),
+		FollowedThreads: s.followedThreads.size(),
+	}
+}
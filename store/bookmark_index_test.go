@@ -0,0 +1,189 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBookmarkIndexesAreKeptInSync(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	s, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("create store: %s", err)
+	}
+
+	postURI := "at://did:plc:author/app.bsky.feed.post/reply"
+	rootURI := "at://did:plc:author/app.bsky.feed.post/root"
+
+	for _, userDID := range []string{"did:plc:user1", "did:plc:user2"} {
+		if err := s.CreateBookmark("", "", postURI, rootURI, "did:plc:author", "author.test", userDID, "a post", 0); err != nil {
+			t.Fatalf("create bookmark: %s", err)
+		}
+	}
+	if !s.IsPostBookmarked(postURI) {
+		t.Fatal("expected post to be bookmarked")
+	}
+	if s.IsThreadFollowed(rootURI) {
+		t.Fatal("expected thread to not be followed")
+	}
+
+	if err := s.SetBookmarkFollowThread(postURI, "did:plc:user1", true); err != nil {
+		t.Fatalf("follow thread: %s", err)
+	}
+	if !s.IsThreadFollowed(rootURI) {
+		t.Fatal("expected thread to be followed")
+	}
+
+	if err := s.DeleteBookmark(postURI, "did:plc:user1"); err != nil {
+		t.Fatalf("delete bookmark: %s", err)
+	}
+	if !s.IsPostBookmarked(postURI) {
+		t.Error("expected post to still be bookmarked by the other user")
+	}
+	if s.IsThreadFollowed(rootURI) {
+		t.Error("expected thread to no longer be followed once the follower deleted their bookmark")
+	}
+
+	if err := s.SetBookmarkFollowThread(postURI, "did:plc:user2", true); err != nil {
+		t.Fatalf("follow thread: %s", err)
+	}
+	s.Close()
+
+	// the indexes are loaded from the database when the store is created
+	s, err = New(dbPath)
+	if err != nil {
+		t.Fatalf("create store: %s", err)
+	}
+	defer s.Close()
+
+	if !s.IsPostBookmarked(postURI) || !s.IsThreadFollowed(rootURI) {
+		t.Fatalf("expected indexes to be loaded, got %+v", s.GetBookmarkIndexStats())
+	}
+
+	if err := s.DeleteBookmark(postURI, "did:plc:user2"); err != nil {
+		t.Fatalf("delete bookmark: %s", err)
+	}
+	if s.IsPostBookmarked(postURI) || s.IsThreadFollowed(rootURI) {
+		t.Errorf("expected indexes to be empty, got %+v", s.GetBookmarkIndexStats())
+	}
+}
+
+func TestStoredPostsIndex(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	s, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("create store: %s", err)
+	}
+
+	bookmarkURI := "at://did:plc:author/app.bsky.feed.post/bookmarked"
+	replyURI := "at://did:plc:replier/app.bsky.feed.post/reply"
+	threadReplyURI := "at://did:plc:replier/app.bsky.feed.post/thread-reply"
+
+	if err := s.CreateBookmark("", "", bookmarkURI, bookmarkURI, "did:plc:author", "author.test", "did:plc:user", "a post", 0); err != nil {
+		t.Fatalf("create bookmark: %s", err)
+	}
+	if err := s.AddRepliedPost(ReplyPost{ReplyURI: replyURI, UserDID: "did:plc:user", SubscribedPostURI: bookmarkURI}); err != nil {
+		t.Fatalf("add replied post: %s", err)
+	}
+	if err := s.AddThreadReply(ThreadReply{ReplyURI: threadReplyURI, RootURI: bookmarkURI, ParentURI: bookmarkURI, Depth: 1}); err != nil {
+		t.Fatalf("add thread reply: %s", err)
+	}
+
+	for _, uri := range []string{bookmarkURI, replyURI, threadReplyURI} {
+		if !s.IsPostStored(uri) {
+			t.Errorf("expected %s to be stored", uri)
+		}
+	}
+	if s.IsPostStored("at://did:plc:other/app.bsky.feed.post/unrelated") {
+		t.Error("expected unrelated post to not be stored")
+	}
+
+	if err := s.DeletePost(replyURI, 1); err != nil {
+		t.Fatalf("delete post: %s", err)
+	}
+	if s.IsPostStored(replyURI) {
+		t.Error("expected deleted reply to no longer be stored")
+	}
+	s.Close()
+
+	// the index is loaded from the database when the store is created
+	s, err = New(dbPath)
+	if err != nil {
+		t.Fatalf("create store: %s", err)
+	}
+	defer s.Close()
+
+	if !s.IsPostStored(bookmarkURI) || !s.IsPostStored(threadReplyURI) || s.IsPostStored(replyURI) {
+		t.Error("expected stored posts index to be loaded")
+	}
+}
+
+func TestStoredPostsAreForgottenWhenDeleted(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("create store: %s", err)
+	}
+	defer s.Close()
+
+	bookmarkURI := "at://did:plc:author/app.bsky.feed.post/bookmarked"
+	sharedReplyURI := "at://did:plc:replier/app.bsky.feed.post/shared"
+	oldReplyURI := "at://did:plc:replier/app.bsky.feed.post/old"
+	threadReplyURI := "at://did:plc:replier/app.bsky.feed.post/thread-reply"
+
+	for _, userDID := range []string{"did:plc:user", "did:plc:other-user"} {
+		if err := s.CreateBookmark("", "", bookmarkURI, bookmarkURI, "did:plc:author", "author.test", userDID, "a post", 0); err != nil {
+			t.Fatalf("create bookmark: %s", err)
+		}
+		if err := s.AddRepliedPost(ReplyPost{ReplyURI: sharedReplyURI, UserDID: userDID, SubscribedPostURI: bookmarkURI}); err != nil {
+			t.Fatalf("add replied post: %s", err)
+		}
+	}
+	if err := s.AddRepliedPost(ReplyPost{ReplyURI: oldReplyURI, UserDID: "did:plc:user", SubscribedPostURI: bookmarkURI}); err != nil {
+		t.Fatalf("add replied post: %s", err)
+	}
+	if err := s.SetBookmarkFollowThread(bookmarkURI, "did:plc:user", true); err != nil {
+		t.Fatalf("follow thread: %s", err)
+	}
+	if err := s.AddThreadReply(ThreadReply{ReplyURI: threadReplyURI, RootURI: bookmarkURI, ParentURI: bookmarkURI, Depth: 1}); err != nil {
+		t.Fatalf("add thread reply: %s", err)
+	}
+
+	// a reply stored for another user is still stored
+	if err := s.DeleteRepliedPostsForBookmarkedPostURIandUserDID(bookmarkURI, "did:plc:user"); err != nil {
+		t.Fatalf("delete replied posts: %s", err)
+	}
+	if !s.IsPostStored(sharedReplyURI) {
+		t.Error("expected reply stored for another user to still be stored")
+	}
+	if s.IsPostStored(oldReplyURI) {
+		t.Error("expected deleted reply to be forgotten")
+	}
+
+	if _, err := s.DeleteRepliesIndexedBefore(time.Now().Add(time.Hour).UnixMilli()); err != nil {
+		t.Fatalf("delete replies indexed before: %s", err)
+	}
+	if s.IsPostStored(sharedReplyURI) {
+		t.Error("expected reply deleted by retention to be forgotten")
+	}
+
+	if err := s.StopTrackingReplies(bookmarkURI, "did:plc:user"); err != nil {
+		t.Fatalf("stop tracking replies: %s", err)
+	}
+	if s.IsPostStored(threadReplyURI) {
+		t.Error("expected replies of an unfollowed thread to be forgotten")
+	}
+
+	if err := s.DeleteBookmark(bookmarkURI, "did:plc:user"); err != nil {
+		t.Fatalf("delete bookmark: %s", err)
+	}
+	if !s.IsPostStored(bookmarkURI) {
+		t.Error("expected post bookmarked by another user to still be stored")
+	}
+	if err := s.DeleteBookmark(bookmarkURI, "did:plc:other-user"); err != nil {
+		t.Fatalf("delete bookmark: %s", err)
+	}
+	if s.IsPostStored(bookmarkURI) {
+		t.Error("expected post to be forgotten once it isn't bookmarked")
+	}
+}
@@ -0,0 +1,62 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+func addBookmarksRecordKeyColumn(tx *sql.Tx) error {
+	statements := []string{
+		`ALTER TABLE bookmarks ADD COLUMN "recordRKey" TEXT NOT NULL DEFAULT '';`,
+		`CREATE INDEX IF NOT EXISTS bookmarks_user_record_rkey ON bookmarks (userDID, recordRKey);`,
+	}
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return fmt.Errorf("exec add bookmarks record key column statement: %w", err)
+		}
+	}
+	return nil
+}
+
+// SetBookmarkRecordKey records the rkey of the record in the users repo that the bookmark was created from.
+func (s *Store) SetBookmarkRecordKey(postATURI, userDID, recordRKey string) error {
+	sql := "UPDATE bookmarks SET recordRKey = ? WHERE postATURI = ? AND userDID = ?;"
+	_, err := s.db.Exec(sql, recordRKey, postATURI, userDID)
+	if err != nil {
+		return fmt.Errorf("exec update bookmark record key: %w", err)
+	}
+	return nil
+}
+
+// GetBookmarkByRecordKey returns the users bookmark that was created from the record with the given rkey, or nil if
+// there isn't one.
+func (s *Store) GetBookmarkByRecordKey(userDID, recordRKey string) (*Bookmark, error) {
+	sql := "SELECT " + bookmarkColumns + " FROM bookmarks WHERE userDID = ? AND recordRKey = ?;"
+	rows, err := s.db.Query(sql, userDID, recordRKey)
+	if err != nil {
+		return nil, fmt.Errorf("run query to get bookmark by record key: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		bookmark, err := scanBookmark(rows)
+		if err != nil {
+			return nil, err
+		}
+		return &bookmark, nil
+	}
+	return nil, nil
+}
+
+// IsKnownUser returns whether the user has any bookmarks or has logged in with OAuth. Bookmark records can be published
+// by any account, so only the records of known users are indexed.
+func (s *Store) IsKnownUser(did string) (bool, error) {
+	sql := "SELECT EXISTS (SELECT 1 FROM bookmarks WHERE userDID = ?) OR EXISTS (SELECT 1 FROM oauth_sessions WHERE did = ?);"
+	var known bool
+	err := s.db.QueryRow(sql, did, did).Scan(&known)
+	if err != nil {
+		return false, fmt.Errorf("run query to check if user is known: %w", err)
+	}
+	return known, nil
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+var ErrCollectionAlreadyExists = errors.New("collection already exists")
+
+// CollectionFeedRKeyPrefix starts the record key of the feed generator record that is published for each collection.
+const CollectionFeedRKeyPrefix = "collection-"
+
+// CollectionFeedRKey is the record key of the feed generator record that is published for a collection.
+func CollectionFeedRKey(collectionID int) string {
+	return fmt.Sprintf("%s%d", CollectionFeedRKeyPrefix, collectionID)
+}
+
+func createCollectionsTable(tx *sql.Tx) error {
+	createCollectionsTableSQL := `CREATE TABLE IF NOT EXISTS collections (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"userDID" TEXT NOT NULL,
+		"name" TEXT NOT NULL,
+		"createdAt" integer NOT NULL,
+		UNIQUE(userDID, name)
+	  );`
+
+	slog.Info("Create collections table...")
+	statement, err := tx.Prepare(createCollectionsTableSQL)
+	if err != nil {
+		return fmt.Errorf("prepare DB statement to create collections table: %w", err)
+	}
+	_, err = statement.Exec()
+	if err != nil {
+		return fmt.Errorf("exec sql statement to create collections table: %w", err)
+	}
+	slog.Info("collections table created")
+
+	return nil
+}
+
+func addBookmarksCollectionColumn(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE bookmarks ADD COLUMN "collectionID" integer NOT NULL DEFAULT 0;`)
+	if err != nil {
+		return fmt.Errorf("exec sql statement to add collectionID column to bookmarks: %w", err)
+	}
+	return nil
+}
+
+type Collection struct {
+	ID        int
+	UserDID   string
+	Name      string
+	CreatedAt int64
+}
+
+func (s *Store) CreateCollection(userDID, name string, createdAt int64) (Collection, error) {
+	sql := `INSERT INTO collections (userDID, name, createdAt) VALUES (?, ?, ?) ON CONFLICT(userDID, name) DO NOTHING;`
+	res, err := s.db.Exec(sql, userDID, name, createdAt)
+	if err != nil {
+		return Collection{}, fmt.Errorf("exec insert collection: %w", err)
+	}
+
+	if x, _ := res.RowsAffected(); x == 0 {
+		return Collection{}, ErrCollectionAlreadyExists
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Collection{}, fmt.Errorf("get inserted collection id: %w", err)
+	}
+
+	return Collection{
+		ID:        int(id),
+		UserDID:   userDID,
+		Name:      name,
+		CreatedAt: createdAt,
+	}, nil
+}
+
+func (s *Store) GetCollectionsForUser(userDID string) ([]Collection, error) {
+	sql := "SELECT id, userDID, name, createdAt FROM collections WHERE userDID = ? ORDER BY name;"
+	return s.queryCollections(sql, userDID)
+}
+
+func (s *Store) GetAllCollections() ([]Collection, error) {
+	sql := "SELECT id, userDID, name, createdAt FROM collections ORDER BY id;"
+	return s.queryCollections(sql)
+}
+
+func (s *Store) GetCollection(id int) (*Collection, error) {
+	sql := "SELECT id, userDID, name, createdAt FROM collections WHERE id = ?;"
+	collections, err := s.queryCollections(sql, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(collections) == 0 {
+		return nil, nil
+	}
+	return &collections[0], nil
+}
+
+func (s *Store) GetCollectionByName(userDID, name string) (*Collection, error) {
+	sql := "SELECT id, userDID, name, createdAt FROM collections WHERE userDID = ? AND name = ?;"
+	collections, err := s.queryCollections(sql, userDID, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(collections) == 0 {
+		return nil, nil
+	}
+	return &collections[0], nil
+}
+
+func (s *Store) queryCollections(sql string, args ...any) ([]Collection, error) {
+	rows, err := s.db.Query(sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("run query to get collections: %w", err)
+	}
+	defer rows.Close()
+
+	results := make([]Collection, 0)
+	for rows.Next() {
+		var collection Collection
+		if err := rows.Scan(&collection.ID, &collection.UserDID, &collection.Name, &collection.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		results = append(results, collection)
+	}
+	return results, nil
+}
+
+// SetBookmarkCollection moves a users bookmark into a collection. A collectionID of 0 removes the bookmark from any
+// collection.
+func (s *Store) SetBookmarkCollection(postATURI, userDID string, collectionID int) error {
+	sql := "UPDATE bookmarks SET collectionID = ? WHERE postATURI = ? AND userDID = ?;"
+	res, err := s.db.Exec(sql, collectionID, postATURI, userDID)
+	if err != nil {
+		return fmt.Errorf("exec update bookmark collection: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBookmarkNotFound
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+func createCursorsTable(tx *sql.Tx) error {
+	createCursorsTableSQL := `CREATE TABLE IF NOT EXISTS cursors (
+		"name" TEXT NOT NULL PRIMARY KEY,
+		"cursor" integer NOT NULL,
+		"updatedAt" integer NOT NULL
+	  );`
+
+	slog.Info("Create cursors table...")
+	statement, err := tx.Prepare(createCursorsTableSQL)
+	if err != nil {
+		return fmt.Errorf("prepare DB statement to create cursors table: %w", err)
+	}
+	_, err = statement.Exec()
+	if err != nil {
+		return fmt.Errorf("exec sql statement to create cursors table: %w", err)
+	}
+	slog.Info("cursors table created")
+
+	return nil
+}
+
+// GetCursor returns the last saved cursor for the given name. If no cursor has been saved yet then 0 is returned.
+func (s *Store) GetCursor(name string) (int64, error) {
+	sql := "SELECT cursor FROM cursors WHERE name = ?;"
+	rows, err := s.db.Query(sql, name)
+	if err != nil {
+		return 0, fmt.Errorf("run query to get cursor: %w", err)
+	}
+	defer rows.Close()
+
+	var cursor int64
+	if rows.Next() {
+		if err := rows.Scan(&cursor); err != nil {
+			return 0, fmt.Errorf("scan row: %w", err)
+		}
+	}
+	return cursor, nil
+}
+
+func (s *Store) SaveCursor(name string, cursor int64) error {
+	sql := `INSERT INTO cursors (name, cursor, updatedAt) VALUES (?, ?, ?) ON CONFLICT(name) DO UPDATE SET cursor = excluded.cursor, updatedAt = excluded.updatedAt;`
+	_, err := s.db.Exec(sql, name, cursor, time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("exec upsert cursor: %w", err)
+	}
+	return nil
+}
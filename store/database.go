@@ -1,53 +1,101 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"sync"
 
 	_ "github.com/glebarez/go-sqlite"
 )
 
 type Store struct {
 	db *sql.DB
+
+	// indexSyncMu is held while bookmarks are changed and the in memory indexes are synced
+	indexSyncMu     sync.Mutex
+	bookmarkedPosts *uriIndex
+	followedThreads *uriIndex
+	// storedPosts holds the URIs of bookmarked posts, replies and thread replies so that deletes of every other post
+	// can be ignored without touching the database
+	storedPosts *uriIndex
+	// storedPostsMu is held while posts are stored or deleted and storedPosts is updated, so that a post being stored
+	// again can't be forgotten
+	storedPostsMu sync.Mutex
 }
 
 func New(dbPath string) (*Store, error) {
-	if dbPath != ":memory:" {
-		err := createDbFile(dbPath)
-		if err != nil {
-			return nil, fmt.Errorf("create db file: %w", err)
-		}
+	db, err := openDB(dbPath)
+	if err != nil {
+		return nil, err
 	}
 
-	db, err := sql.Open("sqlite", dbPath)
+	_, err = migrate(db, false)
 	if err != nil {
-		return nil, fmt.Errorf("open database: %w", err)
+		db.Close()
+		return nil, fmt.Errorf("migrating database: %w", err)
 	}
 
-	err = db.Ping()
+	s := &Store{
+		db:              db,
+		bookmarkedPosts: newURIIndex(),
+		followedThreads: newURIIndex(),
+		storedPosts:     newURIIndex(),
+	}
+
+	err = s.loadBookmarkIndexes()
 	if err != nil {
-		return nil, fmt.Errorf("ping db: %w", err)
+		db.Close()
+		return nil, fmt.Errorf("loading bookmark indexes: %w", err)
+	}
+	stats := s.GetBookmarkIndexStats()
+	slog.Info("bookmark indexes loaded", "bookmarked posts", stats.BookmarkedPosts, "followed threads", stats.FollowedThreads)
+
+	return s, nil
+}
+
+func (s *Store) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// DryRunMigrations runs any pending migrations against the database inside a transaction which is then rolled back.
+// It returns the migrations that would have been applied.
+func DryRunMigrations(dbPath string) ([]Migration, error) {
+	db, err := openDB(dbPath)
+	if err != nil {
+		return nil, err
 	}
+	defer db.Close()
 
-	err = createRepliesTable(db)
+	pending, err := migrate(db, true)
 	if err != nil {
-		return nil, fmt.Errorf("creating replies table: %w", err)
+		return nil, fmt.Errorf("dry run migrating database: %w", err)
+	}
+	return pending, nil
+}
+
+func openDB(dbPath string) (*sql.DB, error) {
+	if dbPath != ":memory:" {
+		err := createDbFile(dbPath)
+		if err != nil {
+			return nil, fmt.Errorf("create db file: %w", err)
+		}
 	}
 
-	err = createBookmarksTable(db)
+	db, err := sql.Open("sqlite", dbPath)
 	if err != nil {
-		return nil, fmt.Errorf("creating bookmarks table: %w", err)
+		return nil, fmt.Errorf("open database: %w", err)
 	}
 
-	err = createOauthRequestsTable(db)
+	err = db.Ping()
 	if err != nil {
-		return nil, fmt.Errorf("creating oauth requests table: %w", err)
+		return nil, fmt.Errorf("ping db: %w", err)
 	}
 
-	return &Store{db: db}, nil
+	return db, nil
 }
 
 func (s *Store) Close() {
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+func addBookmarksDeletedAtColumn(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE bookmarks ADD COLUMN "deletedAt" integer NOT NULL DEFAULT 0;`)
+	if err != nil {
+		return fmt.Errorf("exec sql statement to add deletedAt column to bookmarks: %w", err)
+	}
+	return nil
+}
+
+// DeletePost is called when a post has been deleted by its author. Any replies, quotes or thread replies that were the
+// deleted post are removed. Bookmarks of the deleted post are kept so that users can see what they had saved, but are
+// marked as deleted so that they are no longer served in feeds.
+func (s *Store) DeletePost(postATURI string, deletedAt int64) error {
+	s.storedPostsMu.Lock()
+	defer s.storedPostsMu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM replies WHERE replyURI = ?;", postATURI)
+	if err != nil {
+		return fmt.Errorf("exec delete replies for deleted post: %w", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM thread_replies WHERE replyURI = ?;", postATURI)
+	if err != nil {
+		return fmt.Errorf("exec delete thread replies for deleted post: %w", err)
+	}
+
+	_, err = tx.Exec("UPDATE bookmarks SET deletedAt = ? WHERE postATURI = ? AND deletedAt = 0;", deletedAt, postATURI)
+	if err != nil {
+		return fmt.Errorf("exec mark bookmarks of deleted post as deleted: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	s.storedPosts.set(postATURI, 0)
+	return nil
+}
+
+// IsPostStored returns if the post could be a bookmarked post, reply or thread reply that is stored, and so needs
+// removing when it's deleted. It doesn't touch the database.
+func (s *Store) IsPostStored(postATURI string) bool {
+	return s.storedPosts.has(postATURI)
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const (
+	DigestOff         = "off"
+	DigestImmediately = "immediately"
+	DigestHourly      = "hourly"
+	DigestDaily       = "daily"
+)
+
+func addUserSettingsDigestColumns(tx *sql.Tx) error {
+	statements := []string{
+		`ALTER TABLE user_settings ADD COLUMN "digestSchedule" TEXT NOT NULL DEFAULT 'off';`,
+		`ALTER TABLE user_settings ADD COLUMN "digestConvoID" TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE user_settings ADD COLUMN "lastDigestAt" integer NOT NULL DEFAULT 0;`,
+	}
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return fmt.Errorf("exec add user settings digest columns statement: %w", err)
+		}
+	}
+	return nil
+}
+
+// SetDigestSchedule sets how often the user is sent a digest of new replies and the chat to send it to. When a digest
+// is first turned on only replies from then onwards are included, rather than every reply the user already has.
+func (s *Store) SetDigestSchedule(userDID, schedule, convoID string, now int64) error {
+	sql := `INSERT INTO user_settings (userDID, digestSchedule, digestConvoID, lastDigestAt) VALUES (?, ?, ?, ?)
+			ON CONFLICT(userDID) DO UPDATE SET
+				digestSchedule = excluded.digestSchedule,
+				digestConvoID = excluded.digestConvoID,
+				lastDigestAt = CASE WHEN user_settings.digestSchedule = 'off' THEN excluded.lastDigestAt ELSE user_settings.lastDigestAt END;`
+	_, err := s.db.Exec(sql, userDID, schedule, convoID, now)
+	if err != nil {
+		return fmt.Errorf("exec upsert user settings digest schedule: %w", err)
+	}
+	return nil
+}
+
+// GetDigestSubscribers returns the settings of every user that has a digest turned on.
+func (s *Store) GetDigestSubscribers() ([]UserSettings, error) {
+	sql := "SELECT " + userSettingsColumns + " FROM user_settings WHERE digestSchedule != 'off';"
+	rows, err := s.db.Query(sql)
+	if err != nil {
+		return nil, fmt.Errorf("run query to get digest subscribers: %w", err)
+	}
+	defer rows.Close()
+
+	subscribers := make([]UserSettings, 0)
+	for rows.Next() {
+		settings, err := scanUserSettings(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscribers = append(subscribers, settings)
+	}
+	return subscribers, nil
+}
+
+// DigestEntry is a bookmarked post along with how many new replies and quotes it has had.
+type DigestEntry struct {
+	PostATURI    string
+	PostURI      string
+	AuthorHandle string
+	Content      string
+	Replies      int
+	Quotes       int
+}
+
+// GetDigestEntries returns the user's bookmarked posts that have had replies stored from the after time up to but not
+// including the until time, with the most replied to first.
+func (s *Store) GetDigestEntries(userDID string, after, until int64) ([]DigestEntry, error) {
+	sql := `SELECT bookmarks.postATURI, bookmarks.postURI, bookmarks.authorHandle, bookmarks.content,
+				SUM(CASE WHEN replies.kind = 'quote' THEN 0 ELSE 1 END),
+				SUM(CASE WHEN replies.kind = 'quote' THEN 1 ELSE 0 END)
+			FROM replies
+			JOIN bookmarks ON bookmarks.postATURI = replies.subscribedPostURI AND bookmarks.userDID = replies.userDID
+			WHERE replies.userDID = ? AND replies.indexedAt >= ? AND replies.indexedAt < ?
+			GROUP BY bookmarks.postATURI
+			ORDER BY COUNT(*) DESC, MAX(replies.indexedAt) DESC;`
+	rows, err := s.db.Query(sql, userDID, after, until)
+	if err != nil {
+		return nil, fmt.Errorf("run query to get digest entries: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make([]DigestEntry, 0)
+	for rows.Next() {
+		var entry DigestEntry
+		if err := rows.Scan(&entry.PostATURI, &entry.PostURI, &entry.AuthorHandle, &entry.Content, &entry.Replies, &entry.Quotes); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *Store) SetLastDigestAt(userDID string, lastDigestAt int64) error {
+	sql := "UPDATE user_settings SET lastDigestAt = ? WHERE userDID = ?;"
+	_, err := s.db.Exec(sql, lastDigestAt, userDID)
+	if err != nil {
+		return fmt.Errorf("exec update last digest at: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const dayMillis = 24 * 60 * 60 * 1000
+
+func addBookmarkExpiryColumns(tx *sql.Tx) error {
+	statements := []string{
+		`ALTER TABLE bookmarks ADD COLUMN "expiresAt" integer NOT NULL DEFAULT 0;`,
+		`ALTER TABLE bookmarks ADD COLUMN "trackReplies" integer NOT NULL DEFAULT 1;`,
+		`ALTER TABLE user_settings ADD COLUMN "bookmarkTTLDays" integer NOT NULL DEFAULT 0;`,
+	}
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return fmt.Errorf("exec add bookmark expiry columns statement: %w", err)
+		}
+	}
+	return nil
+}
+
+// SetBookmarkExpiry sets when a single bookmark expires. An expiresAt of 0 means the users bookmark TTL setting is used
+// instead.
+func (s *Store) SetBookmarkExpiry(postATURI, userDID string, expiresAt int64) error {
+	sql := "UPDATE bookmarks SET expiresAt = ? WHERE postATURI = ? AND userDID = ?;"
+	res, err := s.db.Exec(sql, expiresAt, postATURI, userDID)
+	if err != nil {
+		return fmt.Errorf("exec update bookmark expiry: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBookmarkNotFound
+	}
+	return nil
+}
+
+func (s *Store) SetBookmarkTTLDays(userDID string, days int) error {
+	sql := `INSERT INTO user_settings (userDID, bookmarkTTLDays) VALUES (?, ?) ON CONFLICT(userDID) DO UPDATE SET bookmarkTTLDays = excluded.bookmarkTTLDays;`
+	_, err := s.db.Exec(sql, userDID, days)
+	if err != nil {
+		return fmt.Errorf("exec upsert user settings bookmark TTL days: %w", err)
+	}
+	return nil
+}
+
+// GetExpiredBookmarks returns bookmarks that have expired by now, either because their own expiry has passed or
+// because they are older than the users bookmark TTL.
+func (s *Store) GetExpiredBookmarks(now int64, limit int) ([]Bookmark, error) {
+	sql := `SELECT ` + bookmarkColumns + ` FROM bookmarks
+			WHERE (expiresAt > 0 AND expiresAt <= ?)
+			OR (expiresAt = 0 AND EXISTS (
+				SELECT 1 FROM user_settings
+				WHERE user_settings.userDID = bookmarks.userDID
+				AND user_settings.bookmarkTTLDays > 0
+				AND bookmarks.createdAt + user_settings.bookmarkTTLDays * ? <= ?
+			))
+			LIMIT ?;`
+	rows, err := s.db.Query(sql, now, dayMillis, now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("run query to get expired bookmarks: %w", err)
+	}
+	defer rows.Close()
+
+	bookmarks := make([]Bookmark, 0)
+	for rows.Next() {
+		bookmark, err := scanBookmark(rows)
+		if err != nil {
+			return nil, err
+		}
+		bookmarks = append(bookmarks, bookmark)
+	}
+	return bookmarks, nil
+}
+
+// GetBookmarksTrackingRepliesCreatedBefore returns bookmarks that are still tracking replies or following their thread
+// and were created before the given time.
+func (s *Store) GetBookmarksTrackingRepliesCreatedBefore(before int64, limit int) ([]Bookmark, error) {
+	sql := `SELECT ` + bookmarkColumns + ` FROM bookmarks WHERE (trackReplies = 1 OR followThread = 1) AND createdAt < ? LIMIT ?;`
+	rows, err := s.db.Query(sql, before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("run query to get bookmarks tracking replies: %w", err)
+	}
+	defer rows.Close()
+
+	bookmarks := make([]Bookmark, 0)
+	for rows.Next() {
+		bookmark, err := scanBookmark(rows)
+		if err != nil {
+			return nil, err
+		}
+		bookmarks = append(bookmarks, bookmark)
+	}
+	return bookmarks, nil
+}
+
+// StopTrackingReplies stops new replies to the bookmarked post, and to its thread if it was followed, being stored for
+// the user. Replies already stored for the thread are removed once nobody follows it.
+func (s *Store) StopTrackingReplies(postATURI, userDID string) error {
+	s.indexSyncMu.Lock()
+	defer s.indexSyncMu.Unlock()
+
+	sql := "UPDATE bookmarks SET trackReplies = 0, followThread = 0 WHERE postATURI = ? AND userDID = ? RETURNING rootURI;"
+	rows, err := s.db.Query(sql, postATURI, userDID)
+	if err != nil {
+		return fmt.Errorf("exec update bookmark track replies: %w", err)
+	}
+	defer rows.Close()
+
+	var rootURI string
+	if rows.Next() {
+		if err := rows.Scan(&rootURI); err != nil {
+			return fmt.Errorf("scan row: %w", err)
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return fmt.Errorf("exec update bookmark track replies: %w", err)
+	}
+
+	err = s.syncBookmarkIndexes(postATURI, rootURI)
+	if err != nil {
+		return fmt.Errorf("sync bookmark indexes: %w", err)
+	}
+
+	if rootURI == "" || s.followedThreads.has(rootURI) {
+		return nil
+	}
+
+	s.storedPostsMu.Lock()
+	defer s.storedPostsMu.Unlock()
+
+	rows, err = s.db.Query("DELETE FROM thread_replies WHERE rootURI = ? RETURNING replyURI;", rootURI)
+	if err != nil {
+		return fmt.Errorf("exec delete thread replies for unfollowed thread: %w", err)
+	}
+	replyURIs, err := scanURIs(rows)
+	if err != nil {
+		return fmt.Errorf("exec delete thread replies for unfollowed thread: %w", err)
+	}
+
+	err = s.forgetStoredPosts(replyURIs)
+	if err != nil {
+		return fmt.Errorf("forget deleted thread replies: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+var ErrDatabaseNewerThanBinary = errors.New("database schema is newer than this binary supports")
+
+type Migration struct {
+	Version int
+	Name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations are applied in order of their version. Once a migration has been released it should never be changed or
+// removed, instead add a new migration to the end of the list.
+var migrations = []Migration{
+	{Version: 1, Name: "create replies table", up: createRepliesTable},
+	{Version: 2, Name: "create bookmarks table", up: createBookmarksTable},
+	{Version: 3, Name: "create oauth requests table", up: createOauthRequestsTable},
+	{Version: 4, Name: "create cursors table", up: createCursorsTable},
+	{Version: 5, Name: "make bookmarks unique by post AT URI", up: migrateBookmarksUniqueKey},
+	{Version: 6, Name: "create collections table", up: createCollectionsTable},
+	{Version: 7, Name: "add collection to bookmarks", up: addBookmarksCollectionColumn},
+	{Version: 8, Name: "create bookmark tags table", up: createBookmarkTagsTable},
+	{Version: 9, Name: "create bookmarks search index", up: createBookmarksSearchIndex},
+	{Version: 10, Name: "create user settings table", up: createUserSettingsTable},
+	{Version: 11, Name: "add thread columns to bookmarks", up: addBookmarksThreadColumns},
+	{Version: 12, Name: "create thread replies table", up: createThreadRepliesTable},
+	{Version: 13, Name: "add kind to replies", up: addRepliesKindColumn},
+	{Version: 14, Name: "add deleted at to bookmarks", up: addBookmarksDeletedAtColumn},
+	{Version: 15, Name: "add indexed at to replies", up: addRepliesIndexedAtColumn},
+	{Version: 16, Name: "add digest settings to user settings", up: addUserSettingsDigestColumns},
+	{Version: 17, Name: "add bookmark expiry", up: addBookmarkExpiryColumns},
+	{Version: 18, Name: "add replies retention indexes", up: addRepliesRetentionIndexes},
+	{Version: 19, Name: "add record key to bookmarks", up: addBookmarksRecordKeyColumn},
+	{Version: 20, Name: "create oauth sessions table", up: createOauthSessionsTable},
+	{Version: 21, Name: "create web sessions table", up: createWebSessionsTable},
+	{Version: 22, Name: "add replies indexed at index", up: addRepliesIndexedAtIndex},
+	{Version: 23, Name: "add refresh backoff to oauth sessions", up: addOauthSessionsRefreshBackoffColumns},
+}
+
+func createSchemaMigrationsTable(tx *sql.Tx) error {
+	createSchemaMigrationsTableSQL := `CREATE TABLE IF NOT EXISTS schema_migrations (
+		"version" integer NOT NULL PRIMARY KEY,
+		"name" TEXT,
+		"appliedAt" integer NOT NULL
+	  );`
+
+	_, err := tx.Exec(createSchemaMigrationsTableSQL)
+	if err != nil {
+		return fmt.Errorf("exec sql statement to create schema_migrations table: %w", err)
+	}
+	return nil
+}
+
+// migrate applies all migrations newer than the current database version in a single transaction. If dryRun is true
+// then the transaction is rolled back instead of committed. The migrations that were (or would have been) applied are
+// returned.
+func migrate(db *sql.DB, dryRun bool) ([]Migration, error) {
+	err := validateMigrations(migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = createSchemaMigrationsTable(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var currentVersion int
+	err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations;").Scan(&currentVersion)
+	if err != nil {
+		return nil, fmt.Errorf("get current schema version: %w", err)
+	}
+
+	latestVersion := migrations[len(migrations)-1].Version
+	if currentVersion > latestVersion {
+		return nil, fmt.Errorf("%w: database is at version %d but the latest known version is %d", ErrDatabaseNewerThanBinary, currentVersion, latestVersion)
+	}
+
+	applied := make([]Migration, 0)
+	for _, migration := range migrations {
+		if migration.Version <= currentVersion {
+			continue
+		}
+
+		slog.Info("applying migration", "version", migration.Version, "name", migration.Name, "dry run", dryRun)
+		err = migration.up(tx)
+		if err != nil {
+			return nil, fmt.Errorf("apply migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, name, appliedAt) VALUES (?, ?, ?);", migration.Version, migration.Name, time.Now().UnixMilli())
+		if err != nil {
+			return nil, fmt.Errorf("record migration %d: %w", migration.Version, err)
+		}
+
+		applied = append(applied, migration)
+	}
+
+	if dryRun {
+		return applied, nil
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("commit migrations: %w", err)
+	}
+
+	slog.Info("database schema up to date", "version", latestVersion, "applied migrations", len(applied))
+	return applied, nil
+}
+
+func validateMigrations(migrations []Migration) error {
+	if len(migrations) == 0 {
+		return fmt.Errorf("no migrations defined")
+	}
+
+	previousVersion := 0
+	for _, migration := range migrations {
+		if migration.Version <= previousVersion {
+			return fmt.Errorf("migration %d (%s) is out of order", migration.Version, migration.Name)
+		}
+		previousVersion = migration.Version
+	}
+	return nil
+}
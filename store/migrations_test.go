@@ -0,0 +1,72 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewAppliesAllMigrations(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+
+	s, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("create store: %s", err)
+	}
+	defer s.Close()
+
+	var version int
+	if err := s.db.QueryRow("SELECT MAX(version) FROM schema_migrations;").Scan(&version); err != nil {
+		t.Fatalf("get schema version: %s", err)
+	}
+	if latest := migrations[len(migrations)-1].Version; version != latest {
+		t.Errorf("expected schema version %d, got %d", latest, version)
+	}
+
+	pending, err := DryRunMigrations(dbPath)
+	if err != nil {
+		t.Fatalf("dry run migrations: %s", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("expected no pending migrations, got %d", len(pending))
+	}
+}
+
+func TestDryRunMigrationsDoesNotApply(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+
+	pending, err := DryRunMigrations(dbPath)
+	if err != nil {
+		t.Fatalf("dry run migrations: %s", err)
+	}
+	if len(pending) != len(migrations) {
+		t.Errorf("expected %d pending migrations, got %d", len(migrations), len(pending))
+	}
+
+	pending, err = DryRunMigrations(dbPath)
+	if err != nil {
+		t.Fatalf("dry run migrations: %s", err)
+	}
+	if len(pending) != len(migrations) {
+		t.Errorf("expected dry run to not apply migrations, got %d pending", len(pending))
+	}
+}
+
+func TestNewRefusesNewerDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+
+	s, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("create store: %s", err)
+	}
+	_, err = s.db.Exec("INSERT INTO schema_migrations (version, name, appliedAt) VALUES (?, 'from the future', 0);", migrations[len(migrations)-1].Version+1)
+	if err != nil {
+		t.Fatalf("insert future migration: %s", err)
+	}
+	s.Close()
+
+	_, err = New(dbPath)
+	if !errors.Is(err, ErrDatabaseNewerThanBinary) {
+		t.Errorf("expected ErrDatabaseNewerThanBinary, got %v", err)
+	}
+}
@@ -9,7 +9,7 @@ import (
 
 var ErrOauthRequestAlreadyExists = errors.New("oauth request already exists")
 
-func createOauthRequestsTable(db *sql.DB) error {
+func createOauthRequestsTable(tx *sql.Tx) error {
 	createOauthRequestsTableSQL := `CREATE TABLE IF NOT EXISTS oauthrequests (
 		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
 		"authserverIss" TEXT,
@@ -22,7 +22,7 @@ func createOauthRequestsTable(db *sql.DB) error {
 	  );`
 
 	slog.Info("Create oauthrequests table...")
-	statement, err := db.Prepare(createOauthRequestsTableSQL)
+	statement, err := tx.Prepare(createOauthRequestsTableSQL)
 	if err != nil {
 		return fmt.Errorf("prepare DB statement to create oauthrequests table: %w", err)
 	}
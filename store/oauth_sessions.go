@@ -0,0 +1,168 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+func createOauthSessionsTable(tx *sql.Tx) error {
+	createOauthSessionsTableSQL := `CREATE TABLE IF NOT EXISTS oauth_sessions (
+		"did" TEXT NOT NULL PRIMARY KEY,
+		"pdsURL" TEXT NOT NULL,
+		"authserverIss" TEXT NOT NULL,
+		"accessToken" TEXT NOT NULL,
+		"refreshToken" TEXT NOT NULL,
+		"dpopAuthserverNonce" TEXT NOT NULL DEFAULT '',
+		"dpopPdsNonce" TEXT NOT NULL DEFAULT '',
+		"dpopPrivateJwk" TEXT NOT NULL,
+		"expiresAt" integer NOT NULL,
+		"updatedAt" integer NOT NULL
+	  );`
+
+	slog.Info("Create oauth_sessions table...")
+	statement, err := tx.Prepare(createOauthSessionsTableSQL)
+	if err != nil {
+		return fmt.Errorf("prepare DB statement to create oauth_sessions table: %w", err)
+	}
+	_, err = statement.Exec()
+	if err != nil {
+		return fmt.Errorf("exec sql statement to create oauth_sessions table: %w", err)
+	}
+	slog.Info("oauth_sessions table created")
+
+	return nil
+}
+
+// addOauthSessionsRefreshBackoffColumns records failed refreshes so that sessions that keep failing are retried less
+// often and don't hold up the refresh of everyone else's.
+func addOauthSessionsRefreshBackoffColumns(tx *sql.Tx) error {
+	statements := []string{
+		`ALTER TABLE oauth_sessions ADD COLUMN "refreshFailures" integer NOT NULL DEFAULT 0;`,
+		`ALTER TABLE oauth_sessions ADD COLUMN "nextRefreshAt" integer NOT NULL DEFAULT 0;`,
+	}
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return fmt.Errorf("exec add oauth sessions refresh backoff columns statement: %w", err)
+		}
+	}
+	return nil
+}
+
+// OauthSession holds the tokens from a users OAuth login which are used to act on their behalf in their PDS. There is
+// one per user and logging in again replaces it.
+type OauthSession struct {
+	Did                 string
+	PdsURL              string
+	AuthserverIss       string
+	AccessToken         string
+	RefreshToken        string
+	DpopAuthserverNonce string
+	DpopPdsNonce        string
+	DpopPrivateJwk      string
+	// ExpiresAt is the unix milli time that the access token expires
+	ExpiresAt int64
+	UpdatedAt int64
+	// RefreshFailures is how many times in a row refreshing the session has failed
+	RefreshFailures int
+	// NextRefreshAt is the unix milli time before which the session won't be picked up to be refreshed again after a
+	// failure
+	NextRefreshAt int64
+}
+
+func (s *Store) SaveOauthSession(session OauthSession) error {
+	sql := `INSERT INTO oauth_sessions (did, pdsURL, authserverIss, accessToken, refreshToken, dpopAuthserverNonce, dpopPdsNonce, dpopPrivateJwk, expiresAt, updatedAt, refreshFailures, nextRefreshAt)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(did) DO UPDATE SET pdsURL = excluded.pdsURL, authserverIss = excluded.authserverIss, accessToken = excluded.accessToken,
+				refreshToken = excluded.refreshToken, dpopAuthserverNonce = excluded.dpopAuthserverNonce, dpopPdsNonce = excluded.dpopPdsNonce,
+				dpopPrivateJwk = excluded.dpopPrivateJwk, expiresAt = excluded.expiresAt, updatedAt = excluded.updatedAt,
+				refreshFailures = excluded.refreshFailures, nextRefreshAt = excluded.nextRefreshAt;`
+	_, err := s.db.Exec(sql, session.Did, session.PdsURL, session.AuthserverIss, session.AccessToken, session.RefreshToken, session.DpopAuthserverNonce, session.DpopPdsNonce, session.DpopPrivateJwk, session.ExpiresAt, session.UpdatedAt, session.RefreshFailures, session.NextRefreshAt)
+	if err != nil {
+		return fmt.Errorf("exec upsert oauth session: %w", err)
+	}
+	return nil
+}
+
+// GetOauthSession returns the users OAuth session, or nil if they don't have one.
+func (s *Store) GetOauthSession(did string) (*OauthSession, error) {
+	sql := `SELECT did, pdsURL, authserverIss, accessToken, refreshToken, dpopAuthserverNonce, dpopPdsNonce, dpopPrivateJwk, expiresAt, updatedAt, refreshFailures, nextRefreshAt
+			FROM oauth_sessions WHERE did = ?;`
+	rows, err := s.db.Query(sql, did)
+	if err != nil {
+		return nil, fmt.Errorf("run query to get oauth session: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		session, err := scanOauthSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		return &session, nil
+	}
+	return nil, nil
+}
+
+// GetOauthSessionsExpiringBefore returns the sessions with access tokens that expire before the given time, soonest
+// first. Sessions that are backing off after a failed refresh are left out until their next refresh time has passed.
+func (s *Store) GetOauthSessionsExpiringBefore(before, now int64, limit int) ([]OauthSession, error) {
+	sql := `SELECT did, pdsURL, authserverIss, accessToken, refreshToken, dpopAuthserverNonce, dpopPdsNonce, dpopPrivateJwk, expiresAt, updatedAt, refreshFailures, nextRefreshAt
+			FROM oauth_sessions WHERE expiresAt < ? AND nextRefreshAt <= ? ORDER BY expiresAt LIMIT ?;`
+	rows, err := s.db.Query(sql, before, now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("run query to get expiring oauth sessions: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := make([]OauthSession, 0)
+	for rows.Next() {
+		session, err := scanOauthSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func scanOauthSession(row scanner) (OauthSession, error) {
+	var session OauthSession
+	err := row.Scan(&session.Did, &session.PdsURL, &session.AuthserverIss, &session.AccessToken, &session.RefreshToken, &session.DpopAuthserverNonce, &session.DpopPdsNonce, &session.DpopPrivateJwk, &session.ExpiresAt, &session.UpdatedAt, &session.RefreshFailures, &session.NextRefreshAt)
+	if err != nil {
+		return session, fmt.Errorf("scan row: %w", err)
+	}
+	return session, nil
+}
+
+// UpdateOauthSessionDpopPdsNonce stores the latest DPoP nonce the users PDS handed out so that the next request doesn't
+// have to be retried to get it.
+func (s *Store) UpdateOauthSessionDpopPdsNonce(did, nonce string) error {
+	sql := "UPDATE oauth_sessions SET dpopPdsNonce = ? WHERE did = ?;"
+	_, err := s.db.Exec(sql, nonce, did)
+	if err != nil {
+		return fmt.Errorf("exec update oauth session dpop pds nonce: %w", err)
+	}
+	return nil
+}
+
+// SetOauthSessionRefreshBackoff records how many refreshes of the users session have failed in a row and when it
+// should next be refreshed.
+func (s *Store) SetOauthSessionRefreshBackoff(did string, failures int, nextRefreshAt int64) error {
+	sql := "UPDATE oauth_sessions SET refreshFailures = ?, nextRefreshAt = ? WHERE did = ?;"
+	_, err := s.db.Exec(sql, failures, nextRefreshAt, did)
+	if err != nil {
+		return fmt.Errorf("exec update oauth session refresh backoff: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) DeleteOauthSession(did string) error {
+	sql := "DELETE FROM oauth_sessions WHERE did = ?;"
+	_, err := s.db.Exec(sql, did)
+	if err != nil {
+		return fmt.Errorf("exec delete oauth session: %w", err)
+	}
+	return nil
+}
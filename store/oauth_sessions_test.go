@@ -0,0 +1,65 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestOauthSessions(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("create store: %s", err)
+	}
+	defer s.Close()
+
+	session, err := s.GetOauthSession("did:plc:user")
+	if err != nil {
+		t.Fatalf("get missing oauth session: %s", err)
+	}
+	if session != nil {
+		t.Fatalf("expected no session, got %+v", session)
+	}
+
+	saved := OauthSession{
+		Did:            "did:plc:user",
+		PdsURL:         "https://pds.test",
+		AuthserverIss:  "https://auth.test",
+		AccessToken:    "access",
+		RefreshToken:   "refresh",
+		DpopPrivateJwk: "{}",
+		ExpiresAt:      1000,
+		UpdatedAt:      1,
+	}
+	if err := s.SaveOauthSession(saved); err != nil {
+		t.Fatalf("save oauth session: %s", err)
+	}
+
+	// logging in again replaces the session
+	saved.AccessToken = "new access"
+	if err := s.SaveOauthSession(saved); err != nil {
+		t.Fatalf("save oauth session again: %s", err)
+	}
+	if err := s.UpdateOauthSessionDpopPdsNonce("did:plc:user", "nonce"); err != nil {
+		t.Fatalf("update dpop pds nonce: %s", err)
+	}
+
+	session, err = s.GetOauthSession("did:plc:user")
+	if err != nil {
+		t.Fatalf("get oauth session: %s", err)
+	}
+	saved.DpopPdsNonce = "nonce"
+	if session == nil || *session != saved {
+		t.Fatalf("expected %+v, got %+v", saved, session)
+	}
+
+	if err := s.DeleteOauthSession("did:plc:user"); err != nil {
+		t.Fatalf("delete oauth session: %s", err)
+	}
+	session, err = s.GetOauthSession("did:plc:user")
+	if err != nil {
+		t.Fatalf("get deleted oauth session: %s", err)
+	}
+	if session != nil {
+		t.Errorf("expected session to be deleted, got %+v", session)
+	}
+}
@@ -4,9 +4,10 @@ import (
 	"database/sql"
 	"fmt"
 	"log/slog"
+	"time"
 )
 
-func createRepliesTable(db *sql.DB) error {
+func createRepliesTable(tx *sql.Tx) error {
 	createRepliesTableSQL := `CREATE TABLE IF NOT EXISTS replies (
 		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
 		"replyURI" TEXT,
@@ -17,7 +18,7 @@ func createRepliesTable(db *sql.DB) error {
 	  );`
 
 	slog.Info("Create replies table...")
-	statement, err := db.Prepare(createRepliesTableSQL)
+	statement, err := tx.Prepare(createRepliesTableSQL)
 	if err != nil {
 		return fmt.Errorf("prepare DB statement to create replies table: %w", err)
 	}
@@ -30,25 +31,66 @@ func createRepliesTable(db *sql.DB) error {
 	return nil
 }
 
+const (
+	ReplyKindReply = "reply"
+	ReplyKindQuote = "quote"
+)
+
+// addRepliesKindColumn lets quotes of bookmarked posts be stored alongside replies.
+func addRepliesKindColumn(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE replies ADD COLUMN "kind" TEXT NOT NULL DEFAULT 'reply';`)
+	if err != nil {
+		return fmt.Errorf("exec sql statement to add kind column to replies: %w", err)
+	}
+	return nil
+}
+
+// addRepliesIndexedAtColumn records when replies were stored, since the createdAt of a post is set by its author and
+// can't be trusted to find replies that are new.
+func addRepliesIndexedAtColumn(tx *sql.Tx) error {
+	statements := []string{
+		`ALTER TABLE replies ADD COLUMN "indexedAt" integer NOT NULL DEFAULT 0;`,
+		`CREATE INDEX IF NOT EXISTS replies_user_indexed_at ON replies (userDID, indexedAt);`,
+	}
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return fmt.Errorf("exec add replies indexed at column statement: %w", err)
+		}
+	}
+	return nil
+}
+
 type ReplyPost struct {
 	ID                int
 	ReplyURI          string
 	UserDID           string
 	SubscribedPostURI string
 	CreatedAt         int64
+	// Kind is either a reply to or a quote of the subscribed post
+	Kind string
 }
 
 func (s *Store) AddRepliedPost(replyPost ReplyPost) error {
-	sql := `INSERT INTO replies (replyURI, userDID, subscribedPostURI, createdAt) VALUES (?, ?, ?, ?) ON CONFLICT(replyURI, userDID) DO NOTHING;`
-	_, err := s.db.Exec(sql, replyPost.ReplyURI, replyPost.UserDID, replyPost.SubscribedPostURI, replyPost.CreatedAt)
+	kind := replyPost.Kind
+	if kind == "" {
+		kind = ReplyKindReply
+	}
+
+	s.storedPostsMu.Lock()
+	defer s.storedPostsMu.Unlock()
+
+	sql := `INSERT INTO replies (replyURI, userDID, subscribedPostURI, createdAt, kind, indexedAt) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT(replyURI, userDID) DO NOTHING;`
+	_, err := s.db.Exec(sql, replyPost.ReplyURI, replyPost.UserDID, replyPost.SubscribedPostURI, replyPost.CreatedAt, kind, time.Now().UnixMilli())
 	if err != nil {
 		return fmt.Errorf("exec insert replies post: %w", err)
 	}
+	s.storedPosts.add(replyPost.ReplyURI)
 	return nil
 }
 
 func (s *Store) GetUsersReplies(usersDID string, cursor int64, limit int) ([]ReplyPost, error) {
-	sql := `SELECT id, replyURI, userDID, subscribedPostURI, createdAt FROM replies
+	sql := `SELECT id, replyURI, userDID, subscribedPostURI, createdAt, kind FROM replies
 			WHERE userDID = ? AND createdAt < ?
 			ORDER BY createdAt DESC LIMIT ?;`
 	rows, err := s.db.Query(sql, usersDID, cursor, limit)
@@ -60,7 +102,7 @@ func (s *Store) GetUsersReplies(usersDID string, cursor int64, limit int) ([]Rep
 	repliedPosts := make([]ReplyPost, 0)
 	for rows.Next() {
 		var replyPost ReplyPost
-		if err := rows.Scan(&replyPost.ID, &replyPost.ReplyURI, &replyPost.UserDID, &replyPost.SubscribedPostURI, &replyPost.CreatedAt); err != nil {
+		if err := rows.Scan(&replyPost.ID, &replyPost.ReplyURI, &replyPost.UserDID, &replyPost.SubscribedPostURI, &replyPost.CreatedAt, &replyPost.Kind); err != nil {
 			return nil, fmt.Errorf("scan row: %w", err)
 		}
 		repliedPosts = append(repliedPosts, replyPost)
@@ -70,18 +112,24 @@ func (s *Store) GetUsersReplies(usersDID string, cursor int64, limit int) ([]Rep
 }
 
 func (s *Store) DeleteRepliedPostsForBookmarkedPostURIandUserDID(subscribedPostURI, userDID string) error {
-	sql := "DELETE FROM replies WHERE subscribedPostURI = ? AND userDID = ?;"
-	statement, err := s.db.Prepare(sql)
+	s.storedPostsMu.Lock()
+	defer s.storedPostsMu.Unlock()
+
+	sql := "DELETE FROM replies WHERE subscribedPostURI = ? AND userDID = ? RETURNING replyURI;"
+	rows, err := s.db.Query(sql, subscribedPostURI, userDID)
 	if err != nil {
-		return fmt.Errorf("prepare delete replies: %w", err)
+		return fmt.Errorf("exec delete replies: %w", err)
 	}
-	res, err := statement.Exec(subscribedPostURI, userDID)
+	replyURIs, err := scanURIs(rows)
 	if err != nil {
 		return fmt.Errorf("exec delete replies: %w", err)
 	}
 
-	n, _ := res.RowsAffected()
+	slog.Info("delete replies result", "affected rows", len(replyURIs))
 
-	slog.Info("delete replies result", "affected rows", n)
+	err = s.forgetStoredPosts(replyURIs)
+	if err != nil {
+		return fmt.Errorf("forget deleted replies: %w", err)
+	}
 	return nil
 }
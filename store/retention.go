@@ -0,0 +1,139 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+const autoVacuumIncremental = 2
+
+func addRepliesRetentionIndexes(tx *sql.Tx) error {
+	statements := []string{
+		`CREATE INDEX IF NOT EXISTS replies_created_at ON replies (createdAt);`,
+		`CREATE INDEX IF NOT EXISTS replies_user_subscribed_post ON replies (userDID, subscribedPostURI, createdAt);`,
+	}
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return fmt.Errorf("exec add replies retention indexes statement: %w", err)
+		}
+	}
+	return nil
+}
+
+func addRepliesIndexedAtIndex(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS replies_indexed_at ON replies (indexedAt);`)
+	if err != nil {
+		return fmt.Errorf("exec create replies indexedAt index: %w", err)
+	}
+	return nil
+}
+
+// DeleteRepliesIndexedBefore deletes replies to bookmarks that were stored before the given time and returns how many
+// were deleted. The createdAt of a reply is set by its author so it isn't used, apart from for replies stored before
+// indexedAt was added.
+func (s *Store) DeleteRepliesIndexedBefore(before int64) (int64, error) {
+	s.storedPostsMu.Lock()
+	defer s.storedPostsMu.Unlock()
+
+	sql := "DELETE FROM replies WHERE indexedAt < ? AND (indexedAt > 0 OR createdAt < ?) RETURNING replyURI;"
+	rows, err := s.db.Query(sql, before, before)
+	if err != nil {
+		return 0, fmt.Errorf("exec delete replies indexed before: %w", err)
+	}
+	replyURIs, err := scanURIs(rows)
+	if err != nil {
+		return 0, fmt.Errorf("exec delete replies indexed before: %w", err)
+	}
+
+	err = s.forgetStoredPosts(replyURIs)
+	if err != nil {
+		return 0, fmt.Errorf("forget deleted replies: %w", err)
+	}
+	return int64(len(replyURIs)), nil
+}
+
+// DeleteRepliesOverCap keeps the most recently indexed maxPerBookmark replies for each of a users bookmarks and deletes
+// the rest. Like DeleteRepliesIndexedBefore it goes by when a reply was indexed rather than the createdAt the author
+// chose, so a future dated reply can't hold on to a place. It returns how many were deleted.
+func (s *Store) DeleteRepliesOverCap(maxPerBookmark int) (int64, error) {
+	s.storedPostsMu.Lock()
+	defer s.storedPostsMu.Unlock()
+
+	sql := `DELETE FROM replies WHERE id IN (
+				SELECT id FROM (
+					SELECT id, ROW_NUMBER() OVER (PARTITION BY userDID, subscribedPostURI ORDER BY indexedAt DESC, id DESC) AS position
+					FROM replies
+				) WHERE position > ?
+			) RETURNING replyURI;`
+	rows, err := s.db.Query(sql, maxPerBookmark)
+	if err != nil {
+		return 0, fmt.Errorf("exec delete replies over cap: %w", err)
+	}
+	replyURIs, err := scanURIs(rows)
+	if err != nil {
+		return 0, fmt.Errorf("exec delete replies over cap: %w", err)
+	}
+
+	err = s.forgetStoredPosts(replyURIs)
+	if err != nil {
+		return 0, fmt.Errorf("forget deleted replies: %w", err)
+	}
+	return int64(len(replyURIs)), nil
+}
+
+// Compact gives the space freed by deleted rows back to the filesystem. Databases that weren't created with
+// incremental auto vacuum are switched over to it, which needs a full VACUUM the first time. After that only the free
+// pages are released, which is much cheaper.
+func (s *Store) Compact(ctx context.Context) error {
+	// auto vacuum and VACUUM are per connection so they need to run on the same one
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get connection: %w", err)
+	}
+	defer conn.Close()
+
+	var autoVacuum int
+	err = conn.QueryRowContext(ctx, "PRAGMA auto_vacuum;").Scan(&autoVacuum)
+	if err != nil {
+		return fmt.Errorf("get auto vacuum mode: %w", err)
+	}
+
+	if autoVacuum == autoVacuumIncremental {
+		var freePages int
+		err = conn.QueryRowContext(ctx, "PRAGMA freelist_count;").Scan(&freePages)
+		if err != nil {
+			return fmt.Errorf("get free page count: %w", err)
+		}
+		if freePages == 0 {
+			return nil
+		}
+
+		// each step of the pragma frees a single page, so every row has to be read for all of them to be freed
+		rows, err := conn.QueryContext(ctx, fmt.Sprintf("PRAGMA incremental_vacuum(%d);", freePages))
+		if err != nil {
+			return fmt.Errorf("run incremental vacuum: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("run incremental vacuum: %w", err)
+		}
+		return nil
+	}
+
+	slog.Info("switching database to incremental auto vacuum - running full vacuum...")
+	_, err = conn.ExecContext(ctx, "PRAGMA auto_vacuum = INCREMENTAL;")
+	if err != nil {
+		return fmt.Errorf("set auto vacuum mode: %w", err)
+	}
+	_, err = conn.ExecContext(ctx, "VACUUM;")
+	if err != nil {
+		return fmt.Errorf("exec vacuum: %w", err)
+	}
+	slog.Info("full vacuum complete")
+	return nil
+}
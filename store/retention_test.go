@@ -0,0 +1,226 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRepliesRetention(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	s, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("create store: %s", err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		for _, postURI := range []string{"at://did:plc:author/app.bsky.feed.post/a", "at://did:plc:author/app.bsky.feed.post/b"} {
+			err := s.AddRepliedPost(ReplyPost{
+				ReplyURI:          fmt.Sprintf("%s-reply-%d", postURI, i),
+				UserDID:           "did:plc:user",
+				SubscribedPostURI: postURI,
+				CreatedAt:         int64(i * 1000),
+			})
+			if err != nil {
+				t.Fatalf("add replied post: %s", err)
+			}
+		}
+	}
+
+	deleted, err := s.DeleteRepliesOverCap(3)
+	if err != nil {
+		t.Fatalf("delete replies over cap: %s", err)
+	}
+	if deleted != 4 {
+		t.Errorf("expected the 2 oldest replies of each bookmark to be deleted, got %d deleted", deleted)
+	}
+
+	if _, err := s.db.Exec("UPDATE replies SET indexedAt = createdAt;"); err != nil {
+		t.Fatalf("set replies indexed at: %s", err)
+	}
+	deleted, err = s.DeleteRepliesIndexedBefore(5000)
+	if err != nil {
+		t.Fatalf("delete replies indexed before: %s", err)
+	}
+	if deleted != 4 {
+		t.Errorf("expected 4 old replies to be deleted, got %d deleted", deleted)
+	}
+
+	replies, err := s.GetUsersReplies("did:plc:user", 10000, 10)
+	if err != nil {
+		t.Fatalf("get users replies: %s", err)
+	}
+	if len(replies) != 2 {
+		t.Fatalf("expected the newest reply of each bookmark to remain, got %+v", replies)
+	}
+	for _, reply := range replies {
+		if reply.CreatedAt != 5000 {
+			t.Errorf("expected only the newest replies to remain, got %+v", reply)
+		}
+	}
+}
+
+func TestDeleteRepliesIndexedBeforeIgnoresCreatedAt(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("create store: %s", err)
+	}
+	defer s.Close()
+
+	replies := map[string]struct {
+		createdAt int64
+		indexedAt int64
+	}{
+		// the author can claim their reply was made at any time
+		"backdated":      {createdAt: 1000, indexedAt: 9000},
+		"future dated":   {createdAt: 99999, indexedAt: 1000},
+		"legacy old":     {createdAt: 1000, indexedAt: 0},
+		"legacy new":     {createdAt: 9000, indexedAt: 0},
+		"indexed recent": {createdAt: 9000, indexedAt: 9000},
+	}
+	for name, reply := range replies {
+		err := s.AddRepliedPost(ReplyPost{ReplyURI: name, UserDID: "did:plc:user", SubscribedPostURI: "at://did:plc:author/app.bsky.feed.post/a", CreatedAt: reply.createdAt})
+		if err != nil {
+			t.Fatalf("add replied post: %s", err)
+		}
+		if _, err := s.db.Exec("UPDATE replies SET indexedAt = ? WHERE replyURI = ?;", reply.indexedAt, name); err != nil {
+			t.Fatalf("set reply indexed at: %s", err)
+		}
+	}
+
+	deleted, err := s.DeleteRepliesIndexedBefore(5000)
+	if err != nil {
+		t.Fatalf("delete replies indexed before: %s", err)
+	}
+	if deleted != 2 {
+		t.Errorf("expected 2 replies to be deleted, got %d", deleted)
+	}
+
+	rows, err := s.db.Query("SELECT replyURI FROM replies ORDER BY replyURI;")
+	if err != nil {
+		t.Fatalf("get remaining replies: %s", err)
+	}
+	defer rows.Close()
+	var remaining []string
+	for rows.Next() {
+		var replyURI string
+		if err := rows.Scan(&replyURI); err != nil {
+			t.Fatalf("scan row: %s", err)
+		}
+		remaining = append(remaining, replyURI)
+	}
+	want := []string{"backdated", "indexed recent", "legacy new"}
+	if !slices.Equal(remaining, want) {
+		t.Errorf("expected %v to remain, got %v", want, remaining)
+	}
+}
+
+func TestDeleteRepliesOverCapIgnoresCreatedAt(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("create store: %s", err)
+	}
+	defer s.Close()
+
+	replies := []struct {
+		replyURI  string
+		createdAt int64
+		indexedAt int64
+	}{
+		{replyURI: "future dated", createdAt: 99999, indexedAt: 1000},
+		{replyURI: "old", createdAt: 2000, indexedAt: 2000},
+		{replyURI: "backdated", createdAt: 1, indexedAt: 3000},
+		{replyURI: "new", createdAt: 4000, indexedAt: 4000},
+	}
+	for _, reply := range replies {
+		err := s.AddRepliedPost(ReplyPost{ReplyURI: reply.replyURI, UserDID: "did:plc:user", SubscribedPostURI: "at://did:plc:author/app.bsky.feed.post/a", CreatedAt: reply.createdAt})
+		if err != nil {
+			t.Fatalf("add replied post: %s", err)
+		}
+		if _, err := s.db.Exec("UPDATE replies SET indexedAt = ? WHERE replyURI = ?;", reply.indexedAt, reply.replyURI); err != nil {
+			t.Fatalf("set reply indexed at: %s", err)
+		}
+	}
+
+	deleted, err := s.DeleteRepliesOverCap(2)
+	if err != nil {
+		t.Fatalf("delete replies over cap: %s", err)
+	}
+	if deleted != 2 {
+		t.Errorf("expected 2 replies to be deleted, got %d", deleted)
+	}
+
+	rows, err := s.db.Query("SELECT replyURI FROM replies ORDER BY replyURI;")
+	if err != nil {
+		t.Fatalf("get remaining replies: %s", err)
+	}
+	defer rows.Close()
+	var remaining []string
+	for rows.Next() {
+		var replyURI string
+		if err := rows.Scan(&replyURI); err != nil {
+			t.Fatalf("scan row: %s", err)
+		}
+		remaining = append(remaining, replyURI)
+	}
+	want := []string{"backdated", "new"}
+	if !slices.Equal(remaining, want) {
+		t.Errorf("expected %v to remain, got %v", want, remaining)
+	}
+}
+
+func TestCompactFreesAllPages(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("create store: %s", err)
+	}
+	defer s.Close()
+
+	// the first compaction switches to incremental vacuum
+	if err := s.Compact(context.Background()); err != nil {
+		t.Fatalf("compact: %s", err)
+	}
+	var autoVacuum int
+	if err := s.db.QueryRow("PRAGMA auto_vacuum;").Scan(&autoVacuum); err != nil {
+		t.Fatalf("get auto vacuum: %s", err)
+	}
+	if autoVacuum != autoVacuumIncremental {
+		t.Errorf("expected auto vacuum to be incremental, got %d", autoVacuum)
+	}
+
+	for i := range 500 {
+		err := s.AddRepliedPost(ReplyPost{
+			ReplyURI:          fmt.Sprintf("at://did:plc:replier/app.bsky.feed.post/%s-%d", strings.Repeat("r", 200), i),
+			UserDID:           "did:plc:user",
+			SubscribedPostURI: "at://did:plc:author/app.bsky.feed.post/a",
+			CreatedAt:         int64(i),
+		})
+		if err != nil {
+			t.Fatalf("add replied post: %s", err)
+		}
+	}
+	if _, err := s.DeleteRepliesOverCap(1); err != nil {
+		t.Fatalf("delete replies over cap: %s", err)
+	}
+
+	var freePages int
+	if err := s.db.QueryRow("PRAGMA freelist_count;").Scan(&freePages); err != nil {
+		t.Fatalf("get free page count: %s", err)
+	}
+	if freePages < 2 {
+		t.Fatalf("expected deleting replies to leave several free pages, got %d", freePages)
+	}
+
+	if err := s.Compact(context.Background()); err != nil {
+		t.Fatalf("compact: %s", err)
+	}
+	if err := s.db.QueryRow("PRAGMA freelist_count;").Scan(&freePages); err != nil {
+		t.Fatalf("get free page count: %s", err)
+	}
+	if freePages != 0 {
+		t.Errorf("expected every free page to be released, got %d left", freePages)
+	}
+}
@@ -0,0 +1,156 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+func createBookmarkTagsTable(tx *sql.Tx) error {
+	createBookmarkTagsTableSQL := `CREATE TABLE IF NOT EXISTS bookmark_tags (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"bookmarkID" integer NOT NULL,
+		"tag" TEXT NOT NULL,
+		UNIQUE(bookmarkID, tag)
+	  );`
+
+	slog.Info("Create bookmark_tags table...")
+	statement, err := tx.Prepare(createBookmarkTagsTableSQL)
+	if err != nil {
+		return fmt.Errorf("prepare DB statement to create bookmark_tags table: %w", err)
+	}
+	_, err = statement.Exec()
+	if err != nil {
+		return fmt.Errorf("exec sql statement to create bookmark_tags table: %w", err)
+	}
+	slog.Info("bookmark_tags table created")
+
+	return nil
+}
+
+// createBookmarksSearchIndex creates an FTS5 index over bookmark content, author handles and tags. The index is kept
+// up to date by triggers on the bookmarks and bookmark_tags tables, so nothing writing to those tables needs to know
+// about it. Note that bookmarks created before full post text was stored will only have a truncated snippet indexed.
+func createBookmarksSearchIndex(tx *sql.Tx) error {
+	tagsForBookmarkSQL := "(SELECT COALESCE(group_concat(tag, ' '), '') FROM bookmark_tags WHERE bookmarkID = %s)"
+
+	statements := []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS bookmarks_fts USING fts5(content, authorHandle, tags, tokenize = 'unicode61 remove_diacritics 2');`,
+		`CREATE TRIGGER IF NOT EXISTS bookmarks_fts_insert AFTER INSERT ON bookmarks BEGIN
+			INSERT INTO bookmarks_fts (rowid, content, authorHandle, tags) VALUES (new.id, new.content, new.authorHandle, '');
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS bookmarks_fts_update AFTER UPDATE OF content, authorHandle ON bookmarks BEGIN
+			UPDATE bookmarks_fts SET content = new.content, authorHandle = new.authorHandle WHERE rowid = new.id;
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS bookmarks_fts_delete AFTER DELETE ON bookmarks BEGIN
+			DELETE FROM bookmarks_fts WHERE rowid = old.id;
+			DELETE FROM bookmark_tags WHERE bookmarkID = old.id;
+		END;`,
+		fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS bookmark_tags_fts_insert AFTER INSERT ON bookmark_tags BEGIN
+			UPDATE bookmarks_fts SET tags = %s WHERE rowid = new.bookmarkID;
+		END;`, fmt.Sprintf(tagsForBookmarkSQL, "new.bookmarkID")),
+		fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS bookmark_tags_fts_delete AFTER DELETE ON bookmark_tags BEGIN
+			UPDATE bookmarks_fts SET tags = %s WHERE rowid = old.bookmarkID;
+		END;`, fmt.Sprintf(tagsForBookmarkSQL, "old.bookmarkID")),
+		`DELETE FROM bookmarks_fts;`,
+		`INSERT INTO bookmarks_fts (rowid, content, authorHandle, tags)
+			SELECT id, content, authorHandle, ` + fmt.Sprintf(tagsForBookmarkSQL, "bookmarks.id") + ` FROM bookmarks;`,
+	}
+
+	slog.Info("Create bookmarks search index...")
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return fmt.Errorf("exec bookmarks search index statement: %w", err)
+		}
+	}
+	slog.Info("bookmarks search index created")
+
+	return nil
+}
+
+// SetBookmarkTags replaces all of the tags on a users bookmark.
+func (s *Store) SetBookmarkTags(postATURI, userDID string, tags []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var bookmarkID int
+	err = tx.QueryRow("SELECT id FROM bookmarks WHERE postATURI = ? AND userDID = ?;", postATURI, userDID).Scan(&bookmarkID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrBookmarkNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("get bookmark to tag: %w", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM bookmark_tags WHERE bookmarkID = ?;", bookmarkID)
+	if err != nil {
+		return fmt.Errorf("exec delete bookmark tags: %w", err)
+	}
+
+	for _, tag := range tags {
+		_, err = tx.Exec("INSERT INTO bookmark_tags (bookmarkID, tag) VALUES (?, ?) ON CONFLICT(bookmarkID, tag) DO NOTHING;", bookmarkID, tag)
+		if err != nil {
+			return fmt.Errorf("exec insert bookmark tag: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+// SearchBookmarks does a full text search over a users bookmarks, returning the best matches first. Each term in the
+// query is prefix matched and all terms must match. Terms starting with # only match tags.
+func (s *Store) SearchBookmarks(userDID, query string, limit int) ([]Bookmark, error) {
+	matchQuery := buildSearchMatchQuery(query)
+	if matchQuery == "" {
+		return []Bookmark{}, nil
+	}
+
+	sql := `SELECT ` + bookmarkColumns + ` FROM bookmarks
+			JOIN (SELECT rowid, rank FROM bookmarks_fts WHERE bookmarks_fts MATCH ?) AS matches ON matches.rowid = bookmarks.id
+			WHERE userDID = ?
+			ORDER BY matches.rank LIMIT ?;`
+	rows, err := s.db.Query(sql, matchQuery, userDID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("run query to search bookmarks: %w", err)
+	}
+	defer rows.Close()
+
+	results := make([]Bookmark, 0)
+	for rows.Next() {
+		bookmark, err := scanBookmark(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, bookmark)
+	}
+	return results, nil
+}
+
+// buildSearchMatchQuery turns user input into an FTS5 match expression. Every term is quoted so that users can't
+// inject FTS5 syntax.
+func buildSearchMatchQuery(query string) string {
+	terms := strings.Fields(query)
+	matchTerms := make([]string, 0, len(terms))
+	for _, term := range terms {
+		column := ""
+		if tag, ok := strings.CutPrefix(term, "#"); ok {
+			term = tag
+			column = "tags : "
+		}
+		if term == "" {
+			continue
+		}
+		matchTerms = append(matchTerms, fmt.Sprintf(`%s"%s"*`, column, strings.ReplaceAll(term, `"`, `""`)))
+	}
+	return strings.Join(matchTerms, " ")
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestSearchBookmarks(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("create store: %s", err)
+	}
+	defer s.Close()
+
+	userDID := "did:plc:user"
+	bookmarks := map[string]string{
+		"at://did:plc:author/app.bsky.feed.post/1": "Writing a feed generator in Go",
+		"at://did:plc:author/app.bsky.feed.post/2": "Sourdough baking tips",
+	}
+	for uri, content := range bookmarks {
+		if err := s.CreateBookmark("", "", uri, "", "did:plc:author", "author.test", userDID, content, 0); err != nil {
+			t.Fatalf("create bookmark: %s", err)
+		}
+	}
+	if err := s.CreateBookmark("", "", "at://did:plc:author/app.bsky.feed.post/1", "", "did:plc:author", "author.test", "did:plc:other", "Writing a feed generator in Go", 0); err != nil {
+		t.Fatalf("create bookmark: %s", err)
+	}
+	if err := s.SetBookmarkTags("at://did:plc:author/app.bsky.feed.post/2", userDID, []string{"bread"}); err != nil {
+		t.Fatalf("set bookmark tags: %s", err)
+	}
+
+	tt := map[string]struct {
+		query string
+		want  []string
+	}{
+		"prefix match on content": {
+			query: "gen",
+			want:  []string{"at://did:plc:author/app.bsky.feed.post/1"},
+		},
+		"all terms must match": {
+			query: "feed sourdough",
+			want:  []string{},
+		},
+		"tag": {
+			query: "#bread",
+			want:  []string{"at://did:plc:author/app.bsky.feed.post/2"},
+		},
+		"tag terms only match tags": {
+			query: "#go",
+			want:  []string{},
+		},
+		"fts syntax is escaped": {
+			query: `"feed OR`,
+			want:  []string{},
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			results, err := s.SearchBookmarks(userDID, tc.query, 10)
+			if err != nil {
+				t.Fatalf("search bookmarks: %s", err)
+			}
+			if len(results) != len(tc.want) {
+				t.Fatalf("expected %d results, got %d", len(tc.want), len(results))
+			}
+			for i, result := range results {
+				if result.PostATURI != tc.want[i] {
+					t.Errorf("expected result %d to be %q, got %q", i, tc.want[i], result.PostATURI)
+				}
+			}
+		})
+	}
+}
+
+func TestSetBookmarkTagsBookmarkNotFound(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("create store: %s", err)
+	}
+	defer s.Close()
+
+	err = s.SetBookmarkTags("at://did:plc:author/app.bsky.feed.post/missing", "did:plc:user", []string{"go"})
+	if !errors.Is(err, ErrBookmarkNotFound) {
+		t.Errorf("expected ErrBookmarkNotFound, got %v", err)
+	}
+}
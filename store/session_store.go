@@ -0,0 +1,239 @@
+package store
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// lastSeenInterval is how often the last seen time of a session is updated, so that every request doesn't write.
+const lastSeenInterval = time.Minute
+
+// SessionStore is a gorilla sessions store that keeps sessions in the database. The cookie only carries a signed,
+// opaque session ID, so sessions can be listed and revoked, and they expire after being idle or after an absolute
+// timeout no matter what the cookie says.
+type SessionStore struct {
+	Options *sessions.Options
+
+	store           *Store
+	codecs          []securecookie.Codec
+	idleTimeout     time.Duration
+	absoluteTimeout time.Duration
+}
+
+// NewSessionStore creates a session store. Key pairs are used to sign the session ID cookie, the first pair signs new
+// cookies and the rest are only used to verify them so that keys can be rotated without signing everyone out.
+func NewSessionStore(store *Store, idleTimeout, absoluteTimeout time.Duration, keyPairs ...[]byte) *SessionStore {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(int(absoluteTimeout.Seconds()))
+		}
+	}
+
+	return &SessionStore{
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   int(absoluteTimeout.Seconds()),
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+		},
+		store:           store,
+		codecs:          codecs,
+		idleTimeout:     idleTimeout,
+		absoluteTimeout: absoluteTimeout,
+	}
+}
+
+// Get returns the named session for the request, loading it once per request.
+func (ss *SessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(ss, name)
+}
+
+// New loads the named session from the database. A new session is returned if the cookie is missing, invalid or the
+// session has expired.
+func (ss *SessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(ss, name)
+	opts := *ss.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var id string
+	err = securecookie.DecodeMulti(name, cookie.Value, &id, ss.codecs...)
+	if err != nil {
+		// the cookie was signed with a key that's no longer in use or has been tampered with, so start again
+		return session, nil
+	}
+
+	idHash := hashSessionID(id)
+	webSession, data, err := ss.store.getWebSession(idHash)
+	if err != nil {
+		return session, fmt.Errorf("get web session: %w", err)
+	}
+	if webSession == nil {
+		return session, nil
+	}
+
+	now := time.Now()
+	if webSession.ExpiresAt <= now.UnixMilli() || webSession.LastSeenAt < now.Add(-ss.idleTimeout).UnixMilli() {
+		err = ss.store.deleteWebSession(idHash)
+		if err != nil {
+			return session, fmt.Errorf("delete expired web session: %w", err)
+		}
+		return session, nil
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Values)
+	if err != nil {
+		return session, fmt.Errorf("decode web session values: %w", err)
+	}
+	session.ID = id
+	session.IsNew = false
+
+	if webSession.LastSeenAt < now.Add(-lastSeenInterval).UnixMilli() {
+		err = ss.store.touchWebSession(idHash, now.UnixMilli())
+		if err != nil {
+			return session, fmt.Errorf("update web session last seen: %w", err)
+		}
+	}
+
+	return session, nil
+}
+
+// Save writes the session to the database and sets the session ID cookie. A negative MaxAge deletes the session.
+func (ss *SessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			err := ss.store.deleteWebSession(hashSessionID(session.ID))
+			if err != nil {
+				return fmt.Errorf("delete web session: %w", err)
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		id, err := newSessionID()
+		if err != nil {
+			return err
+		}
+		session.ID = id
+	}
+
+	var data bytes.Buffer
+	err := gob.NewEncoder(&data).Encode(session.Values)
+	if err != nil {
+		return fmt.Errorf("encode web session values: %w", err)
+	}
+
+	// the expiry is only set when the session is created, after that it can only be shortened by the absolute timeout
+	now := time.Now()
+	lifetime := ss.absoluteTimeout
+	if maxAge := time.Duration(session.Options.MaxAge) * time.Second; maxAge > 0 && maxAge < lifetime {
+		lifetime = maxAge
+	}
+
+	userDID, _ := session.Values["did"].(string)
+	expiresAt, err := ss.store.saveWebSession(WebSession{
+		IDHash:     hashSessionID(session.ID),
+		UserDID:    userDID,
+		UserAgent:  r.UserAgent(),
+		CreatedAt:  now.UnixMilli(),
+		LastSeenAt: now.UnixMilli(),
+		ExpiresAt:  now.Add(lifetime).UnixMilli(),
+	}, data.Bytes())
+	if err != nil {
+		return fmt.Errorf("save web session: %w", err)
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, ss.codecs...)
+	if err != nil {
+		return fmt.Errorf("encode session ID cookie: %w", err)
+	}
+
+	opts := *session.Options
+	opts.MaxAge = int(time.Until(time.UnixMilli(expiresAt)).Seconds())
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, &opts))
+	return nil
+}
+
+// RenewID deletes the session from the database and clears its ID so that it's saved with a new one. It should be
+// called when a user logs in so that a session ID known before logging in can't be used afterwards.
+func (ss *SessionStore) RenewID(session *sessions.Session) error {
+	if session.ID == "" {
+		return nil
+	}
+
+	err := ss.store.deleteWebSession(hashSessionID(session.ID))
+	if err != nil {
+		return fmt.Errorf("delete web session: %w", err)
+	}
+	session.ID = ""
+	session.IsNew = true
+	return nil
+}
+
+// SessionsForUser returns the users sessions that haven't expired.
+func (ss *SessionStore) SessionsForUser(userDID string) ([]WebSession, error) {
+	now := time.Now()
+	sessions, err := ss.store.GetWebSessionsForUser(userDID, now.Add(-ss.idleTimeout).UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+
+	active := make([]WebSession, 0, len(sessions))
+	for _, session := range sessions {
+		if session.ExpiresAt > now.UnixMilli() {
+			active = append(active, session)
+		}
+	}
+	return active, nil
+}
+
+// RevokeForUser deletes one of the users sessions by its ID hash.
+func (ss *SessionStore) RevokeForUser(idHash, userDID string) error {
+	return ss.store.DeleteWebSessionForUser(idHash, userDID)
+}
+
+// DeleteExpired deletes sessions that have expired or been idle for longer than the idle timeout.
+func (ss *SessionStore) DeleteExpired(now time.Time) (int64, error) {
+	return ss.store.deleteExpiredWebSessions(now.UnixMilli(), now.Add(-ss.idleTimeout).UnixMilli())
+}
+
+// SessionIDHash returns the hash that the session is stored and listed by.
+func SessionIDHash(session *sessions.Session) string {
+	if session.ID == "" {
+		return ""
+	}
+	return hashSessionID(session.ID)
+}
+
+func hashSessionID(id string) string {
+	hash := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(hash[:])
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("generate session ID: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,185 @@
+package store
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSessionStore(t *testing.T, keyPairs ...[]byte) (*Store, *SessionStore) {
+	t.Helper()
+
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("create store: %s", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s, NewSessionStore(s, time.Hour, time.Hour*24, keyPairs...)
+}
+
+// saveSession saves a session for the user and returns the cookie that was set.
+func saveSession(t *testing.T, ss *SessionStore, did string) *http.Cookie {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("User-Agent", "test-agent")
+	session, err := ss.New(r, "session")
+	if err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	session.Values["did"] = did
+
+	w := httptest.NewRecorder()
+	if err := ss.Save(r, w, session); err != nil {
+		t.Fatalf("save session: %s", err)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie, got %d", len(cookies))
+	}
+	return cookies[0]
+}
+
+func loadSession(t *testing.T, ss *SessionStore, cookie *http.Cookie) (string, bool) {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	session, err := ss.New(r, "session")
+	if err != nil {
+		t.Fatalf("load session: %s", err)
+	}
+	did, ok := session.Values["did"].(string)
+	return did, ok
+}
+
+func TestSessionStoreCookieOnlyHasSessionID(t *testing.T) {
+	_, ss := newTestSessionStore(t, []byte("key"))
+
+	cookie := saveSession(t, ss, "did:plc:user")
+
+	did, ok := loadSession(t, ss, cookie)
+	if !ok || did != "did:plc:user" {
+		t.Fatalf("expected session for did:plc:user, got %q", did)
+	}
+
+	sessions, err := ss.SessionsForUser("did:plc:user")
+	if err != nil {
+		t.Fatalf("get sessions for user: %s", err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(sessions))
+	}
+	if sessions[0].UserAgent != "test-agent" {
+		t.Errorf("expected user agent to be stored, got %q", sessions[0].UserAgent)
+	}
+
+	// a cookie that hasn't been signed by the key is ignored
+	_, forged := newTestSessionStore(t, []byte("other key"))
+	forgedCookie := saveSession(t, forged, "did:plc:user")
+	if _, ok := loadSession(t, ss, forgedCookie); ok {
+		t.Fatal("expected cookie signed by another key to be rejected")
+	}
+}
+
+func TestSessionStoreRevoke(t *testing.T) {
+	_, ss := newTestSessionStore(t, []byte("key"))
+
+	first := saveSession(t, ss, "did:plc:user")
+	second := saveSession(t, ss, "did:plc:user")
+
+	sessions, err := ss.SessionsForUser("did:plc:user")
+	if err != nil {
+		t.Fatalf("get sessions for user: %s", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(sessions))
+	}
+
+	// another user can't revoke the session
+	for _, session := range sessions {
+		if err := ss.RevokeForUser(session.IDHash, "did:plc:other"); err != nil {
+			t.Fatalf("revoke session for other user: %s", err)
+		}
+	}
+	if _, ok := loadSession(t, ss, first); !ok {
+		t.Fatal("expected session to not be revoked by another user")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(first)
+	session, err := ss.New(r, "session")
+	if err != nil {
+		t.Fatalf("load session: %s", err)
+	}
+	if err := ss.RevokeForUser(SessionIDHash(session), "did:plc:user"); err != nil {
+		t.Fatalf("revoke session: %s", err)
+	}
+
+	if _, ok := loadSession(t, ss, first); ok {
+		t.Fatal("expected revoked session to be signed out")
+	}
+	if _, ok := loadSession(t, ss, second); !ok {
+		t.Fatal("expected other session to still be signed in")
+	}
+}
+
+func TestSessionStoreKeyRotation(t *testing.T) {
+	s, old := newTestSessionStore(t, []byte("old key"))
+	cookie := saveSession(t, old, "did:plc:user")
+
+	rotated := NewSessionStore(s, time.Hour, time.Hour*24, []byte("new key"), nil, []byte("old key"), nil)
+	if did, ok := loadSession(t, rotated, cookie); !ok || did != "did:plc:user" {
+		t.Fatal("expected cookie signed by the previous key to still be valid")
+	}
+
+	newKeyOnly := NewSessionStore(s, time.Hour, time.Hour*24, []byte("new key"))
+	if _, ok := loadSession(t, newKeyOnly, cookie); ok {
+		t.Fatal("expected cookie signed by a removed key to be rejected")
+	}
+}
+
+func TestSessionStoreTimeouts(t *testing.T) {
+	s, ss := newTestSessionStore(t, []byte("key"))
+
+	idle := saveSession(t, ss, "did:plc:idle")
+	expired := saveSession(t, ss, "did:plc:expired")
+	active := saveSession(t, ss, "did:plc:active")
+
+	now := time.Now()
+	_, err := s.db.Exec("UPDATE web_sessions SET lastSeenAt = ? WHERE userDID = ?;", now.Add(-time.Hour*2).UnixMilli(), "did:plc:idle")
+	if err != nil {
+		t.Fatalf("make session idle: %s", err)
+	}
+	_, err = s.db.Exec("UPDATE web_sessions SET expiresAt = ? WHERE userDID = ?;", now.Add(-time.Second).UnixMilli(), "did:plc:expired")
+	if err != nil {
+		t.Fatalf("expire session: %s", err)
+	}
+
+	if _, ok := loadSession(t, ss, idle); ok {
+		t.Error("expected idle session to be signed out")
+	}
+	if _, ok := loadSession(t, ss, expired); ok {
+		t.Error("expected expired session to be signed out")
+	}
+	if _, ok := loadSession(t, ss, active); !ok {
+		t.Error("expected active session to be signed in")
+	}
+
+	// loading the expired sessions deleted them, so make one idle again for the janitor to clean up
+	_, err = s.db.Exec("UPDATE web_sessions SET lastSeenAt = ? WHERE userDID = ?;", now.Add(-time.Hour*2).UnixMilli(), "did:plc:active")
+	if err != nil {
+		t.Fatalf("make session idle: %s", err)
+	}
+	deleted, err := ss.DeleteExpired(now)
+	if err != nil {
+		t.Fatalf("delete expired sessions: %s", err)
+	}
+	if deleted != 1 {
+		t.Errorf("expected 1 session to be deleted, got %d", deleted)
+	}
+}
@@ -0,0 +1,21 @@
+package store
+
+import "fmt"
+
+// countedTables are the tables that grow with use and are worth keeping an eye on.
+var countedTables = []string{"bookmarks", "replies", "thread_replies"}
+
+// GetTableRowCounts returns the number of rows in each of the bookmark and reply tables, keyed by table name.
+func (s *Store) GetTableRowCounts() (map[string]int, error) {
+	counts := make(map[string]int, len(countedTables))
+	for _, table := range countedTables {
+		var count int
+		// table names can't be bound as parameters but they all come from the fixed list above
+		err := s.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s;", table)).Scan(&count)
+		if err != nil {
+			return nil, fmt.Errorf("count rows in %s: %w", table, err)
+		}
+		counts[table] = count
+	}
+	return counts, nil
+}
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// addBookmarksThreadColumns adds the columns needed for a bookmark to follow the whole thread it's in. Bookmarks that
+// already exist don't know which thread they are in, so they are treated as the root of their own thread.
+func addBookmarksThreadColumns(tx *sql.Tx) error {
+	statements := []string{
+		`ALTER TABLE bookmarks ADD COLUMN "rootURI" TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE bookmarks ADD COLUMN "followThread" integer NOT NULL DEFAULT 0;`,
+		`UPDATE bookmarks SET rootURI = postATURI;`,
+		`CREATE INDEX IF NOT EXISTS bookmarks_root_uri ON bookmarks (rootURI);`,
+	}
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return fmt.Errorf("exec add bookmarks thread columns statement: %w", err)
+		}
+	}
+	return nil
+}
+
+func createThreadRepliesTable(tx *sql.Tx) error {
+	createThreadRepliesTableSQL := `CREATE TABLE IF NOT EXISTS thread_replies (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"replyURI" TEXT NOT NULL,
+		"rootURI" TEXT NOT NULL,
+		"parentURI" TEXT NOT NULL,
+		"depth" integer NOT NULL,
+		"createdAt" integer NOT NULL,
+		UNIQUE(replyURI)
+	  );`
+
+	slog.Info("Create thread_replies table...")
+	statement, err := tx.Prepare(createThreadRepliesTableSQL)
+	if err != nil {
+		return fmt.Errorf("prepare DB statement to create thread_replies table: %w", err)
+	}
+	_, err = statement.Exec()
+	if err != nil {
+		return fmt.Errorf("exec sql statement to create thread_replies table: %w", err)
+	}
+
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS thread_replies_root_uri ON thread_replies (rootURI, createdAt);`)
+	if err != nil {
+		return fmt.Errorf("exec sql statement to create thread_replies index: %w", err)
+	}
+	slog.Info("thread_replies table created")
+
+	return nil
+}
+
+// ThreadReply is a reply somewhere in a thread that is being followed. Thread replies are shared between all of the
+// users following the thread. Depth is how many replies away from the root post the reply is, so a direct reply to the
+// root has a depth of 1.
+type ThreadReply struct {
+	ID        int
+	ReplyURI  string
+	RootURI   string
+	ParentURI string
+	Depth     int
+	CreatedAt int64
+}
+
+func (s *Store) SetBookmarkFollowThread(postATURI, userDID string, follow bool) error {
+	s.indexSyncMu.Lock()
+	defer s.indexSyncMu.Unlock()
+
+	sql := "UPDATE bookmarks SET followThread = ? WHERE postATURI = ? AND userDID = ? RETURNING rootURI;"
+	rows, err := s.db.Query(sql, follow, postATURI, userDID)
+	if err != nil {
+		return fmt.Errorf("exec update bookmark follow thread: %w", err)
+	}
+	defer rows.Close()
+
+	var rootURI string
+	if rows.Next() {
+		if err := rows.Scan(&rootURI); err != nil {
+			return fmt.Errorf("scan row: %w", err)
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return fmt.Errorf("exec update bookmark follow thread: %w", err)
+	}
+	if rootURI == "" {
+		return ErrBookmarkNotFound
+	}
+
+	err = s.syncBookmarkIndexes(postATURI, rootURI)
+	if err != nil {
+		return fmt.Errorf("sync bookmark indexes: %w", err)
+	}
+	return nil
+}
+
+// GetThreadReplyDepth returns the depth of a stored thread reply, or 0 if the reply hasn't been stored.
+func (s *Store) GetThreadReplyDepth(replyURI string) (int, error) {
+	sql := "SELECT depth FROM thread_replies WHERE replyURI = ?;"
+	rows, err := s.db.Query(sql, replyURI)
+	if err != nil {
+		return 0, fmt.Errorf("run query to get thread reply depth: %w", err)
+	}
+	defer rows.Close()
+
+	var depth int
+	if rows.Next() {
+		if err := rows.Scan(&depth); err != nil {
+			return 0, fmt.Errorf("scan row: %w", err)
+		}
+	}
+	return depth, nil
+}
+
+func (s *Store) AddThreadReply(reply ThreadReply) error {
+	s.storedPostsMu.Lock()
+	defer s.storedPostsMu.Unlock()
+
+	sql := `INSERT INTO thread_replies (replyURI, rootURI, parentURI, depth, createdAt) VALUES (?, ?, ?, ?, ?) ON CONFLICT(replyURI) DO NOTHING;`
+	_, err := s.db.Exec(sql, reply.ReplyURI, reply.RootURI, reply.ParentURI, reply.Depth, reply.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("exec insert thread reply: %w", err)
+	}
+	s.storedPosts.add(reply.ReplyURI)
+	return nil
+}
+
+// GetUsersThreadReplies returns the replies in all of the threads that the user is following, newest first.
+func (s *Store) GetUsersThreadReplies(userDID string, cursor int64, limit int) ([]ThreadReply, error) {
+	sql := `SELECT id, replyURI, rootURI, parentURI, depth, createdAt FROM thread_replies
+			WHERE EXISTS (SELECT 1 FROM bookmarks WHERE bookmarks.rootURI = thread_replies.rootURI AND bookmarks.userDID = ? AND bookmarks.followThread = 1)
+			AND createdAt < ?
+			ORDER BY createdAt DESC LIMIT ?;`
+	rows, err := s.db.Query(sql, userDID, cursor, limit)
+	if err != nil {
+		return nil, fmt.Errorf("run query to get users thread replies: %w", err)
+	}
+	defer rows.Close()
+
+	replies := make([]ThreadReply, 0)
+	for rows.Next() {
+		var reply ThreadReply
+		if err := rows.Scan(&reply.ID, &reply.ReplyURI, &reply.RootURI, &reply.ParentURI, &reply.Depth, &reply.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
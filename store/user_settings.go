@@ -0,0 +1,99 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+func createUserSettingsTable(tx *sql.Tx) error {
+	createUserSettingsTableSQL := `CREATE TABLE IF NOT EXISTS user_settings (
+		"userDID" TEXT NOT NULL PRIMARY KEY,
+		"confirmationsMuted" integer NOT NULL DEFAULT 0
+	  );`
+
+	slog.Info("Create user_settings table...")
+	statement, err := tx.Prepare(createUserSettingsTableSQL)
+	if err != nil {
+		return fmt.Errorf("prepare DB statement to create user_settings table: %w", err)
+	}
+	_, err = statement.Exec()
+	if err != nil {
+		return fmt.Errorf("exec sql statement to create user_settings table: %w", err)
+	}
+	slog.Info("user_settings table created")
+
+	return nil
+}
+
+type UserSettings struct {
+	UserDID            string
+	ConfirmationsMuted bool
+	DigestSchedule     string
+	// DigestConvoID is the chat the user set up their digest from, which is where digests are sent
+	DigestConvoID string
+	// LastDigestAt is the unix milli time up to which replies have been included in a digest
+	LastDigestAt int64
+	// BookmarkTTLDays is how many days bookmarks are kept for before they expire, or 0 to keep them forever
+	BookmarkTTLDays int
+}
+
+const userSettingsColumns = "userDID, confirmationsMuted, digestSchedule, digestConvoID, lastDigestAt, bookmarkTTLDays"
+
+func scanUserSettings(row scanner) (UserSettings, error) {
+	var settings UserSettings
+	err := row.Scan(&settings.UserDID, &settings.ConfirmationsMuted, &settings.DigestSchedule, &settings.DigestConvoID, &settings.LastDigestAt, &settings.BookmarkTTLDays)
+	if err != nil {
+		return settings, fmt.Errorf("scan row: %w", err)
+	}
+	return settings, nil
+}
+
+// GetUserSettings returns the settings for a user. If the user has never changed any settings then the defaults are
+// returned.
+func (s *Store) GetUserSettings(userDID string) (UserSettings, error) {
+	settings := UserSettings{
+		UserDID:        userDID,
+		DigestSchedule: DigestOff,
+	}
+
+	sql := "SELECT " + userSettingsColumns + " FROM user_settings WHERE userDID = ?;"
+	rows, err := s.db.Query(sql, userDID)
+	if err != nil {
+		return settings, fmt.Errorf("run query to get user settings: %w", err)
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		return scanUserSettings(rows)
+	}
+	return settings, nil
+}
+
+func (s *Store) SetConfirmationsMuted(userDID string, muted bool) error {
+	sql := `INSERT INTO user_settings (userDID, confirmationsMuted) VALUES (?, ?) ON CONFLICT(userDID) DO UPDATE SET confirmationsMuted = excluded.confirmationsMuted;`
+	_, err := s.db.Exec(sql, userDID, muted)
+	if err != nil {
+		return fmt.Errorf("exec upsert user settings confirmations muted: %w", err)
+	}
+	return nil
+}
+
+type UserStats struct {
+	Bookmarks   int
+	Replies     int
+	Collections int
+}
+
+func (s *Store) GetUserStats(userDID string) (UserStats, error) {
+	var stats UserStats
+	sql := `SELECT
+		(SELECT COUNT(*) FROM bookmarks WHERE userDID = ?),
+		(SELECT COUNT(*) FROM replies WHERE userDID = ?),
+		(SELECT COUNT(*) FROM collections WHERE userDID = ?);`
+	err := s.db.QueryRow(sql, userDID, userDID, userDID).Scan(&stats.Bookmarks, &stats.Replies, &stats.Collections)
+	if err != nil {
+		return stats, fmt.Errorf("run query to get user stats: %w", err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+func createWebSessionsTable(tx *sql.Tx) error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS web_sessions (
+		"idHash" TEXT NOT NULL PRIMARY KEY,
+		"userDID" TEXT NOT NULL DEFAULT '',
+		"data" BLOB NOT NULL,
+		"userAgent" TEXT NOT NULL DEFAULT '',
+		"createdAt" integer NOT NULL,
+		"lastSeenAt" integer NOT NULL,
+		"expiresAt" integer NOT NULL
+	  );`,
+		`CREATE INDEX IF NOT EXISTS web_sessions_user ON web_sessions (userDID);`,
+	}
+
+	slog.Info("Create web_sessions table...")
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return fmt.Errorf("exec create web_sessions table statement: %w", err)
+		}
+	}
+	slog.Info("web_sessions table created")
+
+	return nil
+}
+
+// WebSession is a users logged in browser session. Only a hash of the session ID is stored so the ID can't be taken
+// from the database and used, which means the hash can safely be used to refer to the session.
+type WebSession struct {
+	IDHash     string
+	UserDID    string
+	UserAgent  string
+	CreatedAt  int64
+	LastSeenAt int64
+	ExpiresAt  int64
+}
+
+// saveWebSession creates or updates a session, returning when it expires. The creation time and expiry of existing
+// sessions aren't changed.
+func (s *Store) saveWebSession(session WebSession, data []byte) (int64, error) {
+	sql := `INSERT INTO web_sessions (idHash, userDID, data, userAgent, createdAt, lastSeenAt, expiresAt) VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(idHash) DO UPDATE SET userDID = excluded.userDID, data = excluded.data, lastSeenAt = excluded.lastSeenAt
+			RETURNING expiresAt;`
+	var expiresAt int64
+	err := s.db.QueryRow(sql, session.IDHash, session.UserDID, data, session.UserAgent, session.CreatedAt, session.LastSeenAt, session.ExpiresAt).Scan(&expiresAt)
+	if err != nil {
+		return 0, fmt.Errorf("exec upsert web session: %w", err)
+	}
+	return expiresAt, nil
+}
+
+// getWebSession returns a session and its data, or nil if it doesn't exist.
+func (s *Store) getWebSession(idHash string) (*WebSession, []byte, error) {
+	sql := "SELECT idHash, userDID, userAgent, createdAt, lastSeenAt, expiresAt, data FROM web_sessions WHERE idHash = ?;"
+	rows, err := s.db.Query(sql, idHash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("run query to get web session: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var session WebSession
+		var data []byte
+		err := rows.Scan(&session.IDHash, &session.UserDID, &session.UserAgent, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("scan row: %w", err)
+		}
+		return &session, data, nil
+	}
+	return nil, nil, nil
+}
+
+func (s *Store) touchWebSession(idHash string, lastSeenAt int64) error {
+	sql := "UPDATE web_sessions SET lastSeenAt = ? WHERE idHash = ?;"
+	_, err := s.db.Exec(sql, lastSeenAt, idHash)
+	if err != nil {
+		return fmt.Errorf("exec update web session last seen: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) deleteWebSession(idHash string) error {
+	sql := "DELETE FROM web_sessions WHERE idHash = ?;"
+	_, err := s.db.Exec(sql, idHash)
+	if err != nil {
+		return fmt.Errorf("exec delete web session: %w", err)
+	}
+	return nil
+}
+
+// GetWebSessionsForUser returns the users sessions that were active after the given time, most recently used first.
+func (s *Store) GetWebSessionsForUser(userDID string, activeAfter int64) ([]WebSession, error) {
+	sql := `SELECT idHash, userDID, userAgent, createdAt, lastSeenAt, expiresAt FROM web_sessions
+			WHERE userDID = ? AND lastSeenAt > ? ORDER BY lastSeenAt DESC;`
+	rows, err := s.db.Query(sql, userDID, activeAfter)
+	if err != nil {
+		return nil, fmt.Errorf("run query to get web sessions for user: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := make([]WebSession, 0)
+	for rows.Next() {
+		var session WebSession
+		err := rows.Scan(&session.IDHash, &session.UserDID, &session.UserAgent, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// DeleteWebSessionForUser revokes one of the users sessions. It only deletes the session if it belongs to the user.
+func (s *Store) DeleteWebSessionForUser(idHash, userDID string) error {
+	sql := "DELETE FROM web_sessions WHERE idHash = ? AND userDID = ?;"
+	_, err := s.db.Exec(sql, idHash, userDID)
+	if err != nil {
+		return fmt.Errorf("exec delete web session for user: %w", err)
+	}
+	return nil
+}
+
+// deleteExpiredWebSessions deletes sessions that have passed their expiry or haven't been used since idleBefore.
+func (s *Store) deleteExpiredWebSessions(now, idleBefore int64) (int64, error) {
+	sql := "DELETE FROM web_sessions WHERE expiresAt <= ? OR lastSeenAt < ?;"
+	res, err := s.db.Exec(sql, now, idleBefore)
+	if err != nil {
+		return 0, fmt.Errorf("exec delete expired web sessions: %w", err)
+	}
+	deleted, _ := res.RowsAffected()
+	return deleted, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	maxTagLength       = 50
+	maxTagsPerBookmark = 10
+)
+
+// parseTags splits user input into tags. Tags can be separated by spaces or commas and an optional leading # is
+// removed.
+func parseTags(input string) ([]string, error) {
+	fields := strings.FieldsFunc(input, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+
+	tags := make([]string, 0, len(fields))
+	for _, field := range fields {
+		tag := strings.ToLower(strings.TrimLeft(field, "#"))
+		if tag == "" || slices.Contains(tags, tag) {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			return nil, fmt.Errorf("tags can't be longer than %d characters", maxTagLength)
+		}
+		tags = append(tags, tag)
+	}
+
+	if len(tags) > maxTagsPerBookmark {
+		return nil, fmt.Errorf("a bookmark can't have more than %d tags", maxTagsPerBookmark)
+	}
+	return tags, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/bugsnag/bugsnag-go/v2"
+	oauth "github.com/haileyok/atproto-oauth-golang"
+)
+
+var (
+	errNoOauthSession = errors.New("user has no oauth session")
+	// errOauthSessionExpired is returned when the users session can no longer be refreshed and they need to log in again
+	errOauthSessionExpired = errors.New("oauth session has expired")
+)
+
+// OauthSessionSource provides the DPoP bound request args for a users OAuth session so that requests can be made to
+// their PDS on their behalf.
+type OauthSessionSource interface {
+	AuthArgs(ctx context.Context, did string) (*oauth.XrpcAuthedRequestArgs, error)
+	UpdateDpopPdsNonce(did, nonce string) error
+}
+
+type DeleteRecordRequest struct {
+	Repo       string `json:"repo"`
+	Collection string `json:"collection"`
+	RKey       string `json:"rkey"`
+}
+
+// userRepoWriter writes records to a users own repo using the DPoP bound tokens from their OAuth login.
+type userRepoWriter struct {
+	sessions   OauthSessionSource
+	xrpcClient *oauth.XrpcClient
+}
+
+func newUserRepoWriter(sessions OauthSessionSource) *userRepoWriter {
+	return &userRepoWriter{
+		sessions: sessions,
+		xrpcClient: &oauth.XrpcClient{
+			OnDpopPdsNonceChanged: func(did, newNonce string) {
+				err := sessions.UpdateDpopPdsNonce(did, newNonce)
+				if err != nil {
+					slog.Error("update oauth session dpop pds nonce", "error", err, "did", did)
+					_ = bugsnag.Notify(err)
+				}
+			},
+		},
+	}
+}
+
+func (u *userRepoWriter) PutUserRecord(ctx context.Context, userDID, collection, rkey string, record any) error {
+	authArgs, err := u.sessions.AuthArgs(ctx, userDID)
+	if err != nil {
+		return err
+	}
+
+	req := PutRecordRequest{
+		Repo:       userDID,
+		Collection: collection,
+		RKey:       rkey,
+		Record:     record,
+	}
+	err = u.xrpcClient.Do(ctx, authArgs, xrpc.Procedure, "application/json", "com.atproto.repo.putRecord", nil, req, nil)
+	if err != nil {
+		return fmt.Errorf("put record: %w", err)
+	}
+	return nil
+}
+
+func (u *userRepoWriter) DeleteUserRecord(ctx context.Context, userDID, collection, rkey string) error {
+	authArgs, err := u.sessions.AuthArgs(ctx, userDID)
+	if err != nil {
+		return err
+	}
+
+	req := DeleteRecordRequest{
+		Repo:       userDID,
+		Collection: collection,
+		RKey:       rkey,
+	}
+	err = u.xrpcClient.Do(ctx, authArgs, xrpc.Procedure, "application/json", "com.atproto.repo.deleteRecord", nil, req, nil)
+	if err != nil {
+		return fmt.Errorf("delete record: %w", err)
+	}
+	return nil
+}